@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 const (
 	StorageDir   = "storage"
 	TemplatesDir = "templates"
@@ -7,8 +9,66 @@ const (
 	ServerPort   = "0.0.0.0:8080"
 	SessionAge   = 30 * 24 * 60 * 60 // 30 days in seconds
 
+	// Session lifecycle
+	SessionIdleTimeout   = 7 * 24 * 60 * 60 // Sliding expiry: 7 days of inactivity, in seconds
+	SessionTouchInterval = 1 * time.Minute  // Minimum gap between last-seen updates
+	SessionSweepInterval = 1 * time.Hour    // How often expired sessions are purged
+
+	// Only enable when running behind a reverse proxy that sets X-Forwarded-For
+	TrustProxyHeaders = false
+
 	// Performance tuning
 	MaxConcurrentUploads = 10
 	ReaderBufferSize     = 32 * 1024 // 32 KB
 	WriteBufferSize      = 32 * 1024 // 32 KB
+
+	// Storage quotas
+	DefaultStorageQuota = 10 << 30                 // 10 GB per user unless an admin overrides it (0 = unlimited)
+	DefaultGroupQuota   = 50 << 30                 // 50 GB per group unless an admin overrides it (0 = unlimited)
+	QuotaRequestSlack   = 1 << 20                  // Multipart overhead allowed when pre-checking Content-Length
+	UploadStagingDir    = StorageDir + "/.staging" // Partial uploads, on the same disk as the blob store
+
+	// Content-addressed blob store
+	BlobDir        = StorageDir + "/.blobs" // File contents named by SHA-256, stored once however many files share them
+	BlobGCGrace    = 1 * time.Hour          // Unreferenced blobs are kept this long before they are reclaimed
+	BlobGCInterval = 1 * time.Hour          // How often unreferenced blobs are collected
+
+	// Trash
+	TrashRetention     = 30 * 24 * time.Hour // Items are purged this long after deletion (0 = keep until emptied)
+	TrashPurgeInterval = 1 * time.Hour
+
+	// File versions
+	DefaultMaxFileVersions = 10      // Earlier versions kept per file unless the user changes it (0 = unlimited)
+	DefaultMaxVersionSpace = 1 << 30 // Bytes a user's earlier versions may take up (0 = unlimited)
+
+	// Full-text search
+	SearchIndexInterval  = 5 * time.Second // How often the indexer picks up added, moved and changed files
+	SearchIndexBatch     = 100             // Files indexed per transaction
+	SearchMaxExtractSize = 64 << 20        // Larger files are found by name and path only
+	SearchMaxTextSize    = 1 << 20         // Text indexed per file
+	SearchResultLimit    = 100             // Results returned per page
+	MaxSavedSearches     = 50              // Saved searches per user
+
+	// Tags
+	MaxTagLength   = 50 // Characters in a tag
+	MaxTagsPerFile = 20
+
+	// Public share links
+	ShareUnlockAge = 12 * time.Hour // How long a visitor stays in after entering a link's password
+
+	// Resumable (tus) uploads
+	ResumableUploadDir     = StorageDir + "/.resumable" // Partial files, kept across restarts
+	ResumableUploadExpiry  = 24 * time.Hour             // Unfinished uploads idle this long are discarded
+	ResumableSweepInterval = 1 * time.Hour
+
+	// Password hashing (PBKDF2-SHA256)
+	PasswordHashIterations = 600000
+	PasswordSaltLength     = 16 // bytes
+	PasswordKeyLength      = 32 // bytes
+
+	// Two-factor authentication (TOTP)
+	TOTPIssuer            = "HAYA-DISK"     // Name shown in authenticator apps
+	TOTPRecoveryCodeCount = 10              // Single-use recovery codes issued on enrollment
+	TOTPChallengeTTL      = 5 * time.Minute // Time allowed to enter the code after the password
+	TOTPMaxAttempts       = 5               // Wrong codes before the login must be restarted
 )
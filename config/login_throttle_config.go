@@ -0,0 +1,39 @@
+package config
+
+import "time"
+
+// LoginThrottleSettings defines the brute-force protection applied to logins.
+// Failures are counted separately per client IP and per account; once a
+// counter passes its free attempts every further failure doubles the wait,
+// and hitting the lockout threshold blocks the key for LockoutDuration.
+type LoginThrottleSettings struct {
+	CredentialFreeAttempts     int           // Failures per account before backoff starts
+	CredentialLockoutThreshold int           // Failures per account before it is locked
+	IPFreeAttempts             int           // Failures per IP before backoff starts
+	IPLockoutThreshold         int           // Failures per IP before it is blocked
+	BaseDelay                  time.Duration // First backoff delay, doubled on each failure
+	MaxDelay                   time.Duration // Upper bound for a backoff delay
+	LockoutDuration            time.Duration // How long a lockout lasts
+	ResetAfter                 time.Duration // Quiet time after which failures are forgotten
+	SweepInterval              time.Duration // How often stale counters are purged
+
+	// Plain request rate limit per IP for the anonymous auth routes
+	IPRequestLimit  int
+	IPRequestWindow time.Duration
+}
+
+// DefaultLoginThrottleSettings is the default login protection: 3 free
+// tries per account, locked for 15 minutes after 10 failures
+var DefaultLoginThrottleSettings = LoginThrottleSettings{
+	CredentialFreeAttempts:     3,
+	CredentialLockoutThreshold: 10,
+	IPFreeAttempts:             10,
+	IPLockoutThreshold:         50,
+	BaseDelay:                  2 * time.Second,
+	MaxDelay:                   5 * time.Minute,
+	LockoutDuration:            15 * time.Minute,
+	ResetAfter:                 1 * time.Hour,
+	SweepInterval:              1 * time.Hour,
+	IPRequestLimit:             30,
+	IPRequestWindow:            time.Minute,
+}
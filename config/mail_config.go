@@ -0,0 +1,39 @@
+package config
+
+import "time"
+
+// MailSettings defines how outgoing email (password resets, verification)
+// is delivered
+type MailSettings struct {
+	Driver  string // "smtp", "file" (write .eml files) or "log" (print to the server log)
+	From    string // Sender address
+	BaseURL string // Public URL of the server, used in emailed and share links (required)
+
+	// SMTP driver
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string // Leave empty for servers without authentication
+	SMTPPassword string
+
+	// File driver
+	OutboxDir string // Directory .eml files are written to
+}
+
+// DefaultMailSettings returns the default mail configuration
+// Messages are written to ./mail_outbox until an SMTP server is configured
+var DefaultMailSettings = MailSettings{
+	Driver:    "file",
+	From:      "HAYA-DISK <no-reply@localhost>",
+	BaseURL:   "http://localhost:8080",
+	SMTPHost:  "localhost",
+	SMTPPort:  25,
+	OutboxDir: "mail_outbox",
+}
+
+// Lifetimes of emailed links
+const (
+	PasswordResetTokenTTL     = 1 * time.Hour
+	EmailVerificationTokenTTL = 48 * time.Hour
+	TokenResendInterval       = 1 * time.Minute // Minimum gap between emails of the same kind to one user
+	TokenSweepInterval        = 1 * time.Hour   // How often used/expired tokens are purged
+)
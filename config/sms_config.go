@@ -0,0 +1,35 @@
+package config
+
+import "time"
+
+// SMSSettings defines how one-time login codes are sent by text message
+type SMSSettings struct {
+	Enabled bool   // Offer "log in with SMS code" on the login page
+	Driver  string // "http" (SMS gateway) or "console" (print codes to the server log)
+
+	// HTTP gateway driver: codes are POSTed as JSON {"to", "from", "message"}
+	GatewayURL string
+	APIKey     string // Sent as "Authorization: Bearer <key>" when set
+	Sender     string // Sender ID or number passed to the gateway
+
+	CodeLength      int           // Digits per code
+	CodeTTL         time.Duration // How long a code stays valid
+	ResendInterval  time.Duration // Minimum gap between codes for one number or account
+	MaxCodesPerHour int           // Codes one number or account can request per hour
+	MaxAttempts     int           // Wrong guesses before a code is burned
+}
+
+// DefaultSMSSettings returns the default SMS login configuration
+// SMS login stays off until a gateway is configured; the console driver
+// only prints codes to the server log, for development
+var DefaultSMSSettings = SMSSettings{
+	Enabled:         false,
+	Driver:          "console",
+	GatewayURL:      "http://localhost:9090/send",
+	Sender:          "HAYA-DISK",
+	CodeLength:      6,
+	CodeTTL:         5 * time.Minute,
+	ResendInterval:  1 * time.Minute,
+	MaxCodesPerHour: 5,
+	MaxAttempts:     5,
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+)
+
+// invalidLinkMessage is shown for unknown, expired or already used links
+const invalidLinkMessage = "This link is invalid or has expired. Please request a new one."
+
+// absoluteURL builds a link for emails and share links from
+// MailSettings.BaseURL, which main checks at startup. Links never come from
+// the request's Host header, which a client controls.
+func absoluteURL(path string) string {
+	return strings.TrimRight(config.DefaultMailSettings.BaseURL, "/") + path
+}
+
+// sendVerificationEmail issues a verification token for the user's current
+// email address and mails the link in the background
+func sendVerificationEmail(user *models.User) error {
+	token, err := services.CreateUserToken(user.Username, services.TokenPurposeVerifyEmail, user.Email, config.EmailVerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := absoluteURL("/verify-email?token=" + token)
+	go func(email, username string) {
+		if err := services.SendVerificationEmail(email, username, link); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}(user.Email, user.Username)
+	return nil
+}
+
+// ForgotPasswordHandler emails a password reset link
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		email := strings.TrimSpace(r.FormValue("email"))
+
+		// The response is identical whether or not the account exists
+		user := services.FindUserByEmail(email)
+		if user != nil && user.Email != "" &&
+			!services.UserTokenIssuedSince(user.Username, services.TokenPurposePasswordReset, time.Now().Add(-config.TokenResendInterval)) {
+			token, err := services.CreateUserToken(user.Username, services.TokenPurposePasswordReset, user.Email, config.PasswordResetTokenTTL)
+			if err != nil {
+				log.Printf("Warning: %v", err)
+			} else {
+				link := absoluteURL("/reset-password?token=" + token)
+				go func(email, username string) {
+					if err := services.SendPasswordResetEmail(email, username, link); err != nil {
+						log.Printf("Warning: %v", err)
+					}
+				}(user.Email, user.Username)
+			}
+		}
+
+		renderTemplate(w, r, "forgot_password.html", map[string]interface{}{
+			"message": "If an account uses that email, a reset link is on its way.",
+		})
+		return
+	}
+
+	renderTemplate(w, r, "forgot_password.html", nil)
+}
+
+// ResetPasswordHandler lets the holder of a reset link choose a new password
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	// Keep the token out of Referer headers sent to other sites
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	token := r.FormValue("token")
+	if _, err := services.GetUserToken(token, services.TokenPurposePasswordReset); err != nil {
+		renderTemplate(w, r, "forgot_password.html", map[string]interface{}{"error": invalidLinkMessage})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		password := r.FormValue("password")
+		confirmPassword := r.FormValue("confirm_password")
+
+		var errorMsg string
+		if password == "" {
+			errorMsg = "Password is required"
+		} else if password != confirmPassword {
+			errorMsg = "Passwords do not match"
+		}
+		if errorMsg != "" {
+			renderTemplate(w, r, "reset_password.html", map[string]interface{}{"token": token, "error": errorMsg})
+			return
+		}
+
+		if _, err := services.ResetPasswordWithToken(token, password); err != nil {
+			if !errors.Is(err, services.ErrInvalidToken) {
+				log.Printf("Warning: password reset failed: %v", err)
+			}
+			renderTemplate(w, r, "forgot_password.html", map[string]interface{}{"error": invalidLinkMessage})
+			return
+		}
+
+		// Any session in this browser belonged to the old password
+		middleware.ClearSessionCookie(w)
+		renderLogin(w, r, map[string]interface{}{"message": "Your password has been reset. Please log in."})
+		return
+	}
+
+	renderTemplate(w, r, "reset_password.html", map[string]interface{}{"token": token})
+}
+
+// VerifyEmailHandler confirms an email address from an emailed link
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	if _, err := services.VerifyEmailWithToken(r.URL.Query().Get("token")); err != nil {
+		if !errors.Is(err, services.ErrInvalidToken) {
+			log.Printf("Warning: email verification failed: %v", err)
+		}
+		renderTemplate(w, r, "verify_email.html", map[string]interface{}{"error": invalidLinkMessage})
+		return
+	}
+
+	renderTemplate(w, r, "verify_email.html", map[string]interface{}{"message": "Your email address has been verified."})
+}
+
+// APIResendVerificationHandler sends a new verification link to the
+// current user's email address
+func APIResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		writeJSON(w, http.StatusUnauthorized, models.UpdateProfileResponse{Success: false, Message: "Unauthorized"})
+		return
+	}
+
+	user := services.GetUser(username)
+	if user == nil || user.Email == "" {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "No email address on this account"})
+		return
+	}
+	if user.EmailVerified {
+		writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: "Email already verified"})
+		return
+	}
+	if services.UserTokenIssuedSince(username, services.TokenPurposeVerifyEmail, time.Now().Add(-config.TokenResendInterval)) {
+		writeJSON(w, http.StatusTooManyRequests, models.UpdateProfileResponse{Success: false, Message: "A link was just sent. Please wait a minute before asking again."})
+		return
+	}
+
+	if err := sendVerificationEmail(user); err != nil {
+		writeJSON(w, http.StatusInternalServerError, models.UpdateProfileResponse{Success: false, Message: "Failed to send verification email"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: "Verification email sent to " + user.Email})
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// adminPageSize is the number of users per page in the admin console
+const adminPageSize = 25
+
+// AdminPageHandler renders the admin console (routes are wrapped in
+// middleware.RequireAdmin)
+func AdminPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin" {
+		http.NotFound(w, r)
+		return
+	}
+
+	renderTemplate(w, r, "admin.html", map[string]interface{}{
+		"username": middleware.GetSessionUser(r),
+	})
+}
+
+// APIAdminListUsersHandler lists users with optional search and paging
+func APIAdminListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	users, total, err := services.ListUsersAdmin(r.URL.Query().Get("q"), adminPageSize, (page-1)*adminPageSize)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load users"})
+		return
+	}
+
+	for i := range users {
+		users[i].StorageUsedStr = utils.FormatFileSize(users[i].StorageUsed)
+		users[i].QuotaStr = "Unlimited"
+		if users[i].StorageQuota > 0 {
+			users[i].QuotaStr = utils.FormatFileSize(users[i].StorageQuota)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, models.AdminUserListResponse{
+		Users:    users,
+		Total:    total,
+		Page:     page,
+		PageSize: adminPageSize,
+	})
+}
+
+// decodeAdminRequest reads an admin action and rejects actions on oneself
+// that could lock the admin out
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, allowSelf bool) (*models.AdminUserRequest, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	var req models.AdminUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Username) == "" {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Invalid request"})
+		return nil, false
+	}
+
+	if !allowSelf && req.Username == middleware.GetSessionUser(r) {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "You cannot do this to your own account"})
+		return nil, false
+	}
+
+	return &req, true
+}
+
+// writeAdminResult reports the outcome of an admin action
+func writeAdminResult(w http.ResponseWriter, err error, action, success string) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: success})
+	case errors.Is(err, services.ErrUserNotFound):
+		writeJSON(w, http.StatusNotFound, models.UpdateProfileResponse{Success: false, Message: "User not found"})
+	case errors.Is(err, services.ErrLastAdmin):
+		writeJSON(w, http.StatusConflict, models.UpdateProfileResponse{Success: false, Message: "At least one active admin is required"})
+	default:
+		log.Printf("Admin %s failed: %v", action, err)
+		writeJSON(w, http.StatusInternalServerError, models.UpdateProfileResponse{Success: false, Message: "Failed to " + action})
+	}
+}
+
+// APIAdminSetDisabledHandler disables or re-enables an account
+func APIAdminSetDisabledHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAdminRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	err := services.SetUserDisabled(req.Username, req.Disabled)
+	if err == nil {
+		log.Printf("Admin %s set disabled=%t for %s", middleware.GetSessionUser(r), req.Disabled, req.Username)
+	}
+
+	message := "Account enabled"
+	if req.Disabled {
+		message = "Account disabled and signed out"
+	}
+	writeAdminResult(w, err, "update account", message)
+}
+
+// APIAdminSetRoleHandler grants or revokes the admin role
+func APIAdminSetRoleHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAdminRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	err := services.SetUserAdmin(req.Username, req.IsAdmin)
+	if err == nil {
+		log.Printf("Admin %s set is_admin=%t for %s", middleware.GetSessionUser(r), req.IsAdmin, req.Username)
+	}
+
+	message := "Admin role removed"
+	if req.IsAdmin {
+		message = "Admin role granted"
+	}
+	writeAdminResult(w, err, "update role", message)
+}
+
+// APIAdminSetQuotaHandler overrides a user's storage quota (0 = unlimited)
+// or, when quota is null, returns them to the default
+func APIAdminSetQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAdminRequest(w, r, true)
+	if !ok {
+		return
+	}
+	if req.Quota != nil && *req.Quota < 0 {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Quota cannot be negative"})
+		return
+	}
+
+	err := services.SetUserQuota(req.Username, req.Quota)
+	if err == nil {
+		log.Printf("Admin %s set the storage quota for %s", middleware.GetSessionUser(r), req.Username)
+	}
+
+	message := "Quota reset to the default"
+	if req.Quota != nil {
+		message = "Quota updated"
+	}
+	writeAdminResult(w, err, "update quota", message)
+}
+
+// APIAdminDeleteUserHandler deletes an account and all of its files
+func APIAdminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAdminRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	err := services.DeleteUserAccount(req.Username)
+	if err == nil {
+		log.Printf("Admin %s deleted user %s", middleware.GetSessionUser(r), req.Username)
+	}
+	writeAdminResult(w, err, "delete user", "User and files deleted")
+}
+
+// APIAdminListGroupsHandler lists every group with its owners and storage
+// use
+func APIAdminListGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groups, err := services.ListGroupsAdmin()
+	if err != nil {
+		log.Printf("Failed to list groups: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load groups"})
+		return
+	}
+
+	for i := range groups {
+		groups[i].StorageUsedStr = utils.FormatFileSize(groups[i].StorageUsed)
+		groups[i].QuotaStr = "Unlimited"
+		if groups[i].StorageQuota > 0 {
+			groups[i].QuotaStr = utils.FormatFileSize(groups[i].StorageQuota)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"groups": groups})
+}
+
+// APIAdminSetGroupQuotaHandler overrides a group's storage quota (0 =
+// unlimited) or, when quota is null, returns it to the group default
+func APIAdminSetGroupQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.AdminGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.GroupID <= 0 {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Invalid request"})
+		return
+	}
+	if req.Quota != nil && *req.Quota < 0 {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Quota cannot be negative"})
+		return
+	}
+
+	err := services.SetGroupQuota(req.GroupID, req.Quota)
+	switch {
+	case errors.Is(err, services.ErrGroupNotFound):
+		writeJSON(w, http.StatusNotFound, models.UpdateProfileResponse{Success: false, Message: "Group not found"})
+		return
+	case err != nil:
+		log.Printf("Admin update group quota failed: %v", err)
+		writeJSON(w, http.StatusInternalServerError, models.UpdateProfileResponse{Success: false, Message: "Failed to update quota"})
+		return
+	}
+
+	log.Printf("Admin %s set the storage quota for group %d", middleware.GetSessionUser(r), req.GroupID)
+	message := "Quota reset to the default"
+	if req.Quota != nil {
+		message = "Quota updated"
+	}
+	writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: message})
+}
+
+// APIAdminResetPasswordHandler resets a user's password, either by emailing
+// them a reset link or by setting a new password directly. Admins never
+// sign in as the user.
+func APIAdminResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAdminRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	user := services.GetUser(req.Username)
+	if user == nil {
+		writeAdminResult(w, services.ErrUserNotFound, "reset password", "")
+		return
+	}
+
+	if req.SendEmail {
+		if user.Email == "" {
+			writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "This user has no email address"})
+			return
+		}
+
+		token, err := services.CreateUserToken(user.Username, services.TokenPurposePasswordReset, user.Email, config.PasswordResetTokenTTL)
+		if err != nil {
+			writeAdminResult(w, err, "reset password", "")
+			return
+		}
+		if err := services.SendPasswordResetEmail(user.Email, user.Username, absoluteURL("/reset-password?token="+token)); err != nil {
+			writeAdminResult(w, err, "send reset email", "")
+			return
+		}
+
+		log.Printf("Admin %s sent a password reset email to %s", middleware.GetSessionUser(r), req.Username)
+		writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: "Reset link sent to " + user.Email})
+		return
+	}
+
+	if req.NewPassword == "" {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "New password is required"})
+		return
+	}
+
+	err := services.AdminSetPassword(req.Username, req.NewPassword)
+	if err == nil {
+		log.Printf("Admin %s set a new password for %s", middleware.GetSessionUser(r), req.Username)
+	}
+	writeAdminResult(w, err, "reset password", "Password reset; the user has been signed out everywhere")
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// archiveEntry is one file or folder to put in a download archive
+type archiveEntry struct {
+	name    string // Path inside the archive, "/"-separated
+	hash    string // Blob holding the content
+	isDir   bool
+	modTime time.Time
+}
+
+// ArchiveDownloadHandler streams a folder, or selected items ("name",
+// repeatable) of a folder, as a zip or tar.gz archive built on the fly
+func ArchiveDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	folder := r.FormValue("folder")
+	names := r.Form["name"]
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar.gz" {
+		http.Error(w, "Unsupported archive format", http.StatusBadRequest)
+		return
+	}
+
+	space, err := resolveFileSpace(username, r.FormValue)
+	if errors.Is(err, services.ErrUserNotFound) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		writeSpaceError(w, err)
+		return
+	}
+	owner := space.owner.Username
+	userStoragePath := space.storagePath
+
+	// Lock for read operation; held until the whole archive is sent so the
+	// files cannot change underneath it
+	services.LockUserFileRead(owner)
+	defer services.UnlockUserFileRead(owner)
+
+	basePath := space.path(folder, "")
+	if len(names) == 0 && basePath == space.root && space.share != nil {
+		// The top of a shared item: the item itself
+		basePath = space.item
+	}
+
+	// Security check: everything collected is below the folder, or one of
+	// the selected items
+	if len(names) == 0 && !space.canRead(basePath) {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+	for _, name := range names {
+		if !space.canRead(filepath.Join(basePath, name)) {
+			http.Error(w, "Unauthorized", http.StatusForbidden)
+			return
+		}
+	}
+
+	archiveName := "HAYA-DISK"
+	if len(names) == 0 && basePath != userStoragePath {
+		// Whole folder: the folder itself becomes the top of the archive
+		names = []string{filepath.Base(basePath)}
+		basePath = filepath.Dir(basePath)
+	}
+	if len(names) == 1 {
+		archiveName = names[0]
+	} else if basePath != userStoragePath {
+		archiveName = filepath.Base(basePath)
+	}
+
+	entries, status, message := collectArchiveEntries(owner, userStoragePath, basePath, names)
+	if status != http.StatusOK {
+		http.Error(w, message, status)
+		return
+	}
+
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		archiveName += ".zip"
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		archiveName += ".tar.gz"
+	}
+	w.Header().Set("Content-Disposition", utils.ContentDisposition("attachment", archiveName))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if format == "zip" {
+		err = writeZipArchive(w, entries)
+	} else {
+		err = writeTarGzArchive(w, entries)
+	}
+	if err != nil {
+		// The response has started, so abort it rather than let the client
+		// keep a truncated archive that looks complete
+		log.Printf("Archive download for %s failed: %v", owner, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// collectArchiveEntries looks up the selected items of basePath, and
+// everything inside the selected folders, in the files table. With no
+// names the user's whole storage is collected.
+func collectArchiveEntries(username, userStoragePath, basePath string, names []string) ([]archiveEntry, int, string) {
+	var roots []string
+	if len(names) == 0 {
+		roots = []string{""}
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !isValidUploadFilename(name) {
+			return nil, http.StatusBadRequest, "Invalid file name"
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		relativePath, _ := filepath.Rel(userStoragePath, filepath.Join(basePath, name))
+		roots = append(roots, relativePath)
+	}
+
+	var entries []archiveEntry
+	for _, root := range roots {
+		files, err := services.GetFileSubtree(username, root)
+		if err != nil {
+			log.Printf("Failed to list %s for archive: %v", root, err)
+			return nil, http.StatusInternalServerError, "Failed to read files"
+		}
+		if len(files) == 0 && root != "" {
+			return nil, http.StatusNotFound, "File not found: " + filepath.Base(root)
+		}
+
+		for _, file := range files {
+			fullPath := filepath.Join(userStoragePath, file.StoragePath)
+			name, err := filepath.Rel(basePath, fullPath)
+			if err != nil || !isPathSafe(fullPath, userStoragePath) {
+				continue
+			}
+			entries = append(entries, archiveEntry{
+				name:    filepath.ToSlash(name),
+				hash:    file.FileHash,
+				isDir:   file.IsDirectory,
+				modTime: file.ModifiedAt,
+			})
+		}
+	}
+	return entries, http.StatusOK, ""
+}
+
+// isCompressedFile reports whether a file is already compressed, so
+// deflating it again would only burn CPU
+func isCompressedFile(name string) bool {
+	switch utils.GetFileCategory(strings.ToLower(filepath.Ext(name))) {
+	case "Images", "Videos", "Audio", "Archives":
+		return true
+	}
+	return false
+}
+
+// writeZipArchive streams entries as a zip. archive/zip switches to Zip64
+// by itself for large files or many entries and flags non-ASCII names as
+// UTF-8.
+func writeZipArchive(w io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Modified: entry.modTime}
+		if entry.isDir {
+			header.Name += "/"
+			header.SetMode(os.ModeDir | 0755)
+			if _, err := zw.CreateHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f, err := services.OpenBlob(entry.hash)
+		if os.IsNotExist(err) {
+			log.Printf("Warning: content of %s is missing, leaving it out of the archive", entry.name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		header.SetMode(0644)
+		header.Method = zip.Deflate
+		if isCompressedFile(entry.name) {
+			header.Method = zip.Store
+		}
+		dst, err := zw.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(dst, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTarGzArchive streams entries as a gzip-compressed tar. archive/tar
+// falls back to PAX headers for UTF-8 names and files over 8 GB.
+func writeTarGzArchive(w io.Writer, entries []archiveEntry) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		if entry.isDir {
+			header := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     entry.name + "/",
+				Mode:     0755,
+				ModTime:  entry.modTime,
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f, err := services.OpenBlob(entry.hash)
+		if os.IsNotExist(err) {
+			log.Printf("Warning: content of %s is missing, leaving it out of the archive", entry.name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		info, err := f.Stat()
+		if err == nil {
+			header := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     entry.name,
+				Size:     info.Size(),
+				Mode:     0644,
+				ModTime:  entry.modTime,
+			}
+			if err = tw.WriteHeader(header); err == nil {
+				_, err = io.CopyN(tw, f, info.Size())
+			}
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
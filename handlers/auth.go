@@ -1,10 +1,12 @@
 package handlers
 
 import (
-	"html/template"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/HAYASAKA7/HAYA-DISK/config"
 	"github.com/HAYASAKA7/HAYA-DISK/middleware"
@@ -26,6 +28,7 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		password := r.FormValue("password")
 
 		var user *models.User
+		var identifier string
 
 		if loginType == "phone" {
 			phone := strings.TrimSpace(r.FormValue("phone"))
@@ -33,29 +36,94 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 			// Clean phone number
 			phone = utils.CleanPhoneNumber(phone)
 			user = services.FindUserByPhoneAndRegion(phone, phoneRegion)
+			identifier = phoneIdentifier(phoneRegion, phone)
 		} else {
 			// Default to email login
 			email := strings.TrimSpace(r.FormValue("email"))
 			user = services.FindUserByEmail(email)
+			identifier = "email:" + strings.ToLower(email)
 		}
 
-		if user == nil || user.Password != password {
-			tmpl, _ := template.ParseFiles(filepath.Join(config.TemplatesDir, "login.html"))
-			tmpl.Execute(w, map[string]string{"error": "Invalid email/phone or password"})
+		// Unknown accounts are throttled by what was typed, so probing
+		// for accounts looks the same as guessing passwords
+		credential := identifier
+		if user != nil {
+			credential = services.UserThrottleKey(user.Username)
+		}
+
+		ip := middleware.GetClientIP(r)
+		if wait := services.CheckLoginAllowed(ip, credential); wait > 0 {
+			renderLogin(w, r, map[string]interface{}{"error": throttleMessage(wait)})
 			return
 		}
 
-		middleware.SetSessionCookie(w, user.Username)
-		http.Redirect(w, r, "/list", http.StatusSeeOther)
+		if user == nil || !services.AuthenticateUser(user, password) {
+			services.RecordLoginFailure(ip, credential)
+			renderLogin(w, r, map[string]interface{}{"error": "Invalid email/phone or password"})
+			return
+		}
+
+		finishFirstFactor(w, r, user)
 		return
 	}
 
-	tmpl, err := template.ParseFiles(filepath.Join(config.TemplatesDir, "login.html"))
-	if err != nil {
-		http.Error(w, "Template error", 500)
+	renderLogin(w, r, nil)
+}
+
+// throttleMessage tells a throttled user how long to wait
+func throttleMessage(wait time.Duration) string {
+	if wait < time.Minute {
+		return fmt.Sprintf("Too many failed login attempts. Please try again in %d seconds.", int(math.Ceil(wait.Seconds())))
+	}
+	return fmt.Sprintf("Too many failed login attempts. Please try again in %d minutes.", int(math.Ceil(wait.Minutes())))
+}
+
+// renderLogin shows the login page with the optional login methods enabled
+func renderLogin(w http.ResponseWriter, r *http.Request, data map[string]interface{}) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["smsLogin"] = config.DefaultSMSSettings.Enabled
+	renderTemplate(w, r, "login.html", data)
+}
+
+// phoneIdentifier is the throttle key for a typed phone number that does
+// not belong to any account
+func phoneIdentifier(region, phone string) string {
+	return "phone:" + region + ":" + phone
+}
+
+// finishFirstFactor continues a login once the password (or SMS code) is
+// verified: accounts with 2FA still need their authenticator code
+func finishFirstFactor(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if user.Disabled {
+		renderLogin(w, r, map[string]interface{}{"error": disabledAccountMessage})
 		return
 	}
-	tmpl.Execute(w, nil)
+
+	if user.TOTPEnabled {
+		setLoginChallengeCookie(w, services.CreateLoginChallenge(user.Username))
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	completeLogin(w, r, user.Username)
+}
+
+// disabledAccountMessage is shown when a disabled account tries to log in
+const disabledAccountMessage = "This account has been disabled. Please contact an administrator."
+
+// completeLogin starts a session for a fully authenticated user
+func completeLogin(w http.ResponseWriter, r *http.Request, username string) {
+	// The account may have been disabled while a second factor was pending
+	if user := services.GetUser(username); user == nil || user.Disabled {
+		renderLogin(w, r, map[string]interface{}{"error": disabledAccountMessage})
+		return
+	}
+
+	services.RecordLoginSuccess(services.UserThrottleKey(username))
+	middleware.SetSessionCookie(w, r, username)
+	http.Redirect(w, r, "/list", http.StatusSeeOther)
 }
 
 // RegisterHandler handles user registration
@@ -94,6 +162,8 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 			errorMsg = "Invalid email format. Please enter a valid email address."
 		} else if phone != "" && !utils.ValidatePhone(phone, phoneRegion) {
 			errorMsg = utils.GetPhoneValidationError(phoneRegion)
+		} else if services.IsReservedUsername(username) {
+			errorMsg = "This username is reserved"
 		} else if password != confirmPassword {
 			errorMsg = "Passwords do not match"
 		} else if email != "" && services.EmailExists(email) {
@@ -108,35 +178,41 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 			templateData["email"] = email
 			templateData["phone"] = phone
 			templateData["phone_region"] = phoneRegion
-			tmpl, _ := template.ParseFiles(filepath.Join(config.TemplatesDir, "register.html"))
-			tmpl.Execute(w, templateData)
+			renderTemplate(w, r, "register.html", templateData)
 			return
 		}
 
 		// Create user with phone region
-		_, err := services.CreateUser(username, email, phone, phoneRegion, password)
+		user, err := services.CreateUser(username, email, phone, phoneRegion, password)
 		if err != nil {
 			templateData["error"] = "Registration failed"
-			tmpl, _ := template.ParseFiles(filepath.Join(config.TemplatesDir, "register.html"))
-			tmpl.Execute(w, templateData)
+			renderTemplate(w, r, "register.html", templateData)
 			return
 		}
 
-		middleware.SetSessionCookie(w, username)
+		// Ask the user to confirm their email; the account works meanwhile
+		if user.Email != "" {
+			if err := sendVerificationEmail(user); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+
+		middleware.SetSessionCookie(w, r, username)
 		http.Redirect(w, r, "/list", http.StatusSeeOther)
 		return
 	}
 
-	tmpl, err := template.ParseFiles(filepath.Join(config.TemplatesDir, "register.html"))
-	if err != nil {
-		http.Error(w, "Template error", 500)
-		return
-	}
-	tmpl.Execute(w, templateData)
+	renderTemplate(w, r, "register.html", templateData)
 }
 
 // LogoutHandler handles user logout
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	middleware.ClearSessionCookie(w)
+	// Logging out changes state, so it must come from a CSRF-checked POST
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	middleware.DestroySession(w, r)
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
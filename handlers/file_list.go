@@ -1,20 +1,21 @@
 package handlers
 
 import (
-	"html/template"
+	"errors"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"github.com/HAYASAKA7/HAYA-DISK/config"
 	"github.com/HAYASAKA7/HAYA-DISK/middleware"
 	"github.com/HAYASAKA7/HAYA-DISK/models"
 	"github.com/HAYASAKA7/HAYA-DISK/services"
 	"github.com/HAYASAKA7/HAYA-DISK/utils"
 )
 
-// ListHandler displays user's files
+// ListHandler displays user's files, the files of an item shared with them
+// ("share") or those of one of their groups ("group"), with their tags,
+// color labels and stars. "tag" lists only the items carrying a tag.
 func ListHandler(w http.ResponseWriter, r *http.Request) {
 	username := middleware.GetSessionUser(r)
 	if username == "" {
@@ -22,6 +23,15 @@ func ListHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	space, err := resolveFileSpace(username, r.URL.Query().Get)
+	if errors.Is(err, services.ErrUserNotFound) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		writeSpaceError(w, err)
+		return
+	}
 	user := services.GetUser(username)
 	if user == nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -34,12 +44,18 @@ func ListHandler(w http.ResponseWriter, r *http.Request) {
 		currentFolder = "/"
 	}
 
+	if space.share != nil || space.group != nil {
+		listSpaceFolder(w, r, space, user, currentFolder)
+		return
+	}
+
 	// Get files from database
 	files, err := getFileList(username, currentFolder)
 	if err != nil {
 		http.Error(w, "Unable to list files", 500)
 		return
 	}
+	files = labelFileList(files, username, username, currentFolder, r.URL.Query().Get("tag"))
 
 	// Get all folders for move functionality
 	allFolders, _ := getAllFoldersFromDB(username)
@@ -61,14 +77,95 @@ func ListHandler(w http.ResponseWriter, r *http.Request) {
 		"storageStats":  storageStats,
 		"recentFiles":   recentFiles,
 		"isHomePage":    isHomePage,
+		"isAdmin":       user.IsAdmin,
+		"canAdd":        true,
 	}
+	space.addTemplateData(data)
+	addLabelData(data, space, r.URL.Query().Get("tag"))
 
-	tmpl, err := template.ParseFiles(filepath.Join(config.TemplatesDir, "list.html"))
-	if err != nil {
-		http.Error(w, "Template error", 500)
-		return
+	renderTemplate(w, r, "list.html", data)
+}
+
+// listSpaceFolder shows a folder of an item another user shared with the
+// user, or of a group's space. Paths are shown relative to the shared
+// folder, and a shared file is listed on its own.
+func listSpaceFolder(w http.ResponseWriter, r *http.Request, space *fileSpace, user *models.User, currentFolder string) {
+	owner := space.owner.Username
+	services.LockUserFileRead(owner)
+	defer services.UnlockUserFileRead(owner)
+
+	folderPath := space.path(currentFolder, "")
+	sharedFile := space.share != nil && !space.share.IsDirectory
+	var files []models.FileInfo
+	if sharedFile {
+		if currentFolder != "/" {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		all, err := getFileList(owner, space.ownerFolder(folderPath))
+		if err != nil {
+			http.Error(w, "Unable to list files", 500)
+			return
+		}
+		for _, file := range all {
+			if file.Name == space.share.Filename {
+				files = append(files, file)
+			}
+		}
+	} else {
+		if !space.canRead(folderPath) {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		if folderPath != space.item {
+			meta, err := services.GetFileByPath(owner, space.relative(folderPath))
+			if err != nil || meta == nil || !meta.IsDirectory {
+				http.Error(w, "Folder not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		var err error
+		files, err = getFileList(owner, space.ownerFolder(folderPath))
+		if err != nil {
+			http.Error(w, "Unable to list files", 500)
+			return
+		}
 	}
-	tmpl.Execute(w, data)
+	for i := range files {
+		// Only paths inside the space are shown
+		files[i].Path = space.folder(space.path(currentFolder, files[i].Name))
+	}
+	files = labelFileList(files, owner, user.Username, space.ownerFolder(folderPath), r.URL.Query().Get("tag"))
+
+	// Folders of the space, for moving files around inside it
+	allFolders := []string{"/"}
+	if !sharedFile {
+		folders, _ := services.GetAllFoldersDB(owner)
+		for _, folder := range folders {
+			folderPath := filepath.Join(space.storagePath, folder.StoragePath)
+			if folderPath != space.item && space.canRead(folderPath) {
+				allFolders = append(allFolders, space.folder(folderPath))
+			}
+		}
+	}
+
+	data := map[string]interface{}{
+		"files":         files,
+		"username":      user.Username,
+		"currentFolder": currentFolder,
+		"allFolders":    allFolders,
+		"isHomePage":    false,
+		"isAdmin":       user.IsAdmin,
+		"canAdd":        space.canAddTo(folderPath),
+	}
+	space.addTemplateData(data)
+	addLabelData(data, space, r.URL.Query().Get("tag"))
+	if space.group != nil {
+		data["groupStorage"] = groupStorageSummary(space.owner.Username)
+	}
+
+	renderTemplate(w, r, "list.html", data)
 }
 
 // getFileList retrieves list of files and folders from database
@@ -108,6 +205,7 @@ func getFileList(username string, currentFolder string) ([]models.FileInfo, erro
 		}
 
 		fileInfo := models.FileInfo{
+			ID:       meta.ID,
 			Name:     meta.Filename,
 			Size:     utils.FormatFileSize(sizeToDisplay),
 			Modified: meta.ModifiedAt.Format("2006-01-02 15:04"),
@@ -286,6 +384,8 @@ func calculateStorageStatsFromDB(username string) models.StorageStats {
 		"Archives":  "#F44336",
 		"Code":      "#00BCD4",
 		"Others":    "#9E9E9E",
+		"Trash":     "#795548",
+		"History":   "#607D8B",
 	}
 
 	// Initialize categories
@@ -297,8 +397,8 @@ func calculateStorageStatsFromDB(username string) models.StorageStats {
 		}
 	}
 
-	// Get all files from database (search with empty query to get all)
-	allFiles, err := services.SearchUserFiles(username, "")
+	// Get all files from database
+	allFiles, err := services.GetFileSubtree(username, "")
 	if err == nil {
 		for _, file := range allFiles {
 			if !file.IsDirectory {
@@ -315,8 +415,25 @@ func calculateStorageStatsFromDB(username string) models.StorageStats {
 		}
 	}
 
+	// Deleted items keep using space until the trash is emptied
+	if trashSize, trashCount, err := services.GetTrashUsage(username); err == nil && trashCount > 0 {
+		stats.TotalSize += trashSize
+		stats.TrashSize = trashSize
+		stats.TrashSizeStr = utils.FormatFileSize(trashSize)
+		stats.TrashCount = trashCount
+		typeMap["Trash"] = &models.FileTypeStats{Type: "Trash", Size: trashSize, Count: trashCount, Color: colorMap["Trash"]}
+		categories = append(categories, "Trash")
+	}
+	// So do earlier versions of files
+	if historySize, historyCount, err := services.GetVersionUsage(username); err == nil && historySize > 0 {
+		stats.TotalSize += historySize
+		typeMap["History"] = &models.FileTypeStats{Type: "History", Size: historySize, Count: historyCount, Color: colorMap["History"]}
+		categories = append(categories, "History")
+	}
+
 	// Calculate percentages and format sizes
 	stats.TotalSizeStr = utils.FormatFileSize(stats.TotalSize)
+	applyQuotaStats(&stats, username)
 
 	for _, cat := range categories {
 		stat := typeMap[cat]
@@ -332,6 +449,28 @@ func calculateStorageStatsFromDB(username string) models.StorageStats {
 	return stats
 }
 
+// applyQuotaStats fills in the user's quota and how much of it is used
+func applyQuotaStats(stats *models.StorageStats, username string) {
+	quota, _, err := services.GetUserQuota(username)
+	if err != nil || quota == 0 {
+		stats.QuotaStr = "Unlimited"
+		return
+	}
+
+	stats.Quota = quota
+	stats.QuotaStr = utils.FormatFileSize(quota)
+	stats.QuotaPercent = float64(stats.TotalSize) / float64(quota) * 100
+	if stats.QuotaPercent > 100 {
+		stats.QuotaPercent = 100
+	}
+
+	remaining := quota - stats.TotalSize
+	if remaining < 0 {
+		remaining = 0
+	}
+	stats.RemainingStr = utils.FormatFileSize(remaining)
+}
+
 // getRecentFiles retrieves the 5 most recently modified files (DEPRECATED - kept for compatibility)
 func getRecentFiles(basePath string) []models.RecentFile {
 	type fileWithTime struct {
@@ -1,21 +1,24 @@
 package handlers
 
 import (
-	"html/template"
-	"io"
+	"errors"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
+	"unicode"
 
 	"github.com/HAYASAKA7/HAYA-DISK/config"
 	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
 	"github.com/HAYASAKA7/HAYA-DISK/services"
 	"github.com/HAYASAKA7/HAYA-DISK/utils"
 )
 
-// UploadHandler handles file uploads
+// UploadHandler handles file uploads, into the user's own files, an item
+// shared with them as editor ("share") or one of their groups ("group").
+// The space is picked in the URL so the body can be streamed.
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	username := middleware.GetSessionUser(r)
 	if username == "" {
@@ -23,143 +26,95 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	space, err := resolveFileSpace(username, r.URL.Query().Get)
+	if errors.Is(err, services.ErrUserNotFound) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		writeSpaceError(w, err)
+		return
+	}
+	if !space.canEdit() {
+		http.Error(w, "You can only view this shared item", http.StatusForbidden)
+		return
+	}
+	// Files go to the owner's storage and count against their quota
+	owner := space.owner.Username
+
 	if r.Method == http.MethodGet {
 		// Show upload page
-		user := services.GetUser(username)
-		if user == nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
+		folders, _ := getFolderList(owner, space.ownerFolder(space.root))
 
-		userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
-		folders, _ := getFolderList(userStoragePath)
+		remaining, err := services.GetRemainingQuota(owner)
+		if err != nil {
+			remaining = -1
+		}
 
 		data := map[string]interface{}{
-			"username": username,
-			"folders":  folders,
+			"username":          username,
+			"folders":           folders,
+			"quotaRemaining":    remaining,
+			"quotaRemainingStr": utils.FormatFileSize(remaining),
 		}
+		space.addTemplateData(data)
 
-		tmpl, _ := template.ParseFiles(filepath.Join(config.TemplatesDir, "upload.html"))
-		tmpl.Execute(w, data)
+		renderTemplate(w, r, "upload.html", data)
 		return
 	}
 
 	if r.Method == http.MethodPost {
-		user := services.GetUser(username)
-		if user == nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		file, header, err := r.FormFile("file")
+		// Refuse uploads that clearly won't fit before reading the body
+		remaining, err := services.GetRemainingQuota(owner)
 		if err != nil {
-			http.Error(w, "File error", 400)
+			http.Error(w, "Quota error", 500)
 			return
 		}
-		defer file.Close()
-
-		// Get target folder from form
-		folder := r.FormValue("folder")
-		userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
-
-		// Normalize folder path
-		if folder == "/" {
-			folder = ""
-		}
-
-		// Build target path
-		var targetPath string
-		if folder != "" && folder != "/" {
-			targetPath = filepath.Join(userStoragePath, folder)
-			// Security check
-			if !isPathSafe(targetPath, userStoragePath) {
-				http.Error(w, "Invalid folder", http.StatusForbidden)
-				return
-			}
-		} else {
-			targetPath = userStoragePath
-			folder = "/"
-		}
-
-		filePath := filepath.Join(targetPath, header.Filename)
-
-		// LOCK before file operations
-		services.LockUserFileWrite(username)
-		defer services.UnlockUserFileWrite(username)
-
-		// Check if file already exists in database
-		relativePath, _ := filepath.Rel(userStoragePath, filePath)
-		exists, _ := services.FileExistsInDB(username, relativePath)
-		if exists {
-			http.Error(w, "File already exists", http.StatusConflict)
+		if remaining == 0 || (remaining > 0 && r.ContentLength > remaining+config.QuotaRequestSlack) {
+			http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
 			return
 		}
 
-		// Check if file already exists on disk (safety check)
-		if _, err := os.Stat(filePath); err == nil {
-			http.Error(w, "File already exists", http.StatusConflict)
-			return
-		}
+		// The whole request counts as one unit against the rate limit
+		folder := "/"
+		response, firstErr := receiveUploadBatch(r, remaining, func(upload *stagedUpload) error {
+			// Folders are chosen within the space; new files need a folder
+			// the user may add to, new versions a file they may change
+			folderPath := space.path(upload.folder, "")
+			target := filepath.Join(folderPath, upload.relDir, upload.filename)
+			if !space.canAddTo(filepath.Dir(target)) && !(upload.newVersion && space.canReplace(target)) {
+				return &uploadError{http.StatusForbidden, "You cannot upload here"}
+			}
+			if owner != username {
+				upload.uploadedBy = username
+			}
+			upload.folder = space.ownerFolder(folderPath)
 
-		f, err := os.Create(filePath)
-		if err != nil {
-			http.Error(w, "Save error", 500)
-			return
-		}
-		defer f.Close()
+			_, err := placeUploadedFile(space.owner, upload)
+			if err == nil {
+				folder = space.folder(folderPath)
+				upload.storedPath = space.folder(filepath.Join(space.storagePath, filepath.FromSlash(upload.storedPath)))
+			}
+			return err
+		})
 
-		// Copy file content
-		written, err := io.Copy(f, file)
-		if err != nil {
-			os.Remove(filePath) // Cleanup on error
-			http.Error(w, "Save error", 500)
+		if wantsJSON(r) {
+			writeUploadBatchJSON(w, response, firstErr)
 			return
 		}
 
-		// Calculate file hash
-		fileHash := utils.CalculateFileSHA256(filePath)
-
-		// Get MIME type
-		mimeType := header.Header.Get("Content-Type")
-		if mimeType == "" {
-			mimeType = "application/octet-stream"
-		}
-
-		// Save file metadata to database
-		err = services.AddFileMetadata(
-			username,
-			header.Filename,
-			relativePath,
-			folder,
-			mimeType,
-			fileHash,
-			written,
-			false, // not a directory
-		)
-		if err != nil {
-			// If database insert fails, remove the file
-			os.Remove(filePath)
-			http.Error(w, "Failed to save file metadata", 500)
+		if firstErr != nil {
+			writeUploadError(w, firstErr)
 			return
 		}
 
-		// Update folder size cache
-		fileInfo, _ := f.Stat()
-		services.UpdateFolderSize(targetPath, fileInfo.Size())
-
-		// Invalidate cache after upload
-		services.InvalidateUserCache(username)
-
 		// Redirect back to the folder where the file was uploaded
-		if folder != "" && folder != "/" {
-			http.Redirect(w, r, "/list?folder="+folder, http.StatusSeeOther)
-		} else {
-			http.Redirect(w, r, "/list", http.StatusSeeOther)
-		}
+		http.Redirect(w, r, space.listURL(folder), http.StatusSeeOther)
 	}
 }
 
-// DownloadHandler handles file downloads
+// DownloadHandler handles file downloads. Files are sent as attachments
+// unless inline=1 asks for them to be shown in the browser.
 func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	username := middleware.GetSessionUser(r)
 	if username == "" {
@@ -167,10 +122,6 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Lock for read operation
-	services.LockUserFileRead(username)
-	defer services.UnlockUserFileRead(username)
-
 	name := r.URL.Query().Get("name")
 	folder := r.URL.Query().Get("folder")
 	if name == "" {
@@ -178,37 +129,41 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := services.GetUser(username)
-	if user == nil {
+	space, err := resolveFileSpace(username, r.URL.Query().Get)
+	if errors.Is(err, services.ErrUserNotFound) {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
-
-	userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
-
-	// Build file path
-	var filePath string
-	if folder != "" && folder != "/" {
-		filePath = filepath.Join(userStoragePath, folder, name)
-	} else {
-		filePath = filepath.Join(userStoragePath, name)
+	if err != nil {
+		writeSpaceError(w, err)
+		return
 	}
 
-	// Security check: ensure path is within user's storage
-	if !isPathSafe(filePath, userStoragePath) {
+	// Lock for read operation
+	services.LockUserFileRead(space.owner.Username)
+	defer services.UnlockUserFileRead(space.owner.Username)
+
+	// Security check: ensure path is within the user's storage, or the
+	// item shared with them
+	filePath := space.path(folder, name)
+	if !space.canRead(filePath) {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
 
-	f, err := os.Open(filePath)
+	f, err := openStoredFile(space.owner.Username, space.storagePath, filePath)
 	if err != nil {
 		http.Error(w, "File not found", 404)
 		return
 	}
 	defer f.Close()
-	w.Header().Set("Content-Disposition", "attachment; filename="+name)
-	w.Header().Set("Content-Type", "application/octet-stream")
-	io.Copy(w, f)
+
+	contentType := f.contentType()
+	disposition := "attachment"
+	if isTruthy(r.URL.Query().Get("inline")) && isInlineSafeContentType(contentType) {
+		disposition = "inline"
+	}
+	serveStoredFile(w, r, f, contentType, disposition)
 }
 
 // ThumbnailHandler handles image thumbnail display
@@ -219,10 +174,6 @@ func ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Lock for read operation
-	services.LockUserFileRead(username)
-	defer services.UnlockUserFileRead(username)
-
 	name := r.URL.Query().Get("name")
 	folder := r.URL.Query().Get("folder")
 	if name == "" {
@@ -230,50 +181,49 @@ func ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := services.GetUser(username)
-	if user == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
 	ext := strings.ToLower(filepath.Ext(name))
 	if !utils.IsImageFile(ext) {
 		http.Error(w, "Not an image file", 400)
 		return
 	}
 
-	userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
-
-	// Build file path
-	var filePath string
-	if folder != "" && folder != "/" {
-		filePath = filepath.Join(userStoragePath, folder, name)
-	} else {
-		filePath = filepath.Join(userStoragePath, name)
+	space, err := resolveFileSpace(username, r.URL.Query().Get)
+	if err != nil {
+		writeSpaceError(w, err)
+		return
 	}
 
+	// Lock for read operation
+	services.LockUserFileRead(space.owner.Username)
+	defer services.UnlockUserFileRead(space.owner.Username)
+
 	// Security check
-	if !isPathSafe(filePath, userStoragePath) {
+	filePath := space.path(folder, name)
+	if !space.canRead(filePath) {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
 
-	f, err := os.Open(filePath)
+	f, err := openStoredFile(space.owner.Username, space.storagePath, filePath)
 	if err != nil {
 		http.Error(w, "File not found", 404)
 		return
 	}
 	defer f.Close()
 
-	w.Header().Set("Content-Type", utils.GetImageContentType(ext))
-	io.Copy(w, f)
+	contentType := f.contentType()
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = utils.GetImageContentType(ext)
+	}
+	serveStoredFile(w, r, f, contentType, "inline")
 }
 
-// isPathSafe checks if a file path is within allowed directory
+// isPathSafe checks if a file path is within allowed directory (or is the
+// directory itself)
 func isPathSafe(filePath, allowedDir string) bool {
 	absPath, _ := filepath.Abs(filePath)
 	absAllowed, _ := filepath.Abs(allowedDir)
-	return strings.HasPrefix(absPath, absAllowed)
+	return absPath == absAllowed || strings.HasPrefix(absPath, absAllowed+string(filepath.Separator))
 }
 
 // DeleteHandler handles file and folder deletion
@@ -284,87 +234,64 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	name := r.URL.Query().Get("name")
-	folder := r.URL.Query().Get("folder")
-	if name == "" {
-		http.Error(w, "Missing file/folder name", 400)
+	// Deletion must never be triggered by a plain link or image load
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	user := services.GetUser(username)
-	if user == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	name := r.FormValue("name")
+	folder := r.FormValue("folder")
+	if name == "" {
+		http.Error(w, "Missing file/folder name", 400)
 		return
 	}
 
-	userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
-
-	// Build full path
-	var targetPath string
-	if folder != "" && folder != "/" {
-		targetPath = filepath.Join(userStoragePath, folder, name)
-	} else {
-		targetPath = filepath.Join(userStoragePath, name)
+	space, err := resolveFileSpace(username, r.FormValue)
+	if err != nil {
+		writeSpaceError(w, err)
+		return
 	}
 
 	// Security check
-	if !isPathSafe(targetPath, userStoragePath) {
+	targetPath := space.path(folder, name)
+	if !space.canChange(targetPath) {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
 
 	// Lock for write operation
-	services.LockUserFileWrite(username)
-	defer services.UnlockUserFileWrite(username)
+	owner := space.owner.Username
+	services.LockUserFileWrite(owner)
+	defer services.UnlockUserFileWrite(owner)
 
 	// Get relative path for database operations
-	relativePath, _ := filepath.Rel(userStoragePath, targetPath)
-
-	// Get file/folder size before deletion from database
-	var deletedSize int64
-	// Check if it's a directory from database
-	fileMetadata, err := services.GetFileByPath(username, relativePath)
-	if err == nil && fileMetadata != nil {
-		if fileMetadata.IsDirectory {
-			// Calculate folder size from database
-			deletedSize, _ = services.CalculateFolderSizeDB(username, relativePath)
-		} else {
-			deletedSize = fileMetadata.FileSize
+	relativePath := space.relative(targetPath)
+
+	// Move to the trash rather than deleting outright; the trash service
+	// keeps the metadata and updates the folder size cache. Items deleted
+	// from a shared folder go to the owner's trash.
+	if _, err := services.MoveToTrash(owner, space.storagePath, relativePath); err != nil {
+		if errors.Is(err, services.ErrFileNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
 		}
-	}
-
-	// Delete from database first (including children if folder)
-	err = services.DeleteFileMetadataRecursive(username, relativePath)
-	if err != nil {
-		http.Error(w, "Database delete error", 500)
-		return
-	}
-
-	// Delete file or folder from disk
-	err = os.RemoveAll(targetPath)
-	if err != nil {
+		log.Printf("Failed to move %s to trash for %s: %v", relativePath, owner, err)
 		http.Error(w, "Delete error", 500)
 		return
 	}
 
-	// Update parent folder size cache
-	var parentFolder string
-	if folder != "" && folder != "/" {
-		parentFolder = filepath.Join(userStoragePath, folder)
-	} else {
-		parentFolder = userStoragePath
-	}
-	services.UpdateFolderSize(parentFolder, -deletedSize)
-
 	// Invalidate cache after deletion
-	services.InvalidateUserCache(username)
+	services.InvalidateUserCache(owner)
 
-	// Redirect back to folder or root
-	if folder != "" && folder != "/" {
-		http.Redirect(w, r, "/list?folder="+folder, http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, "/list", http.StatusSeeOther)
+	// API clients using DELETE get a plain status instead of a redirect
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
+
+	// Redirect back to folder or root
+	http.Redirect(w, r, space.listURL(folder), http.StatusSeeOther)
 }
 
 // CreateFolderHandler handles folder creation
@@ -395,85 +322,101 @@ func CreateFolderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := services.GetUser(username)
-	if user == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	space, err := resolveFileSpace(username, r.FormValue)
+	if err != nil {
+		writeSpaceError(w, err)
 		return
 	}
 
-	userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
-
 	// Normalize current folder
 	if currentFolder == "" || currentFolder == "/" {
 		currentFolder = "/"
 	}
 
 	// Build target path
-	var targetPath string
-	if currentFolder != "" && currentFolder != "/" {
-		targetPath = filepath.Join(userStoragePath, currentFolder, folderName)
-	} else {
-		targetPath = filepath.Join(userStoragePath, folderName)
-	}
+	parentPath := space.path(currentFolder, "")
+	targetPath := filepath.Join(parentPath, folderName)
 
 	// Security check
-	if !isPathSafe(targetPath, userStoragePath) {
+	if !space.canAddTo(parentPath) || !isPathSafe(targetPath, parentPath) {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
 
 	// Lock for write operation
-	services.LockUserFileWrite(username)
-	defer services.UnlockUserFileWrite(username)
+	owner := space.owner.Username
+	services.LockUserFileWrite(owner)
+	defer services.UnlockUserFileWrite(owner)
 
 	// Get relative path for database
-	relativePath, _ := filepath.Rel(userStoragePath, targetPath)
+	relativePath := space.relative(targetPath)
 
 	// Check if folder already exists in database
-	exists, _ := services.FileExistsInDB(username, relativePath)
+	exists, _ := services.FileExistsInDB(owner, relativePath)
 	if exists {
 		http.Error(w, "Folder already exists", http.StatusConflict)
 		return
 	}
 
-	// Create folder on disk
-	err := os.MkdirAll(targetPath, os.ModePerm)
-	if err != nil {
-		http.Error(w, "Failed to create folder", 500)
-		return
-	}
-
-	// Add folder metadata to database
+	// Folders only exist as metadata; contents live in the blob store
 	err = services.AddFileMetadata(
-		username,
+		owner,
 		folderName,
 		relativePath,
-		currentFolder,
+		space.ownerFolder(parentPath),
 		"",   // no mime type for folders
 		"",   // no hash for folders
 		0,    // folders have 0 size
 		true, // is directory
 	)
 	if err != nil {
-		// Cleanup on error
-		os.Remove(targetPath)
 		http.Error(w, "Failed to save folder metadata", 500)
 		return
 	}
 
 	// Invalidate cache after folder creation
-	services.InvalidateUserCache(username)
+	services.InvalidateUserCache(owner)
 
 	// Redirect back
-	if currentFolder != "" && currentFolder != "/" {
-		http.Redirect(w, r, "/list?folder="+currentFolder, http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, "/list", http.StatusSeeOther)
-	}
+	http.Redirect(w, r, space.listURL(currentFolder), http.StatusSeeOther)
 }
 
-// MoveFileHandler handles moving files to folders
+// MoveFileHandler moves files and folders ("file_name", repeatable) from
+// source_folder to target_folder
 func MoveFileHandler(w http.ResponseWriter, r *http.Request) {
+	transferFiles(w, r, false)
+}
+
+// CopyFileHandler copies files and folders ("file_name", repeatable) from
+// source_folder to target_folder
+func CopyFileHandler(w http.ResponseWriter, r *http.Request) {
+	transferFiles(w, r, true)
+}
+
+// transferErrorStatus maps a failed move or copy to an HTTP status, a
+// per-item result status and a message
+func transferErrorStatus(err error) (int, string, string) {
+	switch {
+	case errors.Is(err, services.ErrFileNotFound):
+		return http.StatusNotFound, "error", "File not found"
+	case errors.Is(err, services.ErrFolderNotFound):
+		return http.StatusNotFound, "error", "Destination folder not found"
+	case errors.Is(err, services.ErrFileExists):
+		return http.StatusConflict, "conflict", "A file or folder with that name already exists"
+	case errors.Is(err, services.ErrMoveIntoSelf):
+		return http.StatusBadRequest, "error", "A folder cannot be moved or copied into itself"
+	case errors.Is(err, services.ErrQuotaExceeded):
+		return http.StatusRequestEntityTooLarge, "error", "Storage quota exceeded"
+	case errors.Is(err, errNotAllowed):
+		return http.StatusForbidden, "error", "Your role does not allow changing this item"
+	}
+	return http.StatusInternalServerError, "error", "Failed to transfer file"
+}
+
+// transferFiles moves or copies the selected items one at a time, so one
+// failure doesn't undo the others. "conflict" picks what happens when a
+// name is taken: fail (default), skip, overwrite or rename.
+func transferFiles(w http.ResponseWriter, r *http.Request, copyItems bool) {
 	username := middleware.GetSessionUser(r)
 	if username == "" {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -485,22 +428,28 @@ func MoveFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fileName := r.FormValue("file_name")
 	sourceFolder := r.FormValue("source_folder")
 	targetFolder := r.FormValue("target_folder")
+	fileNames := r.Form["file_name"]
 
-	if fileName == "" {
+	if len(fileNames) == 0 {
 		http.Error(w, "Missing file name", 400)
 		return
 	}
 
-	user := services.GetUser(username)
-	if user == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	policy, ok := services.ParseConflictPolicy(r.FormValue("conflict"))
+	if !ok {
+		http.Error(w, "Invalid conflict policy", 400)
 		return
 	}
 
-	userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
+	// Items only move or copy within one space
+	space, err := resolveFileSpace(username, r.FormValue)
+	if err != nil {
+		writeSpaceError(w, err)
+		return
+	}
+	owner := space.owner.Username
 
 	// Normalize folder paths
 	if sourceFolder == "" || sourceFolder == "/" {
@@ -510,98 +459,197 @@ func MoveFileHandler(w http.ResponseWriter, r *http.Request) {
 		targetFolder = "/"
 	}
 
-	// Build source path
-	var sourcePath string
-	if sourceFolder != "" && sourceFolder != "/" {
-		sourcePath = filepath.Join(userStoragePath, sourceFolder, fileName)
-	} else {
-		sourcePath = filepath.Join(userStoragePath, fileName)
-	}
-
-	// Build target path
-	var targetPath string
-	if targetFolder != "" && targetFolder != "/" {
-		targetPath = filepath.Join(userStoragePath, targetFolder, fileName)
-	} else {
-		targetPath = filepath.Join(userStoragePath, fileName)
-	}
+	sourceFolderPath := space.path(sourceFolder, "")
+	targetFolderPath := space.path(targetFolder, "")
 
 	// Security checks
-	if !isPathSafe(sourcePath, userStoragePath) || !isPathSafe(targetPath, userStoragePath) {
+	if !space.canRead(sourceFolderPath) || !space.canAddTo(targetFolderPath) {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
+	// Replacing an item removes it, which needs the same rights as deleting
+	if policy == services.ConflictOverwrite && !space.canManage() {
+		http.Error(w, "You cannot replace existing items here", http.StatusForbidden)
+		return
+	}
 
 	// Lock for write operation
-	services.LockUserFileWrite(username)
-	defer services.UnlockUserFileWrite(username)
+	services.LockUserFileWrite(owner)
+	defer services.UnlockUserFileWrite(owner)
+
+	done := "moved"
+	if copyItems {
+		done = "copied"
+	}
+
+	response := models.TransferBatchResponse{Results: []models.TransferResult{}}
+	firstStatus, firstMessage := 0, ""
+	for _, fileName := range fileNames {
+		result := models.TransferResult{Name: fileName, Status: done}
+
+		var err error
+		var newPath string
+		sourcePath := filepath.Join(sourceFolderPath, fileName)
+		switch {
+		case !isValidUploadFilename(fileName):
+			err = services.ErrFileNotFound
+		case copyItems && !space.canRead(sourcePath), !copyItems && !space.canChange(sourcePath):
+			err = errNotAllowed
+		default:
+			newPath, err = services.TransferFile(owner, space.storagePath, space.relative(sourcePath),
+				space.ownerFolder(targetFolderPath), copyItems, policy)
+		}
+
+		switch {
+		case err == nil:
+			result.Path = space.folder(filepath.Join(space.storagePath, newPath))
+			response.Done++
+		case errors.Is(err, services.ErrFileSkipped):
+			result.Status = "skipped"
+			result.Message = "A file or folder with that name already exists"
+			response.Skipped++
+		default:
+			var status int
+			status, result.Status, result.Message = transferErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to transfer %s for %s: %v", fileName, owner, err)
+			}
+			if firstStatus == 0 {
+				firstStatus, firstMessage = status, result.Message
+			}
+			response.Failed++
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	// Invalidate cache after moving or copying
+	services.InvalidateUserCache(owner)
+
+	if wantsJSON(r) {
+		response.Success = response.Failed == 0
+		status := http.StatusOK
+		if response.Done == 0 && response.Skipped == 0 {
+			status = firstStatus
+		}
+		writeJSON(w, status, response)
+		return
+	}
+
+	if firstStatus != 0 {
+		http.Error(w, firstMessage, firstStatus)
+		return
+	}
 
-	// Get relative paths for database
-	sourceRelPath, _ := filepath.Rel(userStoragePath, sourcePath)
-	targetRelPath, _ := filepath.Rel(userStoragePath, targetPath)
+	// Redirect back
+	http.Redirect(w, r, space.listURL(sourceFolder), http.StatusSeeOther)
+}
+
+// isValidItemName accepts a name for a new or renamed file or folder
+func isValidItemName(name string) bool {
+	if !isValidUploadFilename(name) || len(name) > 255 || strings.TrimSpace(name) != name {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
 
-	// Get file size before moving
-	var fileSize int64
-	if info, err := os.Stat(sourcePath); err == nil {
-		fileSize = info.Size()
+// RenameHandler renames a file or folder in place. Everything inside a
+// renamed folder keeps its place under the new name.
+func RenameHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
 	}
 
-	// Move file on disk
-	err := os.Rename(sourcePath, targetPath)
-	if err != nil {
-		http.Error(w, "Failed to move file", 500)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Update database: change storage_path and parent_path
-	query := `UPDATE files SET storage_path = ?, parent_path = ?, modified_at = ? WHERE username = ? AND storage_path = ?`
-	_, err = services.GetDB().Exec(query, targetRelPath, targetFolder, time.Now(), username, sourceRelPath)
+	space, err := resolveFileSpace(username, r.FormValue)
 	if err != nil {
-		// Rollback file move on database error
-		os.Rename(targetPath, sourcePath)
-		http.Error(w, "Failed to update file metadata", 500)
+		writeSpaceError(w, err)
 		return
 	}
 
-	// Update folder size caches
-	var sourceFolderPath, targetFolderPath string
-	if sourceFolder != "" && sourceFolder != "/" {
-		sourceFolderPath = filepath.Join(userStoragePath, sourceFolder)
-	} else {
-		sourceFolderPath = userStoragePath
+	name := r.FormValue("name")
+	folder := r.FormValue("folder")
+	newName := strings.TrimSpace(r.FormValue("new_name"))
+	redirect := space.listURL(folder)
+	if name == "" {
+		writeFileOpResult(w, r, http.StatusBadRequest, "Missing file name", redirect)
+		return
 	}
-	if targetFolder != "" && targetFolder != "/" {
-		targetFolderPath = filepath.Join(userStoragePath, targetFolder)
-	} else {
-		targetFolderPath = userStoragePath
+	if !isValidItemName(newName) {
+		writeFileOpResult(w, r, http.StatusBadRequest, "Invalid name", redirect)
+		return
 	}
 
-	// Subtract from source, add to target
-	services.UpdateFolderSize(sourceFolderPath, -fileSize)
-	services.UpdateFolderSize(targetFolderPath, fileSize)
+	// Build source and target paths
+	folderPath := space.path(folder, "")
+	sourcePath := filepath.Join(folderPath, name)
+	targetPath := filepath.Join(folderPath, newName)
 
-	// Invalidate cache after moving file
-	services.InvalidateUserCache(username)
+	// Security checks
+	if !space.canChange(sourcePath) || !space.canChange(targetPath) || !isValidUploadFilename(name) {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
 
-	// Redirect back
-	if sourceFolder != "" && sourceFolder != "/" {
-		http.Redirect(w, r, "/list?folder="+sourceFolder, http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, "/list", http.StatusSeeOther)
+	if newName == name {
+		writeFileOpResult(w, r, http.StatusOK, "Name unchanged", redirect)
+		return
+	}
+
+	// Lock for write operation
+	owner := space.owner.Username
+	services.LockUserFileWrite(owner)
+	defer services.UnlockUserFileWrite(owner)
+
+	sourceRelPath := space.relative(sourcePath)
+	targetRelPath := space.relative(targetPath)
+
+	// Only metadata changes; the content stays where it is in the blob store
+	err = services.RenameFileMetadata(owner, sourceRelPath, targetRelPath, newName)
+	switch {
+	case errors.Is(err, services.ErrFileNotFound):
+		writeFileOpResult(w, r, http.StatusNotFound, "File not found", redirect)
+		return
+	case errors.Is(err, services.ErrFileExists):
+		writeFileOpResult(w, r, http.StatusConflict, "A file or folder named "+newName+" already exists", redirect)
+		return
+	case err != nil:
+		log.Printf("Failed to rename %s for %s: %v", sourceRelPath, owner, err)
+		writeFileOpResult(w, r, http.StatusInternalServerError, "Failed to rename", redirect)
+		return
 	}
+
+	// Sizes don't change, but cached folder sizes are keyed by path
+	services.RenameFolderSizeCache(sourcePath, targetPath)
+
+	// Invalidate cache after renaming
+	services.InvalidateUserCache(owner)
+
+	writeFileOpResult(w, r, http.StatusOK, "Renamed to "+newName, redirect)
 }
 
-// getFolderList returns list of folders in a directory
-func getFolderList(basePath string) ([]string, error) {
+// getFolderList returns the names of the folders in a folder of a user's
+// storage ("/" for the top)
+func getFolderList(username, parentPath string) ([]string, error) {
 	var folders []string
-	entries, err := os.ReadDir(basePath)
+	entries, err := services.GetUserFiles(username, parentPath)
 	if err != nil {
 		return folders, err
 	}
 
 	for _, entry := range entries {
-		if entry.IsDir() {
-			folders = append(folders, entry.Name())
+		if entry.IsDirectory {
+			folders = append(folders, entry.Filename)
 		}
 	}
 	return folders, nil
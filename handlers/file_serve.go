@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// storedFile is open content from the blob store together with the
+// metadata used to answer conditional requests
+type storedFile struct {
+	*os.File
+	name     string
+	mimeType string    // From the files table ("" if unknown)
+	hash     string    // SHA-256 from the files table ("" if unknown)
+	modTime  time.Time // Last-Modified
+}
+
+// openStoredFile opens the content of filePath inside the user's storage.
+// Like the file list, only files registered in the database are served.
+func openStoredFile(username, userStoragePath, filePath string) (*storedFile, error) {
+	relativePath, _ := filepath.Rel(userStoragePath, filePath)
+	meta, err := services.GetFileByPath(username, relativePath)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil || meta.IsDirectory {
+		return nil, os.ErrNotExist
+	}
+	return openFileContent(meta)
+}
+
+// openFileContent opens the content of a file's metadata row
+func openFileContent(meta *models.FileMetadata) (*storedFile, error) {
+	// Content is stored under its hash, so the hash always describes it
+	f, err := services.OpenBlob(meta.FileHash)
+	if err != nil {
+		return nil, err
+	}
+	return &storedFile{File: f, name: meta.Filename, mimeType: meta.MimeType, hash: meta.FileHash, modTime: meta.ModifiedAt}, nil
+}
+
+// contentType returns the recorded MIME type, falling back to one guessed
+// from the extension when the upload did not say
+func (f *storedFile) contentType() string {
+	if f.mimeType != "" && f.mimeType != "application/octet-stream" {
+		return f.mimeType
+	}
+	if guessed := mime.TypeByExtension(strings.ToLower(filepath.Ext(f.name))); guessed != "" {
+		return guessed
+	}
+	return "application/octet-stream"
+}
+
+// isInlineSafeContentType reports whether a file of this type may be shown
+// in the browser. The type comes from the uploader, so only types browsers
+// display without running scripts are allowed; XML-based types such as SVG
+// are not.
+func isInlineSafeContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || strings.HasSuffix(mediaType, "+xml") {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return true
+	}
+	return mediaType == "application/pdf" || mediaType == "text/plain"
+}
+
+// serveStoredFile sends a stored file with the given Content-Type and
+// disposition ("inline" or "attachment"). http.ServeContent takes care of
+// Range, If-Range, If-None-Match, If-Modified-Since and HEAD.
+func serveStoredFile(w http.ResponseWriter, r *http.Request, f *storedFile, contentType, disposition string) {
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", utils.ContentDisposition(disposition, f.name))
+	header.Set("X-Content-Type-Options", "nosniff")
+	// Let the browser keep a copy but check back before reusing it
+	header.Set("Cache-Control", "private, no-cache")
+	if f.hash != "" {
+		header.Set("ETag", `"`+f.hash+`"`)
+	}
+	// Whatever its type, an uploaded file must not run scripts on our origin
+	header.Set("Content-Security-Policy", "sandbox")
+
+	http.ServeContent(w, r, f.name, f.modTime, f)
+}
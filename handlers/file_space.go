@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+)
+
+// errNotAllowed fails an item the user's role in a shared item or group
+// does not let them change
+var errNotAllowed = errors.New("not allowed for your role")
+
+// fileSpace is the storage a file request works on: the user's own files,
+// a file or folder another user shared with them ("share"), or the space of
+// a group they belong to ("group"). In a shared folder, folder parameters
+// are relative to that folder; a shared file sits alone at the top of its
+// space. A group's space starts at the top of its storage.
+type fileSpace struct {
+	owner       *models.User      // Whose files these are
+	storagePath string            // Owner's storage root
+	root        string            // Folder parameters start here
+	item        string            // Everything the request may see is in here
+	share       *models.UserShare // Set for an item shared with the user
+	group       *models.Group     // Set for a group space, with the user's role
+}
+
+// resolveFileSpace returns the space a request of username works on, read
+// from the "share" and "group" parameters through param (r.FormValue, or
+// r.URL.Query().Get where the body must not be read). Fails with
+// services.ErrUserNotFound if the user is gone, and ErrUserShareNotFound or
+// ErrGroupNotFound if they cannot (or can no longer) open the space.
+func resolveFileSpace(username string, param func(string) string) (*fileSpace, error) {
+	user := services.GetUser(username)
+	if user == nil {
+		return nil, services.ErrUserNotFound
+	}
+	shareID, groupID := param("share"), param("group")
+	switch {
+	case shareID != "":
+		return resolveSharedSpace(username, shareID)
+	case groupID != "":
+		return resolveGroupSpace(username, groupID)
+	}
+
+	storagePath := services.GetUserStoragePath(username, user.UniqueCode)
+	return &fileSpace{owner: user, storagePath: storagePath, root: storagePath, item: storagePath}, nil
+}
+
+// resolveSharedSpace returns the space of an item shared with username
+func resolveSharedSpace(username, shareID string) (*fileSpace, error) {
+	id, err := strconv.ParseInt(shareID, 10, 64)
+	if err != nil || id <= 0 {
+		return nil, services.ErrUserShareNotFound
+	}
+	share, err := services.GetSharedWithUser(username, id)
+	if err != nil {
+		return nil, err
+	}
+	owner := services.GetUser(share.Owner)
+	if owner == nil {
+		return nil, services.ErrUserShareNotFound
+	}
+
+	space := &fileSpace{
+		owner:       owner,
+		storagePath: services.GetUserStoragePath(owner.Username, owner.UniqueCode),
+		share:       share,
+	}
+	space.item = filepath.Join(space.storagePath, share.StoragePath)
+	space.root = space.item
+	if !share.IsDirectory {
+		space.root = filepath.Dir(space.item)
+	}
+	return space, nil
+}
+
+// resolveGroupSpace returns the space of a group username is a member of
+func resolveGroupSpace(username, groupID string) (*fileSpace, error) {
+	group, err := lookupGroup(username, groupID)
+	if err != nil {
+		return nil, err
+	}
+	owner := services.GetUser(group.Account)
+	if owner == nil {
+		return nil, services.ErrGroupNotFound
+	}
+
+	storagePath := services.GetUserStoragePath(owner.Username, owner.UniqueCode)
+	return &fileSpace{owner: owner, storagePath: storagePath, root: storagePath, item: storagePath, group: group}, nil
+}
+
+// lookupGroup returns a group by its "group" parameter, with the role of
+// username, who must be a member
+func lookupGroup(username, groupID string) (*models.Group, error) {
+	id, err := strconv.ParseInt(groupID, 10, 64)
+	if err != nil || id <= 0 {
+		return nil, services.ErrGroupNotFound
+	}
+	return services.GetGroupForMember(username, id)
+}
+
+// writeSpaceError answers a request whose space could not be resolved
+func writeSpaceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case errors.Is(err, services.ErrUserShareNotFound), errors.Is(err, services.ErrGroupNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		log.Printf("Failed to open file space: %v", err)
+		http.Error(w, "Failed to open file space", http.StatusInternalServerError)
+	}
+}
+
+// path returns the full path of name in folder ("" for the folder itself)
+func (s *fileSpace) path(folder, name string) string {
+	return filepath.Join(s.root, folder, name)
+}
+
+// relative returns a full path relative to the owner's storage root, as
+// stored in the files table
+func (s *fileSpace) relative(path string) string {
+	relativePath, _ := filepath.Rel(s.storagePath, path)
+	return relativePath
+}
+
+// ownerFolder returns a full folder path as a parent path of the files
+// table ("/" for the owner's root)
+func (s *fileSpace) ownerFolder(path string) string {
+	if relativePath := s.relative(path); relativePath != "." {
+		return filepath.ToSlash(relativePath)
+	}
+	return "/"
+}
+
+// folder returns a full folder path as a folder parameter of this space
+// ("/" for its top)
+func (s *fileSpace) folder(path string) string {
+	if rel, err := filepath.Rel(s.root, path); err == nil && rel != "." {
+		return filepath.ToSlash(rel)
+	}
+	return "/"
+}
+
+// canEdit reports whether the user may add files to the space and upload
+// new versions: the owner, share editors and every group member
+func (s *fileSpace) canEdit() bool {
+	return s.share == nil || s.share.Role == services.ShareRoleEditor
+}
+
+// canManage reports whether the user may delete, rename and move items:
+// the owner, share editors and group admins and owners
+func (s *fileSpace) canManage() bool {
+	if s.group != nil {
+		return services.CanManageGroupFiles(s.group.Role)
+	}
+	return s.canEdit()
+}
+
+// canRead reports whether the user may see path
+func (s *fileSpace) canRead(path string) bool {
+	return isPathSafe(path, s.item)
+}
+
+// canChange reports whether the user may delete, rename, move or replace
+// path. The top of the space itself stays where the owner put it.
+func (s *fileSpace) canChange(path string) bool {
+	return s.canManage() && isPathSafe(path, s.item) && filepath.Clean(path) != filepath.Clean(s.item)
+}
+
+// canReplace reports whether the user may upload a new version of path,
+// which may be a shared file itself
+func (s *fileSpace) canReplace(path string) bool {
+	return s.canEdit() && s.canRead(path)
+}
+
+// canAddTo reports whether the user may add files and folders to folder
+func (s *fileSpace) canAddTo(folder string) bool {
+	if s.share != nil && !s.share.IsDirectory {
+		return false
+	}
+	return s.canEdit() && isPathSafe(folder, s.item)
+}
+
+// shareID returns the "share" parameter of the space ("" unless shared)
+func (s *fileSpace) shareID() string {
+	if s.share == nil {
+		return ""
+	}
+	return strconv.FormatInt(s.share.ID, 10)
+}
+
+// groupID returns the "group" parameter of the space ("" unless a group's)
+func (s *fileSpace) groupID() string {
+	if s.group == nil {
+		return ""
+	}
+	return strconv.FormatInt(s.group.ID, 10)
+}
+
+// query returns the parameters that select the space
+func (s *fileSpace) query() url.Values {
+	query := url.Values{}
+	if id := s.shareID(); id != "" {
+		query.Set("share", id)
+	}
+	if id := s.groupID(); id != "" {
+		query.Set("group", id)
+	}
+	return query
+}
+
+// addTemplateData adds what list.html and upload.html need to know about
+// the space to data
+func (s *fileSpace) addTemplateData(data map[string]interface{}) {
+	data["share"] = s.share
+	data["shareID"] = s.shareID()
+	data["group"] = s.group
+	data["groupID"] = s.groupID()
+	data["ownSpace"] = s.share == nil && s.group == nil
+	// Appended to links as "&" + spaceQuery
+	data["spaceQuery"] = template.URL(s.query().Encode())
+	data["canEdit"] = s.canEdit()
+	data["canManage"] = s.canManage()
+}
+
+// listURL returns the file list page of a folder of the space
+func (s *fileSpace) listURL(folder string) string {
+	return listURL(folder, s.query())
+}
+
+// listURL returns the file list page of a folder, in the space selected by
+// query (nil for the user's own files)
+func listURL(folder string, query url.Values) string {
+	values := url.Values{}
+	for key, value := range query {
+		values[key] = value
+	}
+	if folder != "" && folder != "/" {
+		values.Set("folder", folder)
+	}
+	if len(values) == 0 {
+		return "/list"
+	}
+	return "/list?" + values.Encode()
+}
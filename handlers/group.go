@@ -0,0 +1,322 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// groupURL returns the management page of a group
+func groupURL(id int64) string {
+	return "/groups/manage?id=" + strconv.FormatInt(id, 10)
+}
+
+// groupStorageSummary describes how much of its quota a group's space uses
+func groupStorageSummary(account string) string {
+	used, _, err := services.GetUserStorageStats(account)
+	if err != nil {
+		return ""
+	}
+	quota, _, err := services.GetUserQuota(account)
+	if err != nil || quota == 0 {
+		return utils.FormatFileSize(used) + " used"
+	}
+	return utils.FormatFileSize(used) + " of " + utils.FormatFileSize(quota) + " used"
+}
+
+// writeGroupResult reports the outcome of a group action with JSON for API
+// clients and a redirect to redirect for forms
+func writeGroupResult(w http.ResponseWriter, r *http.Request, err error, action, success, redirect string) {
+	switch {
+	case err == nil:
+		writeFileOpResult(w, r, http.StatusOK, success, redirect)
+	case errors.Is(err, services.ErrGroupNotFound):
+		writeFileOpResult(w, r, http.StatusNotFound, "Group not found", redirect)
+	case errors.Is(err, services.ErrUserNotFound):
+		writeFileOpResult(w, r, http.StatusNotFound, "Member not found", redirect)
+	case errors.Is(err, services.ErrGroupPermission):
+		writeFileOpResult(w, r, http.StatusForbidden, err.Error(), redirect)
+	case errors.Is(err, services.ErrLastGroupOwner), errors.Is(err, services.ErrAlreadyGroupMember):
+		writeFileOpResult(w, r, http.StatusConflict, err.Error(), redirect)
+	case errors.Is(err, services.ErrInvalidGroupName):
+		writeFileOpResult(w, r, http.StatusBadRequest, err.Error(), redirect)
+	default:
+		log.Printf("Failed to %s: %v", action, err)
+		writeFileOpResult(w, r, http.StatusInternalServerError, "Failed to "+action, redirect)
+	}
+}
+
+// groupAction checks the session and method of a group action and returns
+// the user and the group ("id") they act on, with their role in it, or
+// nil after writing an error
+func groupAction(w http.ResponseWriter, r *http.Request) (string, *models.Group) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", nil
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return "", nil
+	}
+
+	group, err := lookupGroup(username, r.FormValue("id"))
+	if err != nil {
+		writeGroupResult(w, r, err, "load group", "", "/groups")
+		return "", nil
+	}
+	return username, group
+}
+
+// GroupsPageHandler lists the groups the user belongs to, with a form to
+// create one
+func GroupsPageHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	groups, err := services.ListUserGroups(username)
+	if err != nil {
+		log.Printf("Failed to list groups of %s: %v", username, err)
+		http.Error(w, "Failed to load groups", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, r, "groups.html", map[string]interface{}{
+		"username": username,
+		"groups":   groups,
+	})
+}
+
+// GroupPageHandler shows a group's members and settings ("id")
+func GroupPageHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	group, err := lookupGroup(username, r.URL.Query().Get("id"))
+	if errors.Is(err, services.ErrGroupNotFound) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load group for %s: %v", username, err)
+		http.Error(w, "Failed to load group", http.StatusInternalServerError)
+		return
+	}
+
+	members, err := services.ListGroupMembers(group.ID)
+	if err != nil {
+		log.Printf("Failed to list members of group %d: %v", group.ID, err)
+		http.Error(w, "Failed to load group", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, r, "group.html", map[string]interface{}{
+		"username":  username,
+		"group":     group,
+		"members":   members,
+		"storage":   groupStorageSummary(group.Account),
+		"canManage": services.CanManageGroupFiles(group.Role),
+		"isOwner":   group.Role == services.GroupRoleOwner,
+	})
+}
+
+// APIGroupsHandler returns the groups the user belongs to as JSON
+func APIGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groups, err := services.ListUserGroups(username)
+	if err != nil {
+		log.Printf("Failed to list groups of %s: %v", username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load groups"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"groups": groups})
+}
+
+// APIGroupMembersHandler returns a group ("id"), its members and its
+// storage use as JSON
+func APIGroupMembersHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	group, err := lookupGroup(username, r.URL.Query().Get("id"))
+	if errors.Is(err, services.ErrGroupNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "Group not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load group for %s: %v", username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load group"})
+		return
+	}
+
+	members, err := services.ListGroupMembers(group.ID)
+	if err != nil {
+		log.Printf("Failed to list members of group %d: %v", group.ID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load group"})
+		return
+	}
+	used, fileCount, _ := services.GetUserStorageStats(group.Account)
+	quota, _, _ := services.GetUserQuota(group.Account)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"group":         group,
+		"members":       members,
+		"storage_used":  used,
+		"storage_quota": quota,
+		"file_count":    fileCount,
+	})
+}
+
+// GroupCreateHandler creates a group with the user as its owner
+func GroupCreateHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	group, err := services.CreateGroup(username, r.FormValue("name"))
+	if err != nil {
+		writeGroupResult(w, r, err, "create group", "", "/groups")
+		return
+	}
+
+	log.Printf("%s created group %d", username, group.ID)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Group created", "group": group})
+		return
+	}
+	http.Redirect(w, r, groupURL(group.ID), http.StatusSeeOther)
+}
+
+// GroupRenameHandler renames a group (admins and owners)
+func GroupRenameHandler(w http.ResponseWriter, r *http.Request) {
+	_, group := groupAction(w, r)
+	if group == nil {
+		return
+	}
+
+	err := services.RenameGroup(group, r.FormValue("name"))
+	writeGroupResult(w, r, err, "rename group", "Group renamed", groupURL(group.ID))
+}
+
+// GroupDeleteHandler deletes a group and every file in its space (owners
+// only)
+func GroupDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	username, group := groupAction(w, r)
+	if group == nil {
+		return
+	}
+
+	err := services.DeleteGroup(group)
+	if err == nil {
+		log.Printf("%s deleted group %d", username, group.ID)
+	}
+	writeGroupResult(w, r, err, "delete group", "Group deleted", "/groups")
+}
+
+// GroupMemberAddHandler adds a registered user, found by "member" (email or
+// phone number), to a group with a role. Admins add members; owners may
+// also add admins and owners.
+func GroupMemberAddHandler(w http.ResponseWriter, r *http.Request) {
+	_, group := groupAction(w, r)
+	if group == nil {
+		return
+	}
+	redirect := groupURL(group.ID)
+
+	role := r.FormValue("role")
+	if role == "" {
+		role = services.GroupRoleMember
+	}
+	if !services.IsValidGroupRole(role) {
+		writeFileOpResult(w, r, http.StatusBadRequest, "Invalid role", redirect)
+		return
+	}
+
+	member := findUserByContact(strings.TrimSpace(r.FormValue("member")), strings.TrimSpace(r.FormValue("phone_region")))
+	if member == nil {
+		writeFileOpResult(w, r, http.StatusNotFound, "No user has that email or phone number", redirect)
+		return
+	}
+
+	err := services.AddGroupMember(group, member.Username, role)
+	writeGroupResult(w, r, err, "add group member", "Added "+member.Username+" as "+role, redirect)
+}
+
+// GroupMemberRoleHandler changes a member's role (owners only)
+func GroupMemberRoleHandler(w http.ResponseWriter, r *http.Request) {
+	_, group := groupAction(w, r)
+	if group == nil {
+		return
+	}
+	redirect := groupURL(group.ID)
+
+	role := r.FormValue("role")
+	if !services.IsValidGroupRole(role) {
+		writeFileOpResult(w, r, http.StatusBadRequest, "Invalid role", redirect)
+		return
+	}
+
+	member := r.FormValue("username")
+	err := services.SetGroupMemberRole(group, member, role)
+	writeGroupResult(w, r, err, "change group role", member+" is now "+role, redirect)
+}
+
+// GroupMemberRemoveHandler takes a member out of a group, or lets the user
+// leave it when "username" is their own
+func GroupMemberRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	username, group := groupAction(w, r)
+	if group == nil {
+		return
+	}
+
+	member := r.FormValue("username")
+	if member == "" {
+		member = username
+	}
+	err := services.RemoveGroupMember(username, group, member)
+
+	if member == username {
+		writeGroupResult(w, r, err, "leave group", "You left "+group.Name, "/groups")
+		return
+	}
+	writeGroupResult(w, r, err, "remove group member", "Removed "+member, groupURL(group.ID))
+}
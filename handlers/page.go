@@ -2,12 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
-	"html/template"
+	"errors"
+	"log"
 	"net/http"
-	"path/filepath"
 	"strings"
 
-	"github.com/HAYASAKA7/HAYA-DISK/config"
 	"github.com/HAYASAKA7/HAYA-DISK/middleware"
 	"github.com/HAYASAKA7/HAYA-DISK/models"
 	"github.com/HAYASAKA7/HAYA-DISK/services"
@@ -49,12 +48,7 @@ func SettingsHandler(w http.ResponseWriter, r *http.Request) {
 		"loginType": user.LoginType,
 	}
 
-	tmpl, err := template.ParseFiles(filepath.Join(config.TemplatesDir, "list.html"))
-	if err != nil {
-		http.Error(w, "Template error", 500)
-		return
-	}
-	tmpl.Execute(w, data)
+	renderTemplate(w, r, "list.html", data)
 }
 
 // APIUpdateProfileHandler handles profile updates via API
@@ -102,7 +96,7 @@ func APIUpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(models.UpdateProfileResponse{Success: false, Message: "Username must be 3-20 characters"})
 			return
 		}
-		if services.UsernameExists(newUsername) {
+		if services.UsernameExists(newUsername) || services.IsReservedUsername(newUsername) {
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(models.UpdateProfileResponse{Success: false, Message: "Username already taken"})
 			return
@@ -165,8 +159,77 @@ func APIUpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Optionally sign out every other device after a credential change
+	if req.RevokeOtherSessions {
+		services.DeleteUserSessions(updatedUsername, middleware.GetSessionCookie(r))
+	}
+
+	// A new email address has to be confirmed again
+	message := "Profile updated successfully"
+	if email != "" && email != user.Email {
+		if updated := services.GetUser(updatedUsername); updated != nil {
+			if err := sendVerificationEmail(updated); err != nil {
+				log.Printf("Warning: %v", err)
+			} else {
+				message = "Profile updated. Check " + email + " for a verification link."
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.UpdateProfileResponse{Success: true, Message: message})
+}
+
+// APIChangePasswordHandler handles password changes via API
+func APIChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(models.UpdateProfileResponse{Success: false, Message: "Unauthorized"})
+		return
+	}
+
+	var req models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(models.UpdateProfileResponse{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(models.UpdateProfileResponse{Success: false, Message: "Current and new password are required"})
+		return
+	}
+
+	if req.NewPassword != req.ConfirmPassword {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(models.UpdateProfileResponse{Success: false, Message: "Passwords do not match"})
+		return
+	}
+
+	if err := services.ChangePassword(username, req.CurrentPassword, req.NewPassword); err != nil {
+		message := "Failed to change password"
+		if errors.Is(err, services.ErrInvalidPassword) {
+			message = "Current password is incorrect"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(models.UpdateProfileResponse{Success: false, Message: message})
+		return
+	}
+
+	// Optionally sign out every other device after a credential change
+	if req.RevokeOtherSessions {
+		services.DeleteUserSessions(username, middleware.GetSessionCookie(r))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(models.UpdateProfileResponse{Success: true, Message: "Profile updated successfully"})
+	json.NewEncoder(w).Encode(models.UpdateProfileResponse{Success: true, Message: "Password changed successfully"})
 }
 
 // APIGetUserInfoHandler returns the current user's information
@@ -192,9 +255,10 @@ func APIGetUserInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(models.UserInfoResponse{
-		Username:    user.Username,
-		Email:       user.Email,
-		Phone:       user.Phone,
-		PhoneRegion: user.PhoneRegion,
+		Username:      user.Username,
+		Email:         user.Email,
+		Phone:         user.Phone,
+		PhoneRegion:   user.PhoneRegion,
+		EmailVerified: user.EmailVerified,
 	})
 }
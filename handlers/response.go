@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+// writeJSON encodes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// wantsJSON reports whether the client asked for a JSON response
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// isTruthy reports whether a form or query flag is switched on
+func isTruthy(value string) bool {
+	return value == "1" || value == "true" || value == "on"
+}
+
+// writeFileOpResult reports the outcome of a file operation: JSON for API
+// clients, plain text for errors otherwise. On success non-JSON clients
+// are redirected back to the redirect page.
+func writeFileOpResult(w http.ResponseWriter, r *http.Request, status int, message, redirect string) {
+	if wantsJSON(r) {
+		writeJSON(w, status, models.UpdateProfileResponse{Success: status == http.StatusOK, Message: message})
+		return
+	}
+	if status != http.StatusOK {
+		http.Error(w, message, status)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// renderTemplate parses and executes a page template, adding the CSRF
+// token every page needs for its forms and API calls
+func renderTemplate(w http.ResponseWriter, r *http.Request, name string, data map[string]interface{}) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	token := middleware.CSRFToken(w, r)
+	data["csrfToken"] = token
+	data["csrfField"] = middleware.CSRFField(token)
+
+	tmpl, err := template.ParseFiles(filepath.Join(config.TemplatesDir, name))
+	if err != nil {
+		http.Error(w, "Template error", 500)
+		return
+	}
+	tmpl.Execute(w, data)
+}
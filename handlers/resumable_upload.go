@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+)
+
+// Resumable uploads follow the tus 1.0 protocol (core, creation and
+// termination extensions), so stock tus clients can talk to /api/uploads.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	tusUploadPath = "/api/uploads/"
+)
+
+// writeTusHeaders adds the headers every tus response carries
+func writeTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// checkTusRequest rejects requests from clients speaking another protocol
+// version. OPTIONS is exempt so clients can discover what we support.
+func checkTusRequest(w http.ResponseWriter, r *http.Request) bool {
+	writeTusHeaders(w)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64value" pairs
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// isValidUploadFilename accepts a bare file name with no path components
+func isValidUploadFilename(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, `/\`) && filepath.Base(name) == name
+}
+
+// ResumableUploadCreateHandler creates a resumable upload (tus creation).
+// The client declares the size up front, so quota and name conflicts are
+// checked before any data is sent.
+func ResumableUploadCreateHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkTusRequest(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := services.GetUser(username)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	filename := metadata["filename"]
+	if !isValidUploadFilename(filename) {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
+	folder, targetPath, err := resolveUploadFolder(userStoragePath, metadata["folder"])
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if folder != "/" {
+		folderPath, _ := filepath.Rel(userStoragePath, targetPath)
+		if meta, err := services.GetFileByPath(username, folderPath); err != nil || meta == nil || !meta.IsDirectory {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	// Fail fast on a name clash instead of after a multi-GB transfer
+	relativePath, _ := filepath.Rel(userStoragePath, filepath.Join(targetPath, filename))
+	if exists, _ := services.FileExistsInDB(username, relativePath); exists {
+		http.Error(w, "File already exists", http.StatusConflict)
+		return
+	}
+
+	// Unfinished uploads reserve their full size against the quota
+	remaining, err := services.GetRemainingQuota(username)
+	if err != nil {
+		http.Error(w, "Quota error", http.StatusInternalServerError)
+		return
+	}
+	if remaining >= 0 {
+		pending, err := services.PendingUploadBytes(username)
+		if err != nil {
+			http.Error(w, "Quota error", http.StatusInternalServerError)
+			return
+		}
+		if length+pending > remaining {
+			http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	upload, err := services.CreateUploadSession(username, filename, folder, metadata["filetype"], length)
+	if err != nil {
+		log.Printf("Failed to create upload for %s: %v", username, err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", tusUploadPath+upload.ID)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// ResumableUploadHandler serves an existing upload: HEAD reports the
+// offset to resume from, PATCH appends a chunk and DELETE abandons it.
+// The file is moved into the user's folder when the last byte arrives.
+func ResumableUploadHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkTusRequest(w, r) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, tusUploadPath)
+	upload, err := services.GetUploadSession(id, username)
+	if err != nil {
+		http.Error(w, "Failed to load upload", http.StatusInternalServerError)
+		return
+	}
+	if upload == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		patchResumableUpload(w, r, upload.ID, username)
+
+	case http.MethodDelete:
+		if !services.TryLockUpload(upload.ID) {
+			http.Error(w, services.ErrUploadBusy.Error(), http.StatusConflict)
+			return
+		}
+		defer services.UnlockUpload(upload.ID)
+
+		if err := services.DeleteUploadSession(upload.ID); err != nil {
+			log.Printf("Failed to delete upload %s: %v", upload.ID, err)
+			http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// patchResumableUpload appends the request body at the client's offset and
+// completes the upload once it is whole. A completed upload that could not
+// be stored (name taken, quota full) stays around, so an empty PATCH at the
+// final offset retries it.
+func patchResumableUpload(w http.ResponseWriter, r *http.Request, id, username string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+
+	if !services.TryLockUpload(id) {
+		http.Error(w, services.ErrUploadBusy.Error(), http.StatusConflict)
+		return
+	}
+	defer services.UnlockUpload(id)
+
+	// Re-read under the lock so the offset check sees the latest write
+	upload, err := services.GetUploadSession(id, username)
+	if err != nil || upload == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	newOffset, err := services.AppendUploadChunk(upload, r.Body)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	if err != nil {
+		if errors.Is(err, services.ErrUploadTooLarge) {
+			http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Usually the client went away; the bytes that arrived are kept
+		log.Printf("Upload %s interrupted at %d/%d: %v", id, newOffset, upload.Length, err)
+		http.Error(w, "Upload interrupted", http.StatusInternalServerError)
+		return
+	}
+
+	if newOffset == upload.Length {
+		user := services.GetUser(username)
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		staged := &stagedUpload{
+			filename: upload.Filename,
+			mimeType: upload.MimeType,
+			folder:   upload.ParentPath,
+			tempPath: services.ResumableUploadPath(upload.ID),
+			size:     upload.Length,
+		}
+		if _, err := placeUploadedFile(user, staged); err != nil {
+			writeUploadError(w, err)
+			return
+		}
+
+		if err := services.DeleteUploadSession(upload.ID); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,482 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// searchHit is a search result as search.html shows it
+type searchHit struct {
+	models.SearchResult
+	Icon        string
+	NameHTML    template.HTML // Escaped by services.SearchFiles
+	SnippetHTML template.HTML
+	FolderURL   string // List page of the folder it is in
+	OpenURL     string // List page of a folder, download of a file
+}
+
+// savedSearchLink is a saved search as search.html lists it
+type savedSearchLink struct {
+	models.SavedSearch
+	URL string
+}
+
+// searchParams are the URL parameters of a search, which are kept when
+// it is saved. The space ("share", "group") is kept too, so a saved search
+// of a group searches that group.
+var searchParams = []string{"q", "type", "category", "mime", "min_size", "max_size",
+	"uploaded_from", "uploaded_to", "modified_from", "modified_to", "folder", "tag", "color",
+	"sort", "order", "share", "group"}
+
+// searchQuery returns the search parameters of query, without the cursor
+// and anything else that is not part of the search
+func searchQuery(query url.Values) url.Values {
+	values := url.Values{}
+	for _, param := range searchParams {
+		for _, value := range query[param] {
+			if value = strings.TrimSpace(value); value != "" {
+				values.Add(param, value)
+			}
+		}
+	}
+	return values
+}
+
+// parseSize reads a size in bytes, or with a unit of 1024 such as "500MB"
+// or "1.5 GB"
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 || n*float64(multiplier) > math.MaxInt64 {
+		return 0, errors.New("invalid size")
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// parseSearchDate reads a date ("2006-01-02", local time), an RFC 3339
+// time, or an age such as "30d" or "2w" (that long ago). A date used as
+// the end of a range covers the whole day.
+func parseSearchDate(value string, end bool) (time.Time, error) {
+	if day, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		if end {
+			return day.AddDate(0, 0, 1), nil
+		}
+		return day, nil
+	}
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	if len(value) > 1 {
+		n, err := strconv.Atoi(value[:len(value)-1])
+		if err == nil && n >= 0 {
+			switch value[len(value)-1] {
+			case 'd':
+				return time.Now().AddDate(0, 0, -n), nil
+			case 'w':
+				return time.Now().AddDate(0, 0, -7*n), nil
+			}
+		}
+	}
+	return time.Time{}, errors.New("invalid date")
+}
+
+// parseSearchFilter reads the filters of a search of space from its URL
+// parameters. It returns a message for the user if one is invalid.
+func parseSearchFilter(query url.Values, space *fileSpace) (services.SearchFilter, string) {
+	filter := services.SearchFilter{
+		Text:     strings.TrimSpace(query.Get("q")),
+		Type:     query.Get("type"),
+		MimeType: strings.TrimSpace(query.Get("mime")),
+		Sort:     query.Get("sort"),
+		Cursor:   query.Get("cursor"),
+	}
+	if space.share != nil {
+		filter.Within = space.relative(space.item)
+	}
+	if filter.Type != "" && filter.Type != "file" && filter.Type != "folder" {
+		return filter, "Type must be file or folder"
+	}
+
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return filter, "Order must be asc or desc"
+	}
+
+	if category := query.Get("category"); category != "" {
+		exts, ok := utils.CategoryExtensions(category)
+		if !ok {
+			return filter, "Unknown category"
+		}
+		if category == "Others" {
+			filter.ExcludeExtensions = exts
+		} else {
+			filter.Extensions = exts
+		}
+	}
+
+	for _, size := range []struct {
+		param  string
+		target *int64
+	}{{"min_size", &filter.MinSize}, {"max_size", &filter.MaxSize}} {
+		if value := query.Get(size.param); value != "" {
+			n, err := parseSize(value)
+			if err != nil {
+				return filter, "Invalid size: " + value
+			}
+			*size.target = n
+		}
+	}
+
+	for _, date := range []struct {
+		param  string
+		end    bool
+		target *time.Time
+	}{
+		{"uploaded_from", false, &filter.UploadedFrom},
+		{"uploaded_to", true, &filter.UploadedTo},
+		{"modified_from", false, &filter.ModifiedFrom},
+		{"modified_to", true, &filter.ModifiedTo},
+	} {
+		if value := strings.TrimSpace(query.Get(date.param)); value != "" {
+			at, err := parseSearchDate(value, date.end)
+			if err != nil {
+				return filter, "Invalid date: " + value
+			}
+			*date.target = at
+		}
+	}
+
+	if folder := query.Get("folder"); folder != "" && folder != "/" {
+		folderPath := space.path(folder, "")
+		if !space.canRead(folderPath) {
+			return filter, "Folder not found"
+		}
+		if folderPath != space.item {
+			filter.Folder = space.relative(folderPath)
+		}
+	}
+
+	for _, value := range query["tag"] {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		tag, err := services.CleanTag(value)
+		if err != nil {
+			return filter, "Invalid tag: " + value
+		}
+		filter.Tags = append(filter.Tags, tag)
+	}
+	filter.ColorLabel = query.Get("color")
+	if !services.IsValidColorLabel(filter.ColorLabel) {
+		return filter, "Unknown color label"
+	}
+
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return filter, "Invalid limit"
+		}
+		filter.Limit = n
+	}
+	return filter, ""
+}
+
+// searchSpace runs a search over the space of a request and returns a page
+// of results with their folders made relative to the space, and the
+// cursor of the next page
+func searchSpace(space *fileSpace, filter services.SearchFilter) ([]models.SearchResult, string, error) {
+	results, next, err := services.SearchFiles(space.owner.Username, filter)
+	if err != nil {
+		return nil, "", err
+	}
+	visible := results[:0]
+	for _, result := range results {
+		path := filepath.Join(space.storagePath, result.StoragePath)
+		if !space.canRead(path) {
+			continue
+		}
+		result.Folder = space.folder(filepath.Dir(path))
+		if !result.IsDirectory {
+			result.FileSizeStr = utils.FormatFileSize(result.FileSize)
+		}
+		visible = append(visible, result)
+	}
+	return visible, next, nil
+}
+
+// isSearchInputError reports whether err is the searcher's mistake rather
+// than the server's
+func isSearchInputError(err error) bool {
+	return errors.Is(err, services.ErrEmptySearch) || errors.Is(err, services.ErrInvalidSearchSort) ||
+		errors.Is(err, services.ErrInvalidSearchCursor)
+}
+
+// itemURLs returns the list page of the folder an item is in (a folder of
+// space) and the page opening it: its list page for a folder, its download
+// for a file. path is the item's full path.
+func itemURLs(space *fileSpace, folder, path, name string, isDir bool) (folderURL, openURL string) {
+	query := space.query()
+	folderURL = listURL(folder, query)
+	if isDir {
+		return folderURL, listURL(space.folder(path), query)
+	}
+	values := url.Values{"name": {name}}
+	if folder != "/" {
+		values.Set("folder", folder)
+	}
+	for key, value := range query {
+		values[key] = value
+	}
+	return folderURL, "/download?" + values.Encode()
+}
+
+// searchHits adds what search.html shows to search results
+func searchHits(space *fileSpace, results []models.SearchResult) []searchHit {
+	hits := make([]searchHit, 0, len(results))
+	for _, result := range results {
+		hit := searchHit{
+			SearchResult: result,
+			Icon:         "📁",
+			NameHTML:     template.HTML(result.Highlight),
+			SnippetHTML:  template.HTML(result.Snippet),
+		}
+		if !result.IsDirectory {
+			hit.Icon = utils.GetFileIcon(strings.ToLower(filepath.Ext(result.Filename)))
+		}
+		path := filepath.Join(space.storagePath, result.StoragePath)
+		hit.FolderURL, hit.OpenURL = itemURLs(space, result.Folder, path, result.Filename, result.IsDirectory)
+		hits = append(hits, hit)
+	}
+	return hits
+}
+
+// SearchPageHandler searches the names, paths and contents of the user's
+// files, or those of a shared item ("share") or group ("group"), and
+// filters them by type, size, date and folder
+func SearchPageHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	space, err := resolveFileSpace(username, r.URL.Query().Get)
+	if errors.Is(err, services.ErrUserNotFound) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		writeSpaceError(w, err)
+		return
+	}
+
+	params := searchQuery(r.URL.Query())
+	data := map[string]interface{}{
+		"username":   username,
+		"params":     params,
+		"categories": utils.FileCategories,
+		"colors":     services.ColorLabels,
+		"backURL":    space.listURL("/"),
+	}
+	space.addTemplateData(data)
+
+	// Only the space's own parameters: nothing to search for yet
+	if len(params) > len(space.query()) {
+		filter, message := parseSearchFilter(r.URL.Query(), space)
+		var results []models.SearchResult
+		next := ""
+		if message == "" {
+			results, next, err = searchSpace(space, filter)
+			if isSearchInputError(err) {
+				message = err.Error()
+			} else if err != nil {
+				log.Printf("Failed to search files of %s: %v", space.owner.Username, err)
+				http.Error(w, "Search failed", http.StatusInternalServerError)
+				return
+			}
+		}
+		if message != "" {
+			data["error"] = message
+		} else {
+			data["results"] = searchHits(space, results)
+			data["searched"] = true
+			data["paged"] = filter.Cursor != ""
+			data["saveQuery"] = params.Encode()
+			if next != "" {
+				nextParams := searchQuery(r.URL.Query())
+				nextParams.Set("cursor", next)
+				data["nextURL"] = "/search?" + nextParams.Encode()
+			}
+		}
+	}
+	if pending, err := services.PendingSearchCount(space.owner.Username); err == nil {
+		data["pending"] = pending
+	}
+	if saved, err := services.ListSavedSearches(username); err == nil {
+		links := make([]savedSearchLink, len(saved))
+		for i, search := range saved {
+			links[i] = savedSearchLink{SavedSearch: search, URL: "/search?" + search.Query}
+		}
+		data["savedSearches"] = links
+	}
+
+	renderTemplate(w, r, "search.html", data)
+}
+
+// APISearchHandler returns a page of search results as JSON, with the
+// cursor of the next page ("" after the last)
+func APISearchHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	space, err := resolveFileSpace(username, r.URL.Query().Get)
+	if err != nil {
+		writeSpaceError(w, err)
+		return
+	}
+
+	filter, message := parseSearchFilter(r.URL.Query(), space)
+	if message != "" {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": message})
+		return
+	}
+	results, next, err := searchSpace(space, filter)
+	if isSearchInputError(err) {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to search files of %s: %v", space.owner.Username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Search failed"})
+		return
+	}
+	pending, _ := services.PendingSearchCount(space.owner.Username)
+
+	if results == nil {
+		results = []models.SearchResult{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"results":     results,
+		"next_cursor": next,
+		"pending":     pending,
+	})
+}
+
+// SaveSearchHandler keeps the search in "query" (its URL parameters) under
+// "name"
+func SaveSearchHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	values, err := url.ParseQuery(r.FormValue("query"))
+	query := searchQuery(values)
+	if err != nil || len(query) == 0 {
+		writeFileOpResult(w, r, http.StatusBadRequest, "Nothing to save: the search has no words or filters", "/search")
+		return
+	}
+	redirect := "/search?" + query.Encode()
+
+	saved, err := services.SaveSearch(username, r.FormValue("name"), query.Encode())
+	switch {
+	case errors.Is(err, services.ErrInvalidSavedSearchName), errors.Is(err, services.ErrTooManySavedSearches):
+		writeFileOpResult(w, r, http.StatusBadRequest, err.Error(), redirect)
+	case err != nil:
+		log.Printf("Failed to save search of %s: %v", username, err)
+		writeFileOpResult(w, r, http.StatusInternalServerError, "Failed to save search", redirect)
+	case wantsJSON(r):
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Search saved", "search": saved})
+	default:
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+	}
+}
+
+// DeleteSavedSearchHandler removes a saved search ("id")
+func DeleteSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	err := services.DeleteSavedSearch(username, id)
+	switch {
+	case errors.Is(err, services.ErrSavedSearchNotFound):
+		writeFileOpResult(w, r, http.StatusNotFound, err.Error(), "/search")
+	case err != nil:
+		log.Printf("Failed to delete saved search of %s: %v", username, err)
+		writeFileOpResult(w, r, http.StatusInternalServerError, "Failed to delete saved search", "/search")
+	default:
+		writeFileOpResult(w, r, http.StatusOK, "Saved search deleted", "/search")
+	}
+}
+
+// APISavedSearchesHandler returns the user's saved searches as JSON; run
+// one with /api/search?<query>
+func APISavedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	searches, err := services.ListSavedSearches(username)
+	if err != nil {
+		log.Printf("Failed to list saved searches of %s: %v", username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load saved searches"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"searches": searches})
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// APIListSessionsHandler returns the current user's active sessions
+func APIListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	current := middleware.GetCurrentSession(r)
+	if current == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "Unauthorized"})
+		return
+	}
+
+	sessions, err := services.GetUserSessions(current.Username)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load sessions"})
+		return
+	}
+
+	infos := []models.SessionInfo{}
+	for _, session := range sessions {
+		infos = append(infos, models.SessionInfo{
+			ID:        session.ID,
+			Device:    utils.DescribeUserAgent(session.UserAgent),
+			IPAddress: session.IPAddress,
+			CreatedAt: session.CreatedAt,
+			LastSeen:  session.LastSeen,
+			Current:   session.ID == current.ID,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": infos})
+}
+
+// APIRevokeSessionHandler revokes one of the current user's sessions
+func APIRevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	current := middleware.GetCurrentSession(r)
+	if current == nil {
+		writeJSON(w, http.StatusUnauthorized, models.UpdateProfileResponse{Success: false, Message: "Unauthorized"})
+		return
+	}
+
+	var req models.RevokeSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == 0 {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	revoked, err := services.DeleteUserSessionByID(current.Username, req.SessionID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, models.UpdateProfileResponse{Success: false, Message: "Failed to revoke session"})
+		return
+	}
+	if !revoked {
+		writeJSON(w, http.StatusNotFound, models.UpdateProfileResponse{Success: false, Message: "Session not found"})
+		return
+	}
+
+	// Revoking the session in use is the same as logging out
+	if req.SessionID == current.ID {
+		middleware.ClearSessionCookie(w)
+	}
+
+	writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: "Session revoked"})
+}
+
+// APIRevokeAllSessionsHandler signs the current user out everywhere,
+// optionally keeping the session making the request
+func APIRevokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	current := middleware.GetCurrentSession(r)
+	if current == nil {
+		writeJSON(w, http.StatusUnauthorized, models.UpdateProfileResponse{Success: false, Message: "Unauthorized"})
+		return
+	}
+
+	var req models.RevokeSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	exceptToken := ""
+	if req.KeepCurrent {
+		exceptToken = middleware.GetSessionCookie(r)
+	}
+
+	if _, err := services.DeleteUserSessions(current.Username, exceptToken); err != nil {
+		writeJSON(w, http.StatusInternalServerError, models.UpdateProfileResponse{Success: false, Message: "Failed to revoke sessions"})
+		return
+	}
+
+	if !req.KeepCurrent {
+		middleware.ClearSessionCookie(w)
+		writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: "Signed out everywhere"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: "Signed out of all other sessions"})
+}
@@ -0,0 +1,622 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// sharePath returns the public path of a link
+func sharePath(token string) string {
+	return "/s/" + token
+}
+
+// loadShares returns a user's links with their URLs filled in
+func loadShares(r *http.Request, username string) ([]models.Share, error) {
+	shares, err := services.ListShares(username)
+	if err != nil {
+		return nil, err
+	}
+	for i := range shares {
+		shares[i].URL = absoluteURL(sharePath(shares[i].Token))
+		shares[i].StoragePath = filepath.ToSlash(shares[i].StoragePath)
+	}
+	return shares, nil
+}
+
+// SharesPageHandler shows the user's public links and the items they
+// shared with other users
+func SharesPageHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	shares, err := loadShares(r, username)
+	if err != nil {
+		log.Printf("Failed to list links for %s: %v", username, err)
+		http.Error(w, "Failed to load links", http.StatusInternalServerError)
+		return
+	}
+	userShares, err := loadUserShares(username)
+	if err != nil {
+		log.Printf("Failed to list shares of %s: %v", username, err)
+		http.Error(w, "Failed to load shares", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, r, "shares.html", map[string]interface{}{
+		"username":   username,
+		"shares":     shares,
+		"userShares": userShares,
+	})
+}
+
+// APISharesHandler returns the user's public links as JSON
+func APISharesHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shares, err := loadShares(r, username)
+	if err != nil {
+		log.Printf("Failed to list links for %s: %v", username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load links"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"shares": shares})
+}
+
+// writeShareResult answers a link action with JSON for API clients and a
+// redirect to the links page for forms
+func writeShareResult(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if wantsJSON(r) {
+		writeJSON(w, status, models.UpdateProfileResponse{Success: status == http.StatusOK, Message: message})
+		return
+	}
+	if status != http.StatusOK {
+		http.Error(w, message, status)
+		return
+	}
+	http.Redirect(w, r, "/shares", http.StatusSeeOther)
+}
+
+// parseShareOptions reads the optional settings of a new link: password,
+// expires (a date, or an RFC 3339 time), max_downloads and allow_upload
+func parseShareOptions(r *http.Request) (services.NewShare, string) {
+	opts := services.NewShare{
+		Password:    r.FormValue("password"),
+		AllowUpload: isTruthy(r.FormValue("allow_upload")),
+	}
+
+	if value := strings.TrimSpace(r.FormValue("expires")); value != "" {
+		if day, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+			// A date means the link works until the end of that day
+			opts.ExpiresAt = day.AddDate(0, 0, 1)
+		} else if at, err := time.Parse(time.RFC3339, value); err == nil {
+			opts.ExpiresAt = at
+		} else {
+			return opts, "Invalid expiry date"
+		}
+		if !opts.ExpiresAt.After(time.Now()) {
+			return opts, "The expiry date must be in the future"
+		}
+	}
+
+	if value := strings.TrimSpace(r.FormValue("max_downloads")); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return opts, "Invalid download limit"
+		}
+		opts.MaxDownloads = n
+	}
+	return opts, ""
+}
+
+// ShareCreateHandler creates a public link to a file or folder
+func ShareCreateHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := services.GetUser(username)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := r.FormValue("name")
+	folder := r.FormValue("folder")
+	if !isValidUploadFilename(name) {
+		writeShareResult(w, r, http.StatusBadRequest, "Invalid file name")
+		return
+	}
+
+	opts, problem := parseShareOptions(r)
+	if problem != "" {
+		writeShareResult(w, r, http.StatusBadRequest, problem)
+		return
+	}
+
+	userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
+	filePath := filepath.Join(userStoragePath, name)
+	if folder != "" && folder != "/" {
+		filePath = filepath.Join(userStoragePath, folder, name)
+	}
+
+	// Security check
+	if !isPathSafe(filePath, userStoragePath) {
+		writeShareResult(w, r, http.StatusForbidden, "Unauthorized")
+		return
+	}
+	relativePath, _ := filepath.Rel(userStoragePath, filePath)
+
+	share, err := services.CreateShare(username, relativePath, opts)
+	switch {
+	case errors.Is(err, services.ErrFileNotFound):
+		writeShareResult(w, r, http.StatusNotFound, "File not found")
+		return
+	case errors.Is(err, services.ErrShareUploadNeedsFolder):
+		writeShareResult(w, r, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to create link for %s: %v", username, err)
+		writeShareResult(w, r, http.StatusInternalServerError, "Failed to create link")
+		return
+	}
+
+	share.URL = absoluteURL(sharePath(share.Token))
+	share.StoragePath = filepath.ToSlash(share.StoragePath)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Link created", "share": share})
+		return
+	}
+	http.Redirect(w, r, "/shares", http.StatusSeeOther)
+}
+
+// ShareRevokeHandler deletes one of the user's links
+func ShareRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeShareResult(w, r, http.StatusBadRequest, "Invalid link")
+		return
+	}
+
+	err = services.RevokeShare(username, id)
+	if errors.Is(err, services.ErrShareNotFound) {
+		writeShareResult(w, r, http.StatusNotFound, "Link not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke link %d for %s: %v", id, username, err)
+		writeShareResult(w, r, http.StatusInternalServerError, "Failed to revoke link")
+		return
+	}
+	writeShareResult(w, r, http.StatusOK, "Link revoked")
+}
+
+// ==================== PUBLIC LINKS ====================
+
+// shareCookieName names the cookie that remembers a link's password
+func shareCookieName(share *models.Share) string {
+	return "share_" + strconv.FormatInt(share.ID, 10)
+}
+
+// shareUnlocked reports whether the visitor may see a link's contents
+func shareUnlocked(r *http.Request, share *models.Share) bool {
+	if !share.HasPassword {
+		return true
+	}
+	cookie, err := r.Cookie(shareCookieName(share))
+	return err == nil && cookie.Value == services.ShareAccessKey(share)
+}
+
+// resolveSharePath turns the "path" a visitor asks for, relative to a
+// shared folder, into the owner's storage path. File links have no path.
+func resolveSharePath(share *models.Share, path string) (string, bool) {
+	storagePath := share.StoragePath
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+		if !share.IsDirectory || !isValidUploadFilename(segment) {
+			return "", false
+		}
+		storagePath = filepath.Join(storagePath, segment)
+	}
+	return storagePath, true
+}
+
+// shareRelativePath returns where an owner's storage path lies inside a
+// shared folder, "/"-separated ("" for the folder itself)
+func shareRelativePath(share *models.Share, storagePath string) string {
+	rel, err := filepath.Rel(share.StoragePath, storagePath)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// renderShareError shows the link page with only an error message
+func renderShareError(w http.ResponseWriter, r *http.Request, message string) {
+	renderTemplate(w, r, "share.html", map[string]interface{}{"error": message})
+}
+
+// ShareHandler serves public links, /s/<token>[/<action>], to anyone who
+// has them. Visitors can view a shared file or browse a shared folder,
+// download files or a folder archive, and add files to a folder shared
+// with uploads allowed. Password-protected links ask for the password
+// first.
+func ShareHandler(w http.ResponseWriter, r *http.Request) {
+	token, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+
+	share, err := services.GetShareByToken(token)
+	switch {
+	case errors.Is(err, services.ErrShareNotFound), errors.Is(err, services.ErrShareExpired):
+		status := http.StatusNotFound
+		if errors.Is(err, services.ErrShareExpired) {
+			status = http.StatusGone
+		}
+		if action == "" {
+			renderShareError(w, r, err.Error())
+		} else {
+			http.Error(w, err.Error(), status)
+		}
+		return
+	case err != nil:
+		log.Printf("Failed to look up link: %v", err)
+		http.Error(w, "Failed to load link", http.StatusInternalServerError)
+		return
+	}
+
+	if action == "unlock" {
+		shareUnlockHandler(w, r, share)
+		return
+	}
+	if !shareUnlocked(r, share) {
+		if action == "" {
+			renderTemplate(w, r, "share.html", map[string]interface{}{"share": share, "base": sharePath(share.Token), "locked": true})
+		} else {
+			http.Error(w, "This link needs a password", http.StatusUnauthorized)
+		}
+		return
+	}
+
+	switch action {
+	case "":
+		sharePageHandler(w, r, share)
+	case "download":
+		shareDownloadHandler(w, r, share)
+	case "archive":
+		shareArchiveHandler(w, r, share)
+	case "upload":
+		shareUploadHandler(w, r, share)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// shareUnlockHandler checks a link's password and remembers it in a cookie
+// limited to the link
+func shareUnlockHandler(w http.ResponseWriter, r *http.Request, share *models.Share) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !services.CheckSharePassword(share, r.FormValue("password")) {
+		renderTemplate(w, r, "share.html", map[string]interface{}{
+			"share":         share,
+			"base":          sharePath(share.Token),
+			"locked":        true,
+			"passwordError": "Wrong password",
+		})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareCookieName(share),
+		Value:    services.ShareAccessKey(share),
+		Path:     sharePath(share.Token),
+		MaxAge:   int(config.ShareUnlockAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, sharePath(share.Token), http.StatusSeeOther)
+}
+
+// shareCrumb is one level of the folder path shown on a link page
+type shareCrumb struct {
+	Name string
+	Path string
+}
+
+// sharePageHandler shows a shared file, or the contents of a shared folder
+// or one of its subfolders
+func sharePageHandler(w http.ResponseWriter, r *http.Request, share *models.Share) {
+	data := map[string]interface{}{
+		"share": share,
+		"base":  sharePath(share.Token),
+	}
+
+	services.LockUserFileRead(share.Owner)
+	defer services.UnlockUserFileRead(share.Owner)
+
+	if !share.IsDirectory {
+		meta, err := services.GetFileByPath(share.Owner, share.StoragePath)
+		if err != nil || meta == nil {
+			renderShareError(w, r, services.ErrShareNotFound.Error())
+			return
+		}
+		data["size"] = utils.FormatFileSize(meta.FileSize)
+		data["icon"] = utils.GetFileIcon(strings.ToLower(filepath.Ext(meta.Filename)))
+		renderTemplate(w, r, "share.html", data)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	storagePath, ok := resolveSharePath(share, path)
+	if !ok {
+		renderShareError(w, r, "Folder not found")
+		return
+	}
+	if storagePath != share.StoragePath {
+		meta, err := services.GetFileByPath(share.Owner, storagePath)
+		if err != nil || meta == nil || !meta.IsDirectory {
+			renderShareError(w, r, "Folder not found")
+			return
+		}
+	}
+
+	items, err := getFileList(share.Owner, filepath.ToSlash(storagePath))
+	if err != nil {
+		log.Printf("Failed to list shared folder %d: %v", share.ID, err)
+		renderShareError(w, r, "Failed to load folder")
+		return
+	}
+	for i := range items {
+		// Visitors only see paths inside the shared folder
+		items[i].Path = shareRelativePath(share, filepath.Join(storagePath, items[i].Name))
+	}
+
+	path = shareRelativePath(share, storagePath)
+	crumbs := []shareCrumb{{Name: share.Filename}}
+	if path != "" {
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			crumbs = append(crumbs, shareCrumb{Name: segment, Path: strings.Join(segments[:i+1], "/")})
+		}
+	}
+
+	data["path"] = path
+	data["crumbs"] = crumbs
+	data["folderName"] = crumbs[len(crumbs)-1].Name
+	data["items"] = items
+	renderTemplate(w, r, "share.html", data)
+}
+
+// countsAsDownload reports whether a request may be answered with any of
+// the file's contents. Every such GET counts, ranges included, since the
+// Range header is the client's to choose; only HEAD and a revalidation
+// answered with 304 Not Modified are free.
+func countsAsDownload(r *http.Request, etag string) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	return etag == "" || r.Header.Get("If-None-Match") != `"`+etag+`"`
+}
+
+// shareDownloadHandler sends a shared file, or a file inside a shared
+// folder, counting it against the link's download limit
+func shareDownloadHandler(w http.ResponseWriter, r *http.Request, share *models.Share) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	storagePath, ok := resolveSharePath(share, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	services.LockUserFileRead(share.Owner)
+	defer services.UnlockUserFileRead(share.Owner)
+
+	meta, err := services.GetFileByPath(share.Owner, storagePath)
+	if err != nil || meta == nil || meta.IsDirectory {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if countsAsDownload(r, meta.FileHash) {
+		if err := services.CountShareDownload(share); err != nil {
+			http.Error(w, services.ErrShareExpired.Error(), http.StatusGone)
+			return
+		}
+	}
+
+	f, err := openFileContent(meta)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	contentType := f.contentType()
+	disposition := "attachment"
+	if isTruthy(r.URL.Query().Get("inline")) && isInlineSafeContentType(contentType) {
+		disposition = "inline"
+	}
+	serveStoredFile(w, r, f, contentType, disposition)
+}
+
+// shareArchiveHandler streams a shared folder, or one of its subfolders,
+// as a zip or tar.gz archive. The archive counts as one download.
+func shareArchiveHandler(w http.ResponseWriter, r *http.Request, share *models.Share) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar.gz" {
+		http.Error(w, "Unsupported archive format", http.StatusBadRequest)
+		return
+	}
+
+	storagePath, ok := resolveSharePath(share, r.URL.Query().Get("path"))
+	if !ok || !share.IsDirectory {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	owner := services.GetUser(share.Owner)
+	if owner == nil {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+	userStoragePath := services.GetUserStoragePath(owner.Username, owner.UniqueCode)
+	folderPath := filepath.Join(userStoragePath, storagePath)
+
+	services.LockUserFileRead(share.Owner)
+	defer services.UnlockUserFileRead(share.Owner)
+
+	entries, status, message := collectArchiveEntries(share.Owner, userStoragePath, filepath.Dir(folderPath), []string{filepath.Base(folderPath)})
+	if status != http.StatusOK {
+		http.Error(w, message, status)
+		return
+	}
+
+	if err := services.CountShareDownload(share); err != nil {
+		http.Error(w, services.ErrShareExpired.Error(), http.StatusGone)
+		return
+	}
+
+	archiveName := filepath.Base(folderPath)
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		archiveName += ".zip"
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		archiveName += ".tar.gz"
+	}
+	w.Header().Set("Content-Disposition", utils.ContentDisposition("attachment", archiveName))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+
+	var err error
+	if format == "zip" {
+		err = writeZipArchive(w, entries)
+	} else {
+		err = writeTarGzArchive(w, entries)
+	}
+	if err != nil {
+		log.Printf("Archive download of link %d failed: %v", share.ID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// shareUploadHandler adds files to a shared folder that allows uploads.
+// They belong to the folder's owner and count against the owner's quota.
+// Taken names are reported as conflicts rather than replaced.
+func shareUploadHandler(w http.ResponseWriter, r *http.Request, share *models.Share) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !share.AllowUpload || !share.IsDirectory {
+		http.Error(w, "This link does not accept uploads", http.StatusForbidden)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	storagePath, ok := resolveSharePath(share, path)
+	if !ok {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	owner := services.GetUser(share.Owner)
+	if owner == nil {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	remaining, err := services.GetRemainingQuota(owner.Username)
+	if err != nil {
+		http.Error(w, "Quota error", http.StatusInternalServerError)
+		return
+	}
+	if remaining == 0 || (remaining > 0 && r.ContentLength > remaining+config.QuotaRequestSlack) {
+		http.Error(w, "This folder is full", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	folder := filepath.ToSlash(storagePath)
+	response, firstErr := receiveUploadBatch(r, remaining, func(upload *stagedUpload) error {
+		// Visitors only ever add files to the folder they were given
+		upload.folder = folder
+		upload.newVersion = false
+		_, err := placeUploadedFile(owner, upload)
+		if err == nil {
+			upload.storedPath = shareRelativePath(share, filepath.FromSlash(upload.storedPath))
+		}
+		return err
+	})
+
+	if wantsJSON(r) {
+		writeUploadBatchJSON(w, response, firstErr)
+		return
+	}
+	if firstErr != nil {
+		writeUploadError(w, firstErr)
+		return
+	}
+
+	target := sharePath(share.Token)
+	if path = shareRelativePath(share, storagePath); path != "" {
+		target += "?path=" + url.QueryEscape(path)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
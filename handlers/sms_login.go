@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// LoginSMSHandler lets accounts with a phone number log in with a one-time
+// code sent by SMS instead of a password
+func LoginSMSHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.DefaultSMSSettings.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	if middleware.GetSessionUser(r) != "" {
+		http.Redirect(w, r, "/list", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		renderTemplate(w, r, "login_sms.html", map[string]interface{}{"phone_region": "CN"})
+		return
+	}
+
+	phone := utils.CleanPhoneNumber(strings.TrimSpace(r.FormValue("phone")))
+	phoneRegion := strings.TrimSpace(r.FormValue("phone_region"))
+	data := map[string]interface{}{
+		"phone":        phone,
+		"phone_region": phoneRegion,
+	}
+
+	if phone == "" || !utils.ValidatePhone(phone, phoneRegion) {
+		data["error"] = utils.GetPhoneValidationError(phoneRegion)
+		renderTemplate(w, r, "login_sms.html", data)
+		return
+	}
+
+	// Same throttling as password logins, keyed the same way
+	user := services.FindUserByPhoneAndRegion(phone, phoneRegion)
+	credential := phoneIdentifier(phoneRegion, phone)
+	if user != nil {
+		credential = services.UserThrottleKey(user.Username)
+	}
+
+	ip := middleware.GetClientIP(r)
+	if wait := services.CheckLoginAllowed(ip, credential); wait > 0 {
+		data["error"] = throttleMessage(wait)
+		renderTemplate(w, r, "login_sms.html", data)
+		return
+	}
+
+	if r.FormValue("action") == "verify" {
+		data["codeSent"] = true
+
+		code := strings.TrimSpace(r.FormValue("code"))
+		if user == nil || services.VerifySMSLoginCode(user.Username, code) != nil {
+			services.RecordLoginFailure(ip, credential)
+			data["error"] = "Invalid or expired code"
+			renderTemplate(w, r, "login_sms.html", data)
+			return
+		}
+
+		finishFirstFactor(w, r, user)
+		return
+	}
+
+	// Unknown numbers get the same answers, so the form can't be used to
+	// discover which numbers have accounts: the resend throttle is kept per
+	// number for all of them, and whatever happens after it is only logged
+	e164 := utils.FormatE164(phone, phoneRegion)
+	err := services.ReserveSMSCodeRequest(e164)
+	if errors.Is(err, services.ErrSMSCodeTooSoon) {
+		data["codeSent"] = true
+		data["error"] = "A code was just requested. Please wait a minute before requesting another."
+		renderTemplate(w, r, "login_sms.html", data)
+		return
+	}
+	if errors.Is(err, services.ErrSMSCodeLimit) {
+		data["error"] = "Too many codes requested. Please try again later or log in with your password."
+		renderTemplate(w, r, "login_sms.html", data)
+		return
+	}
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		data["error"] = "Failed to send the code. Please try again later."
+		renderTemplate(w, r, "login_sms.html", data)
+		return
+	}
+	if user != nil {
+		if err := services.IssueSMSLoginCode(user.Username, e164); err != nil {
+			log.Printf("Warning: SMS login code for %s not sent: %v", user.Username, err)
+		}
+	}
+
+	data["codeSent"] = true
+	data["message"] = "If this number is registered, a login code is on its way."
+	renderTemplate(w, r, "login_sms.html", data)
+}
@@ -0,0 +1,526 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// errNoTags fails a tag change that names no tags
+var errNoTags = errors.New("enter at least one tag")
+
+// parseTags reads the "tag" fields of a request, each of which may hold
+// several tags separated by commas, dropping repeats
+func parseTags(values []string) ([]string, error) {
+	var tags []string
+	seen := map[string]bool{}
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if strings.TrimSpace(part) == "" {
+				continue
+			}
+			tag, err := services.CleanTag(part)
+			if err != nil {
+				return nil, err
+			}
+			if key := strings.ToLower(tag); !seen[key] {
+				seen[key] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return nil, errNoTags
+	}
+	return tags, nil
+}
+
+// labelErrorStatus maps a failed label change to an HTTP status and a
+// message
+func labelErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, services.ErrFileNotFound):
+		return http.StatusNotFound, "File not found"
+	case errors.Is(err, errNotAllowed):
+		return http.StatusForbidden, "Your role does not allow changing this item"
+	case errors.Is(err, services.ErrTooManyTags), errors.Is(err, services.ErrInvalidTag),
+		errors.Is(err, services.ErrInvalidColorLabel), errors.Is(err, errNoTags):
+		return http.StatusBadRequest, err.Error()
+	}
+	return http.StatusInternalServerError, "Failed to update labels"
+}
+
+// labelItems applies change to the selected items ("name", repeatable) of
+// folder one at a time, so one failure doesn't undo the others, and
+// answers with per-item results (JSON) or by going back to the folder.
+// validate (if set) checks the rest of the request first, and allowed
+// decides which items of the space the user may change.
+func labelItems(w http.ResponseWriter, r *http.Request, validate func() error,
+	allowed func(space *fileSpace, path string) bool, change func(space *fileSpace, storagePath string) error) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	folder := r.FormValue("folder")
+	if folder == "" {
+		folder = "/"
+	}
+	names := r.Form["name"]
+	if len(names) == 0 {
+		http.Error(w, "Missing file name", http.StatusBadRequest)
+		return
+	}
+	if validate != nil {
+		if err := validate(); err != nil {
+			status, message := labelErrorStatus(err)
+			writeFileOpResult(w, r, status, message, "")
+			return
+		}
+	}
+
+	space, err := resolveFileSpace(username, r.FormValue)
+	if err != nil {
+		writeSpaceError(w, err)
+		return
+	}
+	owner := space.owner.Username
+	folderPath := space.path(folder, "")
+	if !space.canRead(folderPath) {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	// Labels leave the files themselves alone
+	services.LockUserFileRead(owner)
+	defer services.UnlockUserFileRead(owner)
+
+	response := models.LabelBatchResponse{Results: []models.LabelResult{}}
+	firstStatus, firstMessage := 0, ""
+	for _, name := range names {
+		result := models.LabelResult{Name: name, Status: "done"}
+
+		var err error
+		path := filepath.Join(folderPath, name)
+		switch {
+		case !isValidUploadFilename(name):
+			err = services.ErrFileNotFound
+		case !allowed(space, path):
+			err = errNotAllowed
+		default:
+			err = change(space, space.relative(path))
+		}
+
+		if err == nil {
+			response.Done++
+		} else {
+			var status int
+			status, result.Message = labelErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to label %s for %s: %v", name, owner, err)
+			}
+			if firstStatus == 0 {
+				firstStatus, firstMessage = status, result.Message
+			}
+			result.Status = "error"
+			response.Failed++
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	if wantsJSON(r) {
+		response.Success = response.Failed == 0
+		status := http.StatusOK
+		if response.Done == 0 {
+			status = firstStatus
+		}
+		writeJSON(w, status, response)
+		return
+	}
+
+	if firstStatus != 0 {
+		http.Error(w, firstMessage, firstStatus)
+		return
+	}
+	http.Redirect(w, r, space.listURL(folder), http.StatusSeeOther)
+}
+
+// canLabel reports whether the user may change the tags and color label of
+// path: the owner, share editors and group members, like uploading a new
+// version
+func canLabel(space *fileSpace, path string) bool {
+	return space.canReplace(path)
+}
+
+// AddTagsHandler tags the selected items ("name", repeatable, in "folder")
+// with "tag" (repeatable, or several separated by commas)
+func AddTagsHandler(w http.ResponseWriter, r *http.Request) {
+	changeTags(w, r, services.TagFile)
+}
+
+// RemoveTagsHandler takes tags ("tag") off the selected items
+func RemoveTagsHandler(w http.ResponseWriter, r *http.Request) {
+	changeTags(w, r, services.UntagFile)
+}
+
+// changeTags adds or removes the tags of a request on each selected item
+func changeTags(w http.ResponseWriter, r *http.Request, change func(owner, storagePath string, tags []string) error) {
+	var tags []string
+	validate := func() (err error) {
+		tags, err = parseTags(r.Form["tag"])
+		return err
+	}
+	labelItems(w, r, validate, canLabel, func(space *fileSpace, storagePath string) error {
+		return change(space.owner.Username, storagePath, tags)
+	})
+}
+
+// ColorLabelHandler gives the selected items a color label ("color", one
+// of services.ColorLabels), or clears it ("")
+func ColorLabelHandler(w http.ResponseWriter, r *http.Request) {
+	validate := func() error {
+		if !services.IsValidColorLabel(r.FormValue("color")) {
+			return services.ErrInvalidColorLabel
+		}
+		return nil
+	}
+	labelItems(w, r, validate, canLabel, func(space *fileSpace, storagePath string) error {
+		return services.SetColorLabel(space.owner.Username, storagePath, r.FormValue("color"))
+	})
+}
+
+// StarHandler stars the selected items for the user; anyone who can see
+// an item may star it
+func StarHandler(w http.ResponseWriter, r *http.Request) {
+	setStarred(w, r, true)
+}
+
+// UnstarHandler takes the user's star off the selected items
+func UnstarHandler(w http.ResponseWriter, r *http.Request) {
+	setStarred(w, r, false)
+}
+
+// setStarred stars or unstars the selected items
+func setStarred(w http.ResponseWriter, r *http.Request, starred bool) {
+	username := middleware.GetSessionUser(r)
+	labelItems(w, r, nil, (*fileSpace).canRead, func(space *fileSpace, storagePath string) error {
+		return services.SetStarred(username, space.owner.Username, storagePath, starred)
+	})
+}
+
+// fileSpaceTags returns the tags in use in a space. In a shared item, only
+// the tags inside it count.
+func fileSpaceTags(space *fileSpace) ([]models.Tag, error) {
+	within := ""
+	if space.share != nil {
+		within = space.relative(space.item)
+	}
+	return services.ListTags(space.owner.Username, within)
+}
+
+// APITagsHandler returns the tags in use in the user's files, or those of
+// a shared item ("share") or group ("group"), with how many items carry
+// each
+func APITagsHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	space, err := resolveFileSpace(username, r.URL.Query().Get)
+	if err != nil {
+		writeSpaceError(w, err)
+		return
+	}
+	tags, err := fileSpaceTags(space)
+	if err != nil {
+		log.Printf("Failed to list tags of %s: %v", space.owner.Username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load tags"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tags": tags})
+}
+
+// labelFileList fills in the tags, color labels and stars (of viewer) of
+// the files of a folder of owner (a parent path) and, given a tag, keeps
+// only the files carrying it
+func labelFileList(files []models.FileInfo, owner, viewer, parentPath, tag string) []models.FileInfo {
+	labels, err := services.GetFolderLabels(owner, viewer, parentPath)
+	if err != nil {
+		log.Printf("Failed to load labels of %s: %v", owner, err)
+		return files
+	}
+
+	labeled := files[:0]
+	for _, file := range files {
+		label := labels[file.ID]
+		file.Tags, file.ColorLabel, file.Starred = label.Tags, label.ColorLabel, label.Starred
+		if tag != "" && !hasTag(file.Tags, tag) {
+			continue
+		}
+		labeled = append(labeled, file)
+	}
+	return labeled
+}
+
+// addLabelData adds what list.html needs to show and filter by labels to
+// data: the tag filtered by, the space's tags and the color labels
+func addLabelData(data map[string]interface{}, space *fileSpace, tag string) {
+	data["tagFilter"] = tag
+	data["colorLabels"] = services.ColorLabels
+	if tags, err := fileSpaceTags(space); err == nil {
+		data["spaceTags"] = tags
+	}
+}
+
+// hasTag reports whether tags holds tag, whatever its case
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// starredItem is a starred file or folder as starred.html and
+// /api/starred show it, placed in the space the user opens it through
+type starredItem struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	IsDirectory bool      `json:"is_directory"`
+	Size        int64     `json:"size"`
+	ModifiedAt  time.Time `json:"modified_at"`
+	StarredAt   time.Time `json:"starred_at"`
+	Tags        []string  `json:"tags"`
+	ColorLabel  string    `json:"color_label"`
+	Folder      string    `json:"folder"`          // In its space
+	Share       string    `json:"share,omitempty"` // Space parameters
+	Group       string    `json:"group,omitempty"`
+	Place       string    `json:"-"` // Whose files it is in
+	Icon        string    `json:"-"`
+	SizeStr     string    `json:"-"`
+	FolderURL   string    `json:"-"`
+	OpenURL     string    `json:"-"`
+}
+
+// starredSpaces finds the space a user opens starred files through: their
+// own files, a group's or an item shared with them
+type starredSpaces struct {
+	username string
+	own      *fileSpace
+	groups   map[string]int64   // Group ID by the account owning its files
+	shares   []models.UserShare // Items shared with the user
+	opened   map[string]*fileSpace
+}
+
+// newStarredSpaces loads the groups and shares of username
+func newStarredSpaces(username string) (*starredSpaces, error) {
+	own, err := resolveFileSpace(username, func(string) string { return "" })
+	if err != nil {
+		return nil, err
+	}
+	groups, err := services.ListUserGroups(username)
+	if err != nil {
+		return nil, err
+	}
+	shares, err := services.ListSharedWithUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	spaces := &starredSpaces{username: username, own: own, groups: map[string]int64{}, shares: shares, opened: map[string]*fileSpace{}}
+	for _, group := range groups {
+		spaces.groups[group.Account] = group.ID
+	}
+	return spaces, nil
+}
+
+// open resolves a space by its "share" or "group" parameter, once
+func (s *starredSpaces) open(param, id string) *fileSpace {
+	key := param + ":" + id
+	if space, ok := s.opened[key]; ok {
+		return space
+	}
+	space, err := resolveFileSpace(s.username, func(name string) string {
+		if name == param {
+			return id
+		}
+		return ""
+	})
+	if err != nil {
+		space = nil
+	}
+	s.opened[key] = space
+	return space
+}
+
+// find returns the space the user can open file through, or nil if they
+// no longer can
+func (s *starredSpaces) find(file models.StarredFile) *fileSpace {
+	if file.Username == s.username {
+		return s.own
+	}
+	if id, ok := s.groups[file.Username]; ok {
+		return s.open("group", strconv.FormatInt(id, 10))
+	}
+	for _, share := range s.shares {
+		if share.Owner != file.Username {
+			continue
+		}
+		space := s.open("share", strconv.FormatInt(share.ID, 10))
+		if space != nil && space.canRead(filepath.Join(space.storagePath, file.StoragePath)) {
+			return space
+		}
+	}
+	return nil
+}
+
+// loadStarred returns the items username starred that they can still
+// open, most recently starred first
+func loadStarred(username string) ([]starredItem, error) {
+	files, err := services.ListStarredFiles(username)
+	if err != nil {
+		return nil, err
+	}
+	spaces, err := newStarredSpaces(username)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []starredItem{}
+	for _, file := range files {
+		space := spaces.find(file)
+		if space == nil {
+			continue
+		}
+		path := filepath.Join(space.storagePath, file.StoragePath)
+		item := starredItem{
+			ID:          file.ID,
+			Name:        file.Filename,
+			IsDirectory: file.IsDirectory,
+			Size:        file.FileSize,
+			ModifiedAt:  file.ModifiedAt,
+			StarredAt:   file.StarredAt,
+			Tags:        file.Tags,
+			ColorLabel:  file.ColorLabel,
+			Folder:      space.folder(filepath.Dir(path)),
+			Share:       space.shareID(),
+			Group:       space.groupID(),
+			Place:       "My Files",
+			Icon:        "📁",
+		}
+		switch {
+		case space.group != nil:
+			item.Place = "👪 " + space.group.Name
+		case space.share != nil:
+			item.Place = "👥 Shared by " + space.share.Owner
+		}
+		if item.IsDirectory {
+			item.Size = 0
+		} else {
+			item.Icon = utils.GetFileIcon(strings.ToLower(filepath.Ext(file.Filename)))
+			item.SizeStr = utils.FormatFileSize(file.FileSize)
+		}
+		item.FolderURL, item.OpenURL = itemURLs(space, item.Folder, path, item.Name, item.IsDirectory)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// StarredPageHandler shows the files and folders the user starred, in
+// their own files, their groups and items shared with them
+func StarredPageHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	items, err := loadStarred(username)
+	if errors.Is(err, services.ErrUserNotFound) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to list starred files of %s: %v", username, err)
+		http.Error(w, "Failed to load starred items", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, r, "starred.html", map[string]interface{}{
+		"username": username,
+		"items":    items,
+	})
+}
+
+// APIStarredHandler returns the user's starred files and folders as JSON,
+// each with the folder and space ("share" or "group") to open it in
+func APIStarredHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	items, err := loadStarred(username)
+	if err != nil {
+		log.Printf("Failed to list starred files of %s: %v", username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load starred items"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"starred": items})
+}
+
+// StarredRemoveHandler takes the user's star off an item by its ID ("id"),
+// from the Starred page
+func StarredRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	err := services.RemoveStar(username, id)
+	switch {
+	case errors.Is(err, services.ErrStarNotFound):
+		writeFileOpResult(w, r, http.StatusNotFound, "Starred item not found", "/starred")
+	case err != nil:
+		log.Printf("Failed to remove star of %s: %v", username, err)
+		writeFileOpResult(w, r, http.StatusInternalServerError, "Failed to remove star", "/starred")
+	default:
+		writeFileOpResult(w, r, http.StatusOK, "Star removed", "/starred")
+	}
+}
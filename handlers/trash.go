@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// loadTrash returns a user's trash items with display fields filled in
+func loadTrash(username string) ([]models.TrashItem, error) {
+	items, err := services.ListTrash(username)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		items[i].SizeStr = utils.FormatFileSize(items[i].Size)
+		if items[i].IsDirectory {
+			items[i].Icon = "📁"
+		} else {
+			items[i].Icon = utils.GetFileIcon(strings.ToLower(filepath.Ext(items[i].Filename)))
+		}
+	}
+	return items, nil
+}
+
+// trashOwner returns whose trash a request works on: the user's own, or
+// that of a group they are an admin or owner of ("group")
+func trashOwner(username, groupID string) (*models.User, *models.Group, error) {
+	if groupID == "" {
+		user := services.GetUser(username)
+		if user == nil {
+			return nil, nil, services.ErrUserNotFound
+		}
+		return user, nil, nil
+	}
+
+	space, err := resolveGroupSpace(username, groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !space.canManage() {
+		return nil, nil, services.ErrGroupPermission
+	}
+	return space.owner, space.group, nil
+}
+
+// writeTrashOwnerError answers a request whose trash could not be opened
+func writeTrashOwnerError(w http.ResponseWriter, err error) {
+	if errors.Is(err, services.ErrGroupPermission) {
+		http.Error(w, "Only group admins and owners can open its trash", http.StatusForbidden)
+		return
+	}
+	writeSpaceError(w, err)
+}
+
+// TrashPageHandler shows the user's deleted items, or a group's
+func TrashPageHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	owner, group, err := trashOwner(username, r.URL.Query().Get("group"))
+	if err != nil {
+		writeTrashOwnerError(w, err)
+		return
+	}
+
+	items, err := loadTrash(owner.Username)
+	if err != nil {
+		log.Printf("Failed to list trash for %s: %v", owner.Username, err)
+		http.Error(w, "Failed to load trash", http.StatusInternalServerError)
+		return
+	}
+
+	var totalSize int64
+	for _, item := range items {
+		totalSize += item.Size
+	}
+
+	retentionDays := int(config.TrashRetention.Hours() / 24)
+	renderTemplate(w, r, "trash.html", map[string]interface{}{
+		"username":      username,
+		"items":         items,
+		"totalSizeStr":  utils.FormatFileSize(totalSize),
+		"retentionDays": retentionDays,
+		"group":         group,
+	})
+}
+
+// APITrashListHandler returns the user's deleted items, or a group's, as
+// JSON
+func APITrashListHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	owner, _, err := trashOwner(username, r.URL.Query().Get("group"))
+	if err != nil {
+		writeTrashOwnerError(w, err)
+		return
+	}
+
+	items, err := loadTrash(owner.Username)
+	if err != nil {
+		log.Printf("Failed to list trash for %s: %v", owner.Username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load trash"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+// writeTrashResult answers a trash action with JSON for API clients and a
+// redirect back to the trash page for forms
+func writeTrashResult(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if wantsJSON(r) {
+		writeJSON(w, status, models.UpdateProfileResponse{Success: status == http.StatusOK, Message: message})
+		return
+	}
+	if status != http.StatusOK {
+		http.Error(w, message, status)
+		return
+	}
+	redirect := "/trash"
+	if groupID := r.FormValue("group"); groupID != "" {
+		redirect += "?group=" + url.QueryEscape(groupID)
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// trashRequest checks the session and method of a trash action and returns
+// whose trash it works on ("group" for a group's), or nil after writing an
+// error
+func trashRequest(w http.ResponseWriter, r *http.Request) *models.User {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	owner, _, err := trashOwner(username, r.FormValue("group"))
+	if err != nil {
+		writeTrashOwnerError(w, err)
+		return nil
+	}
+	return owner
+}
+
+// trashItemID reads the "id" form value
+func trashItemID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// TrashRestoreHandler puts a deleted item back in its original folder
+func TrashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	user := trashRequest(w, r)
+	if user == nil {
+		return
+	}
+
+	id, ok := trashItemID(r)
+	if !ok {
+		writeTrashResult(w, r, http.StatusBadRequest, "Invalid trash item")
+		return
+	}
+
+	services.LockUserFileWrite(user.Username)
+	defer services.UnlockUserFileWrite(user.Username)
+
+	userStoragePath := services.GetUserStoragePath(user.Username, user.UniqueCode)
+	restoredPath, err := services.RestoreFromTrash(user.Username, userStoragePath, id)
+	switch {
+	case errors.Is(err, services.ErrTrashItemNotFound):
+		writeTrashResult(w, r, http.StatusNotFound, "Trash item not found")
+		return
+	case errors.Is(err, services.ErrFileExists):
+		writeTrashResult(w, r, http.StatusConflict, "Cannot restore: "+err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to restore trash item %d for %s: %v", id, user.Username, err)
+		writeTrashResult(w, r, http.StatusInternalServerError, "Failed to restore item")
+		return
+	}
+
+	services.InvalidateUserCache(user.Username)
+	writeTrashResult(w, r, http.StatusOK, "Restored to "+filepath.ToSlash(restoredPath))
+}
+
+// TrashDeleteHandler permanently deletes one item from the trash
+func TrashDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	user := trashRequest(w, r)
+	if user == nil {
+		return
+	}
+
+	id, ok := trashItemID(r)
+	if !ok {
+		writeTrashResult(w, r, http.StatusBadRequest, "Invalid trash item")
+		return
+	}
+
+	services.LockUserFileWrite(user.Username)
+	defer services.UnlockUserFileWrite(user.Username)
+
+	err := services.DeleteFromTrash(user.Username, id)
+	if errors.Is(err, services.ErrTrashItemNotFound) {
+		writeTrashResult(w, r, http.StatusNotFound, "Trash item not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete trash item %d for %s: %v", id, user.Username, err)
+		writeTrashResult(w, r, http.StatusInternalServerError, "Failed to delete item")
+		return
+	}
+
+	services.InvalidateUserCache(user.Username)
+	writeTrashResult(w, r, http.StatusOK, "Item deleted permanently")
+}
+
+// TrashEmptyHandler permanently deletes everything in the trash
+func TrashEmptyHandler(w http.ResponseWriter, r *http.Request) {
+	user := trashRequest(w, r)
+	if user == nil {
+		return
+	}
+
+	services.LockUserFileWrite(user.Username)
+	defer services.UnlockUserFileWrite(user.Username)
+
+	removed, err := services.EmptyTrash(user.Username)
+	if err != nil {
+		log.Printf("Failed to empty trash for %s: %v", user.Username, err)
+		writeTrashResult(w, r, http.StatusInternalServerError, "Failed to empty trash")
+		return
+	}
+
+	services.InvalidateUserCache(user.Username)
+	writeTrashResult(w, r, http.StatusOK, strconv.Itoa(removed)+" item(s) deleted permanently")
+}
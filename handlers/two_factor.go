@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+)
+
+// loginChallengeCookie identifies a login waiting for its second factor
+const loginChallengeCookie = "login_challenge"
+
+// setLoginChallengeCookie stores the pending 2FA challenge token
+func setLoginChallengeCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    token,
+		Path:     "/login",
+		MaxAge:   int(config.TOTPChallengeTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearLoginChallengeCookie removes the pending 2FA challenge cookie
+func clearLoginChallengeCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Path:     "/login",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// LoginTwoFactorHandler handles the second login step for accounts with 2FA
+func LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(loginChallengeCookie)
+	if err != nil || services.GetLoginChallengeUser(cookie.Value) == "" {
+		clearLoginChallengeCookie(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	token := cookie.Value
+	username := services.GetLoginChallengeUser(token)
+
+	if r.Method == http.MethodPost {
+		// Wrong codes count against the account like wrong passwords
+		ip := middleware.GetClientIP(r)
+		credential := services.UserThrottleKey(username)
+		if wait := services.CheckLoginAllowed(ip, credential); wait > 0 {
+			services.DeleteLoginChallenge(token)
+			clearLoginChallengeCookie(w)
+			renderLogin(w, r, map[string]interface{}{"error": throttleMessage(wait)})
+			return
+		}
+
+		if err := services.VerifySecondFactor(username, r.FormValue("code")); err != nil {
+			services.RecordLoginFailure(ip, credential)
+			if !services.RecordLoginChallengeFailure(token) {
+				clearLoginChallengeCookie(w)
+				renderLogin(w, r, map[string]interface{}{"error": "Too many invalid codes. Please log in again."})
+				return
+			}
+			renderTemplate(w, r, "login_2fa.html", map[string]interface{}{"error": "Invalid verification code"})
+			return
+		}
+
+		services.DeleteLoginChallenge(token)
+		clearLoginChallengeCookie(w)
+		completeLogin(w, r, username)
+		return
+	}
+
+	renderTemplate(w, r, "login_2fa.html", nil)
+}
+
+// APITwoFactorStatusHandler reports the current user's 2FA state
+func APITwoFactorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "Unauthorized"})
+		return
+	}
+
+	user := services.GetUser(username)
+	if user == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "User not found"})
+		return
+	}
+
+	status := models.TwoFactorStatusResponse{Enabled: user.TOTPEnabled}
+	if user.TOTPEnabled {
+		status.RecoveryCodesLeft = services.CountRecoveryCodes(username)
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// APITwoFactorSetupHandler starts enrollment by issuing a new TOTP secret
+func APITwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		writeJSON(w, http.StatusUnauthorized, models.TwoFactorSetupResponse{Success: false, Message: "Unauthorized"})
+		return
+	}
+
+	secret, uri, err := services.BeginTOTPEnrollment(username)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, models.TwoFactorSetupResponse{Success: false, Message: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.TwoFactorSetupResponse{Success: true, Secret: secret, URI: uri})
+}
+
+// APITwoFactorEnableHandler confirms enrollment with a code from the app
+func APITwoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		writeJSON(w, http.StatusUnauthorized, models.RecoveryCodesResponse{Success: false, Message: "Unauthorized"})
+		return
+	}
+
+	var req models.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeJSON(w, http.StatusBadRequest, models.RecoveryCodesResponse{Success: false, Message: "Verification code is required"})
+		return
+	}
+
+	codes, err := services.ConfirmTOTPEnrollment(username, req.Code)
+	if err != nil {
+		status, message := http.StatusInternalServerError, "Failed to enable two-factor authentication"
+		if errors.Is(err, services.ErrInvalidTOTPCode) {
+			status, message = http.StatusBadRequest, "Invalid verification code"
+		} else if errors.Is(err, services.ErrTOTPNotPending) {
+			status, message = http.StatusBadRequest, "Start two-factor setup first"
+		}
+		writeJSON(w, status, models.RecoveryCodesResponse{Success: false, Message: message})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.RecoveryCodesResponse{
+		Success:       true,
+		Message:       "Two-factor authentication enabled",
+		RecoveryCodes: codes,
+	})
+}
+
+// APITwoFactorDisableHandler turns 2FA off after re-checking the password
+// and a current code
+func APITwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		writeJSON(w, http.StatusUnauthorized, models.UpdateProfileResponse{Success: false, Message: "Unauthorized"})
+		return
+	}
+
+	var req models.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" || req.Code == "" {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Password and verification code are required"})
+		return
+	}
+
+	user := services.GetUser(username)
+	if user == nil || !services.AuthenticateUser(user, req.Password) {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Password is incorrect"})
+		return
+	}
+	if err := services.VerifySecondFactor(username, req.Code); err != nil {
+		writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Invalid verification code"})
+		return
+	}
+
+	if err := services.DisableTOTP(username); err != nil {
+		writeJSON(w, http.StatusInternalServerError, models.UpdateProfileResponse{Success: false, Message: "Failed to disable two-factor authentication"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: "Two-factor authentication disabled"})
+}
+
+// APIRecoveryCodesHandler replaces the user's recovery codes
+func APIRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		writeJSON(w, http.StatusUnauthorized, models.RecoveryCodesResponse{Success: false, Message: "Unauthorized"})
+		return
+	}
+
+	var req models.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeJSON(w, http.StatusBadRequest, models.RecoveryCodesResponse{Success: false, Message: "Verification code is required"})
+		return
+	}
+	if err := services.VerifySecondFactor(username, req.Code); err != nil {
+		writeJSON(w, http.StatusBadRequest, models.RecoveryCodesResponse{Success: false, Message: "Invalid verification code"})
+		return
+	}
+
+	codes, err := services.RegenerateRecoveryCodes(username)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, models.RecoveryCodesResponse{Success: false, Message: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.RecoveryCodesResponse{
+		Success:       true,
+		Message:       "New recovery codes generated",
+		RecoveryCodes: codes,
+	})
+}
@@ -0,0 +1,434 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// uploadError is a failed upload with the status to report
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+// uploadErrorStatus returns the HTTP status for an upload failure
+func uploadErrorStatus(err error) int {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		return ue.status
+	}
+	if errors.Is(err, services.ErrQuotaExceeded) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadResultStatus maps an upload failure to a per-file result status
+// and message for batch responses
+func uploadResultStatus(err error) (string, string) {
+	var ue *uploadError
+	switch {
+	case errors.As(err, &ue) && ue.status == http.StatusConflict:
+		return "conflict", ue.message
+	case errors.As(err, &ue):
+		return "error", ue.message
+	case errors.Is(err, services.ErrQuotaExceeded):
+		return "error", "Storage quota exceeded"
+	}
+	return "error", "Save error"
+}
+
+// writeUploadError reports an upload failure as a plain-text response
+func writeUploadError(w http.ResponseWriter, err error) {
+	_, message := uploadResultStatus(err)
+	http.Error(w, message, uploadErrorStatus(err))
+}
+
+// stagedUpload is an uploaded file saved to the staging area, waiting to be
+// moved into the blob store and recorded in the user's folder
+type stagedUpload struct {
+	filename   string
+	relDir     string // Subfolders from a directory upload ("" for none)
+	mimeType   string
+	folder     string // Target folder chosen by the user
+	newVersion bool   // Replace a file of the same name, keeping it as a version
+	uploadedBy string // Who sent a new version, if not the owner
+	tempPath   string
+	size       int64
+	storedPath string // Set once placed
+}
+
+// displayName returns the path the client sent for this file
+func (u *stagedUpload) displayName() string {
+	if u.relDir == "" {
+		return u.filename
+	}
+	return u.relDir + "/" + u.filename
+}
+
+// splitUploadPath turns a client-supplied relative path such as
+// "Photos/2024/a.jpg" into its folder and file name, rejecting traversal
+func splitUploadPath(name string) (string, string, bool) {
+	var segments []string
+	for _, segment := range strings.Split(strings.ReplaceAll(name, `\`, "/"), "/") {
+		if segment == "" || segment == "." {
+			continue
+		}
+		if !isValidUploadFilename(segment) {
+			return "", "", false
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return "", "", false
+	}
+	return strings.Join(segments[:len(segments)-1], "/"), segments[len(segments)-1], true
+}
+
+// resolveUploadFolder validates a target folder and returns its normalized
+// form ("/" for root) and its path below the user's storage root
+func resolveUploadFolder(userStoragePath, folder string) (string, string, error) {
+	if folder == "" || folder == "/" {
+		return "/", userStoragePath, nil
+	}
+
+	targetPath := filepath.Join(userStoragePath, folder)
+	// Security check
+	if !isPathSafe(targetPath, userStoragePath) {
+		return "", "", &uploadError{http.StatusForbidden, "Invalid folder"}
+	}
+	return folder, targetPath, nil
+}
+
+// ensureUploadFolders creates the subfolders of a directory upload below
+// folder, adding metadata rows for any that are new, and returns the
+// innermost folder and its path. Callers hold the write lock.
+func ensureUploadFolders(username, userStoragePath, folder, targetPath, relDir string) (string, string, error) {
+	for _, segment := range strings.Split(relDir, "/") {
+		childPath := filepath.Join(targetPath, segment)
+		relativePath, _ := filepath.Rel(userStoragePath, childPath)
+
+		childFolder := segment
+		if folder != "/" {
+			childFolder = folder + "/" + segment
+		}
+
+		existing, err := services.GetFileByPath(username, relativePath)
+		if err != nil {
+			return "", "", err
+		}
+		if existing != nil && !existing.IsDirectory {
+			return "", "", &uploadError{http.StatusConflict, "A file named " + childFolder + " already exists"}
+		}
+
+		if existing == nil {
+			err := services.AddFileMetadata(
+				username,
+				segment,
+				relativePath,
+				folder,
+				"",   // no mime type for folders
+				"",   // no hash for folders
+				0,    // folders have 0 size
+				true, // is directory
+			)
+			if err != nil {
+				return "", "", &uploadError{500, "Failed to save folder metadata"}
+			}
+		}
+
+		folder = childFolder
+		targetPath = childPath
+	}
+	return folder, targetPath, nil
+}
+
+// placeUploadedFile moves a fully received file from staging into the blob
+// store and records it in the user's folder. Returns the normalized target
+// folder the user chose.
+func placeUploadedFile(user *models.User, upload *stagedUpload) (string, error) {
+	username := user.Username
+	userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
+
+	baseFolder, basePath, err := resolveUploadFolder(userStoragePath, upload.folder)
+	if err != nil {
+		return "", err
+	}
+
+	// Content is stored under its hash; compute it before taking the lock
+	fileHash := utils.CalculateFileSHA256(upload.tempPath)
+	if fileHash == "" {
+		return "", &uploadError{500, "Save error"}
+	}
+
+	// LOCK before file operations
+	services.LockUserFileWrite(username)
+	defer services.UnlockUserFileWrite(username)
+
+	folder, targetPath := baseFolder, basePath
+	if upload.relDir != "" {
+		folder, targetPath, err = ensureUploadFolders(username, userStoragePath, folder, targetPath, upload.relDir)
+		if err != nil {
+			return "", err
+		}
+	}
+	filePath := filepath.Join(targetPath, upload.filename)
+
+	// Check if file already exists in database
+	relativePath, _ := filepath.Rel(userStoragePath, filePath)
+	exists, _ := services.FileExistsInDB(username, relativePath)
+	if exists && upload.newVersion {
+		if err := placeNewVersion(username, userStoragePath, relativePath, fileHash, upload); err != nil {
+			return "", err
+		}
+		services.InvalidateUserCache(username)
+		upload.storedPath = filepath.ToSlash(relativePath)
+		return baseFolder, nil
+	}
+	if exists {
+		return "", &uploadError{http.StatusConflict, "File already exists"}
+	}
+
+	// Re-check under the lock in case another upload finished meanwhile
+	if err := services.CheckQuota(username, upload.size); err != nil {
+		return "", &uploadError{http.StatusRequestEntityTooLarge, "Storage quota exceeded"}
+	}
+
+	if err := services.PutBlob(upload.tempPath, fileHash, upload.size); err != nil {
+		return "", err
+	}
+
+	// Get MIME type
+	mimeType := upload.mimeType
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	// Save file metadata to database
+	err = services.AddFileMetadata(
+		username,
+		upload.filename,
+		relativePath,
+		folder,
+		mimeType,
+		fileHash,
+		upload.size,
+		false, // not a directory
+	)
+	if err != nil {
+		// The stored content is collected once nothing refers to it
+		return "", &uploadError{500, "Failed to save file metadata"}
+	}
+
+	// Update folder size cache
+	services.UpdateFolderSize(targetPath, upload.size)
+
+	// Invalidate cache after upload
+	services.InvalidateUserCache(username)
+
+	upload.storedPath = filepath.ToSlash(relativePath)
+	return baseFolder, nil
+}
+
+// placeNewVersion makes a fully received upload the new content of an
+// existing file, keeping the old content in its version history. Callers
+// hold the write lock.
+func placeNewVersion(username, userStoragePath, relativePath, fileHash string, upload *stagedUpload) error {
+	meta, err := services.GetFileByPath(username, relativePath)
+	if err != nil {
+		return err
+	}
+	if meta == nil || meta.IsDirectory {
+		return &uploadError{http.StatusConflict, "A folder with this name already exists"}
+	}
+
+	if err := services.CheckQuota(username, upload.size); err != nil {
+		return &uploadError{http.StatusRequestEntityTooLarge, "Storage quota exceeded"}
+	}
+
+	mimeType := upload.mimeType
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	if err := services.PutBlob(upload.tempPath, fileHash, upload.size); err != nil {
+		return err
+	}
+
+	uploadedBy := upload.uploadedBy
+	if uploadedBy == "" {
+		uploadedBy = username
+	}
+	err = services.AddFileVersion(username, userStoragePath, relativePath, services.NewFileVersion{
+		Size:       upload.size,
+		Hash:       fileHash,
+		MimeType:   mimeType,
+		UploadedBy: uploadedBy,
+	})
+	if err != nil {
+		return &uploadError{500, "Failed to save new version"}
+	}
+	return nil
+}
+
+// receiveUploadBatch streams each file of an upload request into staging
+// and places it before reading the next, so a batch needs no more than one
+// file of scratch space. Returns the result of every file and the first
+// error, if any.
+func receiveUploadBatch(r *http.Request, limit int64, place func(*stagedUpload) error) (models.UploadBatchResponse, error) {
+	response := models.UploadBatchResponse{Results: []models.UploadResult{}}
+	var firstErr error
+	err := receiveUploads(r, limit, func(upload *stagedUpload, stageErr error) bool {
+		result := models.UploadResult{Name: upload.displayName(), Status: "uploaded", Size: upload.size}
+		placeErr := stageErr
+		if placeErr == nil {
+			placeErr = place(upload)
+		}
+		if placeErr != nil {
+			if firstErr == nil {
+				firstErr = placeErr
+			}
+			result.Status, result.Message = uploadResultStatus(placeErr)
+			result.Size = 0
+			response.Failed++
+		} else {
+			result.Path = upload.storedPath
+			response.Uploaded++
+		}
+		response.Results = append(response.Results, result)
+		return placeErr == nil
+	})
+	if err != nil && firstErr == nil {
+		// Malformed or truncated body before any file was read
+		firstErr = &uploadError{http.StatusBadRequest, "File error"}
+	}
+	if len(response.Results) == 0 && firstErr == nil {
+		firstErr = &uploadError{http.StatusBadRequest, "File error"}
+	}
+	response.Success = response.Failed == 0 && firstErr == nil
+	return response, firstErr
+}
+
+// writeUploadBatchJSON sends the per-file results of an upload request.
+// The status is only an error if no file at all was kept.
+func writeUploadBatchJSON(w http.ResponseWriter, response models.UploadBatchResponse, firstErr error) {
+	status := http.StatusOK
+	if response.Uploaded == 0 && firstErr != nil {
+		status = uploadErrorStatus(firstErr)
+	}
+	writeJSON(w, status, response)
+}
+
+// receiveUploads copies every "file" part of a multipart upload into the
+// staging area in turn and hands it to place, which reports whether the
+// file was kept. The copy fails with services.ErrQuotaExceeded once the
+// kept files pass limit bytes (negative = no limit), ending the batch.
+//
+// A "relative_path" field before a file part gives its path inside the
+// target folder (for directory uploads); otherwise the path in the part's
+// own filename is used. The body is streamed part by part rather than
+// spooled first.
+func receiveUploads(r *http.Request, limit int64, place func(*stagedUpload, error) bool) error {
+	if err := os.MkdirAll(config.UploadStagingDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	folder := ""
+	newVersion := false
+	handle := func(src io.Reader, name, mimeType string) error {
+		upload := &stagedUpload{folder: folder, mimeType: mimeType, newVersion: newVersion}
+
+		var ok bool
+		upload.relDir, upload.filename, ok = splitUploadPath(name)
+		if !ok {
+			upload.filename = name
+			place(upload, &uploadError{http.StatusBadRequest, "Invalid file name"})
+			return nil
+		}
+
+		tmp, err := os.CreateTemp(config.UploadStagingDir, "upload-*")
+		if err != nil {
+			place(upload, err)
+			return err
+		}
+		upload.tempPath = tmp.Name()
+		defer os.Remove(upload.tempPath) // No-op once moved into place
+
+		upload.size, err = io.Copy(services.NewQuotaWriter(tmp, limit), src)
+		tmp.Close()
+		if err != nil {
+			place(upload, err)
+			return err
+		}
+
+		if place(upload, nil) && limit >= 0 {
+			limit -= upload.size
+		}
+		return nil
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	relativePath := ""
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case part.FormName() == "folder":
+			value, _ := io.ReadAll(io.LimitReader(part, 4096))
+			folder = string(value)
+		case part.FormName() == "new_version":
+			value, _ := io.ReadAll(io.LimitReader(part, 16))
+			newVersion = isTruthy(string(value))
+		case part.FormName() == "relative_path":
+			value, _ := io.ReadAll(io.LimitReader(part, 4096))
+			relativePath = string(value)
+		case part.FormName() == "file" && part.FileName() != "":
+			name := relativePath
+			if name == "" {
+				name = rawPartFilename(part)
+			}
+			relativePath = ""
+
+			if err := handle(part, name, part.Header.Get("Content-Type")); err != nil {
+				part.Close()
+				return err
+			}
+		}
+		part.Close()
+	}
+}
+
+// rawPartFilename returns a part's filename including any directories,
+// which Part.FileName strips
+func rawPartFilename(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return part.FileName()
+	}
+	return params["filename"]
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// loadUserShares returns the items a user shared with others, with paths
+// "/"-separated
+func loadUserShares(username string) ([]models.UserShare, error) {
+	shares, err := services.ListUserSharesByOwner(username)
+	if err != nil {
+		return nil, err
+	}
+	for i := range shares {
+		shares[i].StoragePath = filepath.ToSlash(shares[i].StoragePath)
+	}
+	return shares, nil
+}
+
+// loadSharedWithMe returns the items other users shared with a user. Where
+// an item sits in its owner's storage is none of the recipient's business.
+func loadSharedWithMe(username string) ([]models.UserShare, error) {
+	shares, err := services.ListSharedWithUser(username)
+	if err != nil {
+		return nil, err
+	}
+	for i := range shares {
+		shares[i].StoragePath = ""
+	}
+	return shares, nil
+}
+
+// SharedWithMePageHandler shows the files and folders other users shared
+// with the user
+func SharedWithMePageHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	shares, err := loadSharedWithMe(username)
+	if err != nil {
+		log.Printf("Failed to list items shared with %s: %v", username, err)
+		http.Error(w, "Failed to load shared items", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, r, "shared.html", map[string]interface{}{
+		"username": username,
+		"shares":   shares,
+	})
+}
+
+// APISharedWithMeHandler returns the items other users shared with the
+// user as JSON
+func APISharedWithMeHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shares, err := loadSharedWithMe(username)
+	if err != nil {
+		log.Printf("Failed to list items shared with %s: %v", username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load shared items"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"shares": shares})
+}
+
+// APIUserSharesHandler returns the items the user shared with others as
+// JSON
+func APIUserSharesHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shares, err := loadUserShares(username)
+	if err != nil {
+		log.Printf("Failed to list shares of %s: %v", username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load shares"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"shares": shares})
+}
+
+// findUserByContact looks up a user to share with or add to a group by
+// email, or by phone number (in phone_region when given). Disabled
+// accounts are not found.
+func findUserByContact(contact, phoneRegion string) *models.User {
+	var user *models.User
+	if strings.Contains(contact, "@") {
+		user = services.FindUserByEmail(contact)
+	} else if phone := utils.CleanPhoneNumber(contact); phone != "" {
+		if phoneRegion != "" {
+			user = services.FindUserByPhoneAndRegion(phone, phoneRegion)
+		} else {
+			user, _ = services.GetUserByPhoneDB(phone)
+		}
+	}
+	if user == nil || user.Disabled {
+		return nil
+	}
+	return user
+}
+
+// UserShareAddHandler shares a file or folder with another registered
+// user, found by "recipient" (email or phone number), as viewer or editor.
+// Sharing with the same user again changes their role.
+func UserShareAddHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := services.GetUser(username)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := r.FormValue("name")
+	folder := r.FormValue("folder")
+	if !isValidUploadFilename(name) {
+		writeShareResult(w, r, http.StatusBadRequest, "Invalid file name")
+		return
+	}
+
+	role := r.FormValue("role")
+	if role == "" {
+		role = services.ShareRoleViewer
+	}
+	if !services.IsValidShareRole(role) {
+		writeShareResult(w, r, http.StatusBadRequest, "Invalid role")
+		return
+	}
+
+	recipient := findUserByContact(strings.TrimSpace(r.FormValue("recipient")), strings.TrimSpace(r.FormValue("phone_region")))
+	if recipient == nil {
+		writeShareResult(w, r, http.StatusNotFound, "No user has that email or phone number")
+		return
+	}
+
+	userStoragePath := services.GetUserStoragePath(username, user.UniqueCode)
+	filePath := filepath.Join(userStoragePath, folder, name)
+
+	// Security check
+	if !isPathSafe(filePath, userStoragePath) {
+		writeShareResult(w, r, http.StatusForbidden, "Unauthorized")
+		return
+	}
+	relativePath, _ := filepath.Rel(userStoragePath, filePath)
+
+	share, err := services.ShareWithUser(username, relativePath, recipient.Username, role)
+	switch {
+	case errors.Is(err, services.ErrFileNotFound):
+		writeShareResult(w, r, http.StatusNotFound, "File not found")
+		return
+	case errors.Is(err, services.ErrShareWithSelf):
+		writeShareResult(w, r, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to share %s of %s: %v", relativePath, username, err)
+		writeShareResult(w, r, http.StatusInternalServerError, "Failed to share")
+		return
+	}
+
+	share.StoragePath = filepath.ToSlash(share.StoragePath)
+	message := "Shared with " + recipient.Username + " as " + role
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": message, "share": share})
+		return
+	}
+	http.Redirect(w, r, "/shares", http.StatusSeeOther)
+}
+
+// removeUserShare ends a share for its owner or its recipient and answers
+// with JSON, or a redirect to redirect for forms
+func removeUserShare(w http.ResponseWriter, r *http.Request, message, redirect string) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeFileOpResult(w, r, http.StatusBadRequest, "Invalid share", redirect)
+		return
+	}
+
+	err = services.RemoveUserShare(username, id)
+	if errors.Is(err, services.ErrUserShareNotFound) {
+		writeFileOpResult(w, r, http.StatusNotFound, "Share not found", redirect)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to remove share %d for %s: %v", id, username, err)
+		writeFileOpResult(w, r, http.StatusInternalServerError, "Failed to remove share", redirect)
+		return
+	}
+	writeFileOpResult(w, r, http.StatusOK, message, redirect)
+}
+
+// UserShareRevokeHandler stops sharing an item with a user. They lose
+// access with their next request.
+func UserShareRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	removeUserShare(w, r, "Access removed", "/shares")
+}
+
+// UserShareLeaveHandler removes an item someone shared with the user from
+// their "Shared with me" list
+func UserShareLeaveHandler(w http.ResponseWriter, r *http.Request) {
+	removeUserShare(w, r, "Removed from your shared items", "/shared")
+}
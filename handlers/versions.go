@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/middleware"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+	"github.com/HAYASAKA7/HAYA-DISK/utils"
+)
+
+// versionTarget is the file a version request is about
+type versionTarget struct {
+	user            *models.User
+	userStoragePath string
+	folder          string
+	name            string
+	filePath        string
+	relativePath    string
+}
+
+// resolveVersionTarget reads the "name" and "folder" values of a version
+// request, or writes an error and returns nil
+func resolveVersionTarget(w http.ResponseWriter, r *http.Request) *versionTarget {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	user := services.GetUser(username)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	target := &versionTarget{
+		user:            user,
+		userStoragePath: services.GetUserStoragePath(username, user.UniqueCode),
+		folder:          r.FormValue("folder"),
+		name:            r.FormValue("name"),
+	}
+	if target.name == "" {
+		http.Error(w, "Missing file name", http.StatusBadRequest)
+		return nil
+	}
+
+	if target.folder != "" && target.folder != "/" {
+		target.filePath = filepath.Join(target.userStoragePath, target.folder, target.name)
+	} else {
+		target.filePath = filepath.Join(target.userStoragePath, target.name)
+	}
+
+	// Security check
+	if !isPathSafe(target.filePath, target.userStoragePath) {
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return nil
+	}
+	target.relativePath, _ = filepath.Rel(target.userStoragePath, target.filePath)
+	return target
+}
+
+// loadVersions returns a file's versions with display fields filled in
+func loadVersions(target *versionTarget) ([]models.FileVersion, error) {
+	services.LockUserFileRead(target.user.Username)
+	defer services.UnlockUserFileRead(target.user.Username)
+
+	versions, err := services.ListFileVersions(target.user.Username, target.relativePath)
+	if err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		versions[i].SizeStr = utils.FormatFileSize(versions[i].Size)
+	}
+	return versions, nil
+}
+
+// VersionsPageHandler shows the version history of a file
+func VersionsPageHandler(w http.ResponseWriter, r *http.Request) {
+	if middleware.GetSessionUser(r) == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	target := resolveVersionTarget(w, r)
+	if target == nil {
+		return
+	}
+
+	versions, err := loadVersions(target)
+	if errors.Is(err, services.ErrFileNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to list versions of %s for %s: %v", target.relativePath, target.user.Username, err)
+		http.Error(w, "Failed to load versions", http.StatusInternalServerError)
+		return
+	}
+
+	folder := target.folder
+	if folder == "/" {
+		folder = ""
+	}
+
+	renderTemplate(w, r, "versions.html", map[string]interface{}{
+		"username":   target.user.Username,
+		"name":       target.name,
+		"folder":     folder,
+		"versions":   versions,
+		"hasEarlier": len(versions) > 1,
+	})
+}
+
+// APIVersionsHandler returns the version history of a file as JSON
+func APIVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target := resolveVersionTarget(w, r)
+	if target == nil {
+		return
+	}
+
+	versions, err := loadVersions(target)
+	if errors.Is(err, services.ErrFileNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to list versions of %s for %s: %v", target.relativePath, target.user.Username, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load versions"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"versions": versions})
+}
+
+// VersionDownloadHandler sends an earlier version of a file
+func VersionDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	target := resolveVersionTarget(w, r)
+	if target == nil {
+		return
+	}
+
+	versionNumber, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	// Lock for read operation
+	services.LockUserFileRead(target.user.Username)
+	defer services.UnlockUserFileRead(target.user.Username)
+
+	version, err := services.GetFileVersion(target.user.Username, target.relativePath, versionNumber)
+	if err != nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	blob, err := services.OpenBlob(version.Hash)
+	if err != nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	defer blob.Close()
+
+	f := &storedFile{File: blob, name: target.name, mimeType: version.MimeType, hash: version.Hash, modTime: version.UploadedAt}
+	serveStoredFile(w, r, f, f.contentType(), "attachment")
+}
+
+// VersionRestoreHandler makes an earlier version the current one again
+func VersionRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target := resolveVersionTarget(w, r)
+	if target == nil {
+		return
+	}
+	username := target.user.Username
+
+	versionNumber, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		writeFileOpResult(w, r, http.StatusBadRequest, "Invalid version", listURL(target.folder, nil))
+		return
+	}
+
+	services.LockUserFileWrite(username)
+	defer services.UnlockUserFileWrite(username)
+
+	meta, err := services.GetFileByPath(username, target.relativePath)
+	if err != nil || meta == nil || meta.IsDirectory {
+		writeFileOpResult(w, r, http.StatusNotFound, "File not found", listURL(target.folder, nil))
+		return
+	}
+
+	err = services.RestoreFileVersion(username, target.userStoragePath, target.relativePath, versionNumber, username)
+	switch {
+	case errors.Is(err, services.ErrVersionNotFound):
+		writeFileOpResult(w, r, http.StatusNotFound, "Version not found", listURL(target.folder, nil))
+		return
+	case errors.Is(err, services.ErrQuotaExceeded):
+		writeFileOpResult(w, r, http.StatusRequestEntityTooLarge, "Storage quota exceeded", listURL(target.folder, nil))
+		return
+	case err != nil:
+		log.Printf("Failed to restore version %d of %s for %s: %v", versionNumber, target.relativePath, username, err)
+		writeFileOpResult(w, r, http.StatusInternalServerError, "Failed to restore version", listURL(target.folder, nil))
+		return
+	}
+
+	services.InvalidateUserCache(username)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: "Version " + strconv.Itoa(versionNumber) + " restored"})
+		return
+	}
+	http.Redirect(w, r, "/versions?name="+url.QueryEscape(target.name)+"&folder="+url.QueryEscape(target.folder), http.StatusSeeOther)
+}
+
+// APIVersionPolicyHandler shows (GET) or changes (POST) how much version
+// history the user keeps
+func APIVersionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetSessionUser(r)
+	if username == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "Unauthorized"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		maxVersions, maxSpace, customVersions, customSpace, err := services.GetVersionPolicy(username)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to load version policy"})
+			return
+		}
+		used, _, _ := services.GetVersionUsage(username)
+		writeJSON(w, http.StatusOK, models.VersionPolicyResponse{
+			MaxVersions:        maxVersions,
+			MaxSpace:           maxSpace,
+			CustomVersions:     customVersions,
+			CustomSpace:        customSpace,
+			DefaultMaxVersions: config.DefaultMaxFileVersions,
+			DefaultMaxSpace:    config.DefaultMaxVersionSpace,
+			UsedSpace:          used,
+			UsedSpaceStr:       utils.FormatFileSize(used),
+		})
+
+	case http.MethodPost:
+		var req models.VersionPolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Invalid request"})
+			return
+		}
+		if (req.MaxVersions != nil && *req.MaxVersions < 0) || (req.MaxSpace != nil && *req.MaxSpace < 0) {
+			writeJSON(w, http.StatusBadRequest, models.UpdateProfileResponse{Success: false, Message: "Limits cannot be negative"})
+			return
+		}
+		if err := services.SetVersionPolicy(username, req.MaxVersions, req.MaxSpace); err != nil {
+			writeJSON(w, http.StatusInternalServerError, models.UpdateProfileResponse{Success: false, Message: "Failed to save version policy"})
+			return
+		}
+		writeJSON(w, http.StatusOK, models.UpdateProfileResponse{Success: true, Message: "File history settings saved; they apply from the next upload"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/HAYASAKA7/HAYA-DISK/config"
 	"github.com/HAYASAKA7/HAYA-DISK/handlers"
@@ -37,11 +38,32 @@ func autoMigrate() {
 	log.Println("✓ Auto-migration completed successfully!")
 }
 
+// migrateBlobStore moves file contents left on disk by older versions into
+// the blob store
+func migrateBlobStore() {
+	start := time.Now()
+	moved, err := services.MigrateToBlobStore()
+	if err != nil {
+		log.Printf("Warning: Blob store migration failed: %v", err)
+		return
+	}
+	if moved > 0 {
+		log.Printf("✓ Moved %d files into the blob store in %s", moved, time.Since(start).Round(time.Millisecond))
+	}
+}
+
 func main() {
 	// Create necessary directories
 	os.MkdirAll(config.StorageDir, os.ModePerm)
+	os.RemoveAll(config.UploadStagingDir) // Leftovers from uploads cut off by a restart
 	os.MkdirAll(config.TemplatesDir, os.ModePerm)
 
+	// Emailed and share links are built from BaseURL, never from the
+	// request's Host header
+	if err := services.CheckBaseURL(config.DefaultMailSettings.BaseURL); err != nil {
+		log.Fatal("Invalid mail settings: ", err)
+	}
+
 	// Initialize database (replaces LoadUsers)
 	if err := services.InitDatabase(); err != nil {
 		log.Fatal("Failed to initialize database:", err)
@@ -51,26 +73,158 @@ func main() {
 	// Auto-migrate if users.json exists and database is empty
 	autoMigrate()
 
+	// Convert per-user folders from before the blob store
+	migrateBlobStore()
+
+	// Hash any plaintext passwords left over from older versions
+	if upgraded, err := services.UpgradeLegacyPasswords(); err != nil {
+		log.Printf("Warning: Password upgrade failed: %v", err)
+	} else if upgraded > 0 {
+		log.Printf("✓ Upgraded %d legacy plaintext passwords", upgraded)
+	}
+
+	// Make sure someone can reach the admin console
+	if promoted, err := services.EnsureAdminExists(); err != nil {
+		log.Printf("Warning: Admin check failed: %v", err)
+	} else if promoted != "" {
+		log.Printf("✓ No admin account found; promoted %s to admin", promoted)
+	}
+
 	// Initialize and start backup scheduler
 	backupScheduler := services.InitBackupService()
 	backupScheduler.Start()
 	defer backupScheduler.Stop()
 
+	// Periodically purge expired sessions
+	sessionSweeper := services.InitSessionSweeper()
+	sessionSweeper.Start()
+	defer sessionSweeper.Stop()
+
+	// Periodically forget old failed-login counters
+	loginThrottleSweeper := services.InitLoginThrottleSweeper()
+	loginThrottleSweeper.Start()
+	defer loginThrottleSweeper.Stop()
+
+	// Periodically purge used and expired email tokens
+	tokenSweeper := services.InitUserTokenSweeper()
+	tokenSweeper.Start()
+	defer tokenSweeper.Stop()
+
+	// Periodically purge old SMS login codes
+	smsCodeSweeper := services.InitSMSCodeSweeper()
+	smsCodeSweeper.Start()
+	defer smsCodeSweeper.Stop()
+
+	// Periodically discard abandoned resumable uploads
+	uploadSweeper := services.InitUploadSweeper()
+	uploadSweeper.Start()
+	defer uploadSweeper.Stop()
+
+	// Periodically empty expired items out of the trash
+	trashPurger := services.InitTrashPurger()
+	trashPurger.Start()
+	defer trashPurger.Stop()
+
+	// Periodically reclaim stored contents nothing refers to any more
+	blobCollector := services.InitBlobCollector()
+	blobCollector.Start()
+	defer blobCollector.Stop()
+
+	// Keep the full-text search index up to date
+	searchIndexer := services.InitSearchIndexer()
+	searchIndexer.Start()
+	defer searchIndexer.Stop()
+
 	// Register HTTP handlers
 	http.HandleFunc("/", handlers.IndexHandler)
-	http.HandleFunc("/login", handlers.LoginHandler)
-	http.HandleFunc("/register", handlers.RegisterHandler)
+	http.HandleFunc("/login", middleware.AuthRateLimitMiddleware(handlers.LoginHandler))
+	http.HandleFunc("/login/2fa", middleware.AuthRateLimitMiddleware(handlers.LoginTwoFactorHandler))
+	http.HandleFunc("/login/sms", middleware.AuthRateLimitMiddleware(handlers.LoginSMSHandler))
+	http.HandleFunc("/register", middleware.AuthRateLimitMiddleware(handlers.RegisterHandler))
 	http.HandleFunc("/logout", handlers.LogoutHandler)
+	http.HandleFunc("/forgot-password", middleware.AuthRateLimitMiddleware(handlers.ForgotPasswordHandler))
+	http.HandleFunc("/reset-password", middleware.AuthRateLimitMiddleware(handlers.ResetPasswordHandler))
+	http.HandleFunc("/verify-email", handlers.VerifyEmailHandler)
 	http.HandleFunc("/list", handlers.ListHandler)
 	http.HandleFunc("/upload", middleware.RateLimitMiddleware(handlers.UploadHandler))
+	http.HandleFunc("/api/uploads", middleware.RateLimitMiddleware(handlers.ResumableUploadCreateHandler))
+	http.HandleFunc("/api/uploads/", handlers.ResumableUploadHandler)
 	http.HandleFunc("/download", handlers.DownloadHandler)
+	http.HandleFunc("/download-archive", handlers.ArchiveDownloadHandler)
 	http.HandleFunc("/delete", handlers.DeleteHandler)
 	http.HandleFunc("/create-folder", handlers.CreateFolderHandler)
 	http.HandleFunc("/move-file", handlers.MoveFileHandler)
+	http.HandleFunc("/copy-file", handlers.CopyFileHandler)
+	http.HandleFunc("/rename", handlers.RenameHandler)
 	http.HandleFunc("/thumbnail", handlers.ThumbnailHandler)
+	http.HandleFunc("/trash", handlers.TrashPageHandler)
+	http.HandleFunc("/trash/restore", handlers.TrashRestoreHandler)
+	http.HandleFunc("/trash/delete", handlers.TrashDeleteHandler)
+	http.HandleFunc("/trash/empty", handlers.TrashEmptyHandler)
+	http.HandleFunc("/api/trash", handlers.APITrashListHandler)
+	http.HandleFunc("/shares", handlers.SharesPageHandler)
+	http.HandleFunc("/shares/create", handlers.ShareCreateHandler)
+	http.HandleFunc("/shares/revoke", handlers.ShareRevokeHandler)
+	http.HandleFunc("/api/shares", handlers.APISharesHandler)
+	http.HandleFunc("/s/", middleware.AuthRateLimitMiddleware(handlers.ShareHandler))
+	// Recipients are looked up by email or phone, so adding is rate limited
+	http.HandleFunc("/user-shares/add", middleware.AuthRateLimitMiddleware(handlers.UserShareAddHandler))
+	http.HandleFunc("/user-shares/revoke", handlers.UserShareRevokeHandler)
+	http.HandleFunc("/api/user-shares", handlers.APIUserSharesHandler)
+	http.HandleFunc("/shared", handlers.SharedWithMePageHandler)
+	http.HandleFunc("/shared/leave", handlers.UserShareLeaveHandler)
+	http.HandleFunc("/api/shared-with-me", handlers.APISharedWithMeHandler)
+	http.HandleFunc("/groups", handlers.GroupsPageHandler)
+	http.HandleFunc("/groups/manage", handlers.GroupPageHandler)
+	http.HandleFunc("/groups/create", handlers.GroupCreateHandler)
+	http.HandleFunc("/groups/rename", handlers.GroupRenameHandler)
+	http.HandleFunc("/groups/delete", handlers.GroupDeleteHandler)
+	http.HandleFunc("/groups/members/add", middleware.AuthRateLimitMiddleware(handlers.GroupMemberAddHandler))
+	http.HandleFunc("/groups/members/role", handlers.GroupMemberRoleHandler)
+	http.HandleFunc("/groups/members/remove", handlers.GroupMemberRemoveHandler)
+	http.HandleFunc("/api/groups", handlers.APIGroupsHandler)
+	http.HandleFunc("/api/groups/members", handlers.APIGroupMembersHandler)
+	http.HandleFunc("/search", handlers.SearchPageHandler)
+	http.HandleFunc("/api/search", handlers.APISearchHandler)
+	http.HandleFunc("/search/save", handlers.SaveSearchHandler)
+	http.HandleFunc("/search/saved/delete", handlers.DeleteSavedSearchHandler)
+	http.HandleFunc("/api/search/saved", handlers.APISavedSearchesHandler)
+	http.HandleFunc("/tags/add", handlers.AddTagsHandler)
+	http.HandleFunc("/tags/remove", handlers.RemoveTagsHandler)
+	http.HandleFunc("/api/tags", handlers.APITagsHandler)
+	http.HandleFunc("/color-label", handlers.ColorLabelHandler)
+	http.HandleFunc("/star", handlers.StarHandler)
+	http.HandleFunc("/unstar", handlers.UnstarHandler)
+	http.HandleFunc("/starred", handlers.StarredPageHandler)
+	http.HandleFunc("/starred/remove", handlers.StarredRemoveHandler)
+	http.HandleFunc("/api/starred", handlers.APIStarredHandler)
+	http.HandleFunc("/versions", handlers.VersionsPageHandler)
+	http.HandleFunc("/versions/download", handlers.VersionDownloadHandler)
+	http.HandleFunc("/versions/restore", handlers.VersionRestoreHandler)
+	http.HandleFunc("/api/versions", handlers.APIVersionsHandler)
+	http.HandleFunc("/api/versions/policy", handlers.APIVersionPolicyHandler)
 	http.HandleFunc("/settings", handlers.SettingsHandler)
 	http.HandleFunc("/api/get-user-info", handlers.APIGetUserInfoHandler)
 	http.HandleFunc("/api/update-profile", handlers.APIUpdateProfileHandler)
+	http.HandleFunc("/api/change-password", handlers.APIChangePasswordHandler)
+	http.HandleFunc("/api/sessions", handlers.APIListSessionsHandler)
+	http.HandleFunc("/api/sessions/revoke", handlers.APIRevokeSessionHandler)
+	http.HandleFunc("/api/sessions/revoke-all", handlers.APIRevokeAllSessionsHandler)
+	http.HandleFunc("/api/resend-verification", handlers.APIResendVerificationHandler)
+	http.HandleFunc("/api/2fa/status", handlers.APITwoFactorStatusHandler)
+	http.HandleFunc("/api/2fa/setup", handlers.APITwoFactorSetupHandler)
+	http.HandleFunc("/api/2fa/enable", handlers.APITwoFactorEnableHandler)
+	http.HandleFunc("/api/2fa/disable", handlers.APITwoFactorDisableHandler)
+	http.HandleFunc("/api/2fa/recovery-codes", handlers.APIRecoveryCodesHandler)
+	http.HandleFunc("/admin", middleware.RequireAdmin(handlers.AdminPageHandler))
+	http.HandleFunc("/api/admin/users", middleware.RequireAdmin(handlers.APIAdminListUsersHandler))
+	http.HandleFunc("/api/admin/users/disable", middleware.RequireAdmin(handlers.APIAdminSetDisabledHandler))
+	http.HandleFunc("/api/admin/users/role", middleware.RequireAdmin(handlers.APIAdminSetRoleHandler))
+	http.HandleFunc("/api/admin/users/quota", middleware.RequireAdmin(handlers.APIAdminSetQuotaHandler))
+	http.HandleFunc("/api/admin/users/delete", middleware.RequireAdmin(handlers.APIAdminDeleteUserHandler))
+	http.HandleFunc("/api/admin/users/reset-password", middleware.RequireAdmin(handlers.APIAdminResetPasswordHandler))
+	http.HandleFunc("/api/admin/groups", middleware.RequireAdmin(handlers.APIAdminListGroupsHandler))
+	http.HandleFunc("/api/admin/groups/quota", middleware.RequireAdmin(handlers.APIAdminSetGroupQuotaHandler))
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(config.TemplatesDir))))
 	http.Handle("/resources/", http.StripPrefix("/resources/", http.FileServer(http.Dir("resources"))))
 
@@ -84,7 +238,8 @@ func main() {
 		fmt.Printf("  - Local: http://localhost:8080\n")
 		fmt.Printf("  - Network: http://<your-ip>:8080\n")
 		fmt.Printf("Listening on %s\n", config.ServerPort)
-		if err := http.ListenAndServe(config.ServerPort, nil); err != nil {
+		// Every state-changing request must carry a valid CSRF token
+		if err := http.ListenAndServe(config.ServerPort, middleware.CSRFMiddleware(http.DefaultServeMux)); err != nil {
 			log.Printf("Server error: %v", err)
 		}
 	}()
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+)
+
+// RequireAdmin only lets logged-in admins through. API routes get a JSON
+// error; pages redirect to the login or file list.
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		isAPI := strings.HasPrefix(r.URL.Path, "/api/")
+
+		username := GetSessionUser(r)
+		if username == "" {
+			if isAPI {
+				writeAdminError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		user := services.GetUser(username)
+		if user == nil || !user.IsAdmin || user.Disabled {
+			if isAPI {
+				writeAdminError(w, http.StatusForbidden, "Admin access required")
+				return
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// writeAdminError sends a JSON error for rejected admin API calls
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": message})
+}
@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"mime"
+	"net/http"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
+
+// CSRFToken returns the token pages must embed in forms and API calls.
+// Logged-in users get the synchronizer token bound to their session;
+// anonymous visitors (login, register) get a double-submit cookie.
+func CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if session := GetCurrentSession(r); session != nil {
+		return session.CSRFToken
+	}
+
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	token := services.GenerateCSRFToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   config.SessionAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// CSRFField renders the hidden form input carrying the CSRF token
+func CSRFField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
+
+// expectedCSRFToken returns the token a state-changing request must present
+func expectedCSRFToken(r *http.Request) string {
+	if session := GetCurrentSession(r); session != nil {
+		return session.CSRFToken
+	}
+	if cookie, err := r.Cookie(csrfCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// submittedCSRFToken reads the token from the request header or, for plain
+// HTML forms, the csrf_token field. Multipart bodies are never read here,
+// since that would spool whole uploads before the handlers can check the
+// quota or stream them; multipart forms put the field in the URL instead.
+func submittedCSRFToken(r *http.Request) string {
+	if token := r.Header.Get(csrfHeaderName); token != "" {
+		return token
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		return r.PostFormValue(csrfFormField)
+	case "multipart/form-data":
+		return r.URL.Query().Get(csrfFormField)
+	}
+	return ""
+}
+
+// isSafeMethod reports whether a request method cannot change state
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// CSRFMiddleware rejects state-changing requests that don't carry a valid token
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := expectedCSRFToken(r)
+		submitted := submittedCSRFToken(r)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(submitted)) != 1 {
+			http.Error(w, "Invalid or missing CSRF token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+)
+
+// csrfRequest describes a request sent through CSRFMiddleware
+type csrfRequest struct {
+	method      string
+	query       string // csrf_token in the URL
+	header      string // X-CSRF-Token
+	formField   string // csrf_token in a urlencoded or multipart body
+	contentType string // "form", "multipart", "json" or "" for no body
+	cookie      string // csrf_token cookie (anonymous visitors)
+	session     string // session_id cookie
+}
+
+func (c csrfRequest) build(t *testing.T) *http.Request {
+	t.Helper()
+	target := "/action"
+	if c.query != "" {
+		target += "?" + url.Values{csrfFormField: {c.query}}.Encode()
+	}
+
+	var body io.Reader
+	contentType := ""
+	switch c.contentType {
+	case "form":
+		values := url.Values{"name": {"value"}}
+		if c.formField != "" {
+			values.Set(csrfFormField, c.formField)
+		}
+		body = strings.NewReader(values.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case "multipart":
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		if c.formField != "" {
+			mw.WriteField(csrfFormField, c.formField)
+		}
+		fw, _ := mw.CreateFormFile("file", "upload.txt")
+		fw.Write([]byte("file content"))
+		mw.Close()
+		body = &buf
+		contentType = mw.FormDataContentType()
+	case "json":
+		body = strings.NewReader(`{"` + csrfFormField + `":"` + c.formField + `"}`)
+		contentType = "application/json"
+	}
+
+	r := httptest.NewRequest(c.method, target, body)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if c.header != "" {
+		r.Header.Set(csrfHeaderName, c.header)
+	}
+	if c.cookie != "" {
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: c.cookie})
+	}
+	if c.session != "" {
+		r.AddCookie(&http.Cookie{Name: "session_id", Value: c.session})
+	}
+	return r
+}
+
+// createTestSession logs a new user in and returns the session token and
+// its CSRF token. A user left by an earlier run is deleted first.
+func createTestSession(t *testing.T, username string) (string, string) {
+	t.Helper()
+	if _, err := services.GetDB().Exec(`DELETE FROM users WHERE username = ?`, username); err != nil {
+		t.Fatal(err)
+	}
+	err := services.CreateUserDB(username, username+"@example.com", "", "", "x",
+		services.GenerateUniqueCode(), time.Now(), "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := services.GenerateSessionID()
+	session := &models.Session{Username: username}
+	if err := services.CreateSession(token, session); err != nil {
+		t.Fatal(err)
+	}
+	return token, session.CSRFToken
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	anonymous := services.GenerateCSRFToken()
+	other := services.GenerateCSRFToken()
+	session, sessionCSRF := createTestSession(t, "csrf-user")
+
+	tests := []struct {
+		name    string
+		request csrfRequest
+		allowed bool
+	}{
+		// Safe methods never need a token
+		{"GET without token", csrfRequest{method: http.MethodGet}, true},
+		{"HEAD without token", csrfRequest{method: http.MethodHead}, true},
+		{"OPTIONS without token", csrfRequest{method: http.MethodOptions}, true},
+
+		// Anonymous visitors: double-submit cookie
+		{"header matches cookie", csrfRequest{method: http.MethodPost, header: anonymous, cookie: anonymous}, true},
+		{"form field matches cookie", csrfRequest{method: http.MethodPost, contentType: "form", formField: anonymous, cookie: anonymous}, true},
+		{"multipart with token in URL", csrfRequest{method: http.MethodPost, contentType: "multipart", query: anonymous, cookie: anonymous}, true},
+		{"multipart with token in header", csrfRequest{method: http.MethodPost, contentType: "multipart", header: anonymous, cookie: anonymous}, true},
+		{"DELETE with header", csrfRequest{method: http.MethodDelete, header: anonymous, cookie: anonymous}, true},
+		{"no token", csrfRequest{method: http.MethodPost, cookie: anonymous}, false},
+		{"wrong header", csrfRequest{method: http.MethodPost, header: other, cookie: anonymous}, false},
+		{"wrong form field", csrfRequest{method: http.MethodPost, contentType: "form", formField: other, cookie: anonymous}, false},
+		{"no cookie", csrfRequest{method: http.MethodPost, header: anonymous}, false},
+		{"no cookie and no token", csrfRequest{method: http.MethodPost}, false},
+		{"multipart with token only in body", csrfRequest{method: http.MethodPost, contentType: "multipart", formField: anonymous, cookie: anonymous}, false},
+		{"JSON body field", csrfRequest{method: http.MethodPost, contentType: "json", formField: anonymous, cookie: anonymous}, false},
+		{"urlencoded with token only in URL", csrfRequest{method: http.MethodPost, contentType: "form", query: anonymous, cookie: anonymous}, false},
+		{"PUT without token", csrfRequest{method: http.MethodPut, cookie: anonymous}, false},
+		{"DELETE without token", csrfRequest{method: http.MethodDelete, cookie: anonymous}, false},
+
+		// Logged-in users: the token bound to the session
+		{"session token in header", csrfRequest{method: http.MethodPost, header: sessionCSRF, session: session}, true},
+		{"session token in form field", csrfRequest{method: http.MethodPost, contentType: "form", formField: sessionCSRF, session: session}, true},
+		{"session without token", csrfRequest{method: http.MethodPost, session: session}, false},
+		{"session with cookie token", csrfRequest{method: http.MethodPost, header: anonymous, cookie: anonymous, session: session}, false},
+		{"session token without session", csrfRequest{method: http.MethodPost, header: sessionCSRF}, false},
+		{"unknown session", csrfRequest{method: http.MethodPost, header: sessionCSRF, session: services.GenerateSessionID()}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, tt.request.build(t))
+
+			if called != tt.allowed {
+				t.Errorf("handler called = %v, want %v", called, tt.allowed)
+			}
+			if !tt.allowed && w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestCSRFMiddlewareLeavesMultipartBody(t *testing.T) {
+	token := services.GenerateCSRFToken()
+	request := csrfRequest{method: http.MethodPost, contentType: "multipart", query: token, cookie: token}.build(t)
+
+	var content string
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.MultipartForm != nil {
+			t.Error("middleware parsed the multipart body")
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			t.Fatalf("FormFile: %v", err)
+		}
+		defer file.Close()
+		b, _ := io.ReadAll(file)
+		content = string(b)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	if content != "file content" {
+		t.Errorf("handler read %q, want the uploaded file", content)
+	}
+}
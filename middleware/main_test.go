@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/HAYASAKA7/HAYA-DISK/services"
+)
+
+// TestMain runs the package tests against a fresh database in a temporary
+// directory, since sessions are looked up in SQLite
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "haya-disk-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Chdir(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := services.InitDatabase(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer services.CloseDatabase()
+
+	return m.Run()
+}
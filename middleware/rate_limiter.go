@@ -1,35 +1,64 @@
 package middleware
 
 import (
+	"fmt"
+	"math"
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
 )
 
+// KeyFunc picks the bucket a request is counted against ("" skips limiting)
+type KeyFunc func(r *http.Request) string
+
+// KeyByUser limits logged-in users individually
+func KeyByUser(r *http.Request) string {
+	return GetSessionUser(r)
+}
+
+// KeyByIP limits clients by remote address, for anonymous routes
+func KeyByIP(r *http.Request) string {
+	return GetClientIP(r)
+}
+
 type RateLimiter struct {
-	requests map[string][]time.Time
-	mu       sync.RWMutex
-	limit    int
-	window   time.Duration
+	requests    map[string][]time.Time
+	mu          sync.RWMutex
+	limit       int
+	window      time.Duration
+	lastCleanup time.Time
 }
 
 func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
 	return &RateLimiter{
-		requests: make(map[string][]time.Time),
-		limit:    limit,
-		window:   window,
+		requests:    make(map[string][]time.Time),
+		limit:       limit,
+		window:      window,
+		lastCleanup: time.Now(),
 	}
 }
 
-func (rl *RateLimiter) Allow(username string) bool {
+func (rl *RateLimiter) Allow(key string) bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
 	now := time.Now()
 	cutoff := now.Add(-rl.window)
 
+	// Drop idle keys once per window so IP-keyed limiters don't grow forever
+	if now.Sub(rl.lastCleanup) > rl.window {
+		for k, requests := range rl.requests {
+			if len(requests) == 0 || !requests[len(requests)-1].After(cutoff) {
+				delete(rl.requests, k)
+			}
+		}
+		rl.lastCleanup = now
+	}
+
 	// Clean old requests
-	requests := rl.requests[username]
+	requests := rl.requests[key]
 	validRequests := []time.Time{}
 	for _, req := range requests {
 		if req.After(cutoff) {
@@ -42,19 +71,43 @@ func (rl *RateLimiter) Allow(username string) bool {
 	}
 
 	validRequests = append(validRequests, now)
-	rl.requests[username] = validRequests
+	rl.requests[key] = validRequests
 	return true
 }
 
+// Limit wraps a handler so each key may make at most limit requests per window
+func (rl *RateLimiter) Limit(keyFunc KeyFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := keyFunc(r)
+		if key != "" && !rl.Allow(key) {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(rl.window.Seconds()))))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
 var uploadLimiter = NewRateLimiter(10, time.Minute) // 10 uploads per minute
 
+var authLimiter = NewRateLimiter(
+	config.DefaultLoginThrottleSettings.IPRequestLimit,
+	config.DefaultLoginThrottleSettings.IPRequestWindow,
+)
+
 func RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return uploadLimiter.Limit(KeyByUser, next)
+}
+
+// AuthRateLimitMiddleware limits credential submissions (POSTs) per client IP
+// on the anonymous login and registration routes
+func AuthRateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	limited := authLimiter.Limit(KeyByIP, next)
 	return func(w http.ResponseWriter, r *http.Request) {
-		username := GetSessionUser(r)
-		if username != "" && !uploadLimiter.Allow(username) {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		if r.Method != http.MethodPost {
+			next(w, r)
 			return
 		}
-		next(w, r)
+		limited(w, r)
 	}
 }
@@ -1,7 +1,10 @@
 package middleware
 
 import (
+	"log"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/HAYASAKA7/HAYA-DISK/config"
@@ -18,27 +21,68 @@ func GetSessionCookie(r *http.Request) string {
 	return cookie.Value
 }
 
-// GetSessionUser retrieves the logged-in username from session
-func GetSessionUser(r *http.Request) string {
+// GetClientIP returns the remote IP address of the request
+func GetClientIP(r *http.Request) string {
+	if config.TrustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return strings.TrimSpace(realIP)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// GetCurrentSession retrieves the active session for the request and
+// records activity on it (sliding expiry)
+func GetCurrentSession(r *http.Request) *models.Session {
 	sessionID := GetSessionCookie(r)
 	if sessionID == "" {
-		return ""
+		return nil
 	}
 
 	session := services.GetSession(sessionID)
-	if session == nil || time.Since(session.Timestamp) > time.Duration(config.SessionAge)*time.Second {
+	if session == nil {
+		return nil
+	}
+
+	// Only write last-seen at most once per touch interval
+	if time.Since(session.LastSeen) > config.SessionTouchInterval {
+		if err := services.TouchSession(sessionID, session, GetClientIP(r)); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	return session
+}
+
+// GetSessionUser retrieves the logged-in username from session
+func GetSessionUser(r *http.Request) string {
+	session := GetCurrentSession(r)
+	if session == nil {
 		return ""
 	}
 	return session.Username
 }
 
 // SetSessionCookie creates a new session cookie
-func SetSessionCookie(w http.ResponseWriter, username string) {
+func SetSessionCookie(w http.ResponseWriter, r *http.Request, username string) {
 	sessionID := services.GenerateSessionID()
-	services.CreateSession(sessionID, &models.Session{
+	err := services.CreateSession(sessionID, &models.Session{
 		Username:  username,
-		Timestamp: time.Now(),
+		IPAddress: GetClientIP(r),
+		UserAgent: r.UserAgent(),
 	})
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
 
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session_id",
@@ -46,6 +90,7 @@ func SetSessionCookie(w http.ResponseWriter, username string) {
 		Path:     "/",
 		MaxAge:   config.SessionAge,
 		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	})
 }
 
@@ -56,9 +101,18 @@ func ClearSessionCookie(w http.ResponseWriter) {
 		Path:     "/",
 		MaxAge:   -1,
 		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	})
 }
 
+// DestroySession revokes the current session server-side and clears the cookie
+func DestroySession(w http.ResponseWriter, r *http.Request) {
+	if sessionID := GetSessionCookie(r); sessionID != "" {
+		services.DeleteSession(sessionID)
+	}
+	ClearSessionCookie(w)
+}
+
 // UpdateSession updates the username in an existing session
 func UpdateSession(r *http.Request, newUsername string) {
 	sessionID := GetSessionCookie(r)
@@ -66,9 +120,7 @@ func UpdateSession(r *http.Request, newUsername string) {
 		return
 	}
 
-	session := services.GetSession(sessionID)
-	if session != nil {
-		session.Username = newUsername
-		services.CreateSession(sessionID, session)
+	if err := services.UpdateSessionUsername(sessionID, newUsername); err != nil {
+		log.Printf("Warning: %v", err)
 	}
 }
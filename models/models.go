@@ -12,32 +12,49 @@ type User struct {
 	UniqueCode  string `json:"unique_code"`
 	CreatedAt   string `json:"created_at"`
 	LoginType   string `json:"login_type"` // "email", "phone", or "both"
+	TOTPEnabled bool   `json:"-"`          // Two-factor authentication active
+	TOTPSecret  string `json:"-"`          // Base32 TOTP secret (pending or active)
+
+	EmailVerified bool `json:"email_verified"` // Owner confirmed the email address
+	IsAdmin       bool `json:"is_admin"`       // Can use the admin console
+	Disabled      bool `json:"disabled"`       // Blocked from logging in
 }
 
 // Session represents an active user session
 type Session struct {
+	ID        int64 // Row ID, safe to expose (the token itself is never stored)
 	Username  string
-	Timestamp time.Time
+	CreatedAt time.Time
+	LastSeen  time.Time
+	ExpiresAt time.Time
+	IPAddress string
+	UserAgent string
+	CSRFToken string // Synchronizer token for state-changing requests
 }
 
 // FileInfo contains metadata about a file or folder
 type FileInfo struct {
-	Name     string
-	Size     string
-	Modified string
-	Icon     string
-	IsImage  bool
-	Ext      string
-	IsDir    bool
-	Path     string
+	ID         int64
+	Name       string
+	Size       string
+	Modified   string
+	Icon       string
+	IsImage    bool
+	Ext        string
+	IsDir      bool
+	Path       string
+	Tags       []string
+	ColorLabel string
+	Starred    bool // By the user viewing the list
 }
 
 // UpdateProfileRequest represents a profile update request
 type UpdateProfileRequest struct {
-	Username    string `json:"username"`
-	Email       string `json:"email"`
-	Phone       string `json:"phone"`
-	PhoneRegion string `json:"phone_region"`
+	Username            string `json:"username"`
+	Email               string `json:"email"`
+	Phone               string `json:"phone"`
+	PhoneRegion         string `json:"phone_region"`
+	RevokeOtherSessions bool   `json:"revoke_other_sessions"`
 }
 
 // UpdateProfileResponse represents a profile update response
@@ -46,12 +63,125 @@ type UpdateProfileResponse struct {
 	Message string `json:"message"`
 }
 
+// ChangePasswordRequest represents a password change request
+type ChangePasswordRequest struct {
+	CurrentPassword     string `json:"current_password"`
+	NewPassword         string `json:"new_password"`
+	ConfirmPassword     string `json:"confirm_password"`
+	RevokeOtherSessions bool   `json:"revoke_other_sessions"`
+}
+
+// SessionInfo describes one of the user's active sessions
+type SessionInfo struct {
+	ID        int64     `json:"id"`
+	Device    string    `json:"device"`
+	IPAddress string    `json:"ip_address"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"current"`
+}
+
+// RevokeSessionRequest represents a request to revoke sessions
+type RevokeSessionRequest struct {
+	SessionID   int64 `json:"session_id"`
+	KeepCurrent bool  `json:"keep_current"`
+}
+
+// TwoFactorRequest carries the credentials needed to change 2FA settings
+type TwoFactorRequest struct {
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+// TwoFactorStatusResponse reports whether 2FA is on for the current user
+type TwoFactorStatusResponse struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// TwoFactorSetupResponse holds a pending TOTP secret for enrollment
+type TwoFactorSetupResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	Secret  string `json:"secret,omitempty"`
+	URI     string `json:"otpauth_uri,omitempty"`
+}
+
+// RecoveryCodesResponse returns freshly issued recovery codes (shown once)
+type RecoveryCodesResponse struct {
+	Success       bool     `json:"success"`
+	Message       string   `json:"message"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// AdminUserInfo is one row of the admin console's user list
+type AdminUserInfo struct {
+	Username       string `json:"username"`
+	Email          string `json:"email"`
+	Phone          string `json:"phone"`
+	PhoneRegion    string `json:"phone_region"`
+	CreatedAt      string `json:"created_at"`
+	LoginType      string `json:"login_type"`
+	IsAdmin        bool   `json:"is_admin"`
+	Disabled       bool   `json:"disabled"`
+	EmailVerified  bool   `json:"email_verified"`
+	TOTPEnabled    bool   `json:"totp_enabled"`
+	StorageUsed    int64  `json:"storage_used"`
+	StorageUsedStr string `json:"storage_used_str"`
+	FileCount      int    `json:"file_count"`
+	ActiveSessions int    `json:"active_sessions"`
+	StorageQuota   int64  `json:"storage_quota"` // 0 = unlimited
+	QuotaStr       string `json:"quota_str"`
+	QuotaCustom    bool   `json:"quota_custom"` // Admin override rather than the default
+}
+
+// AdminUserListResponse is a page of users for the admin console
+type AdminUserListResponse struct {
+	Users    []AdminUserInfo `json:"users"`
+	Total    int             `json:"total"`
+	Page     int             `json:"page"`
+	PageSize int             `json:"page_size"`
+}
+
+// AdminUserRequest targets one user with an admin action
+type AdminUserRequest struct {
+	Username    string `json:"username"`
+	Disabled    bool   `json:"disabled"`
+	IsAdmin     bool   `json:"is_admin"`
+	NewPassword string `json:"new_password"`
+	SendEmail   bool   `json:"send_email"`
+	Quota       *int64 `json:"quota"` // Bytes (0 = unlimited); null restores the default
+}
+
+// AdminGroupInfo is one row of the admin console's group list
+type AdminGroupInfo struct {
+	ID             int64     `json:"id"`
+	Name           string    `json:"name"`
+	Owners         []string  `json:"owners"`
+	MemberCount    int       `json:"member_count"`
+	CreatedAt      time.Time `json:"created_at"`
+	StorageUsed    int64     `json:"storage_used"`
+	StorageUsedStr string    `json:"storage_used_str"`
+	FileCount      int       `json:"file_count"`
+	StorageQuota   int64     `json:"storage_quota"` // 0 = unlimited
+	QuotaStr       string    `json:"quota_str"`
+	QuotaCustom    bool      `json:"quota_custom"` // Admin override rather than the default
+}
+
+// AdminGroupRequest targets one group with an admin action
+type AdminGroupRequest struct {
+	GroupID int64  `json:"group_id"`
+	Quota   *int64 `json:"quota"` // Bytes (0 = unlimited); null restores the default
+}
+
 // UserInfoResponse represents user info for the settings modal
 type UserInfoResponse struct {
 	Username    string `json:"username"`
 	Email       string `json:"email"`
 	Phone       string `json:"phone"`
 	PhoneRegion string `json:"phone_region"`
+
+	EmailVerified bool `json:"email_verified"`
 }
 
 // FileTypeStats represents storage statistics for a file type
@@ -69,6 +199,15 @@ type StorageStats struct {
 	TotalSize    int64
 	TotalSizeStr string
 	FileTypes    []FileTypeStats
+
+	Quota        int64 // Bytes allowed (0 = unlimited)
+	QuotaStr     string
+	QuotaPercent float64 // Share of the quota in use, capped at 100
+	RemainingStr string
+
+	TrashSize    int64 // Bytes held by deleted items (included in TotalSize)
+	TrashSizeStr string
+	TrashCount   int
 }
 
 // RecentFile represents a recently uploaded file
@@ -82,6 +221,172 @@ type RecentFile struct {
 	IsImage    bool
 }
 
+// UploadResult reports what happened to one file of an upload batch
+type UploadResult struct {
+	Name    string `json:"name"`           // Path as sent by the client
+	Path    string `json:"path,omitempty"` // Where it was stored
+	Status  string `json:"status"`         // "uploaded", "conflict" or "error"
+	Message string `json:"message,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+// UploadBatchResponse is the JSON reply to a multi-file upload
+type UploadBatchResponse struct {
+	Success  bool           `json:"success"`
+	Uploaded int            `json:"uploaded"`
+	Failed   int            `json:"failed"`
+	Results  []UploadResult `json:"results"`
+}
+
+// TransferResult reports what happened to one item of a move or copy
+type TransferResult struct {
+	Name    string `json:"name"`
+	Path    string `json:"path,omitempty"` // Where it ended up
+	Status  string `json:"status"`         // "moved", "copied", "skipped", "conflict" or "error"
+	Message string `json:"message,omitempty"`
+}
+
+// TransferBatchResponse is the JSON reply to a move or copy
+type TransferBatchResponse struct {
+	Success bool             `json:"success"`
+	Done    int              `json:"done"`
+	Skipped int              `json:"skipped"`
+	Failed  int              `json:"failed"`
+	Results []TransferResult `json:"results"`
+}
+
+// LabelResult is what happened to one item when tagging, starring or
+// color labeling several
+type LabelResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"` // "done" or "error"
+	Message string `json:"message,omitempty"`
+}
+
+// LabelBatchResponse is the JSON reply to tagging, starring or color
+// labeling items
+type LabelBatchResponse struct {
+	Success bool          `json:"success"`
+	Done    int           `json:"done"`
+	Failed  int           `json:"failed"`
+	Results []LabelResult `json:"results"`
+}
+
+// TrashItem is a deleted file or folder waiting in the trash
+type TrashItem struct {
+	ID             int64     `json:"id"`
+	Filename       string    `json:"filename"`
+	OriginalPath   string    `json:"original_path"`   // storage_path it was deleted from
+	OriginalFolder string    `json:"original_folder"` // parent_path it was deleted from
+	IsDirectory    bool      `json:"is_directory"`
+	Size           int64     `json:"size"`       // Total bytes, including a folder's contents
+	ItemCount      int       `json:"item_count"` // Files and folders, including the item itself
+	DeletedAt      time.Time `json:"deleted_at"`
+	ExpiresAt      time.Time `json:"expires_at"` // Zero when the trash is never purged
+
+	SizeStr string `json:"size_str"`
+	Icon    string `json:"-"`
+}
+
+// Share is a public link to a file or folder that works without an account
+type Share struct {
+	ID            int64     `json:"id"`
+	Token         string    `json:"token"`
+	Owner         string    `json:"owner"`
+	FileID        int64     `json:"file_id"`
+	Filename      string    `json:"filename"`
+	StoragePath   string    `json:"path"` // Where the item is now; links follow moves and renames
+	IsDirectory   bool      `json:"is_directory"`
+	HasPassword   bool      `json:"has_password"`
+	PasswordHash  string    `json:"-"`
+	ExpiresAt     time.Time `json:"expires_at"`    // Zero when the link never expires
+	MaxDownloads  int       `json:"max_downloads"` // 0 = unlimited
+	DownloadCount int       `json:"download_count"`
+	AllowUpload   bool      `json:"allow_upload"` // Visitors may add files to a shared folder
+	CreatedAt     time.Time `json:"created_at"`
+
+	URL    string `json:"url"`
+	Status string `json:"status"` // "active", "expired" or "used up"
+}
+
+// UserShare gives another registered user access to a file or folder. The
+// owner's path is left out when it is sent to the recipient.
+type UserShare struct {
+	ID          int64     `json:"id"`
+	Owner       string    `json:"owner"`
+	Recipient   string    `json:"recipient"`
+	FileID      int64     `json:"file_id"`
+	Filename    string    `json:"filename"`
+	StoragePath string    `json:"path,omitempty"`
+	IsDirectory bool      `json:"is_directory"`
+	Role        string    `json:"role"` // "viewer" or "editor"
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Group is a team with a storage space of its own, as seen by one of its
+// members
+type Group struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Account     string    `json:"-"`              // Hidden account that owns the group's files
+	Role        string    `json:"role,omitempty"` // The viewing member's role
+	MemberCount int       `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// GroupMember is one member of a group
+type GroupMember struct {
+	Username string    `json:"username"`
+	Role     string    `json:"role"` // "owner", "admin" or "member"
+	AddedAt  time.Time `json:"added_at"`
+}
+
+// FileVersion is one version of a file, either the current content or an
+// earlier one kept in its history
+type FileVersion struct {
+	Version    int       `json:"version"`
+	Size       int64     `json:"size"`
+	Hash       string    `json:"hash"`
+	MimeType   string    `json:"mime_type"`
+	UploadedBy string    `json:"uploaded_by"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	ReplacedAt time.Time `json:"replaced_at"` // Zero for the current version
+	Current    bool      `json:"current"`
+
+	SizeStr string `json:"size_str"`
+}
+
+// VersionPolicyRequest changes how much history a user keeps
+type VersionPolicyRequest struct {
+	MaxVersions *int   `json:"max_versions"` // Per file (0 = unlimited); null restores the default
+	MaxSpace    *int64 `json:"max_space"`    // Bytes (0 = unlimited); null restores the default
+}
+
+// VersionPolicyResponse reports a user's history limits and usage
+type VersionPolicyResponse struct {
+	MaxVersions        int    `json:"max_versions"`
+	MaxSpace           int64  `json:"max_space"`
+	CustomVersions     bool   `json:"custom_versions"` // User setting rather than the default
+	CustomSpace        bool   `json:"custom_space"`
+	DefaultMaxVersions int    `json:"default_max_versions"`
+	DefaultMaxSpace    int64  `json:"default_max_space"`
+	UsedSpace          int64  `json:"used_space"`
+	UsedSpaceStr       string `json:"used_space_str"`
+}
+
+// UploadSession is a resumable upload that has not been completed yet
+type UploadSession struct {
+	ID         string
+	Username   string
+	Filename   string
+	ParentPath string
+	MimeType   string
+	Length     int64 // Total size declared when the upload was created
+	Offset     int64 // Bytes received so far
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
 // FileMetadata represents file metadata stored in database
 type FileMetadata struct {
 	ID          int64     `json:"id"`
@@ -96,3 +401,50 @@ type FileMetadata struct {
 	UploadedAt  time.Time `json:"uploaded_at"`
 	ModifiedAt  time.Time `json:"modified_at"`
 }
+
+// SearchResult is a file or folder found by a search
+type SearchResult struct {
+	ID          int64     `json:"id"`
+	Filename    string    `json:"filename"`
+	Folder      string    `json:"folder"` // Folder parameter of where it is, in the searched space
+	StoragePath string    `json:"-"`
+	ParentPath  string    `json:"-"`
+	FileSize    int64     `json:"file_size"`
+	FileSizeStr string    `json:"file_size_str,omitempty"`
+	MimeType    string    `json:"mime_type,omitempty"`
+	IsDirectory bool      `json:"is_directory"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	ModifiedAt  time.Time `json:"modified_at"`
+	Highlight   string    `json:"highlight"`         // Filename as HTML, matches in <mark>
+	Snippet     string    `json:"snippet,omitempty"` // Best matching passage as HTML, matches in <mark>
+}
+
+// SavedSearch is a search a user kept under a name
+type SavedSearch struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"` // URL parameters of /search and /api/search
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FileLabels are the tags, color label and star of a file or folder
+type FileLabels struct {
+	Tags       []string `json:"tags"`
+	ColorLabel string   `json:"color_label"` // "" when unlabeled
+	Starred    bool     `json:"starred"`     // By the user asking
+}
+
+// Tag is a tag in use in a user's or group's files
+type Tag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"` // Files and folders carrying it, trash excluded
+}
+
+// StarredFile is a file or folder a user starred, in their own files or
+// anyone else's they can open
+type StarredFile struct {
+	FileMetadata
+	Tags       []string  `json:"tags"`
+	ColorLabel string    `json:"color_label"`
+	StarredAt  time.Time `json:"starred_at"`
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+var (
+	// ErrLastAdmin is returned when an action would leave no active admin
+	ErrLastAdmin = errors.New("at least one active admin account is required")
+	// ErrUserNotFound is returned when an admin action targets a missing user
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// CountActiveAdmins returns how many enabled admin accounts exist
+func CountActiveAdmins() (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM users WHERE is_admin = 1 AND disabled = 0`).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count admins: %w", err)
+	}
+	return count, nil
+}
+
+// EnsureAdminExists promotes the oldest account when there is no active
+// admin, so a fresh or upgraded install always has someone to manage it.
+// Returns the promoted username, or "" if nothing changed.
+func EnsureAdminExists() (string, error) {
+	count, err := CountActiveAdmins()
+	if err != nil || count > 0 {
+		return "", err
+	}
+
+	var username string
+	err = db.QueryRow(`SELECT username FROM users WHERE disabled = 0 AND COALESCE(login_type, '') != ?
+		ORDER BY created_at, id LIMIT 1`, LoginTypeGroup).Scan(&username)
+	if err != nil {
+		// No users yet: the first registration is promoted instead
+		return "", nil
+	}
+
+	if _, err := db.Exec(`UPDATE users SET is_admin = 1 WHERE username = ?`, username); err != nil {
+		return "", fmt.Errorf("failed to promote admin: %w", err)
+	}
+	return username, nil
+}
+
+// adminUserColumns appends the quota, storage usage and session counts to
+// userColumns
+var adminUserColumns = userColumns + `, storage_quota,
+	(SELECT COALESCE(SUM(f.file_size), 0) FROM files f WHERE f.username = users.username AND f.is_directory = 0)
+		+ (SELECT COALESCE(SUM(t.total_size), 0) FROM trash t WHERE t.username = users.username)
+		+ ` + versionUsageSQL("users.username") + `,
+	(SELECT COUNT(*) FROM files f WHERE f.username = users.username AND f.is_directory = 0),
+	(SELECT COUNT(*) FROM sessions s WHERE s.username = users.username AND s.expires_at > ?)`
+
+// ListUsersAdmin returns a page of users matching a search over username,
+// email and phone, with their storage use. Group accounts are listed with
+// their groups instead.
+func ListUsersAdmin(search string, limit, offset int) ([]models.AdminUserInfo, int, error) {
+	where := ` WHERE COALESCE(login_type, '') != ?`
+	args := []interface{}{LoginTypeGroup}
+	if search = strings.TrimSpace(search); search != "" {
+		pattern := "%" + search + "%"
+		where += ` AND (username LIKE ? OR email LIKE ? OR phone LIKE ?)`
+		args = append(args, pattern, pattern, pattern)
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM users`+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	query := `SELECT ` + adminUserColumns + ` FROM users` + where + ` ORDER BY created_at, id LIMIT ? OFFSET ?`
+	queryArgs := append([]interface{}{time.Now().UTC()}, args...)
+	queryArgs = append(queryArgs, limit, offset)
+
+	rows, err := db.Query(query, queryArgs...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []models.AdminUserInfo{}
+	for rows.Next() {
+		var info models.AdminUserInfo
+		var quota sql.NullInt64
+		user, err := scanUser(rows, &quota, &info.StorageUsed, &info.FileCount, &info.ActiveSessions)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan user: %w", err)
+		}
+		info.Username = user.Username
+		info.Email = user.Email
+		info.Phone = user.Phone
+		info.PhoneRegion = user.PhoneRegion
+		info.CreatedAt = user.CreatedAt
+		info.LoginType = user.LoginType
+		info.IsAdmin = user.IsAdmin
+		info.Disabled = user.Disabled
+		info.EmailVerified = user.EmailVerified
+		info.TOTPEnabled = user.TOTPEnabled
+		info.StorageQuota = config.DefaultStorageQuota
+		if quota.Valid {
+			info.StorageQuota = quota.Int64
+			info.QuotaCustom = true
+		}
+		users = append(users, info)
+	}
+
+	return users, total, nil
+}
+
+// requireOtherActiveAdmin fails if user is the only active admin left
+func requireOtherActiveAdmin(user *models.User) error {
+	if !user.IsAdmin || user.Disabled {
+		return nil
+	}
+	count, err := CountActiveAdmins()
+	if err != nil {
+		return err
+	}
+	if count <= 1 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// getUserForAdmin loads the target of an admin action. Group accounts are
+// managed through their groups.
+func getUserForAdmin(username string) (*models.User, error) {
+	user, err := GetUserByUsernameDB(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.LoginType == LoginTypeGroup {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// SetUserDisabled enables or disables an account. Disabling signs the user
+// out everywhere immediately.
+func SetUserDisabled(username string, disabled bool) error {
+	user, err := getUserForAdmin(username)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		if err := requireOtherActiveAdmin(user); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(`UPDATE users SET disabled = ? WHERE username = ?`, disabled, username); err != nil {
+		return fmt.Errorf("failed to update account: %w", err)
+	}
+
+	if disabled {
+		if _, err := DeleteUserSessions(username, ""); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return nil
+}
+
+// SetUserAdmin grants or revokes the admin role
+func SetUserAdmin(username string, isAdmin bool) error {
+	user, err := getUserForAdmin(username)
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		if err := requireOtherActiveAdmin(user); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(`UPDATE users SET is_admin = ? WHERE username = ?`, isAdmin, username); err != nil {
+		return fmt.Errorf("failed to update role: %w", err)
+	}
+	return nil
+}
+
+// AdminSetPassword replaces a user's password without the admin ever
+// acting as that user, and signs them out everywhere
+func AdminSetPassword(username, newPassword string) error {
+	if _, err := getUserForAdmin(username); err != nil {
+		return err
+	}
+	if err := SetUserPassword(username, newPassword); err != nil {
+		return err
+	}
+	if _, err := DeleteUserSessions(username, ""); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	RecordLoginSuccess(UserThrottleKey(username))
+	return nil
+}
+
+// DeleteUserAccount removes a user, every row that references them and
+// their storage folder
+func DeleteUserAccount(username string) error {
+	user, err := getUserForAdmin(username)
+	if err != nil {
+		return err
+	}
+	if err := requireOtherActiveAdmin(user); err != nil {
+		return err
+	}
+
+	// Groups the user owns alone pass to another member first
+	if err := releaseUserGroups(username); err != nil {
+		return err
+	}
+
+	// Keep uploads and other writes out while the account disappears
+	LockUserFileWrite(username)
+	defer UnlockUserFileWrite(username)
+
+	// Files, trash, versions, sessions, tokens and group memberships are
+	// removed by ON DELETE CASCADE; content no other account shares is
+	// then left for the blob collector
+	if _, err := db.Exec(`DELETE FROM users WHERE username = ?`, username); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	InvalidateUserCache(username)
+
+	storagePath := GetUserStoragePath(username, user.UniqueCode)
+	if err := os.RemoveAll(storagePath); err != nil {
+		// The account is already gone; leftover files are only wasted space
+		log.Printf("Warning: failed to remove storage for deleted user %s: %v", username, err)
+	}
+	return nil
+}
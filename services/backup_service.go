@@ -299,9 +299,15 @@ func (bs *BackupScheduler) createCompressedBackup(backupName string) (string, er
 	zipWriter := zip.NewWriter(zipFile)
 	defer zipWriter.Close()
 
-	// Backup database
+	// Backup database from a snapshot, which includes the write-ahead log
 	if bs.settings.BackupDatabase {
-		if err := bs.addFileToZip(zipWriter, "./haya-disk.db", "haya-disk.db"); err != nil {
+		snapshot := filepath.Join(bs.settings.BackupDir, backupName+".db")
+		if err := SnapshotDatabase(snapshot); err != nil {
+			return "", fmt.Errorf("failed to backup database: %w", err)
+		}
+		err := bs.addFileToZip(zipWriter, snapshot, "haya-disk.db")
+		os.Remove(snapshot)
+		if err != nil {
 			return "", fmt.Errorf("failed to backup database: %w", err)
 		}
 		log.Println("  - Database backed up")
@@ -329,9 +335,8 @@ func (bs *BackupScheduler) createDirectoryBackup(backupName string) (string, err
 
 	// Backup database
 	if bs.settings.BackupDatabase {
-		srcDB := "./haya-disk.db"
 		dstDB := filepath.Join(backupPath, "haya-disk.db")
-		if err := copyFile(srcDB, dstDB); err != nil {
+		if err := SnapshotDatabase(dstDB); err != nil {
 			return "", fmt.Errorf("failed to backup database: %w", err)
 		}
 		log.Println("  - Database backed up")
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MigrateToBlobStore moves the contents of the user folders, where older
+// versions kept them, into the blob store. Files and folders on disk with
+// no metadata row are registered, so nothing is lost. Reference counts are
+// then recomputed. Safe to run on every start: once converted there is
+// nothing left to move. Returns how many files were moved.
+func MigrateToBlobStore() (int, error) {
+	users, err := GetAllUsersDB()
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, user := range users {
+		n, err := migrateUserFolder(user.Username, GetUserStoragePath(user.Username, user.UniqueCode))
+		moved += n
+		if err != nil {
+			log.Printf("Warning: blob store migration for %s: %v", user.Username, err)
+		}
+	}
+
+	if err := RecountBlobReferences(); err != nil {
+		return moved, err
+	}
+	return moved, nil
+}
+
+// migrateUserFolder moves the files in a user's folder into the blob store,
+// recording their actual hash and size, and removes the emptied folders.
+// The folder itself stays as the user's storage root.
+func migrateUserFolder(username, userStoragePath string) (int, error) {
+	if _, err := os.Stat(userStoragePath); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	moved := 0
+	var dirs []string
+	err := filepath.WalkDir(userStoragePath, func(path string, d os.DirEntry, err error) error {
+		if err != nil || path == userStoragePath {
+			return nil
+		}
+		relativePath, err := filepath.Rel(userStoragePath, path)
+		if err != nil {
+			return nil
+		}
+		parentPath := filepath.ToSlash(filepath.Dir(relativePath))
+		if parentPath == "." {
+			parentPath = "/"
+		}
+
+		existing, err := GetFileByPath(username, relativePath)
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			dirs = append(dirs, path)
+			if existing == nil {
+				return AddFileMetadata(username, d.Name(), relativePath, parentPath, "", "", 0, true)
+			}
+			if !existing.IsDirectory {
+				log.Printf("Warning: %s of %s is a folder on disk but a file in the database; left in place", relativePath, username)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if existing != nil && existing.IsDirectory {
+			log.Printf("Warning: %s of %s is a file on disk but a folder in the database; left in place", relativePath, username)
+			return nil
+		}
+
+		hash, size, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+
+		// Metadata first: if the move fails, the file is still on disk and
+		// the next start tries again
+		switch {
+		case existing == nil:
+			mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(d.Name())))
+			if mimeType == "" {
+				mimeType = "application/octet-stream"
+			}
+			err = AddFileMetadata(username, d.Name(), relativePath, parentPath, mimeType, hash, size, false)
+		case existing.FileHash != hash || existing.FileSize != size:
+			_, err = db.Exec(`UPDATE files SET file_hash = ?, file_size = ? WHERE id = ?`, hash, size, existing.ID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := PutBlob(path, hash, size); err != nil {
+			return err
+		}
+		moved++
+		return nil
+	})
+
+	// Deepest first; folders still holding something are left alone
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+	return moved, err
+}
@@ -0,0 +1,284 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// File contents live in a content-addressed blob store: one file per
+// distinct SHA-256 under config.BlobDir, however many files, versions and
+// trash entries of however many users have those bytes. Folders and file
+// names exist only as metadata rows, so copies, moves, renames, trashing
+// and restoring never touch the disk.
+//
+// The blobs table counts the rows pointing at each blob. Triggers on every
+// table with a file_hash column keep ref_count in step, so no code path can
+// forget to, and ON DELETE CASCADE deletes (trash items, accounts) count
+// too. A blob whose count drops to zero is left for CollectGarbage.
+
+// blobMu serializes writes to the blob store with the garbage collector, so
+// a blob being stored is never removed under it
+var blobMu sync.Mutex
+
+// blobRefTables are the tables whose rows refer to stored content
+var blobRefTables = []string{"files", "file_versions", "trash_files", "trash_versions"}
+
+// blobTriggersSQL returns the triggers that count a table's references.
+// Folders have no hash and hold no reference. Times are Unix seconds,
+// which triggers can produce without help from Go.
+func blobTriggersSQL(table string) string {
+	release := `UPDATE blobs SET ref_count = ref_count - 1,
+			released_at = CASE WHEN ref_count <= 1 THEN unixepoch() ELSE released_at END
+			WHERE hash = OLD.file_hash;`
+	acquire := `INSERT OR IGNORE INTO blobs (hash, size, created_at) VALUES (NEW.file_hash, NEW.file_size, unixepoch());
+			UPDATE blobs SET ref_count = ref_count + 1, released_at = NULL WHERE hash = NEW.file_hash;`
+
+	return `
+	CREATE TRIGGER IF NOT EXISTS ` + table + `_blob_insert AFTER INSERT ON ` + table + `
+	WHEN COALESCE(NEW.file_hash, '') != '' BEGIN
+		` + acquire + `
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS ` + table + `_blob_delete AFTER DELETE ON ` + table + `
+	WHEN COALESCE(OLD.file_hash, '') != '' BEGIN
+		` + release + `
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS ` + table + `_blob_update_new AFTER UPDATE OF file_hash ON ` + table + `
+	WHEN COALESCE(NEW.file_hash, '') != '' AND NEW.file_hash IS NOT OLD.file_hash BEGIN
+		` + acquire + `
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS ` + table + `_blob_update_old AFTER UPDATE OF file_hash ON ` + table + `
+	WHEN COALESCE(OLD.file_hash, '') != '' AND NEW.file_hash IS NOT OLD.file_hash BEGIN
+		` + release + `
+	END;`
+}
+
+// createBlobTriggers installs the reference-counting triggers
+func createBlobTriggers() error {
+	for _, table := range blobRefTables {
+		if _, err := db.Exec(blobTriggersSQL(table)); err != nil {
+			return fmt.Errorf("failed to create blob triggers on %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// isBlobHash reports whether hash is a hex SHA-256, and so safe to use as
+// a file name
+func isBlobHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// BlobPath returns where the content with the given SHA-256 is kept
+func BlobPath(hash string) string {
+	return filepath.Join(config.BlobDir, hash[:2], hash[2:4], hash)
+}
+
+// OpenBlob opens stored content for reading
+func OpenBlob(hash string) (*os.File, error) {
+	if !isBlobHash(hash) {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(BlobPath(hash))
+}
+
+// hashFile returns the SHA-256 and size of a file's content
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// PutBlob moves a fully written file into the blob store under its SHA-256.
+// If the same content is already stored the file is simply removed. The
+// blob counts as just released, so the collector leaves it alone for
+// config.BlobGCGrace while the caller commits the row that refers to it.
+func PutBlob(tempPath, hash string, size int64) error {
+	if !isBlobHash(hash) {
+		return fmt.Errorf("invalid content hash %q", hash)
+	}
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	blobPath := BlobPath(hash)
+	if _, err := os.Stat(blobPath); err == nil {
+		os.Remove(tempPath)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(blobPath), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Rename(tempPath, blobPath); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec(`INSERT INTO blobs (hash, size, ref_count, created_at, released_at) VALUES (?, ?, 0, ?, ?)
+		ON CONFLICT(hash) DO UPDATE SET size = excluded.size,
+			released_at = CASE WHEN ref_count <= 0 THEN excluded.released_at ELSE released_at END`,
+		hash, size, time.Now().Unix(), time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record blob: %w", err)
+	}
+	return nil
+}
+
+// RecountBlobReferences recomputes every blob's reference count from the
+// tables that refer to it, repairing counts from before the triggers
+// existed
+func RecountBlobReferences() error {
+	query := `SELECT file_hash, COUNT(*), MAX(file_size) FROM (
+		SELECT file_hash, file_size FROM files
+		UNION ALL SELECT file_hash, file_size FROM file_versions
+		UNION ALL SELECT file_hash, file_size FROM trash_files
+		UNION ALL SELECT file_hash, file_size FROM trash_versions
+	) WHERE COALESCE(file_hash, '') != '' GROUP BY file_hash`
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	type blobRefs struct {
+		hash  string
+		count int
+		size  int64
+	}
+	var refs []blobRefs
+	rows, err := tx.Query(query)
+	if err != nil {
+		return fmt.Errorf("failed to count blob references: %w", err)
+	}
+	for rows.Next() {
+		var r blobRefs
+		if err := rows.Scan(&r.hash, &r.count, &r.size); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan blob references: %w", err)
+		}
+		refs = append(refs, r)
+	}
+	rows.Close()
+
+	now := time.Now().Unix()
+	if _, err := tx.Exec(`UPDATE blobs SET ref_count = 0`); err != nil {
+		return fmt.Errorf("failed to reset blob references: %w", err)
+	}
+	for _, r := range refs {
+		_, err := tx.Exec(`INSERT INTO blobs (hash, size, ref_count, created_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(hash) DO UPDATE SET ref_count = excluded.ref_count, released_at = NULL`,
+			r.hash, r.size, r.count, now)
+		if err != nil {
+			return fmt.Errorf("failed to update blob references: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`UPDATE blobs SET released_at = ? WHERE ref_count = 0 AND released_at IS NULL`, now); err != nil {
+		return fmt.Errorf("failed to release unused blobs: %w", err)
+	}
+	return tx.Commit()
+}
+
+// CollectGarbage removes blobs nothing has referred to for
+// config.BlobGCGrace, and files in the store with no blobs row at all.
+// Returns how many blobs were removed and the bytes freed.
+func CollectGarbage() (int, int64, error) {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	cutoff := time.Now().Add(-config.BlobGCGrace)
+	rows, err := db.Query(`SELECT hash FROM blobs WHERE ref_count <= 0 AND released_at < ?`, cutoff.Unix())
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to find unused blobs: %w", err)
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if rows.Scan(&hash) == nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	rows.Close()
+
+	removed := 0
+	var freed int64
+	for _, hash := range hashes {
+		// Re-checked in the delete, in case a reference appeared meanwhile
+		result, err := db.Exec(`DELETE FROM blobs WHERE hash = ? AND ref_count <= 0`, hash)
+		if err != nil {
+			return removed, freed, fmt.Errorf("failed to delete blob: %w", err)
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 || !isBlobHash(hash) {
+			continue
+		}
+		path := BlobPath(hash)
+		if info, err := os.Stat(path); err == nil {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Warning: failed to remove blob %s: %v", hash, err)
+				continue
+			}
+			freed += info.Size()
+			removed++
+		}
+	}
+
+	// Files the table has no row for, e.g. left by a crash between storing
+	// content and recording it
+	filepath.WalkDir(config.BlobDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		var known int
+		if db.QueryRow(`SELECT COUNT(*) FROM blobs WHERE hash = ?`, d.Name()).Scan(&known) == nil && known == 0 {
+			if os.Remove(path) == nil {
+				freed += info.Size()
+				removed++
+			}
+		}
+		return nil
+	})
+
+	return removed, freed, nil
+}
+
+// InitBlobCollector creates the background task that reclaims unreferenced
+// blobs
+func InitBlobCollector() *PeriodicTask {
+	return NewPeriodicTask("Blob collector", config.BlobGCInterval, func() error {
+		removed, freed, err := CollectGarbage()
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			log.Printf("Collected %d unreferenced blobs (%d bytes)", removed, freed)
+		}
+		return nil
+	})
+}
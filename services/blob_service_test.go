@@ -0,0 +1,254 @@
+package services
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// storeTestBlob puts content into the blob store as an upload would and
+// returns its hash
+func storeTestBlob(t *testing.T, content string) string {
+	t.Helper()
+	f, err := os.CreateTemp(".", "upload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+
+	hash, size, err := hashFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutBlob(f.Name(), hash, size); err != nil {
+		t.Fatalf("PutBlob: %v", err)
+	}
+	return hash
+}
+
+// uploadTestFile stores content and records it as a new file
+func uploadTestFile(t *testing.T, username, storagePath, content string) string {
+	t.Helper()
+	hash := storeTestBlob(t, content)
+	err := AddFileMetadata(username, filepath.Base(storagePath), storagePath, normalizeParentPath(filepath.Dir(storagePath)),
+		"text/plain", hash, int64(len(content)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// blobRefCount returns a blob's reference count, or -1 if it has no row
+func blobRefCount(t *testing.T, hash string) int {
+	t.Helper()
+	var count int
+	err := db.QueryRow(`SELECT ref_count FROM blobs WHERE hash = ?`, hash).Scan(&count)
+	if err == sql.ErrNoRows {
+		return -1
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// trashID returns the ID of the trash item for a path
+func trashID(t *testing.T, username, originalPath string) int64 {
+	t.Helper()
+	var id int64
+	err := db.QueryRow(`SELECT id FROM trash WHERE username = ? AND original_path = ?`, username, originalPath).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestBlobRefCount(t *testing.T) {
+	const user = "blob-refs"
+	userStoragePath := createTestUser(t, user, "x")
+	if err := AddFileMetadata(user, "Docs", "Docs", "/", "", "", 0, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unique contents, so other tests cannot change the counts
+	v1 := "blob-refs version 1"
+	v2 := "blob-refs version 2"
+	other := "blob-refs other"
+	var h1, h2, hOther string
+
+	// Each step runs against the state left by the previous ones
+	steps := []struct {
+		name string
+		run  func() error
+		want map[*string]int
+	}{
+		{"upload", func() error {
+			h1 = uploadTestFile(t, user, "a.txt", v1)
+			return nil
+		}, map[*string]int{&h1: 1}},
+		{"upload of the same content", func() error {
+			uploadTestFile(t, user, filepath.Join("Docs", "b.txt"), v1)
+			return nil
+		}, map[*string]int{&h1: 2}},
+		{"copy", func() error {
+			_, err := TransferFile(user, userStoragePath, "a.txt", "Docs", true, ConflictFail)
+			return err
+		}, map[*string]int{&h1: 3}},
+		{"move", func() error {
+			_, err := TransferFile(user, userStoragePath, filepath.Join("Docs", "a.txt"), "/", false, ConflictRename)
+			return err
+		}, map[*string]int{&h1: 3}},
+		{"new version", func() error {
+			h2 = storeTestBlob(t, v2)
+			return AddFileVersion(user, userStoragePath, "a.txt", NewFileVersion{Size: int64(len(v2)), Hash: h2, MimeType: "text/plain", UploadedBy: user})
+		}, map[*string]int{&h1: 3, &h2: 1}},
+		{"restore version", func() error {
+			return RestoreFileVersion(user, userStoragePath, "a.txt", 1, user)
+		}, map[*string]int{&h1: 4, &h2: 1}},
+		{"other file", func() error {
+			hOther = uploadTestFile(t, user, filepath.Join("Docs", "c.txt"), other)
+			return nil
+		}, map[*string]int{&h1: 4, &hOther: 1}},
+		{"trash file with versions", func() error {
+			_, err := MoveToTrash(user, userStoragePath, "a.txt")
+			return err
+		}, map[*string]int{&h1: 4, &h2: 1}},
+		{"restore from trash", func() error {
+			_, err := RestoreFromTrash(user, userStoragePath, trashID(t, user, "a.txt"))
+			return err
+		}, map[*string]int{&h1: 4, &h2: 1}},
+		{"trash again", func() error {
+			_, err := MoveToTrash(user, userStoragePath, "a.txt")
+			return err
+		}, map[*string]int{&h1: 4, &h2: 1}},
+		{"purge file with versions", func() error {
+			return DeleteFromTrash(user, trashID(t, user, "a.txt"))
+		}, map[*string]int{&h1: 2, &h2: 0}},
+		{"trash folder", func() error {
+			_, err := MoveToTrash(user, userStoragePath, "Docs")
+			return err
+		}, map[*string]int{&h1: 2, &hOther: 1}},
+		{"empty trash", func() error {
+			_, err := EmptyTrash(user)
+			return err
+		}, map[*string]int{&h1: 1, &h2: 0, &hOther: 0}},
+	}
+
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		for hash, want := range step.want {
+			if got := blobRefCount(t, *hash); got != want {
+				t.Errorf("%s: ref_count of %.8s = %d, want %d", step.name, *hash, got, want)
+			}
+		}
+	}
+}
+
+func TestBlobRefCountAccountDeletion(t *testing.T) {
+	createTestUser(t, "blob-account", "x")
+	hash := uploadTestFile(t, "blob-account", "file.txt", "blob-account content")
+	if got := blobRefCount(t, hash); got != 1 {
+		t.Fatalf("ref_count after upload = %d, want 1", got)
+	}
+
+	// The files rows go by ON DELETE CASCADE, which fires the triggers too
+	if _, err := db.Exec(`DELETE FROM users WHERE username = ?`, "blob-account"); err != nil {
+		t.Fatal(err)
+	}
+	if got := blobRefCount(t, hash); got != 0 {
+		t.Errorf("ref_count after deleting the account = %d, want 0", got)
+	}
+}
+
+func TestRecountBlobReferences(t *testing.T) {
+	createTestUser(t, "blob-recount", "x")
+	shared := uploadTestFile(t, "blob-recount", "a.txt", "blob-recount shared")
+	uploadTestFile(t, "blob-recount", "b.txt", "blob-recount shared")
+	unused := storeTestBlob(t, "blob-recount unused")
+
+	// Counts from before the triggers existed could be anything
+	if _, err := db.Exec(`UPDATE blobs SET ref_count = 7 WHERE hash IN (?, ?)`, shared, unused); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecountBlobReferences(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hash string
+		want int
+	}{
+		{shared, 2},
+		{unused, 0},
+	}
+	for _, tt := range tests {
+		if got := blobRefCount(t, tt.hash); got != tt.want {
+			t.Errorf("ref_count of %.8s after recount = %d, want %d", tt.hash, got, tt.want)
+		}
+	}
+}
+
+// backdateBlob makes a blob look released, and stored, before the grace
+// period
+func backdateBlob(t *testing.T, hash string) {
+	t.Helper()
+	old := time.Now().Add(-2 * config.BlobGCGrace)
+	if _, err := db.Exec(`UPDATE blobs SET released_at = ? WHERE hash = ?`, old.Unix(), hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(BlobPath(hash), old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	createTestUser(t, "blob-gc", "x")
+
+	referenced := uploadTestFile(t, "blob-gc", "kept.txt", "blob-gc referenced")
+	backdateBlob(t, referenced)
+
+	recent := storeTestBlob(t, "blob-gc just stored")
+
+	released := uploadTestFile(t, "blob-gc", "gone.txt", "blob-gc released")
+	if err := DeleteFileMetadata("blob-gc", "gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+	backdateBlob(t, released)
+
+	orphan := storeTestBlob(t, "blob-gc orphan")
+	if _, err := db.Exec(`DELETE FROM blobs WHERE hash = ?`, orphan); err != nil {
+		t.Fatal(err)
+	}
+	backdateBlob(t, orphan)
+
+	if _, _, err := CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+		kept bool
+	}{
+		{"referenced", referenced, true},
+		{"unreferenced within the grace period", recent, true},
+		{"released before the grace period", released, false},
+		{"stored without a row", orphan, false},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(BlobPath(tt.hash))
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s: kept = %v, want %v", tt.name, kept, tt.kept)
+		}
+		if !tt.kept && blobRefCount(t, tt.hash) != -1 {
+			t.Errorf("%s: blobs row left behind", tt.name)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -88,6 +89,25 @@ func UpdateFolderSize(folderPath string, sizeDelta int64) {
 	folderSizeCache[folderPath] += sizeDelta
 }
 
+// RenameFolderSizeCache moves the cached sizes of a renamed or moved folder
+// and its subfolders to their new paths
+func RenameFolderSizeCache(oldPath, newPath string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	prefix := oldPath + string(filepath.Separator)
+	renamed := make(map[string]int64)
+	for key, size := range folderSizeCache {
+		if key == oldPath || strings.HasPrefix(key, prefix) {
+			renamed[newPath+key[len(oldPath):]] = size
+			delete(folderSizeCache, key)
+		}
+	}
+	for key, size := range renamed {
+		folderSizeCache[key] = size
+	}
+}
+
 // RecalculateFolderSize forces recalculation and caching of folder size
 func RecalculateFolderSize(folderPath string, calculateFunc func(string) int64) int64 {
 	size := calculateFunc(folderPath)
@@ -2,8 +2,10 @@ package services
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -16,7 +18,11 @@ var db *sql.DB
 // InitDatabase initializes the SQLite database and creates tables
 func InitDatabase() error {
 	var err error
-	db, err = sql.Open("sqlite", "./haya-disk.db?_pragma=foreign_keys(1)")
+	// Requests, the search indexer and the sweepers all write. In WAL mode
+	// readers don't block the writer, writers wait up to 5 seconds for each
+	// other instead of failing with SQLITE_BUSY, and transactions take the
+	// write lock up front so one that reads first cannot be refused it later.
+	db, err = sql.Open("sqlite", "./haya-disk.db?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
 	if err != nil {
 		return fmt.Errorf("failed to open database: %w", err)
 	}
@@ -37,7 +43,15 @@ func InitDatabase() error {
 		password TEXT NOT NULL,
 		unique_code TEXT NOT NULL UNIQUE,
 		created_at DATETIME NOT NULL,
-		login_type TEXT
+		login_type TEXT,
+		totp_secret TEXT,
+		totp_enabled BOOLEAN NOT NULL DEFAULT 0,
+		totp_recovery_codes TEXT,
+		totp_last_step INTEGER NOT NULL DEFAULT 0,
+		email_verified BOOLEAN NOT NULL DEFAULT 0,
+		is_admin BOOLEAN NOT NULL DEFAULT 0,
+		disabled BOOLEAN NOT NULL DEFAULT 0,
+		storage_quota INTEGER
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_user_email ON users(email);
@@ -48,7 +62,7 @@ func InitDatabase() error {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		username TEXT NOT NULL,
 		filename TEXT NOT NULL,
-		storage_path TEXT NOT NULL UNIQUE,
+		storage_path TEXT NOT NULL,
 		parent_path TEXT NOT NULL DEFAULT '/',
 		file_size INTEGER NOT NULL DEFAULT 0,
 		mime_type TEXT,
@@ -56,13 +70,277 @@ func InitDatabase() error {
 		is_directory BOOLEAN NOT NULL DEFAULT 0,
 		uploaded_at DATETIME NOT NULL,
 		modified_at DATETIME NOT NULL,
-		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE
+		version INTEGER NOT NULL DEFAULT 1,
+		uploaded_by TEXT NOT NULL DEFAULT '',
+		color_label TEXT NOT NULL DEFAULT '',
+		UNIQUE(username, storage_path),
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_file_user ON files(username);
 	CREATE INDEX IF NOT EXISTS idx_file_parent ON files(username, parent_path);
 	CREATE INDEX IF NOT EXISTS idx_file_path ON files(storage_path);
 	CREATE INDEX IF NOT EXISTS idx_file_hash ON files(file_hash);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		username TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		ip_address TEXT,
+		user_agent TEXT,
+		csrf_token TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_session_user ON sessions(username);
+	CREATE INDEX IF NOT EXISTS idx_session_expires ON sessions(expires_at);
+
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure DATETIME NOT NULL,
+		blocked_until DATETIME,
+		PRIMARY KEY (scope, key)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_login_attempts_last ON login_attempts(last_failure);
+
+	CREATE TABLE IF NOT EXISTS user_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		username TEXT NOT NULL,
+		purpose TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_user_tokens_user ON user_tokens(username, purpose);
+	CREATE INDEX IF NOT EXISTS idx_user_tokens_expires ON user_tokens(expires_at);
+
+	CREATE TABLE IF NOT EXISTS sms_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		phone TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		used_at DATETIME,
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sms_codes_user ON sms_codes(username, created_at);
+
+	CREATE TABLE IF NOT EXISTS sms_code_requests (
+		phone TEXT NOT NULL,
+		requested_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sms_code_requests_phone ON sms_code_requests(phone, requested_at);
+
+	CREATE TABLE IF NOT EXISTS uploads (
+		id TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		parent_path TEXT NOT NULL DEFAULT '/',
+		mime_type TEXT NOT NULL DEFAULT '',
+		upload_length INTEGER NOT NULL,
+		upload_offset INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_uploads_user ON uploads(username);
+	CREATE INDEX IF NOT EXISTS idx_uploads_updated ON uploads(updated_at);
+
+	CREATE TABLE IF NOT EXISTS trash (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		original_path TEXT NOT NULL,
+		original_parent TEXT NOT NULL DEFAULT '/',
+		is_directory BOOLEAN NOT NULL DEFAULT 0,
+		total_size INTEGER NOT NULL DEFAULT 0,
+		item_count INTEGER NOT NULL DEFAULT 1,
+		deleted_at DATETIME NOT NULL,
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_trash_user ON trash(username, deleted_at);
+	CREATE INDEX IF NOT EXISTS idx_trash_deleted ON trash(deleted_at);
+
+	CREATE TABLE IF NOT EXISTS trash_files (
+		trash_id INTEGER NOT NULL,
+		filename TEXT NOT NULL,
+		storage_path TEXT NOT NULL,
+		parent_path TEXT NOT NULL DEFAULT '/',
+		file_size INTEGER NOT NULL DEFAULT 0,
+		mime_type TEXT,
+		file_hash TEXT,
+		is_directory BOOLEAN NOT NULL DEFAULT 0,
+		uploaded_at DATETIME NOT NULL,
+		modified_at DATETIME NOT NULL,
+		file_id INTEGER NOT NULL DEFAULT 0,
+		version INTEGER NOT NULL DEFAULT 1,
+		uploaded_by TEXT NOT NULL DEFAULT '',
+		color_label TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (trash_id) REFERENCES trash(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_trash_files_item ON trash_files(trash_id);
+
+	CREATE TABLE IF NOT EXISTS file_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL,
+		username TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		file_size INTEGER NOT NULL DEFAULT 0,
+		mime_type TEXT,
+		file_hash TEXT NOT NULL,
+		uploaded_by TEXT NOT NULL DEFAULT '',
+		uploaded_at DATETIME NOT NULL,
+		replaced_at DATETIME NOT NULL,
+		UNIQUE(file_id, version),
+		FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_file_versions_user ON file_versions(username, replaced_at);
+	CREATE INDEX IF NOT EXISTS idx_file_versions_hash ON file_versions(username, file_hash);
+
+	CREATE TABLE IF NOT EXISTS trash_versions (
+		trash_id INTEGER NOT NULL,
+		file_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		file_size INTEGER NOT NULL DEFAULT 0,
+		mime_type TEXT,
+		file_hash TEXT NOT NULL,
+		uploaded_by TEXT NOT NULL DEFAULT '',
+		uploaded_at DATETIME NOT NULL,
+		replaced_at DATETIME NOT NULL,
+		FOREIGN KEY (trash_id) REFERENCES trash(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_trash_versions_item ON trash_versions(trash_id);
+
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash TEXT PRIMARY KEY,
+		size INTEGER NOT NULL DEFAULT 0,
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		released_at INTEGER
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_blobs_unused ON blobs(ref_count, released_at);
+
+	CREATE TABLE IF NOT EXISTS shares (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token TEXT NOT NULL UNIQUE,
+		username TEXT NOT NULL,
+		file_id INTEGER NOT NULL,
+		password_hash TEXT,
+		expires_at DATETIME,
+		max_downloads INTEGER NOT NULL DEFAULT 0,
+		download_count INTEGER NOT NULL DEFAULT 0,
+		allow_upload BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_shares_user ON shares(username, created_at);
+	CREATE INDEX IF NOT EXISTS idx_shares_file ON shares(file_id);
+
+	CREATE TABLE IF NOT EXISTS user_shares (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL,
+		recipient TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'viewer',
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (recipient) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+		UNIQUE(file_id, recipient)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_user_shares_recipient ON user_shares(recipient, created_at);
+
+	CREATE TABLE IF NOT EXISTS user_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		account TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (account) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS group_members (
+		group_id INTEGER NOT NULL,
+		username TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'member',
+		added_at DATETIME NOT NULL,
+		PRIMARY KEY (group_id, username),
+		FOREIGN KEY (group_id) REFERENCES user_groups(id) ON DELETE CASCADE,
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_group_members_user ON group_members(username);
+
+	CREATE VIRTUAL TABLE IF NOT EXISTS file_search USING fts5(
+		filename,
+		path,
+		tags,
+		content,
+		file_hash UNINDEXED,
+		tokenize = 'unicode61 remove_diacritics 2',
+		prefix = '2 3'
+	);
+
+	CREATE TABLE IF NOT EXISTS search_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL UNIQUE
+	);
+
+	CREATE TABLE IF NOT EXISTS saved_searches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		name TEXT NOT NULL,
+		query TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		UNIQUE(username, name),
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		name TEXT NOT NULL COLLATE NOCASE,
+		UNIQUE(username, name),
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS file_tags (
+		file_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY (file_id, tag_id),
+		FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_file_tags_tag ON file_tags(tag_id);
+
+	CREATE TABLE IF NOT EXISTS file_stars (
+		username TEXT NOT NULL,
+		file_id INTEGER NOT NULL,
+		starred_at DATETIME NOT NULL,
+		PRIMARY KEY (username, file_id),
+		FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_file_stars_file ON file_stars(file_id);
 	`
 
 	_, err = db.Exec(schema)
@@ -75,21 +353,76 @@ func InitDatabase() error {
 		log.Printf("Warning: Migration error (may be safe to ignore): %v", err)
 	}
 
+	// Blob reference counting (after migrations, which may rebuild tables)
+	if err = createBlobTriggers(); err != nil {
+		return err
+	}
+
+	// Full-text search index, kept up to date by triggers on files
+	if err = initSearchIndex(); err != nil {
+		return err
+	}
+
+	// Tags and stars outlive a file only while it is in the trash
+	if err = createLabelTriggers(); err != nil {
+		return err
+	}
+
+	// So do links and shares
+	if err = createShareTriggers(); err != nil {
+		return err
+	}
+
 	log.Println("Database initialized successfully")
 	return nil
 }
 
 // runMigrations handles database schema migrations for existing databases
 func runMigrations() error {
-	// Migration: Add phone_region column if it doesn't exist
-	_, err := db.Exec(`ALTER TABLE users ADD COLUMN phone_region TEXT`)
-	if err != nil {
-		// Ignore error if column already exists
-		if !strings.Contains(err.Error(), "duplicate column") && !strings.Contains(err.Error(), "already exists") {
-			// Log but don't fail - column might already exist
+	migrations := []string{
+		// Add phone_region column if it doesn't exist
+		`ALTER TABLE users ADD COLUMN phone_region TEXT`,
+		// Per-session CSRF token
+		`ALTER TABLE sessions ADD COLUMN csrf_token TEXT NOT NULL DEFAULT ''`,
+		// TOTP two-factor authentication
+		`ALTER TABLE users ADD COLUMN totp_secret TEXT`,
+		`ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN totp_recovery_codes TEXT`,
+		`ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0`,
+		// Email verification
+		`ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT 0`,
+		// Admin role and account disabling
+		`ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT 0`,
+		// Per-user storage quota override (NULL uses the default)
+		`ALTER TABLE users ADD COLUMN storage_quota INTEGER`,
+		// File versioning: current version number and who uploaded it
+		// ('' = the owner), the per-user history policy (NULL uses the
+		// defaults), and what a trashed file needs to get its history back
+		`ALTER TABLE files ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE files ADD COLUMN uploaded_by TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN max_file_versions INTEGER`,
+		`ALTER TABLE users ADD COLUMN max_version_space INTEGER`,
+		`ALTER TABLE trash_files ADD COLUMN file_id INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE trash_files ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE trash_files ADD COLUMN uploaded_by TEXT NOT NULL DEFAULT ''`,
+		// Color labels, kept in the trash like the rest of a file's row
+		`ALTER TABLE files ADD COLUMN color_label TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE trash_files ADD COLUMN color_label TEXT NOT NULL DEFAULT ''`,
+	}
+
+	for _, migration := range migrations {
+		if _, err := db.Exec(migration); err != nil {
+			// Ignore error if column already exists
+			if !strings.Contains(err.Error(), "duplicate column") && !strings.Contains(err.Error(), "already exists") {
+				return fmt.Errorf("migration failed (%s): %w", migration, err)
+			}
 		}
 	}
-	return nil
+	if err := migrateFilesUniqueness(); err != nil {
+		return err
+	}
+	return migrateShareFileKeys()
 }
 
 // GetDB returns the database connection
@@ -105,8 +438,43 @@ func CloseDatabase() error {
 	return nil
 }
 
+// SnapshotDatabase writes a consistent copy of the database to path, which
+// must not exist yet. Copying haya-disk.db itself could miss transactions
+// still in the write-ahead log.
+func SnapshotDatabase(path string) error {
+	if _, err := db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("failed to snapshot database: %w", err)
+	}
+	return nil
+}
+
 // ==================== USER DATABASE OPERATIONS ====================
 
+// userColumns is the column list shared by every user lookup (see scanUser)
+const userColumns = `username, email, phone, COALESCE(phone_region, ''), password, unique_code, created_at, login_type,
+	totp_enabled, COALESCE(totp_secret, ''), email_verified, is_admin, disabled`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads a user row selected with userColumns, followed by any
+// extra columns the query appended
+func scanUser(row rowScanner, extra ...interface{}) (*models.User, error) {
+	var user models.User
+	dest := []interface{}{
+		&user.Username, &user.Email, &user.Phone, &user.PhoneRegion, &user.Password,
+		&user.UniqueCode, &user.CreatedAt, &user.LoginType,
+		&user.TOTPEnabled, &user.TOTPSecret, &user.EmailVerified, &user.IsAdmin, &user.Disabled,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 // CreateUserDB creates a new user in the database
 func CreateUserDB(username, email, phone, phoneRegion, password, uniqueCode string, createdAt time.Time, loginType string) error {
 	query := `INSERT INTO users (username, email, phone, phone_region, password, unique_code, created_at, login_type) 
@@ -121,14 +489,9 @@ func CreateUserDB(username, email, phone, phoneRegion, password, uniqueCode stri
 
 // GetUserByUsernameDB retrieves a user by username
 func GetUserByUsernameDB(username string) (*models.User, error) {
-	query := `SELECT username, email, phone, COALESCE(phone_region, ''), password, unique_code, created_at, login_type 
-			  FROM users WHERE username = ?`
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = ?`
 
-	var user models.User
-	err := db.QueryRow(query, username).Scan(
-		&user.Username, &user.Email, &user.Phone, &user.PhoneRegion, &user.Password,
-		&user.UniqueCode, &user.CreatedAt, &user.LoginType,
-	)
+	user, err := scanUser(db.QueryRow(query, username))
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -137,7 +500,7 @@ func GetUserByUsernameDB(username string) (*models.User, error) {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
-	return &user, nil
+	return user, nil
 }
 
 // GetUserByEmailDB retrieves a user by email
@@ -146,14 +509,9 @@ func GetUserByEmailDB(email string) (*models.User, error) {
 		return nil, nil
 	}
 
-	query := `SELECT username, email, phone, COALESCE(phone_region, ''), password, unique_code, created_at, login_type 
-			  FROM users WHERE email = ?`
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = ?`
 
-	var user models.User
-	err := db.QueryRow(query, email).Scan(
-		&user.Username, &user.Email, &user.Phone, &user.PhoneRegion, &user.Password,
-		&user.UniqueCode, &user.CreatedAt, &user.LoginType,
-	)
+	user, err := scanUser(db.QueryRow(query, email))
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -162,7 +520,7 @@ func GetUserByEmailDB(email string) (*models.User, error) {
 		return nil, fmt.Errorf("failed to get user by email: %w", err)
 	}
 
-	return &user, nil
+	return user, nil
 }
 
 // GetUserByPhoneDB retrieves a user by phone
@@ -171,14 +529,9 @@ func GetUserByPhoneDB(phone string) (*models.User, error) {
 		return nil, nil
 	}
 
-	query := `SELECT username, email, phone, COALESCE(phone_region, ''), password, unique_code, created_at, login_type 
-			  FROM users WHERE phone = ?`
+	query := `SELECT ` + userColumns + ` FROM users WHERE phone = ?`
 
-	var user models.User
-	err := db.QueryRow(query, phone).Scan(
-		&user.Username, &user.Email, &user.Phone, &user.PhoneRegion, &user.Password,
-		&user.UniqueCode, &user.CreatedAt, &user.LoginType,
-	)
+	user, err := scanUser(db.QueryRow(query, phone))
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -187,7 +540,7 @@ func GetUserByPhoneDB(phone string) (*models.User, error) {
 		return nil, fmt.Errorf("failed to get user by phone: %w", err)
 	}
 
-	return &user, nil
+	return user, nil
 }
 
 // GetUserByPhoneAndRegionDB retrieves a user by phone number and region
@@ -196,14 +549,9 @@ func GetUserByPhoneAndRegionDB(phone, phoneRegion string) (*models.User, error)
 		return nil, nil
 	}
 
-	query := `SELECT username, email, phone, COALESCE(phone_region, ''), password, unique_code, created_at, login_type 
-			  FROM users WHERE phone = ? AND phone_region = ?`
+	query := `SELECT ` + userColumns + ` FROM users WHERE phone = ? AND phone_region = ?`
 
-	var user models.User
-	err := db.QueryRow(query, phone, phoneRegion).Scan(
-		&user.Username, &user.Email, &user.Phone, &user.PhoneRegion, &user.Password,
-		&user.UniqueCode, &user.CreatedAt, &user.LoginType,
-	)
+	user, err := scanUser(db.QueryRow(query, phone, phoneRegion))
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -212,7 +560,7 @@ func GetUserByPhoneAndRegionDB(phone, phoneRegion string) (*models.User, error)
 		return nil, fmt.Errorf("failed to get user by phone and region: %w", err)
 	}
 
-	return &user, nil
+	return user, nil
 }
 
 // EmailExistsDB checks if an email already exists in the database
@@ -265,7 +613,7 @@ func PhoneAndRegionExistsDB(phone, phoneRegion string) (bool, error) {
 
 // GetAllUsersDB retrieves all users from the database
 func GetAllUsersDB() ([]*models.User, error) {
-	query := `SELECT username, email, phone, COALESCE(phone_region, ''), password, unique_code, created_at, login_type FROM users`
+	query := `SELECT ` + userColumns + ` FROM users`
 
 	rows, err := db.Query(query)
 	if err != nil {
@@ -275,20 +623,38 @@ func GetAllUsersDB() ([]*models.User, error) {
 
 	var users []*models.User
 	for rows.Next() {
-		var user models.User
-		err := rows.Scan(
-			&user.Username, &user.Email, &user.Phone, &user.PhoneRegion, &user.Password,
-			&user.UniqueCode, &user.CreatedAt, &user.LoginType,
-		)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan user: %w", err)
 		}
-		users = append(users, &user)
+		users = append(users, user)
 	}
 
 	return users, nil
 }
 
+// UpdateUserPasswordDB replaces the stored password hash for a user
+func UpdateUserPasswordDB(username, passwordHash string) error {
+	query := `UPDATE users SET password = ? WHERE username = ?`
+	_, err := db.Exec(query, passwordHash, username)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	return nil
+}
+
+// SetEmailVerifiedDB marks a user's email as verified, provided it is still
+// the address the verification was sent to
+func SetEmailVerifiedDB(username, email string) (bool, error) {
+	query := `UPDATE users SET email_verified = 1 WHERE username = ? AND email = ?`
+	result, err := db.Exec(query, username, email)
+	if err != nil {
+		return false, fmt.Errorf("failed to verify email: %w", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
 // ==================== FILE DATABASE OPERATIONS ====================
 
 // AddFileMetadata adds a file metadata record to the database
@@ -371,18 +737,82 @@ func DeleteFileMetadataRecursive(username, storagePath string) error {
 	return nil
 }
 
-// RenameFileMetadata updates the filename and storage path when a file is renamed
+var (
+	// ErrFileNotFound is returned when a file or folder has no metadata row
+	ErrFileNotFound = errors.New("file not found")
+	// ErrFileExists is returned when the destination name is already taken
+	ErrFileExists = errors.New("a file or folder with that name already exists")
+)
+
+// RenameFileMetadata renames a file or folder in one transaction. For a
+// folder, the storage and parent paths of everything inside it are
+// rewritten too. Callers hold the write lock.
 func RenameFileMetadata(username, oldPath, newPath, newFilename string) error {
-	query := `UPDATE files SET filename = ?, storage_path = ?, modified_at = ? 
-			  WHERE username = ? AND storage_path = ?`
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var isDir bool
+	err = tx.QueryRow(`SELECT is_directory FROM files WHERE username = ? AND storage_path = ?`, username, oldPath).Scan(&isDir)
+	if err == sql.ErrNoRows {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get file metadata: %w", err)
+	}
 
-	_, err := db.Exec(query, newFilename, newPath, time.Now(), username, oldPath)
+	var taken int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM files WHERE username = ? AND storage_path = ?`, username, newPath).Scan(&taken)
 	if err != nil {
+		return fmt.Errorf("failed to check file existence: %w", err)
+	}
+	if taken > 0 {
+		return ErrFileExists
+	}
+
+	query := `UPDATE files SET filename = ?, storage_path = ?, modified_at = ?
+			  WHERE username = ? AND storage_path = ?`
+	if _, err := tx.Exec(query, newFilename, newPath, time.Now().UTC(), username, oldPath); err != nil {
+		return fmt.Errorf("failed to rename file metadata: %w", err)
+	}
+
+	if isDir {
+		if err := rewriteChildPaths(tx, username, oldPath, newPath); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to rename file metadata: %w", err)
 	}
 	return nil
 }
 
+// rewriteChildPaths moves the rows below folder oldPath to below newPath.
+// storage_path uses the OS separator, parent_path always uses "/".
+func rewriteChildPaths(tx *sql.Tx, username, oldPath, newPath string) error {
+	oldPrefix := oldPath + string(filepath.Separator)
+	newPrefix := newPath + string(filepath.Separator)
+	query := `UPDATE files SET storage_path = ? || substr(storage_path, length(?) + 1)
+			  WHERE username = ? AND substr(storage_path, 1, length(?)) = ?`
+	if _, err := tx.Exec(query, newPrefix, oldPrefix, username, oldPrefix, oldPrefix); err != nil {
+		return fmt.Errorf("failed to rewrite child paths: %w", err)
+	}
+
+	oldParent := filepath.ToSlash(oldPath)
+	newParent := filepath.ToSlash(newPath)
+	query = `UPDATE files SET parent_path = CASE WHEN parent_path = ? THEN ? ELSE ? || substr(parent_path, length(?) + 1) END
+			 WHERE username = ? AND (parent_path = ? OR substr(parent_path, 1, length(?)) = ?)`
+	_, err := tx.Exec(query, oldParent, newParent, newParent+"/", oldParent+"/",
+		username, oldParent, oldParent+"/", oldParent+"/")
+	if err != nil {
+		return fmt.Errorf("failed to rewrite child folders: %w", err)
+	}
+	return nil
+}
+
 // MoveFileMetadata updates the parent path when a file is moved
 func MoveFileMetadata(username, storagePath, newParentPath string) error {
 	query := `UPDATE files SET parent_path = ?, modified_at = ? 
@@ -434,11 +864,14 @@ func GetFileByPath(username, storagePath string) (*models.FileMetadata, error) {
 	return &file, nil
 }
 
-// GetUserStorageStats calculates total storage size and file count for a user
+// GetUserStorageStats calculates total storage size and file count for a
+// user. Items in the trash and earlier file versions still take up space,
+// so they count towards the size but not the file count.
 func GetUserStorageStats(username string) (totalSize int64, fileCount int, err error) {
-	query := `SELECT COALESCE(SUM(file_size), 0), COUNT(*) FROM files WHERE username = ? AND is_directory = 0`
+	query := `SELECT COALESCE(SUM(file_size), 0) + (SELECT COALESCE(SUM(total_size), 0) FROM trash WHERE username = ?) + ` + versionUsageSQL("?") + `, COUNT(*)
+			  FROM files WHERE username = ? AND is_directory = 0`
 
-	err = db.QueryRow(query, username).Scan(&totalSize, &fileCount)
+	err = db.QueryRow(query, username, username, username, username).Scan(&totalSize, &fileCount)
 	if err != nil {
 		return 0, 0, fmt.Errorf("failed to get storage stats: %w", err)
 	}
@@ -446,14 +879,24 @@ func GetUserStorageStats(username string) (totalSize int64, fileCount int, err e
 	return totalSize, fileCount, nil
 }
 
-// SearchUserFiles searches for files by filename pattern
-func SearchUserFiles(username, searchQuery string) ([]models.FileMetadata, error) {
-	query := `SELECT id, username, filename, storage_path, parent_path, file_size, mime_type, file_hash, is_directory, uploaded_at, modified_at 
-			  FROM files WHERE username = ? AND filename LIKE ? ORDER BY is_directory DESC, filename ASC`
-
-	rows, err := db.Query(query, username, "%"+searchQuery+"%")
+// GetFileSubtree returns the file or folder at storagePath and everything
+// below it, ordered so each folder comes before its contents. An empty
+// storagePath returns all of the user's files.
+func GetFileSubtree(username, storagePath string) ([]models.FileMetadata, error) {
+	query := `SELECT id, username, filename, storage_path, parent_path, file_size, mime_type, file_hash, is_directory, uploaded_at, modified_at
+			  FROM files WHERE username = ?`
+	args := []interface{}{username}
+	if storagePath != "" {
+		// substr rather than LIKE so "_" and "%" in names match literally
+		query += ` AND (storage_path = ? OR substr(storage_path, 1, length(?)) = ?)`
+		prefix := storagePath + string(filepath.Separator)
+		args = append(args, storagePath, prefix, prefix)
+	}
+	query += ` ORDER BY storage_path`
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to search files: %w", err)
+		return nil, fmt.Errorf("failed to get file subtree: %w", err)
 	}
 	defer rows.Close()
 
@@ -476,7 +919,7 @@ func SearchUserFiles(username, searchQuery string) ([]models.FileMetadata, error
 		files = append(files, file)
 	}
 
-	return files, nil
+	return files, rows.Err()
 }
 
 // GetAllFoldersDB retrieves all folders for a user (for move/copy operations)
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// migrateFilesUniqueness rebuilds a files table from before storage paths
+// were unique per user rather than across all users.
+//
+// Storage paths are relative to the user's root ("Work/notes.txt"), so the
+// original UNIQUE(storage_path) failed the upload of any path another user
+// already had. SQLite cannot drop a constraint, so the table is rebuilt.
+func migrateFilesUniqueness() error {
+	tableSQL, err := tableDefinition("files")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(tableSQL, "storage_path TEXT NOT NULL UNIQUE") {
+		return nil
+	}
+
+	err = rebuildTable("files", `CREATE TABLE files_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			storage_path TEXT NOT NULL,
+			parent_path TEXT NOT NULL DEFAULT '/',
+			file_size INTEGER NOT NULL DEFAULT 0,
+			mime_type TEXT,
+			file_hash TEXT,
+			is_directory BOOLEAN NOT NULL DEFAULT 0,
+			uploaded_at DATETIME NOT NULL,
+			modified_at DATETIME NOT NULL,
+			version INTEGER NOT NULL DEFAULT 1,
+			uploaded_by TEXT NOT NULL DEFAULT '',
+			color_label TEXT NOT NULL DEFAULT '',
+			UNIQUE(username, storage_path),
+			FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+		`id, username, filename, storage_path, parent_path, file_size, mime_type, file_hash, is_directory, uploaded_at, modified_at, version, uploaded_by, color_label`,
+		`CREATE INDEX idx_file_user ON files(username)`,
+		`CREATE INDEX idx_file_parent ON files(username, parent_path)`,
+		`CREATE INDEX idx_file_path ON files(storage_path)`,
+		`CREATE INDEX idx_file_hash ON files(file_hash)`,
+	)
+	if err != nil {
+		return err
+	}
+	log.Println("✓ File paths are now unique per user instead of across all users")
+	return nil
+}
+
+// migrateShareFileKeys rebuilds shares and user_shares tables whose
+// file_id was a foreign key with ON DELETE CASCADE. Moving a file to the
+// trash deletes its files row, which took its links and shares with it;
+// they are now removed by triggers only once the file is deleted for good.
+func migrateShareFileKeys() error {
+	tables := []struct {
+		name      string
+		createSQL string
+		columns   string
+		indexes   []string
+	}{
+		{"shares", `CREATE TABLE shares_new (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				token TEXT NOT NULL UNIQUE,
+				username TEXT NOT NULL,
+				file_id INTEGER NOT NULL,
+				password_hash TEXT,
+				expires_at DATETIME,
+				max_downloads INTEGER NOT NULL DEFAULT 0,
+				download_count INTEGER NOT NULL DEFAULT 0,
+				allow_upload BOOLEAN NOT NULL DEFAULT 0,
+				created_at DATETIME NOT NULL,
+				FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+			)`,
+			`id, token, username, file_id, password_hash, expires_at, max_downloads, download_count, allow_upload, created_at`,
+			[]string{
+				`CREATE INDEX idx_shares_user ON shares(username, created_at)`,
+				`CREATE INDEX idx_shares_file ON shares(file_id)`,
+			}},
+		{"user_shares", `CREATE TABLE user_shares_new (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				file_id INTEGER NOT NULL,
+				recipient TEXT NOT NULL,
+				role TEXT NOT NULL DEFAULT 'viewer',
+				created_at DATETIME NOT NULL,
+				FOREIGN KEY (recipient) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+				UNIQUE(file_id, recipient)
+			)`,
+			`id, file_id, recipient, role, created_at`,
+			[]string{
+				`CREATE INDEX idx_user_shares_recipient ON user_shares(recipient, created_at)`,
+			}},
+	}
+
+	for _, table := range tables {
+		tableSQL, err := tableDefinition(table.name)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(tableSQL, "REFERENCES files(id)") {
+			continue
+		}
+		if err := rebuildTable(table.name, table.createSQL, table.columns, table.indexes...); err != nil {
+			return err
+		}
+		log.Printf("✓ Rebuilt the %s table so links and shares survive the trash", table.name)
+	}
+	return nil
+}
+
+// tableDefinition returns the CREATE TABLE statement of a table
+func tableDefinition(table string) (string, error) {
+	var tableSQL string
+	err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&tableSQL)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s table: %w", table, err)
+	}
+	return tableSQL, nil
+}
+
+// rebuildTable replaces a table with one created by createSQL (as
+// <table>_new), copying columns across with the same IDs, then recreates
+// its indexes. SQLite cannot drop a constraint any other way. The foreign
+// keys pointing at the table are checked before the rebuild is committed.
+func rebuildTable(table, createSQL, columns string, indexes ...string) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// With foreign keys on, dropping the old table would cascade into the
+	// tables referring to it. The pragma has no effect inside a transaction.
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	newTable := table + "_new"
+	statements := []string{
+		createSQL,
+		`INSERT INTO ` + newTable + ` (` + columns + `) SELECT ` + columns + ` FROM ` + table,
+		// Keep counting IDs from where the old table was: trashed files
+		// get their old ID back when restored
+		`DELETE FROM sqlite_sequence WHERE name = '` + newTable + `'`,
+		`INSERT INTO sqlite_sequence (name, seq) SELECT '` + newTable + `', seq FROM sqlite_sequence WHERE name = '` + table + `'`,
+		`DROP TABLE ` + table,
+		`ALTER TABLE ` + newTable + ` RENAME TO ` + table,
+	}
+	for _, statement := range append(statements, indexes...) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to rebuild %s table: %w", table, err)
+		}
+	}
+
+	// Foreign keys were off, so nothing stopped a row from losing its
+	// parent on the way; keep the old table if one did
+	rows, err := tx.QueryContext(ctx, `PRAGMA foreign_key_check`)
+	if err != nil {
+		return fmt.Errorf("failed to check foreign keys: %w", err)
+	}
+	var violations []string
+	for rows.Next() {
+		var child, parent string
+		var rowID sql.NullInt64
+		var fkID int
+		if err := rows.Scan(&child, &rowID, &parent, &fkID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to check foreign keys: %w", err)
+		}
+		violations = append(violations, fmt.Sprintf("%s row %d -> %s", child, rowID.Int64, parent))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to check foreign keys: %w", err)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("rebuilding the %s table would break %d foreign keys: %s", table, len(violations), strings.Join(violations, ", "))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to rebuild %s table: %w", table, err)
+	}
+	return nil
+}
@@ -0,0 +1,476 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+var (
+	// ErrGroupNotFound is returned for unknown groups and groups the user is
+	// not a member of
+	ErrGroupNotFound = errors.New("group not found")
+	// ErrGroupPermission is returned when a member's role does not allow an
+	// action
+	ErrGroupPermission = errors.New("your role in this group does not allow that")
+	// ErrLastGroupOwner is returned when an action would leave a group
+	// without an owner
+	ErrLastGroupOwner = errors.New("a group needs at least one owner")
+	// ErrAlreadyGroupMember is returned when adding someone who is already
+	// in the group
+	ErrAlreadyGroupMember = errors.New("already a member of this group")
+	// ErrInvalidGroupName is returned for empty or overlong group names
+	ErrInvalidGroupName = errors.New("group name must be 1-50 characters")
+)
+
+// Roles of a group member
+const (
+	GroupRoleOwner  = "owner"  // Everything, including roles and deleting the group
+	GroupRoleAdmin  = "admin"  // Manage files and add or remove members
+	GroupRoleMember = "member" // Browse, download, upload and create folders
+)
+
+// LoginTypeGroup marks the hidden account that owns a group's files. It
+// has no email, phone or usable password, so nobody can sign in as it.
+const LoginTypeGroup = "group"
+
+// groupAccountPrefix starts the username of every group account; users
+// cannot pick names that start with it
+const groupAccountPrefix = "group@"
+
+// IsValidGroupRole reports whether role is a known group role
+func IsValidGroupRole(role string) bool {
+	return role == GroupRoleOwner || role == GroupRoleAdmin || role == GroupRoleMember
+}
+
+// IsReservedUsername reports whether username is kept for group accounts
+func IsReservedUsername(username string) bool {
+	return strings.HasPrefix(strings.ToLower(username), groupAccountPrefix)
+}
+
+// groupRoleRank orders roles from least to most trusted
+func groupRoleRank(role string) int {
+	switch role {
+	case GroupRoleOwner:
+		return 3
+	case GroupRoleAdmin:
+		return 2
+	case GroupRoleMember:
+		return 1
+	}
+	return 0
+}
+
+// CanManageGroupFiles reports whether a role may rename, move and delete
+// files in the group's space
+func CanManageGroupFiles(role string) bool {
+	return groupRoleRank(role) >= groupRoleRank(GroupRoleAdmin)
+}
+
+// cleanGroupName trims a group name and checks its length
+func cleanGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > 50 {
+		return "", ErrInvalidGroupName
+	}
+	return name, nil
+}
+
+// groupColumns is the column list read by scanGroup, for a query joining
+// user_groups g with the viewing member's group_members m
+const groupColumns = `g.id, g.name, g.account, m.role,
+	(SELECT COUNT(*) FROM group_members c WHERE c.group_id = g.id), g.created_at`
+
+// scanGroup reads a row selected with groupColumns
+func scanGroup(row rowScanner) (*models.Group, error) {
+	var group models.Group
+	err := row.Scan(&group.ID, &group.Name, &group.Account, &group.Role, &group.MemberCount, &group.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// CreateGroup creates a group owned by owner, with an empty storage space
+// of its own
+func CreateGroup(owner, name string) (*models.Group, error) {
+	name, err := cleanGroupName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The account's password is never handed out; it only fills the column
+	passwordHash, err := HashPassword(GenerateUniqueCode() + GenerateUniqueCode())
+	if err != nil {
+		return nil, err
+	}
+	account := groupAccountPrefix + GenerateUniqueCode()
+	uniqueCode := GenerateUniqueCode()
+	now := time.Now().UTC()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO users (username, email, phone, phone_region, password, unique_code, created_at, login_type)
+		VALUES (?, '', '', '', ?, ?, ?, ?)`, account, passwordHash, uniqueCode, now, LoginTypeGroup); err != nil {
+		return nil, fmt.Errorf("failed to create group account: %w", err)
+	}
+	result, err := tx.Exec(`INSERT INTO user_groups (name, account, created_at) VALUES (?, ?, ?)`, name, account, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+	if _, err := tx.Exec(`INSERT INTO group_members (group_id, username, role, added_at) VALUES (?, ?, ?, ?)`,
+		id, owner, GroupRoleOwner, now); err != nil {
+		return nil, fmt.Errorf("failed to add group owner: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+
+	if err := os.MkdirAll(GetUserStoragePath(account, uniqueCode), os.ModePerm); err != nil {
+		log.Printf("Warning: failed to create storage for group %d: %v", id, err)
+	}
+	return GetGroupForMember(owner, id)
+}
+
+// ListUserGroups returns the groups a user is a member of, by name
+func ListUserGroups(username string) ([]models.Group, error) {
+	rows, err := db.Query(`SELECT `+groupColumns+` FROM user_groups g
+		JOIN group_members m ON m.group_id = g.id
+		WHERE m.username = ? ORDER BY g.name COLLATE NOCASE, g.id`, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups := []models.Group{}
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan group: %w", err)
+		}
+		groups = append(groups, *group)
+	}
+	return groups, rows.Err()
+}
+
+// GetGroupForMember returns a group with the user's role in it. It is
+// looked up on every request, so membership and role changes take effect
+// at once.
+func GetGroupForMember(username string, id int64) (*models.Group, error) {
+	group, err := scanGroup(db.QueryRow(`SELECT `+groupColumns+` FROM user_groups g
+		JOIN group_members m ON m.group_id = g.id
+		WHERE g.id = ? AND m.username = ?`, id, username))
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group: %w", err)
+	}
+	return group, nil
+}
+
+// ListGroupMembers returns the members of a group, owners first
+func ListGroupMembers(groupID int64) ([]models.GroupMember, error) {
+	rows, err := db.Query(`SELECT username, role, added_at FROM group_members WHERE group_id = ?
+		ORDER BY CASE role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, added_at, username`, groupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list group members: %w", err)
+	}
+	defer rows.Close()
+
+	members := []models.GroupMember{}
+	for rows.Next() {
+		var member models.GroupMember
+		if err := rows.Scan(&member.Username, &member.Role, &member.AddedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan group member: %w", err)
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// getGroupMemberRole returns a member's role, or "" if they are not in the
+// group
+func getGroupMemberRole(groupID int64, username string) (string, error) {
+	var role string
+	err := db.QueryRow(`SELECT role FROM group_members WHERE group_id = ? AND username = ?`, groupID, username).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get group member: %w", err)
+	}
+	return role, nil
+}
+
+// requireOtherGroupOwner fails if username is the only owner of a group
+func requireOtherGroupOwner(groupID int64, username string) error {
+	var others int
+	err := db.QueryRow(`SELECT COUNT(*) FROM group_members WHERE group_id = ? AND role = ? AND username != ?`,
+		groupID, GroupRoleOwner, username).Scan(&others)
+	if err != nil {
+		return fmt.Errorf("failed to count group owners: %w", err)
+	}
+	if others == 0 {
+		return ErrLastGroupOwner
+	}
+	return nil
+}
+
+// AddGroupMember adds a user to a group. group carries the acting member's
+// role: admins may add members, only owners may add admins and owners.
+func AddGroupMember(group *models.Group, username, role string) error {
+	if !CanManageGroupFiles(group.Role) || (role != GroupRoleMember && group.Role != GroupRoleOwner) {
+		return ErrGroupPermission
+	}
+
+	current, err := getGroupMemberRole(group.ID, username)
+	if err != nil {
+		return err
+	}
+	if current != "" {
+		return ErrAlreadyGroupMember
+	}
+
+	if _, err := db.Exec(`INSERT INTO group_members (group_id, username, role, added_at) VALUES (?, ?, ?, ?)`,
+		group.ID, username, role, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to add group member: %w", err)
+	}
+	return nil
+}
+
+// SetGroupMemberRole changes a member's role. Only owners may change roles,
+// and the last owner cannot step down.
+func SetGroupMemberRole(group *models.Group, username, role string) error {
+	if group.Role != GroupRoleOwner {
+		return ErrGroupPermission
+	}
+
+	current, err := getGroupMemberRole(group.ID, username)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return ErrUserNotFound
+	}
+	if current == GroupRoleOwner && role != GroupRoleOwner {
+		if err := requireOtherGroupOwner(group.ID, username); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(`UPDATE group_members SET role = ? WHERE group_id = ? AND username = ?`,
+		role, group.ID, username); err != nil {
+		return fmt.Errorf("failed to update group member: %w", err)
+	}
+	return nil
+}
+
+// RemoveGroupMember takes a user out of a group. Anyone may leave; admins
+// may remove members and owners anyone. The last owner has to hand the
+// group over or delete it instead.
+func RemoveGroupMember(actor string, group *models.Group, username string) error {
+	current, err := getGroupMemberRole(group.ID, username)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return ErrUserNotFound
+	}
+	if username != actor && (!CanManageGroupFiles(group.Role) ||
+		(group.Role != GroupRoleOwner && current != GroupRoleMember)) {
+		return ErrGroupPermission
+	}
+	if current == GroupRoleOwner {
+		if err := requireOtherGroupOwner(group.ID, username); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(`DELETE FROM group_members WHERE group_id = ? AND username = ?`, group.ID, username); err != nil {
+		return fmt.Errorf("failed to remove group member: %w", err)
+	}
+	return nil
+}
+
+// RenameGroup changes a group's display name (admins and owners)
+func RenameGroup(group *models.Group, name string) error {
+	if !CanManageGroupFiles(group.Role) {
+		return ErrGroupPermission
+	}
+	name, err := cleanGroupName(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`UPDATE user_groups SET name = ? WHERE id = ?`, name, group.ID); err != nil {
+		return fmt.Errorf("failed to rename group: %w", err)
+	}
+	return nil
+}
+
+// DeleteGroup deletes a group with all of its files (owners only)
+func DeleteGroup(group *models.Group) error {
+	if group.Role != GroupRoleOwner {
+		return ErrGroupPermission
+	}
+	return deleteGroupAccount(group.Account)
+}
+
+// deleteGroupAccount removes a group's account, which takes the group, its
+// members, files, trash and versions with it, and its storage folder
+func deleteGroupAccount(account string) error {
+	user, err := GetUserByUsernameDB(account)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrGroupNotFound
+	}
+
+	LockUserFileWrite(account)
+	defer UnlockUserFileWrite(account)
+
+	if _, err := db.Exec(`DELETE FROM users WHERE username = ? AND login_type = ?`, account, LoginTypeGroup); err != nil {
+		return fmt.Errorf("failed to delete group: %w", err)
+	}
+
+	InvalidateUserCache(account)
+
+	if err := os.RemoveAll(GetUserStoragePath(account, user.UniqueCode)); err != nil {
+		log.Printf("Warning: failed to remove storage for deleted group %s: %v", account, err)
+	}
+	return nil
+}
+
+// releaseUserGroups hands the groups a user is the only owner of to their
+// longest-serving admin, or else member, before the user is deleted.
+// Groups with nobody else in them are deleted.
+func releaseUserGroups(username string) error {
+	rows, err := db.Query(`SELECT g.id, g.account FROM user_groups g
+		JOIN group_members m ON m.group_id = g.id
+		WHERE m.username = ? AND m.role = ? AND NOT EXISTS (
+			SELECT 1 FROM group_members o WHERE o.group_id = g.id AND o.role = ? AND o.username != ?)`,
+		username, GroupRoleOwner, GroupRoleOwner, username)
+	if err != nil {
+		return fmt.Errorf("failed to list owned groups: %w", err)
+	}
+	type ownedGroup struct {
+		id      int64
+		account string
+	}
+	var owned []ownedGroup
+	for rows.Next() {
+		var group ownedGroup
+		if err := rows.Scan(&group.id, &group.account); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan owned group: %w", err)
+		}
+		owned = append(owned, group)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list owned groups: %w", err)
+	}
+
+	for _, group := range owned {
+		var successor string
+		err := db.QueryRow(`SELECT username FROM group_members WHERE group_id = ? AND username != ?
+			ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, added_at, username LIMIT 1`,
+			group.id, username).Scan(&successor)
+		if err == sql.ErrNoRows {
+			if err := deleteGroupAccount(group.account); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find new group owner: %w", err)
+		}
+		if _, err := db.Exec(`UPDATE group_members SET role = ? WHERE group_id = ? AND username = ?`,
+			GroupRoleOwner, group.id, successor); err != nil {
+			return fmt.Errorf("failed to hand over group: %w", err)
+		}
+	}
+	return nil
+}
+
+// ListGroupsAdmin returns every group with its owners and storage use, by
+// name
+func ListGroupsAdmin() ([]models.AdminGroupInfo, error) {
+	rows, err := db.Query(`SELECT g.id, g.name, g.account, g.created_at,
+		(SELECT COUNT(*) FROM group_members c WHERE c.group_id = g.id)
+		FROM user_groups g ORDER BY g.name COLLATE NOCASE, g.id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups: %w", err)
+	}
+	var groups []models.AdminGroupInfo
+	var accounts []string
+	for rows.Next() {
+		var info models.AdminGroupInfo
+		var account string
+		if err := rows.Scan(&info.ID, &info.Name, &account, &info.CreatedAt, &info.MemberCount); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan group: %w", err)
+		}
+		groups = append(groups, info)
+		accounts = append(accounts, account)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list groups: %w", err)
+	}
+
+	for i := range groups {
+		if groups[i].StorageUsed, groups[i].FileCount, err = GetUserStorageStats(accounts[i]); err != nil {
+			return nil, err
+		}
+		if groups[i].StorageQuota, groups[i].QuotaCustom, err = GetUserQuota(accounts[i]); err != nil {
+			return nil, err
+		}
+
+		members, err := ListGroupMembers(groups[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		groups[i].Owners = []string{}
+		for _, member := range members {
+			if member.Role == GroupRoleOwner {
+				groups[i].Owners = append(groups[i].Owners, member.Username)
+			}
+		}
+	}
+	if groups == nil {
+		groups = []models.AdminGroupInfo{}
+	}
+	return groups, nil
+}
+
+// SetGroupQuota overrides a group's storage quota in bytes (0 = unlimited),
+// or returns it to config.DefaultGroupQuota when quota is nil
+func SetGroupQuota(id int64, quota *int64) error {
+	var account string
+	err := db.QueryRow(`SELECT account FROM user_groups WHERE id = ?`, id).Scan(&account)
+	if err == sql.ErrNoRows {
+		return ErrGroupNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get group: %w", err)
+	}
+	return SetUserQuota(account, quota)
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// Login failures are tracked under two scopes so that both a single client
+// hammering many accounts and many clients hammering one account are slowed
+const (
+	throttleScopeIP         = "ip"
+	throttleScopeCredential = "credential"
+)
+
+// loginThrottleMu serializes the read-modify-write of failure counters and
+// guards loginThrottle
+var loginThrottleMu sync.Mutex
+
+// loginThrottle is the active brute-force protection configuration
+var loginThrottle = config.DefaultLoginThrottleSettings
+
+// loginThrottleSettings returns a copy of the active configuration
+func loginThrottleSettings() config.LoginThrottleSettings {
+	loginThrottleMu.Lock()
+	defer loginThrottleMu.Unlock()
+	return loginThrottle
+}
+
+// SetLoginThrottleSettings replaces the login protection thresholds
+func SetLoginThrottleSettings(settings config.LoginThrottleSettings) {
+	loginThrottleMu.Lock()
+	defer loginThrottleMu.Unlock()
+	loginThrottle = settings
+}
+
+// UserThrottleKey returns the credential key for an existing account
+func UserThrottleKey(username string) string {
+	return "user:" + username
+}
+
+// blockedUntil returns when a scope/key is next allowed to try, if blocked
+func blockedUntil(scope, key string) (time.Time, error) {
+	var until sql.NullTime
+	query := `SELECT blocked_until FROM login_attempts WHERE scope = ? AND key = ?`
+	err := db.QueryRow(query, scope, key).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to check login attempts: %w", err)
+	}
+	return until.Time, nil
+}
+
+// CheckLoginAllowed reports how long the caller must wait before another
+// login attempt from ip against credential. Zero means go ahead.
+func CheckLoginAllowed(ip, credential string) time.Duration {
+	now := time.Now().UTC()
+	var wait time.Duration
+
+	for _, check := range []struct{ scope, key string }{
+		{throttleScopeIP, ip},
+		{throttleScopeCredential, credential},
+	} {
+		if check.key == "" {
+			continue
+		}
+		until, err := blockedUntil(check.scope, check.key)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		if remaining := until.Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+
+	return wait
+}
+
+// throttleDelay returns the block applied after the given number of failures
+func throttleDelay(settings config.LoginThrottleSettings, failures, freeAttempts, lockoutThreshold int) time.Duration {
+	if failures >= lockoutThreshold {
+		return settings.LockoutDuration
+	}
+	if failures <= freeAttempts {
+		return 0
+	}
+
+	delay := settings.BaseDelay
+	for i := freeAttempts + 1; i < failures && delay < settings.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > settings.MaxDelay {
+		delay = settings.MaxDelay
+	}
+	return delay
+}
+
+// recordFailure bumps one failure counter and applies backoff or lockout
+func recordFailure(settings config.LoginThrottleSettings, scope, key string, freeAttempts, lockoutThreshold int) error {
+	now := time.Now().UTC()
+
+	var failures int
+	var lastFailure time.Time
+	query := `SELECT failures, last_failure FROM login_attempts WHERE scope = ? AND key = ?`
+	err := db.QueryRow(query, scope, key).Scan(&failures, &lastFailure)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read login attempts: %w", err)
+	}
+
+	// A long quiet period wipes the slate clean
+	if now.Sub(lastFailure) > settings.ResetAfter {
+		failures = 0
+	}
+	failures++
+
+	var until sql.NullTime
+	if delay := throttleDelay(settings, failures, freeAttempts, lockoutThreshold); delay > 0 {
+		until = sql.NullTime{Time: now.Add(delay), Valid: true}
+		if failures == lockoutThreshold {
+			log.Printf("Login %s %q locked out after %d failed attempts", scope, key, failures)
+		}
+	}
+
+	upsert := `INSERT INTO login_attempts (scope, key, failures, last_failure, blocked_until)
+			   VALUES (?, ?, ?, ?, ?)
+			   ON CONFLICT(scope, key) DO UPDATE SET
+			   failures = excluded.failures, last_failure = excluded.last_failure, blocked_until = excluded.blocked_until`
+	if _, err := db.Exec(upsert, scope, key, failures, now, until); err != nil {
+		return fmt.Errorf("failed to record login attempt: %w", err)
+	}
+	return nil
+}
+
+// RecordLoginFailure counts a failed attempt against both the IP and the
+// credential (either may be empty)
+func RecordLoginFailure(ip, credential string) {
+	loginThrottleMu.Lock()
+	defer loginThrottleMu.Unlock()
+	settings := loginThrottle
+
+	if ip != "" {
+		if err := recordFailure(settings, throttleScopeIP, ip, settings.IPFreeAttempts, settings.IPLockoutThreshold); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	if credential != "" {
+		if err := recordFailure(settings, throttleScopeCredential, credential, settings.CredentialFreeAttempts, settings.CredentialLockoutThreshold); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
+
+// RecordLoginSuccess clears the failure counter for a credential. The IP
+// counter is left alone so one valid account cannot reset an attacker's IP.
+func RecordLoginSuccess(credential string) {
+	query := `DELETE FROM login_attempts WHERE scope = ? AND key = ?`
+	if _, err := db.Exec(query, throttleScopeCredential, credential); err != nil {
+		log.Printf("Warning: failed to reset login attempts: %v", err)
+	}
+}
+
+// DeleteStaleLoginAttempts removes counters that are no longer blocking
+// and have been quiet for longer than the reset period
+func DeleteStaleLoginAttempts() (int64, error) {
+	now := time.Now().UTC()
+	query := `DELETE FROM login_attempts
+			  WHERE last_failure < ? AND (blocked_until IS NULL OR blocked_until < ?)`
+	result, err := db.Exec(query, now.Add(-loginThrottleSettings().ResetAfter), now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete stale login attempts: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// InitLoginThrottleSweeper creates the background task that purges stale
+// login failure counters
+func InitLoginThrottleSweeper() *PeriodicTask {
+	return NewPeriodicTask("Login attempt sweeper", loginThrottleSettings().SweepInterval, func() error {
+		removed, err := DeleteStaleLoginAttempts()
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			log.Printf("Removed %d stale login attempt counters", removed)
+		}
+		return nil
+	})
+}
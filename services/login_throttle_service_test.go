@@ -0,0 +1,216 @@
+package services
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// useLoginThrottleSettings switches to settings for the rest of a test and
+// starts it without any recorded failures
+func useLoginThrottleSettings(t *testing.T, settings config.LoginThrottleSettings) {
+	t.Helper()
+	if _, err := db.Exec(`DELETE FROM login_attempts`); err != nil {
+		t.Fatal(err)
+	}
+	SetLoginThrottleSettings(settings)
+	t.Cleanup(func() { SetLoginThrottleSettings(config.DefaultLoginThrottleSettings) })
+}
+
+func TestThrottleDelay(t *testing.T) {
+	settings := config.LoginThrottleSettings{
+		BaseDelay:       2 * time.Second,
+		MaxDelay:        time.Minute,
+		LockoutDuration: 15 * time.Minute,
+	}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{3, 0},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		{8, 32 * time.Second},
+		{9, time.Minute}, // 64s, capped
+		{12, time.Minute},
+		{20, 15 * time.Minute},
+		{25, 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := throttleDelay(settings, tt.failures, 3, 20); got != tt.want {
+			t.Errorf("throttleDelay(%d, 3, 20) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// waitWithin reports whether a wait is in (0, max]
+func waitWithin(wait, max time.Duration) bool {
+	return wait > 0 && wait <= max
+}
+
+func TestLoginThrottleCredential(t *testing.T) {
+	useLoginThrottleSettings(t, config.LoginThrottleSettings{
+		CredentialFreeAttempts:     2,
+		CredentialLockoutThreshold: 4,
+		IPFreeAttempts:             100,
+		IPLockoutThreshold:         100,
+		BaseDelay:                  time.Minute,
+		MaxDelay:                   time.Hour,
+		LockoutDuration:            24 * time.Hour,
+		ResetAfter:                 48 * time.Hour,
+	})
+	const ip, credential = "192.0.2.10", "user:throttle-credential"
+
+	// Each failure is recorded, then the next attempt checked
+	steps := []struct {
+		failures int
+		max      time.Duration // zero means not blocked
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 24 * time.Hour},
+	}
+
+	for _, step := range steps {
+		RecordLoginFailure(ip, credential)
+		wait := CheckLoginAllowed(ip, credential)
+		if step.max == 0 && wait != 0 {
+			t.Errorf("after %d failures: wait = %v, want none", step.failures, wait)
+		}
+		if step.max != 0 && !waitWithin(wait, step.max) {
+			t.Errorf("after %d failures: wait = %v, want up to %v", step.failures, wait, step.max)
+		}
+	}
+	if wait := CheckLoginAllowed(ip, credential); wait <= time.Hour {
+		t.Errorf("wait after lockout = %v, want the lockout duration", wait)
+	}
+
+	// The block follows the account to other IPs, but not to other accounts
+	if wait := CheckLoginAllowed("192.0.2.11", credential); wait == 0 {
+		t.Error("locked account allowed from another IP")
+	}
+	if wait := CheckLoginAllowed(ip, "user:someone-else"); wait != 0 {
+		t.Errorf("other account blocked for %v", wait)
+	}
+
+	RecordLoginSuccess(credential)
+	if wait := CheckLoginAllowed(ip, credential); wait != 0 {
+		t.Errorf("wait after a successful login = %v, want none", wait)
+	}
+}
+
+func TestLoginThrottleIP(t *testing.T) {
+	useLoginThrottleSettings(t, config.LoginThrottleSettings{
+		CredentialFreeAttempts:     100,
+		CredentialLockoutThreshold: 100,
+		IPFreeAttempts:             1,
+		IPLockoutThreshold:         3,
+		BaseDelay:                  time.Minute,
+		MaxDelay:                   time.Hour,
+		LockoutDuration:            24 * time.Hour,
+		ResetAfter:                 48 * time.Hour,
+	})
+	const ip = "192.0.2.20"
+
+	// One client trying a different account each time is still slowed
+	for i, credential := range []string{"user:a", "user:b", "user:c"} {
+		RecordLoginFailure(ip, "throttle-ip-"+credential)
+		wait := CheckLoginAllowed(ip, "throttle-ip-user:d")
+		if i == 0 && wait != 0 {
+			t.Errorf("after one failure: wait = %v, want none", wait)
+		}
+		if i > 0 && wait == 0 {
+			t.Errorf("after %d failures: not blocked", i+1)
+		}
+	}
+	if wait := CheckLoginAllowed(ip, ""); wait <= time.Hour {
+		t.Errorf("wait after IP lockout = %v, want the lockout duration", wait)
+	}
+
+	// A successful login only clears the account, not the IP
+	RecordLoginSuccess("throttle-ip-user:a")
+	if wait := CheckLoginAllowed(ip, "throttle-ip-user:a"); wait == 0 {
+		t.Error("a successful login cleared the IP block")
+	}
+	if wait := CheckLoginAllowed("192.0.2.21", "throttle-ip-user:a"); wait != 0 {
+		t.Errorf("another IP blocked for %v", wait)
+	}
+}
+
+func TestLoginThrottleResetAfterQuietPeriod(t *testing.T) {
+	useLoginThrottleSettings(t, config.LoginThrottleSettings{
+		CredentialFreeAttempts:     1,
+		CredentialLockoutThreshold: 3,
+		IPFreeAttempts:             100,
+		IPLockoutThreshold:         100,
+		BaseDelay:                  time.Minute,
+		MaxDelay:                   time.Hour,
+		LockoutDuration:            24 * time.Hour,
+		ResetAfter:                 time.Hour,
+	})
+	const credential = "user:throttle-reset"
+
+	RecordLoginFailure("", credential)
+	RecordLoginFailure("", credential)
+	if wait := CheckLoginAllowed("", credential); wait == 0 {
+		t.Fatal("not blocked after passing the free attempts")
+	}
+
+	// Two hours pass without failures, and the backoff has run out
+	_, err := db.Exec(`UPDATE login_attempts SET last_failure = ?, blocked_until = ? WHERE scope = ? AND key = ?`,
+		time.Now().UTC().Add(-2*time.Hour), time.Now().UTC().Add(-time.Hour), throttleScopeCredential, credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The counter starts over, so the next failure is free again
+	RecordLoginFailure("", credential)
+	if wait := CheckLoginAllowed("", credential); wait != 0 {
+		t.Errorf("wait after the counter reset = %v, want none", wait)
+	}
+}
+
+func TestDeleteStaleLoginAttempts(t *testing.T) {
+	useLoginThrottleSettings(t, config.LoginThrottleSettings{ResetAfter: time.Hour})
+	now := time.Now().UTC()
+
+	tests := []struct {
+		key          string
+		lastFailure  time.Time
+		blockedUntil sql.NullTime
+		kept         bool
+	}{
+		{"stale-quiet", now.Add(-2 * time.Hour), sql.NullTime{}, false},
+		{"stale-expired-block", now.Add(-2 * time.Hour), sql.NullTime{Time: now.Add(-time.Minute), Valid: true}, false},
+		{"stale-locked", now.Add(-2 * time.Hour), sql.NullTime{Time: now.Add(time.Hour), Valid: true}, true},
+		{"recent", now.Add(-time.Minute), sql.NullTime{}, true},
+	}
+
+	for _, tt := range tests {
+		_, err := db.Exec(`INSERT INTO login_attempts (scope, key, failures, last_failure, blocked_until) VALUES (?, ?, 1, ?, ?)`,
+			throttleScopeCredential, tt.key, tt.lastFailure, tt.blockedUntil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := DeleteStaleLoginAttempts(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		var count int
+		db.QueryRow(`SELECT COUNT(*) FROM login_attempts WHERE scope = ? AND key = ?`, throttleScopeCredential, tt.key).Scan(&count)
+		if kept := count == 1; kept != tt.kept {
+			t.Errorf("%s: kept = %v, want %v", tt.key, kept, tt.kept)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// MailMessage is a plain-text email
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outgoing email
+type Mailer interface {
+	Send(msg *MailMessage) error
+}
+
+// buildMessage renders a message in RFC 5322 format
+func buildMessage(from string, msg *MailMessage, now time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// SMTPMailer sends mail through an SMTP server (STARTTLS is used
+// automatically when the server offers it)
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers a message over SMTP
+func (m *SMTPMailer) Send(msg *MailMessage) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	if err := smtp.SendMail(addr, auth, from.Address, []string{msg.To}, buildMessage(m.From, msg, time.Now())); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
+
+// FileMailer writes each message as an .eml file, for development and for
+// servers without outgoing mail
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+// Send writes a message to the outbox directory
+func (m *FileMailer) Send(msg *MailMessage) error {
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return fmt.Errorf("failed to create outbox: %w", err)
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%s_%s.eml", now.Format("2006-01-02_150405.000000000"), sanitizeMailName(msg.To))
+	if err := os.WriteFile(filepath.Join(m.Dir, name), buildMessage(m.From, msg, now), 0600); err != nil {
+		return fmt.Errorf("failed to write mail: %w", err)
+	}
+	return nil
+}
+
+// sanitizeMailName makes an address safe to use in a file name
+func sanitizeMailName(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r == '_' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, address)
+}
+
+// LogMailer prints messages to the server log
+type LogMailer struct{}
+
+// Send logs a message instead of delivering it
+func (LogMailer) Send(msg *MailMessage) error {
+	log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// NewMailer creates the mailer selected by the settings
+func NewMailer(settings config.MailSettings) Mailer {
+	switch settings.Driver {
+	case "smtp":
+		return &SMTPMailer{
+			Host:     settings.SMTPHost,
+			Port:     settings.SMTPPort,
+			Username: settings.SMTPUsername,
+			Password: settings.SMTPPassword,
+			From:     settings.From,
+		}
+	case "log":
+		return LogMailer{}
+	default:
+		return &FileMailer{Dir: settings.OutboxDir, From: settings.From}
+	}
+}
+
+// CheckBaseURL makes sure links have a fixed public origin to point to:
+// an http or https URL with a host and nothing after the path
+func CheckBaseURL(base string) error {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("MailSettings.BaseURL must be the public http(s) URL of the server, e.g. \"https://disk.example.com\" (got %q)", base)
+	}
+	return nil
+}
+
+var (
+	mailer   Mailer = NewMailer(config.DefaultMailSettings)
+	mailerMu sync.RWMutex
+)
+
+// SetMailer replaces the mailer used for outgoing email
+func SetMailer(m Mailer) {
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
+	mailer = m
+}
+
+// SendMail delivers a message with the configured mailer
+func SendMail(to, subject, body string) error {
+	mailerMu.RLock()
+	m := mailer
+	mailerMu.RUnlock()
+	return m.Send(&MailMessage{To: to, Subject: subject, Body: body})
+}
+
+// SendPasswordResetEmail emails a password reset link
+func SendPasswordResetEmail(email, username, link string) error {
+	body := fmt.Sprintf(`Hi %s,
+
+Someone asked to reset the password for your HAYA-DISK account.
+Open this link within %s to choose a new password:
+
+%s
+
+If you didn't ask for this, you can ignore this email; your password
+has not been changed.
+`, username, formatMailDuration(config.PasswordResetTokenTTL), link)
+	return SendMail(email, "Reset your HAYA-DISK password", body)
+}
+
+// SendVerificationEmail emails a link confirming the address belongs to the user
+func SendVerificationEmail(email, username, link string) error {
+	body := fmt.Sprintf(`Hi %s,
+
+Please confirm this email address for your HAYA-DISK account by opening
+this link within %s:
+
+%s
+
+If you didn't sign up, you can ignore this email.
+`, username, formatMailDuration(config.EmailVerificationTokenTTL), link)
+	return SendMail(email, "Verify your HAYA-DISK email address", body)
+}
+
+// formatMailDuration renders a token lifetime for humans ("1 hour", "48 hours")
+func formatMailDuration(d time.Duration) string {
+	if d < time.Hour {
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	}
+	hours := int(d.Hours())
+	if hours == 1 {
+		return "1 hour"
+	}
+	return fmt.Sprintf("%d hours", hours)
+}
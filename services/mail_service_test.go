@@ -0,0 +1,150 @@
+package services
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpSession is what a fakeSMTPServer received in one connection
+type smtpSession struct {
+	auth string // Decoded AUTH PLAIN response
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer accepts one connection on a local port and speaks just
+// enough SMTP for net/smtp to deliver a message. rejectRcpt makes it
+// refuse every recipient.
+func fakeSMTPServer(t *testing.T, rejectRcpt bool) (port int, done <-chan smtpSession) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		var session smtpSession
+		defer func() { sessions <- session }()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ESMTP")
+
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				_, encoded, _ := strings.Cut(arg, " ")
+				decoded, _ := base64.StdEncoding.DecodeString(encoded)
+				session.auth = string(decoded)
+				text.PrintfLine("235 Authenticated")
+			case "MAIL":
+				session.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+				text.PrintfLine("250 OK")
+			case "RCPT":
+				if rejectRcpt {
+					text.PrintfLine("550 No such user")
+					continue
+				}
+				session.to = append(session.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 Go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				session.data = string(data)
+				text.PrintfLine("250 Queued")
+			case "QUIT":
+				text.PrintfLine("221 Bye")
+				return
+			default:
+				text.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, sessions
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		wantAuth string
+	}{
+		{"with login", "mailer", "\x00mailer\x00secret"},
+		{"without login", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, done := fakeSMTPServer(t, false)
+			m := &SMTPMailer{Host: "127.0.0.1", Port: port, Username: tt.username, Password: "secret", From: "HAYA-DISK <noreply@example.com>"}
+
+			err := m.Send(&MailMessage{To: "alice@example.com", Subject: "Réinitialiser", Body: "line one\nline two\n"})
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			session := <-done
+
+			if session.auth != tt.wantAuth {
+				t.Errorf("AUTH PLAIN %q, want %q", session.auth, tt.wantAuth)
+			}
+			if session.from != "noreply@example.com" {
+				t.Errorf("MAIL FROM %q, want the bare address", session.from)
+			}
+			if len(session.to) != 1 || session.to[0] != "alice@example.com" {
+				t.Errorf("RCPT TO %v, want alice@example.com", session.to)
+			}
+
+			headers, body, _ := strings.Cut(session.data, "\n\n")
+			for _, header := range []string{
+				"From: HAYA-DISK <noreply@example.com>",
+				"To: alice@example.com",
+				"Subject: =?utf-8?q?R=C3=A9initialiser?=",
+				"Content-Type: text/plain; charset=utf-8",
+			} {
+				if !strings.Contains(headers, header+"\n") {
+					t.Errorf("headers missing %q:\n%s", header, headers)
+				}
+			}
+			if body != "line one\nline two\n" {
+				t.Errorf("body %q", body)
+			}
+		})
+	}
+}
+
+func TestSMTPMailerSendErrors(t *testing.T) {
+	port, done := fakeSMTPServer(t, true)
+	m := &SMTPMailer{Host: "127.0.0.1", Port: port, From: "noreply@example.com"}
+	if err := m.Send(&MailMessage{To: "nobody@example.com", Subject: "Hi", Body: "Hi"}); err == nil {
+		t.Error("Send succeeded although the recipient was refused")
+	}
+	if session := <-done; session.data != "" {
+		t.Errorf("message data sent after the recipient was refused: %q", session.data)
+	}
+
+	m = &SMTPMailer{Host: "127.0.0.1", Port: port, From: "not an address"}
+	if err := m.Send(&MailMessage{To: "alice@example.com", Subject: "Hi", Body: "Hi"}); err == nil {
+		t.Error("Send succeeded with an invalid sender")
+	}
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain runs the package tests against a fresh database. The database
+// and the storage directory are relative paths, so the tests run inside a
+// temporary directory.
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "haya-disk-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Chdir(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := InitDatabase(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer CloseDatabase()
+
+	return m.Run()
+}
+
+// createTestUser inserts a user row with the given stored password and
+// returns its storage path. A user left by an earlier run of the same test
+// (go test -count) is deleted first, along with everything they own.
+func createTestUser(t *testing.T, username, password string) string {
+	t.Helper()
+	if _, err := db.Exec(`DELETE FROM users WHERE username = ?`, username); err != nil {
+		t.Fatal(err)
+	}
+	uniqueCode := GenerateUniqueCode()
+	if err := CreateUserDB(username, username+"@example.com", "", "", password, uniqueCode, time.Now(), "email"); err != nil {
+		t.Fatalf("CreateUserDB(%q): %v", username, err)
+	}
+	userStoragePath := GetUserStoragePath(username, uniqueCode)
+	if err := os.MkdirAll(userStoragePath, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	return userStoragePath
+}
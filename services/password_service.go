@@ -0,0 +1,87 @@
+package services
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// Stored password hashes use the format:
+//
+//	pbkdf2-sha256$<iterations>$<base64 salt>$<base64 key>
+//
+// Anything without the scheme prefix is treated as a legacy plaintext
+// password (from old databases or users.json) and is upgraded on login.
+const passwordHashScheme = "pbkdf2-sha256"
+
+// HashPassword derives a salted PBKDF2-SHA256 hash for the given password
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, config.PasswordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, config.PasswordHashIterations, config.PasswordKeyLength)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	return fmt.Sprintf("%s$%d$%s$%s",
+		passwordHashScheme,
+		config.PasswordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// IsPasswordHashed reports whether a stored password uses the hashed format
+func IsPasswordHashed(stored string) bool {
+	return strings.HasPrefix(stored, passwordHashScheme+"$")
+}
+
+// VerifyPassword checks a password against a stored value.
+// needsRehash is true when the password matched but the stored value is
+// plaintext or was hashed with weaker parameters than the current config.
+func VerifyPassword(stored, password string) (match bool, needsRehash bool) {
+	if !IsPasswordHashed(stored) {
+		// Legacy plaintext row
+		match = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return match, match
+	}
+
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 {
+		return false, false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(expected) == 0 {
+		return false, false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false, false
+	}
+
+	match = subtle.ConstantTimeCompare(key, expected) == 1
+	needsRehash = match && (iterations < config.PasswordHashIterations ||
+		len(salt) < config.PasswordSaltLength ||
+		len(expected) < config.PasswordKeyLength)
+	return match, needsRehash
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// weakHash hashes a password with the given parameters, standing in for a
+// row written under an older configuration
+func weakHash(t *testing.T, password string, iterations, saltLength, keyLength int) string {
+	t.Helper()
+	salt := make([]byte, saltLength)
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, keyLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	for _, password := range []string{"correct horse battery staple", "", "パスワード", "with$dollar"} {
+		stored, err := HashPassword(password)
+		if err != nil {
+			t.Fatalf("HashPassword(%q): %v", password, err)
+		}
+		if !IsPasswordHashed(stored) {
+			t.Errorf("HashPassword(%q) = %q, not in the hashed format", password, stored)
+		}
+
+		tests := []struct {
+			name        string
+			password    string
+			match       bool
+			needsRehash bool
+		}{
+			{"same password", password, true, false},
+			{"wrong password", password + "x", false, false},
+			{"stored value", stored, false, false},
+		}
+		for _, tt := range tests {
+			match, needsRehash := VerifyPassword(stored, tt.password)
+			if match != tt.match || needsRehash != tt.needsRehash {
+				t.Errorf("%q, %s: VerifyPassword = (%v, %v), want (%v, %v)",
+					password, tt.name, match, needsRehash, tt.match, tt.needsRehash)
+			}
+		}
+	}
+}
+
+func TestHashPasswordSalted(t *testing.T) {
+	first, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("two hashes of the same password are equal: %q", first)
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	tests := []struct {
+		name        string
+		stored      string
+		password    string
+		match       bool
+		needsRehash bool
+	}{
+		{"legacy plaintext", "secret", "secret", true, true},
+		{"legacy plaintext, wrong password", "secret", "Secret", false, false},
+		{"legacy empty password", "", "", true, true},
+		{"fewer iterations", weakHash(t, "secret", 1000, config.PasswordSaltLength, config.PasswordKeyLength), "secret", true, true},
+		{"fewer iterations, wrong password", weakHash(t, "secret", 1000, config.PasswordSaltLength, config.PasswordKeyLength), "other", false, false},
+		{"shorter salt", weakHash(t, "secret", config.PasswordHashIterations, 8, config.PasswordKeyLength), "secret", true, true},
+		{"shorter key", weakHash(t, "secret", config.PasswordHashIterations, config.PasswordSaltLength, 16), "secret", true, true},
+		{"missing field", passwordHashScheme + "$1000$c2FsdA", "secret", false, false},
+		{"extra field", passwordHashScheme + "$1000$c2FsdA$a2V5$x", "secret", false, false},
+		{"bad iterations", passwordHashScheme + "$abc$c2FsdA$a2V5", "secret", false, false},
+		{"zero iterations", passwordHashScheme + "$0$c2FsdA$a2V5", "secret", false, false},
+		{"bad salt", passwordHashScheme + "$1000$!!!$a2V5", "secret", false, false},
+		{"empty key", passwordHashScheme + "$1000$c2FsdA$", "secret", false, false},
+		{"scheme only", passwordHashScheme + "$", passwordHashScheme + "$", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, needsRehash := VerifyPassword(tt.stored, tt.password)
+			if match != tt.match || needsRehash != tt.needsRehash {
+				t.Errorf("VerifyPassword(%q, %q) = (%v, %v), want (%v, %v)",
+					tt.stored, tt.password, match, needsRehash, tt.match, tt.needsRehash)
+			}
+		})
+	}
+}
+
+func TestAuthenticateUserUpgradesLegacyPassword(t *testing.T) {
+	createTestUser(t, "legacy-login", "plaintext")
+
+	user, err := GetUserByUsernameDB("legacy-login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if AuthenticateUser(user, "wrong") {
+		t.Fatal("AuthenticateUser accepted a wrong password")
+	}
+	if !AuthenticateUser(user, "plaintext") {
+		t.Fatal("AuthenticateUser rejected the legacy password")
+	}
+
+	user, err = GetUserByUsernameDB("legacy-login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPasswordHashed(user.Password) {
+		t.Fatalf("password still stored as %q after login", user.Password)
+	}
+	if match, needsRehash := VerifyPassword(user.Password, "plaintext"); !match || needsRehash {
+		t.Errorf("VerifyPassword after upgrade = (%v, %v), want (true, false)", match, needsRehash)
+	}
+}
+
+func TestUpgradeLegacyPasswords(t *testing.T) {
+	createTestUser(t, "legacy-upgrade", "hunter2")
+	hashed, err := HashPassword("already hashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestUser(t, "hashed-upgrade", hashed)
+
+	if _, err := UpgradeLegacyPasswords(); err != nil {
+		t.Fatalf("UpgradeLegacyPasswords: %v", err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+	}{
+		{"legacy-upgrade", "hunter2"},
+		{"hashed-upgrade", "already hashed"},
+	}
+	for _, tt := range tests {
+		user, err := GetUserByUsernameDB(tt.username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsPasswordHashed(user.Password) {
+			t.Errorf("%s: password still stored as %q", tt.username, user.Password)
+		}
+		if match, needsRehash := VerifyPassword(user.Password, tt.password); !match || needsRehash {
+			t.Errorf("%s: VerifyPassword = (%v, %v), want (true, false)", tt.username, match, needsRehash)
+		}
+	}
+
+	user, _ := GetUserByUsernameDB("hashed-upgrade")
+	if user.Password != hashed {
+		t.Errorf("an already hashed password was hashed again")
+	}
+
+	if upgraded, err := UpgradeLegacyPasswords(); err != nil || upgraded != 0 {
+		t.Errorf("second UpgradeLegacyPasswords = (%d, %v), want (0, nil)", upgraded, err)
+	}
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// PeriodicTask runs a maintenance function on a fixed interval in the background
+type PeriodicTask struct {
+	name      string
+	interval  time.Duration
+	task      func() error
+	stopChan  chan struct{}
+	wg        sync.WaitGroup
+	isRunning bool
+	mu        sync.Mutex
+}
+
+// NewPeriodicTask creates a background task that calls fn every interval
+func NewPeriodicTask(name string, interval time.Duration, fn func() error) *PeriodicTask {
+	return &PeriodicTask{
+		name:     name,
+		interval: interval,
+		task:     fn,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start runs the task once immediately and then on every interval
+func (pt *PeriodicTask) Start() {
+	pt.mu.Lock()
+	if pt.isRunning {
+		pt.mu.Unlock()
+		return
+	}
+	pt.isRunning = true
+	pt.mu.Unlock()
+
+	pt.wg.Add(1)
+	go pt.run()
+
+	log.Printf("✓ %s started (every %s)", pt.name, pt.interval)
+}
+
+// Stop gracefully stops the task and waits for a running pass to finish
+func (pt *PeriodicTask) Stop() {
+	pt.mu.Lock()
+	if !pt.isRunning {
+		pt.mu.Unlock()
+		return
+	}
+	pt.isRunning = false
+	pt.mu.Unlock()
+
+	close(pt.stopChan)
+	pt.wg.Wait()
+	log.Printf("%s stopped", pt.name)
+}
+
+// run is the main task loop
+func (pt *PeriodicTask) run() {
+	defer pt.wg.Done()
+
+	ticker := time.NewTicker(pt.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := pt.task(); err != nil {
+			log.Printf("✗ %s failed: %v", pt.name, err)
+		}
+
+		select {
+		case <-pt.stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
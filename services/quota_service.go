@@ -0,0 +1,112 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// ErrQuotaExceeded is returned when a write would take a user over their quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// GetUserQuota returns a user's quota in bytes (0 means unlimited) and
+// whether it is an admin override rather than the global default. Group
+// accounts fall back to the group default.
+func GetUserQuota(username string) (quota int64, custom bool, err error) {
+	var override sql.NullInt64
+	var loginType sql.NullString
+	err = db.QueryRow(`SELECT storage_quota, login_type FROM users WHERE username = ?`, username).Scan(&override, &loginType)
+	if err == sql.ErrNoRows {
+		return 0, false, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get storage quota: %w", err)
+	}
+	if override.Valid {
+		return override.Int64, true, nil
+	}
+	if loginType.String == LoginTypeGroup {
+		return config.DefaultGroupQuota, false, nil
+	}
+	return config.DefaultStorageQuota, false, nil
+}
+
+// SetUserQuota stores an admin override in bytes (0 = unlimited), or
+// returns the user to the default quota when quota is nil
+func SetUserQuota(username string, quota *int64) error {
+	if quota != nil && *quota < 0 {
+		return fmt.Errorf("quota cannot be negative")
+	}
+
+	result, err := db.Exec(`UPDATE users SET storage_quota = ? WHERE username = ?`, quota, username)
+	if err != nil {
+		return fmt.Errorf("failed to update storage quota: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// GetRemainingQuota returns how many more bytes a user may store, or -1 if
+// their quota is unlimited
+func GetRemainingQuota(username string) (int64, error) {
+	quota, _, err := GetUserQuota(username)
+	if err != nil {
+		return 0, err
+	}
+	if quota == 0 {
+		return -1, nil
+	}
+
+	used, _, err := GetUserStorageStats(username)
+	if err != nil {
+		return 0, err
+	}
+	if used >= quota {
+		return 0, nil
+	}
+	return quota - used, nil
+}
+
+// CheckQuota fails with ErrQuotaExceeded if storing size more bytes would
+// take the user over their quota. Callers hold the user's write lock so
+// concurrent uploads cannot both squeeze in.
+func CheckQuota(username string, size int64) error {
+	remaining, err := GetRemainingQuota(username)
+	if err != nil {
+		return err
+	}
+	if remaining >= 0 && size > remaining {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// quotaWriter fails once more than limit bytes have been written
+type quotaWriter struct {
+	w       io.Writer
+	limit   int64
+	written int64
+}
+
+// NewQuotaWriter wraps w so a streaming copy is aborted with
+// ErrQuotaExceeded as soon as it passes limit bytes (negative = no limit)
+func NewQuotaWriter(w io.Writer, limit int64) io.Writer {
+	if limit < 0 {
+		return w
+	}
+	return &quotaWriter{w: w, limit: limit}
+}
+
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	if qw.written+int64(len(p)) > qw.limit {
+		return 0, ErrQuotaExceeded
+	}
+	n, err := qw.w.Write(p)
+	qw.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestQuotaWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int64
+		writes  []string
+		written string
+		err     error
+	}{
+		{"under the limit", 10, []string{"abc", "def"}, "abcdef", nil},
+		{"exactly the limit", 6, []string{"abc", "def"}, "abcdef", nil},
+		{"single write over the limit", 5, []string{"abcdef"}, "", ErrQuotaExceeded},
+		{"second write over the limit", 5, []string{"abc", "def"}, "abc", ErrQuotaExceeded},
+		{"writes after the limit", 3, []string{"abc", "d", "e"}, "abc", ErrQuotaExceeded},
+		{"empty write at the limit", 3, []string{"abc", ""}, "abc", nil},
+		{"zero limit", 0, []string{"a"}, "", ErrQuotaExceeded},
+		{"zero limit, nothing written", 0, []string{""}, "", nil},
+		{"no limit", -1, []string{"abc", "def"}, "abcdef", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewQuotaWriter(&buf, tt.limit)
+
+			var err error
+			for _, s := range tt.writes {
+				var n int
+				n, err = w.Write([]byte(s))
+				if err != nil {
+					if n != 0 {
+						t.Errorf("rejected write reported %d bytes written", n)
+					}
+					break
+				}
+				if n != len(s) {
+					t.Errorf("Write(%q) = %d", s, n)
+				}
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+			if buf.String() != tt.written {
+				t.Errorf("written %q, want %q", buf.String(), tt.written)
+			}
+		})
+	}
+}
+
+func TestQuotaWriterNoLimitIsPassthrough(t *testing.T) {
+	var buf bytes.Buffer
+	if w := NewQuotaWriter(&buf, -1); w != io.Writer(&buf) {
+		t.Errorf("NewQuotaWriter(w, -1) = %T, want w itself", w)
+	}
+}
+
+func TestQuotaWriterCopy(t *testing.T) {
+	tests := []struct {
+		size  int
+		limit int64
+		err   error
+	}{
+		{1 << 20, 1 << 20, nil},
+		{1<<20 + 1, 1 << 20, ErrQuotaExceeded},
+		{1 << 20, 1 << 10, ErrQuotaExceeded},
+		{1 << 20, -1, nil},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		_, err := io.Copy(NewQuotaWriter(&buf, tt.limit), strings.NewReader(strings.Repeat("x", tt.size)))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("copy %d bytes, limit %d: err = %v, want %v", tt.size, tt.limit, err, tt.err)
+		}
+		if tt.limit >= 0 && int64(buf.Len()) > tt.limit {
+			t.Errorf("copy %d bytes, limit %d: %d bytes got through", tt.size, tt.limit, buf.Len())
+		}
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	createTestUser(t, "quota-check", "x")
+	hash := strings.Repeat("ab", 32)
+	if err := AddFileMetadata("quota-check", "a.bin", "a.bin", "", "application/octet-stream", hash, 60, false); err != nil {
+		t.Fatal(err)
+	}
+
+	limit := func(n int64) *int64 { return &n }
+	tests := []struct {
+		name  string
+		quota *int64
+		size  int64
+		err   error
+	}{
+		{"fits", limit(100), 40, nil},
+		{"over by one byte", limit(100), 41, ErrQuotaExceeded},
+		{"already over", limit(50), 1, ErrQuotaExceeded},
+		{"already over, nothing to add", limit(50), 0, nil},
+		{"unlimited", limit(0), 1 << 40, nil},
+		{"default quota", nil, 1 << 20, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetUserQuota("quota-check", tt.quota); err != nil {
+				t.Fatal(err)
+			}
+			if err := CheckQuota("quota-check", tt.size); !errors.Is(err, tt.err) {
+				t.Errorf("CheckQuota(%d) = %v, want %v", tt.size, err, tt.err)
+			}
+		})
+	}
+
+	if err := CheckQuota("nobody", 1); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("CheckQuota for an unknown user = %v, want %v", err, ErrUserNotFound)
+	}
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+var (
+	// ErrSavedSearchNotFound is returned for a saved search the user does
+	// not have
+	ErrSavedSearchNotFound = errors.New("saved search not found")
+	// ErrInvalidSavedSearchName is returned for an empty or overlong name
+	ErrInvalidSavedSearchName = errors.New("a saved search needs a name of up to 100 characters")
+	// ErrTooManySavedSearches is returned when a user has
+	// config.MaxSavedSearches already
+	ErrTooManySavedSearches = fmt.Errorf("you can keep up to %d saved searches", config.MaxSavedSearches)
+)
+
+// SaveSearch keeps a search under a name, replacing one saved under the
+// same name. query holds the search's URL parameters.
+func SaveSearch(username, name, query string) (*models.SavedSearch, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > 100 {
+		return nil, ErrInvalidSavedSearchName
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM saved_searches WHERE username = ? AND name != ?`, username, name).Scan(&count)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count saved searches: %w", err)
+	}
+	if count >= config.MaxSavedSearches {
+		return nil, ErrTooManySavedSearches
+	}
+
+	saved := models.SavedSearch{Name: name, Query: query, CreatedAt: time.Now().UTC()}
+	err = tx.QueryRow(`INSERT INTO saved_searches (username, name, query, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(username, name) DO UPDATE SET query = excluded.query, created_at = excluded.created_at
+		RETURNING id`, username, name, query, saved.CreatedAt).Scan(&saved.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save search: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to save search: %w", err)
+	}
+	return &saved, nil
+}
+
+// ListSavedSearches returns a user's saved searches by name
+func ListSavedSearches(username string) ([]models.SavedSearch, error) {
+	rows, err := db.Query(`SELECT id, name, query, created_at FROM saved_searches WHERE username = ? ORDER BY name COLLATE NOCASE`, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list saved searches: %w", err)
+	}
+	defer rows.Close()
+
+	searches := []models.SavedSearch{}
+	for rows.Next() {
+		var saved models.SavedSearch
+		if err := rows.Scan(&saved.ID, &saved.Name, &saved.Query, &saved.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan saved search: %w", err)
+		}
+		searches = append(searches, saved)
+	}
+	return searches, rows.Err()
+}
+
+// DeleteSavedSearch removes one of a user's saved searches
+func DeleteSavedSearch(username string, id int64) error {
+	result, err := db.Exec(`DELETE FROM saved_searches WHERE id = ? AND username = ?`, id, username)
+	if err != nil {
+		return fmt.Errorf("failed to delete saved search: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrSavedSearchNotFound
+	}
+	return nil
+}
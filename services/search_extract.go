@@ -0,0 +1,398 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// Text extraction for the search index. Only formats whose text can be
+// read without outside tools are handled: plain text, Markdown and source
+// code, the XML inside Office Open XML and OpenDocument files, and the
+// text operators of PDF pages that use simple fonts. Anything else is
+// found by its name and path only.
+
+// plainTextExts are read as they are
+var plainTextExts = map[string]bool{
+	".txt": true, ".text": true, ".md": true, ".markdown": true, ".rst": true, ".org": true, ".tex": true,
+	".csv": true, ".tsv": true, ".log": true, ".srt": true, ".vtt": true,
+	".json": true, ".xml": true, ".yaml": true, ".yml": true, ".toml": true, ".ini": true, ".conf": true, ".cfg": true, ".env": true,
+	".html": true, ".htm": true, ".css": true, ".scss": true, ".less": true, ".svg": true,
+	".go": true, ".js": true, ".mjs": true, ".jsx": true, ".ts": true, ".tsx": true, ".vue": true,
+	".py": true, ".java": true, ".kt": true, ".scala": true, ".c": true, ".h": true, ".cpp": true, ".cc": true, ".hpp": true,
+	".cs": true, ".rs": true, ".rb": true, ".php": true, ".swift": true, ".lua": true, ".pl": true, ".r": true, ".dart": true,
+	".sh": true, ".bash": true, ".zsh": true, ".bat": true, ".cmd": true, ".ps1": true, ".sql": true, ".gradle": true,
+}
+
+// officeTextParts lists where each office format keeps its text. A
+// trailing "*" matches numbered parts such as one per slide.
+var officeTextParts = map[string][]string{
+	".docx": {"word/document.xml"},
+	".xlsx": {"xl/sharedStrings.xml"},
+	".pptx": {"ppt/slides/slide*.xml"},
+	".odt":  {"content.xml"},
+	".ods":  {"content.xml"},
+	".odp":  {"content.xml"},
+}
+
+// xmlBreakElements end a paragraph, cell or line in office XML
+var xmlBreakElements = map[string]bool{"p": true, "h": true, "br": true, "tab": true, "si": true, "tc": true, "table-cell": true}
+
+// isExtractable reports whether the text of a file can be indexed
+func isExtractable(filename, mimeType string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return plainTextExts[ext] || officeTextParts[ext] != nil || ext == ".pdf" || strings.HasPrefix(mimeType, "text/")
+}
+
+// extractText returns the searchable text of stored content, at most
+// config.SearchMaxTextSize bytes of it. Content of a format that cannot
+// be read, or larger than config.SearchMaxExtractSize, has none.
+func extractText(filename, mimeType, hash string, size int64) (string, error) {
+	if !isExtractable(filename, mimeType) || size > config.SearchMaxExtractSize || !isBlobHash(hash) {
+		return "", nil
+	}
+
+	var text string
+	var err error
+	switch ext := strings.ToLower(filepath.Ext(filename)); {
+	case officeTextParts[ext] != nil:
+		text, err = extractOfficeText(BlobPath(hash), officeTextParts[ext])
+	case ext == ".pdf":
+		text, err = extractPDFText(BlobPath(hash))
+	default:
+		text, err = extractPlainText(BlobPath(hash))
+	}
+	if err != nil {
+		return "", err
+	}
+	return cleanExtractedText(text), nil
+}
+
+// extractPlainText reads a text file, skipping anything that looks binary
+func extractPlainText(blobPath string) (string, error) {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, config.SearchMaxTextSize))
+	if err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", nil
+	}
+	return string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))), nil
+}
+
+// extractOfficeText collects the character data of the XML parts of a
+// zipped office document
+func extractOfficeText(blobPath string, parts []string) (string, error) {
+	archive, err := zip.OpenReader(blobPath)
+	if err != nil {
+		// Not a valid document; index it by name only
+		return "", nil
+	}
+	defer archive.Close()
+
+	var matched []*zip.File
+	for _, file := range archive.File {
+		for _, part := range parts {
+			if ok, _ := path.Match(part, file.Name); ok {
+				matched = append(matched, file)
+				break
+			}
+		}
+	}
+	// slide2.xml before slide10.xml
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i].Name, matched[j].Name
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+
+	var text strings.Builder
+	for _, file := range matched {
+		if text.Len() >= config.SearchMaxTextSize {
+			break
+		}
+		rc, err := file.Open()
+		if err != nil {
+			continue
+		}
+		// Limited, so a zip bomb cannot run the indexer out of memory
+		xmlText(io.LimitReader(rc, config.SearchMaxExtractSize), &text)
+		rc.Close()
+		text.WriteByte('\n')
+	}
+	return text.String(), nil
+}
+
+// xmlText appends the character data of an XML document to text, with a
+// line break after each paragraph-like element
+func xmlText(r io.Reader, text *strings.Builder) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	for text.Len() < config.SearchMaxTextSize {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if xmlBreakElements[t.Name.Local] {
+				text.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// extractPDFText reads the text shown by a PDF's content streams. Only
+// strings in a simple font's encoding come out readable; text drawn with
+// embedded CID fonts or as images is not found.
+func extractPDFText(blobPath string) (string, error) {
+	data, err := os.ReadFile(blobPath)
+	if err != nil {
+		return "", err
+	}
+
+	var text strings.Builder
+	for rest := data; text.Len() < config.SearchMaxTextSize; {
+		start := bytes.Index(rest, []byte("stream"))
+		if start < 0 {
+			break
+		}
+		// The stream's dictionary is between the object header and here
+		dict := rest[:start]
+		if obj := bytes.LastIndex(dict, []byte(" obj")); obj >= 0 {
+			dict = dict[obj:]
+		}
+		body := rest[start+len("stream"):]
+		body = bytes.TrimPrefix(body, []byte("\r"))
+		body = bytes.TrimPrefix(body, []byte("\n"))
+		end := bytes.Index(body, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		rest = body[end+len("endstream"):]
+
+		if content := pdfStreamContent(dict, body[:end]); content != nil {
+			pdfContentText(content, &text)
+		}
+	}
+	return text.String(), nil
+}
+
+// pdfStreamContent returns the decoded bytes of a stream that may hold
+// page content, or nil for images, fonts and filters that are not handled
+func pdfStreamContent(dict, body []byte) []byte {
+	for _, skip := range []string{"/Image", "/Length1", "/XRef", "/ObjStm", "/Metadata"} {
+		if bytes.Contains(dict, []byte(skip)) {
+			return nil
+		}
+	}
+	if !bytes.Contains(dict, []byte("/Filter")) {
+		return body
+	}
+	if !bytes.Contains(dict, []byte("/FlateDecode")) {
+		return nil
+	}
+	for _, filter := range []string{"/ASCII85Decode", "/ASCIIHexDecode", "/LZWDecode", "/RunLengthDecode", "/DCTDecode", "/JPXDecode"} {
+		if bytes.Contains(dict, []byte(filter)) {
+			return nil
+		}
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+	// A truncated stream still yields what was decoded before the error
+	content, _ := io.ReadAll(io.LimitReader(zr, config.SearchMaxExtractSize))
+	return content
+}
+
+// pdfContentText appends the strings shown between BT and ET in a content
+// stream to text. The pieces of a TJ array are joined, each show operator
+// ends a word and each text object a line.
+func pdfContentText(content []byte, text *strings.Builder) {
+	inText := false
+	var shown []byte
+	for i := 0; i < len(content) && text.Len() < config.SearchMaxTextSize; {
+		c := content[i]
+		switch {
+		case c == '(':
+			s, next := pdfLiteralString(content, i)
+			if inText {
+				shown = append(shown, s...)
+			}
+			i = next
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			s, next := pdfHexString(content, i)
+			if inText {
+				shown = append(shown, s...)
+			}
+			i = next
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case isPDFRegular(c):
+			start := i
+			for i < len(content) && isPDFRegular(content[i]) {
+				i++
+			}
+			switch string(content[start:i]) {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				text.WriteByte('\n')
+			case "Tj", "TJ", "'", "\"":
+				writeLatin1(text, shown)
+				text.WriteByte(' ')
+				shown = shown[:0]
+			}
+		default:
+			i++
+		}
+	}
+}
+
+// isPDFRegular reports whether c can be part of a PDF operator or number
+func isPDFRegular(c byte) bool {
+	return c > ' ' && c < 0x7f && !strings.ContainsRune("()<>[]{}/%", rune(c))
+}
+
+// pdfLiteralString decodes the (string) starting at content[start] and
+// returns it with the index just past it
+func pdfLiteralString(content []byte, start int) ([]byte, int) {
+	var s []byte
+	depth := 0
+	for i := start; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '\\' && i+1 < len(content):
+			i++
+			switch e := content[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r', 't', 'b', 'f':
+				s = append(s, ' ')
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for n := 0; n < 3 && i < len(content) && content[i] >= '0' && content[i] <= '7'; n++ {
+						v = v*8 + int(content[i]-'0')
+						i++
+					}
+					i--
+					s = append(s, byte(v))
+				} else {
+					s = append(s, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				s = append(s, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return s, i + 1
+			}
+			s = append(s, c)
+		default:
+			s = append(s, c)
+		}
+	}
+	return s, len(content)
+}
+
+// pdfHexString decodes the <hex string> starting at content[start]. Hex
+// strings usually hold glyph IDs rather than characters, so one that does
+// not decode to printable text is dropped.
+func pdfHexString(content []byte, start int) ([]byte, int) {
+	end := bytes.IndexByte(content[start:], '>')
+	if end < 0 {
+		return nil, len(content)
+	}
+	var digits []byte
+	for _, c := range content[start+1 : start+end] {
+		if unicode.Is(unicode.ASCII_Hex_Digit, rune(c)) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	s := make([]byte, len(digits)/2)
+	for i := range s {
+		s[i] = hexValue(digits[2*i])<<4 | hexValue(digits[2*i+1])
+		if s[i] < ' ' || s[i] >= 0x7f {
+			return nil, start + end + 1
+		}
+	}
+	return s, start + end + 1
+}
+
+// hexValue returns the value of a hex digit
+func hexValue(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// writeLatin1 appends bytes in a single-byte PDF encoding to text, read as
+// Latin-1, which is right for the letters most text uses
+func writeLatin1(text *strings.Builder, s []byte) {
+	for _, c := range s {
+		text.WriteRune(rune(c))
+	}
+}
+
+// cleanExtractedText makes extracted text valid UTF-8 without control
+// characters (which also keeps the search highlight markers unambiguous),
+// and cuts it to config.SearchMaxTextSize bytes
+func cleanExtractedText(text string) string {
+	text = strings.ToValidUTF8(text, " ")
+	text = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+	if len(text) > config.SearchMaxTextSize {
+		text = text[:config.SearchMaxTextSize]
+		for len(text) > 0 && !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return strings.TrimSpace(text)
+}
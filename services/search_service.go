@@ -0,0 +1,584 @@
+package services
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+// Files are searched through file_search, an FTS5 table with one row per
+// file or folder (rowid = files.id) holding its name, path, tags and the
+// text extracted from its content.
+//
+// Triggers on files queue every added, renamed, moved or changed row in
+// search_queue and drop deleted rows from the index straight away, so no
+// code path has to remember to. The search indexer then works through the
+// queue in the background, reading content only when it changed: a moved
+// file keeps the text it was indexed with.
+
+// ErrEmptySearch is returned for a query with no words to look for
+var ErrEmptySearch = errors.New("enter at least one word to search for")
+
+// Highlighted matches are marked with control characters, which neither
+// names nor extracted text contain, and turned into <mark> once escaped
+const (
+	searchMarkStart = "\x02"
+	searchMarkEnd   = "\x03"
+)
+
+// searchTriggersSQL keeps the search queue in step with the files table
+const searchTriggersSQL = `
+	CREATE TRIGGER IF NOT EXISTS files_search_insert AFTER INSERT ON files BEGIN
+		INSERT OR REPLACE INTO search_queue (file_id) VALUES (NEW.id);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS files_search_update AFTER UPDATE OF filename, storage_path, parent_path, file_hash ON files BEGIN
+		INSERT OR REPLACE INTO search_queue (file_id) VALUES (NEW.id);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS files_search_delete AFTER DELETE ON files BEGIN
+		DELETE FROM file_search WHERE rowid = OLD.id;
+		DELETE FROM search_queue WHERE file_id = OLD.id;
+	END;`
+
+// initSearchIndex installs the search triggers and queues the files the
+// index does not have yet, such as all of them after an upgrade
+func initSearchIndex() error {
+	if _, err := db.Exec(searchTriggersSQL); err != nil {
+		return fmt.Errorf("failed to create search triggers: %w", err)
+	}
+	_, err := db.Exec(`INSERT OR IGNORE INTO search_queue (file_id)
+		SELECT id FROM files WHERE id NOT IN (SELECT rowid FROM file_search)`)
+	if err != nil {
+		return fmt.Errorf("failed to queue files for indexing: %w", err)
+	}
+	return nil
+}
+
+// searchPathSQL is the path of a files row as indexed, e.g. "Work/notes.md"
+const searchPathSQL = `CASE WHEN parent_path = '/' THEN filename ELSE parent_path || '/' || filename END`
+
+// queuedFile is a file waiting to be indexed
+type queuedFile struct {
+	queueID  int64
+	fileID   int64
+	filename string
+	mimeType string
+	fileHash string
+	fileSize int64
+	found    bool
+}
+
+// IndexPendingFiles indexes the queued files, one batch at a time until
+// the queue is empty, and returns how many it indexed
+func IndexPendingFiles() (int, error) {
+	indexed := 0
+	for {
+		batch, err := nextSearchBatch()
+		if err != nil || len(batch) == 0 {
+			return indexed, err
+		}
+		if err := indexSearchBatch(batch); err != nil {
+			return indexed, err
+		}
+		indexed += len(batch)
+	}
+}
+
+// nextSearchBatch reads the oldest queued files with what indexing needs
+// to know about them
+func nextSearchBatch() ([]queuedFile, error) {
+	query := `SELECT q.id, q.file_id, f.id IS NOT NULL, COALESCE(f.filename, ''), COALESCE(f.mime_type, ''),
+			COALESCE(f.file_hash, ''), COALESCE(f.file_size, 0)
+		FROM search_queue q LEFT JOIN files f ON f.id = q.file_id
+		ORDER BY q.id LIMIT ?`
+	rows, err := db.Query(query, config.SearchIndexBatch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read search queue: %w", err)
+	}
+	defer rows.Close()
+
+	var batch []queuedFile
+	for rows.Next() {
+		var file queuedFile
+		if err := rows.Scan(&file.queueID, &file.fileID, &file.found, &file.filename, &file.mimeType, &file.fileHash, &file.fileSize); err != nil {
+			return nil, fmt.Errorf("failed to scan search queue: %w", err)
+		}
+		batch = append(batch, file)
+	}
+	return batch, rows.Err()
+}
+
+// indexSearchBatch writes the index rows of a batch. Text is extracted
+// before the transaction, as it may take a while. Name and path are read
+// from files in the same statement that writes the row, and a queue entry
+// is only cleared if it was not queued again meanwhile, so a change made
+// while the batch ran is picked up by the next one.
+func indexSearchBatch(batch []queuedFile) error {
+	contents := make([]sql.NullString, len(batch))
+	for i, file := range batch {
+		if !file.found || file.fileHash == "" {
+			continue
+		}
+		var indexedHash string
+		err := db.QueryRow(`SELECT file_hash FROM file_search WHERE rowid = ?`, file.fileID).Scan(&indexedHash)
+		if err == nil && indexedHash == file.fileHash {
+			// Same content as indexed; keep its text (NULL below)
+			continue
+		}
+		text, err := extractText(file.filename, file.mimeType, file.fileHash, file.fileSize)
+		if err != nil {
+			log.Printf("Warning: failed to extract text of file %d: %v", file.fileID, err)
+		}
+		contents[i] = sql.NullString{String: text, Valid: true}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	insert := `INSERT OR REPLACE INTO file_search (rowid, filename, path, tags, content, file_hash)
+		SELECT f.id, f.filename, ` + searchPathSQL + `,
+			COALESCE((SELECT group_concat(t.name, ' ') FROM file_tags ft JOIN tags t ON t.id = ft.tag_id WHERE ft.file_id = f.id), ''),
+			COALESCE(?, (SELECT content FROM file_search WHERE rowid = f.id), ''), COALESCE(f.file_hash, '')
+		FROM files f WHERE f.id = ? AND COALESCE(f.file_hash, '') = ?`
+	for i, file := range batch {
+		if file.found {
+			if _, err := tx.Exec(insert, contents[i], file.fileID, file.fileHash); err != nil {
+				return fmt.Errorf("failed to index file %d: %w", file.fileID, err)
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM search_queue WHERE id = ?`, file.queueID); err != nil {
+			return fmt.Errorf("failed to update search queue: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// PendingSearchCount returns how many of a user's files are waiting to be
+// indexed, and so may be missing from search results
+func PendingSearchCount(username string) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM search_queue q JOIN files f ON f.id = q.file_id WHERE f.username = ?`, username).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count queued files: %w", err)
+	}
+	return count, nil
+}
+
+// InitSearchIndexer creates the background task that keeps the search
+// index up to date
+func InitSearchIndexer() *PeriodicTask {
+	return NewPeriodicTask("Search indexer", config.SearchIndexInterval, func() error {
+		_, err := IndexPendingFiles()
+		return err
+	})
+}
+
+// ==================== QUERIES ====================
+
+// BuildSearchQuery turns what a user typed into an FTS5 query. Words match
+// as prefixes ("repo" finds "report"), "quoted phrases" match exactly and
+// in order, OR between two terms accepts either, and a -word excludes
+// results containing it. Everything else the FTS5 syntax would treat
+// specially is matched as text.
+func BuildSearchQuery(input string) (string, error) {
+	var groups [][]string // ANDed together; the terms of each are ORed
+	var excluded []string
+	joinNext := false
+
+	for _, term := range splitSearchTerms(input) {
+		if !term.phrase && term.text == "OR" && len(groups) > 0 {
+			joinNext = true
+			continue
+		}
+		words := searchWords(term.text)
+		if len(words) == 0 {
+			continue
+		}
+		expr := `"` + strings.Join(words, " ") + `"`
+		if !term.phrase {
+			expr += "*"
+		}
+		switch {
+		case term.exclude:
+			excluded = append(excluded, expr)
+		case joinNext:
+			groups[len(groups)-1] = append(groups[len(groups)-1], expr)
+		default:
+			groups = append(groups, []string{expr})
+		}
+		joinNext = false
+	}
+	if len(groups) == 0 {
+		return "", ErrEmptySearch
+	}
+
+	var parts []string
+	for _, group := range groups {
+		if len(group) == 1 {
+			parts = append(parts, group[0])
+		} else {
+			parts = append(parts, "("+strings.Join(group, " OR ")+")")
+		}
+	}
+	query := strings.Join(parts, " AND ")
+	for _, expr := range excluded {
+		query += " NOT " + expr
+	}
+	return query, nil
+}
+
+// searchTerm is a word or phrase of a search
+type searchTerm struct {
+	text    string
+	phrase  bool
+	exclude bool
+}
+
+// splitSearchTerms splits a search into words and "quoted phrases"; an
+// unclosed quote runs to the end
+func splitSearchTerms(input string) []searchTerm {
+	var terms []searchTerm
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+		term := searchTerm{}
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			term.exclude = true
+			i++
+		}
+		start := i
+		if runes[i] == '"' {
+			term.phrase = true
+			i++
+			start = i
+			for i < len(runes) && runes[i] != '"' {
+				i++
+			}
+			term.text = string(runes[start:i])
+			i++
+		} else {
+			for i < len(runes) && !unicode.IsSpace(runes[i]) {
+				i++
+			}
+			term.text = string(runes[start:i])
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// searchWords splits text into the tokens the index holds: runs of letters
+// and digits, as the unicode61 tokenizer sees them
+func searchWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.Is(unicode.Mn, r)
+	})
+}
+
+// markedHTML escapes text marked by snippet() or highlight() and turns the
+// marks into <mark> elements
+func markedHTML(text string) string {
+	escaped := html.EscapeString(text)
+	escaped = strings.ReplaceAll(escaped, searchMarkStart, "<mark>")
+	return strings.ReplaceAll(escaped, searchMarkEnd, "</mark>")
+}
+
+// Sort orders of SearchFiles
+const (
+	SearchSortRelevance = "relevance" // Best matches first; only for text searches
+	SearchSortName      = "name"
+	SearchSortSize      = "size"
+	SearchSortUploaded  = "uploaded"
+	SearchSortModified  = "modified"
+)
+
+// searchSortKeys are what each order sorts by. Times are compared as the
+// text they are stored as, like everywhere else, and cast so the driver
+// hands the cursor the same text back.
+var searchSortKeys = map[string]string{
+	SearchSortRelevance: "bm25(file_search, 10.0, 2.0, 5.0, 1.0)",
+	SearchSortName:      "lower(f.filename)",
+	SearchSortSize:      "f.file_size",
+	SearchSortUploaded:  "CAST(f.uploaded_at AS TEXT)",
+	SearchSortModified:  "CAST(f.modified_at AS TEXT)",
+}
+
+var (
+	// ErrInvalidSearchSort is returned for an unknown sort order, or
+	// relevance without text to match
+	ErrInvalidSearchSort = errors.New("invalid sort order")
+	// ErrInvalidSearchCursor is returned for a cursor that was not made
+	// by a search with the same order
+	ErrInvalidSearchCursor = errors.New("invalid page cursor")
+)
+
+// SearchFilter describes a search of a user's files. Every field is
+// optional; a zero value leaves that filter out, and an empty filter
+// finds everything.
+type SearchFilter struct {
+	Text              string   // Words and phrases, see BuildSearchQuery
+	Within            string   // Only this file or folder and what is below it (storage path); paths are not matched
+	Folder            string   // Only what is below this folder (storage path)
+	Type              string   // "file" or "folder"
+	Extensions        []string // Only files ending in one of these (".mp4")
+	ExcludeExtensions []string // No files ending in one of these
+	MimeType          string   // This type, or all of a kind with "video/*"
+	MinSize           int64    // Files of at least this many bytes
+	MaxSize           int64    // Files of at most this many bytes
+	UploadedFrom      time.Time
+	UploadedTo        time.Time // Exclusive
+	ModifiedFrom      time.Time
+	ModifiedTo        time.Time // Exclusive
+	Tags              []string  // Only files and folders with all of these tags
+	ColorLabel        string    // Only files and folders with this color label
+	Sort              string    // A SearchSort order; relevance for text searches, else modified
+	Descending        bool      // Ignored for relevance
+	Cursor            string    // NextCursor of the previous page
+	Limit             int       // Results per page, at most config.SearchResultLimit
+}
+
+// searchCursor is where a page of results ends, as the sort key and ID of
+// its last result
+type searchCursor struct {
+	Sort       string      `json:"s"`
+	Descending bool        `json:"d,omitempty"`
+	Key        interface{} `json:"k"`
+	ID         int64       `json:"i"`
+}
+
+// encode returns the cursor as an opaque URL-safe string
+func (c searchCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeSearchCursor reads a cursor made for the given order
+func decodeSearchCursor(value, sort string, descending bool) (*searchCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidSearchCursor
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var cursor searchCursor
+	if err := decoder.Decode(&cursor); err != nil || cursor.Sort != sort || cursor.Descending != descending {
+		return nil, ErrInvalidSearchCursor
+	}
+
+	// Give the key back the type it came from the database with
+	switch key := cursor.Key.(type) {
+	case json.Number:
+		if sort == SearchSortSize {
+			cursor.Key, err = key.Int64()
+		} else {
+			cursor.Key, err = key.Float64()
+		}
+		if err != nil {
+			return nil, ErrInvalidSearchCursor
+		}
+	case string:
+	default:
+		return nil, ErrInvalidSearchCursor
+	}
+	return &cursor, nil
+}
+
+// conditions returns the WHERE conditions of the filters other than text,
+// on the files table as f
+func (filter *SearchFilter) conditions() ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, values ...interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+
+	// substr rather than LIKE so "_" and "%" in names match literally
+	if filter.Within != "" {
+		prefix := filter.Within + string(filepath.Separator)
+		add(`(f.storage_path = ? OR substr(f.storage_path, 1, length(?)) = ?)`, filter.Within, prefix, prefix)
+	}
+	if filter.Folder != "" {
+		prefix := filter.Folder + string(filepath.Separator)
+		add(`substr(f.storage_path, 1, length(?)) = ?`, prefix, prefix)
+	}
+	switch filter.Type {
+	case "file":
+		add(`f.is_directory = 0`)
+	case "folder":
+		add(`f.is_directory = 1`)
+	}
+	if len(filter.Extensions) > 0 {
+		add(`f.is_directory = 0 AND (`+strings.TrimSuffix(strings.Repeat(`lower(f.filename) LIKE ? OR `, len(filter.Extensions)), ` OR `)+`)`,
+			extensionPatterns(filter.Extensions)...)
+	}
+	if len(filter.ExcludeExtensions) > 0 {
+		add(`f.is_directory = 0 AND NOT (`+strings.TrimSuffix(strings.Repeat(`lower(f.filename) LIKE ? OR `, len(filter.ExcludeExtensions)), ` OR `)+`)`,
+			extensionPatterns(filter.ExcludeExtensions)...)
+	}
+	if mimeType := strings.ToLower(filter.MimeType); strings.HasSuffix(mimeType, "/*") {
+		prefix := strings.TrimSuffix(mimeType, "*")
+		add(`substr(lower(COALESCE(f.mime_type, '')), 1, length(?)) = ?`, prefix, prefix)
+	} else if mimeType != "" {
+		add(`lower(COALESCE(f.mime_type, '')) = ?`, mimeType)
+	}
+	if filter.MinSize > 0 {
+		add(`f.is_directory = 0 AND f.file_size >= ?`, filter.MinSize)
+	}
+	if filter.MaxSize > 0 {
+		add(`f.is_directory = 0 AND f.file_size <= ?`, filter.MaxSize)
+	}
+	if !filter.UploadedFrom.IsZero() {
+		add(`f.uploaded_at >= ?`, filter.UploadedFrom.UTC())
+	}
+	if !filter.UploadedTo.IsZero() {
+		add(`f.uploaded_at < ?`, filter.UploadedTo.UTC())
+	}
+	if !filter.ModifiedFrom.IsZero() {
+		add(`f.modified_at >= ?`, filter.ModifiedFrom.UTC())
+	}
+	if !filter.ModifiedTo.IsZero() {
+		add(`f.modified_at < ?`, filter.ModifiedTo.UTC())
+	}
+	for _, tag := range filter.Tags {
+		add(`f.id IN (SELECT ft.file_id FROM file_tags ft JOIN tags t ON t.id = ft.tag_id WHERE t.username = f.username AND t.name = ?)`, tag)
+	}
+	if filter.ColorLabel != "" {
+		add(`f.color_label = ?`, filter.ColorLabel)
+	}
+	return conditions, args
+}
+
+// extensionPatterns returns LIKE patterns matching names ending in exts
+func extensionPatterns(exts []string) []interface{} {
+	patterns := make([]interface{}, len(exts))
+	for i, ext := range exts {
+		patterns[i] = "%" + strings.ToLower(ext)
+	}
+	return patterns
+}
+
+// SearchFiles returns a page of a user's files and folders that match a
+// filter, with the cursor of the next page ("" after the last). Names of
+// text search results come back with their matches highlighted, and a
+// snippet of the best matching column.
+func SearchFiles(username string, filter SearchFilter) ([]models.SearchResult, string, error) {
+	sort := filter.Sort
+	if sort == "" {
+		sort = SearchSortModified
+		if filter.Text != "" {
+			sort = SearchSortRelevance
+		}
+	}
+	key, ok := searchSortKeys[sort]
+	if !ok || (sort == SearchSortRelevance && filter.Text == "") {
+		return nil, "", ErrInvalidSearchSort
+	}
+	descending := filter.Descending && sort != SearchSortRelevance
+	limit := filter.Limit
+	if limit <= 0 || limit > config.SearchResultLimit {
+		limit = config.SearchResultLimit
+	}
+
+	columns := `f.id AS id, f.filename, f.storage_path, f.parent_path, f.file_size, COALESCE(f.mime_type, ''),
+			f.is_directory, f.uploaded_at, f.modified_at`
+	var inner string
+	var args []interface{}
+	if filter.Text != "" {
+		match, err := BuildSearchQuery(filter.Text)
+		if err != nil {
+			return nil, "", err
+		}
+		if filter.Within != "" {
+			// Paths start at the owner's root, above Within, so they would
+			// give away the names of folders the searcher cannot open
+			match = "{filename tags content} : (" + match + ")"
+		}
+		inner = `SELECT ` + columns + `, highlight(file_search, 0, ?, ?), snippet(file_search, -1, ?, ?, '…', 24),
+				` + key + ` AS sort_key
+			FROM file_search JOIN files f ON f.id = file_search.rowid
+			WHERE file_search MATCH ? AND f.username = ?`
+		args = append(args, searchMarkStart, searchMarkEnd, searchMarkStart, searchMarkEnd, match, username)
+	} else {
+		inner = `SELECT ` + columns + `, '', '', ` + key + ` AS sort_key FROM files f WHERE f.username = ?`
+		args = append(args, username)
+	}
+	conditions, conditionArgs := filter.conditions()
+	for _, condition := range conditions {
+		inner += ` AND ` + condition
+	}
+	args = append(args, conditionArgs...)
+
+	// Keyset pagination: continue after the last result of the previous
+	// page, with the ID breaking ties
+	query := `SELECT * FROM (` + inner + `)`
+	compare, direction := ">", "ASC"
+	if descending {
+		compare, direction = "<", "DESC"
+	}
+	if filter.Cursor != "" {
+		cursor, err := decodeSearchCursor(filter.Cursor, sort, descending)
+		if err != nil {
+			return nil, "", err
+		}
+		query += ` WHERE (sort_key ` + compare + ` ? OR (sort_key = ? AND id ` + compare + ` ?))`
+		args = append(args, cursor.Key, cursor.Key, cursor.ID)
+	}
+	query += ` ORDER BY sort_key ` + direction + `, id ` + direction + ` LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to search files: %w", err)
+	}
+	defer rows.Close()
+
+	var results []models.SearchResult
+	var last searchCursor
+	for rows.Next() {
+		if len(results) == limit {
+			// There is another page
+			return results, last.encode(), nil
+		}
+		var result models.SearchResult
+		var highlight, snippet string
+		var sortKey interface{}
+		err := rows.Scan(&result.ID, &result.Filename, &result.StoragePath, &result.ParentPath, &result.FileSize,
+			&result.MimeType, &result.IsDirectory, &result.UploadedAt, &result.ModifiedAt, &highlight, &snippet, &sortKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan search result: %w", err)
+		}
+		if filter.Text != "" {
+			result.Highlight = markedHTML(highlight)
+		} else {
+			result.Highlight = html.EscapeString(result.Filename)
+		}
+		// A snippet without a mark is from a column that did not match,
+		// e.g. the start of the content when only the name did
+		if strings.Contains(snippet, searchMarkStart) {
+			result.Snippet = markedHTML(snippet)
+		}
+		results = append(results, result)
+		last = searchCursor{Sort: sort, Descending: descending, Key: sortKey, ID: result.ID}
+	}
+	return results, "", rows.Err()
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+func TestBuildSearchQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		err   error
+	}{
+		{"word", "report", `"report"*`, nil},
+		{"words", "annual  report", `"annual"* AND "report"*`, nil},
+		{"phrase", `"annual report"`, `"annual report"`, nil},
+		{"phrase and word", `"annual report" 2024`, `"annual report" AND "2024"*`, nil},
+		{"OR", "cats OR dogs", `("cats"* OR "dogs"*)`, nil},
+		{"OR chain", "cats OR dogs OR birds pets", `("cats"* OR "dogs"* OR "birds"*) AND "pets"*`, nil},
+		{"OR with a phrase", `cats OR "big dogs"`, `("cats"* OR "big dogs")`, nil},
+		{"leading OR", "OR cats", `"OR"* AND "cats"*`, nil},
+		{"trailing OR", "cats OR", `"cats"*`, nil},
+		{"lowercase or", "cats or dogs", `"cats"* AND "or"* AND "dogs"*`, nil},
+		{"quoted OR", `cats "OR" dogs`, `"cats"* AND "OR" AND "dogs"*`, nil},
+		{"exclude", "report -draft", `"report"* NOT "draft"*`, nil},
+		{"exclude phrase", `report -"first draft"`, `"report"* NOT "first draft"`, nil},
+		{"exclude first", "-draft report", `"report"* NOT "draft"*`, nil},
+		{"lone dash", "a - b", `"a"* AND "b"*`, nil},
+		{"hyphenated word", "e-mail", `"e mail"*`, nil},
+		{"AND and NOT as text", "this AND NOT that", `"this"* AND "AND"* AND "NOT"* AND "that"*`, nil},
+		{"NEAR", "NEAR(a b, 3)", `"NEAR a"* AND "b"* AND "3"*`, nil},
+		{"column filter", "filename:secret", `"filename secret"*`, nil},
+		{"prefix and initial token", "^rep* +x", `"rep"* AND "x"*`, nil},
+		{"braces and parentheses", "{filename}:(a)", `"filename a"*`, nil},
+		{"quote inside a word", `it"s`, `"it s"*`, nil},
+		{"unclosed quote", `report "annual sum`, `"report"* AND "annual sum"`, nil},
+		{"unclosed exclude", `report -"annual`, `"report"* NOT "annual"`, nil},
+		{"accents and scripts", "café 東京", `"café"* AND "東京"*`, nil},
+		{"empty", "", "", ErrEmptySearch},
+		{"spaces", "   ", "", ErrEmptySearch},
+		{"punctuation only", `"" * ( )`, "", ErrEmptySearch},
+		{"exclude only", "-draft", "", ErrEmptySearch},
+		{"exclude only phrases", `-"first draft" -final`, "", ErrEmptySearch},
+		{"OR only", "OR", `"OR"*`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BuildSearchQuery(tt.input)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("BuildSearchQuery(%q) err = %v, want %v", tt.input, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("BuildSearchQuery(%q) = %s, want %s", tt.input, got, tt.want)
+			}
+			if err != nil {
+				return
+			}
+
+			// Whatever was typed, FTS5 accepts the result
+			var count int
+			if err := db.QueryRow(`SELECT COUNT(*) FROM file_search WHERE file_search MATCH ?`, got).Scan(&count); err != nil {
+				t.Errorf("MATCH %s: %v", got, err)
+			}
+		})
+	}
+}
+
+// searchResultNames returns the names of results in order
+func searchResultNames(results []models.SearchResult) []string {
+	names := make([]string, len(results))
+	for i, result := range results {
+		names[i] = result.Filename
+	}
+	return names
+}
+
+func TestSearchFilesPages(t *testing.T) {
+	const user = "search-pages"
+	createTestUser(t, user, "x")
+
+	// Uploaded in this order; two sizes are equal, so the ID breaks the tie
+	files := []struct {
+		path    string
+		content string
+	}{
+		{"report-b.txt", strings.Repeat("b", 30)},
+		{"Report-a.txt", strings.Repeat("a", 10)},
+		{"report-d.txt", strings.Repeat("d", 20)},
+		{"report-c.txt", strings.Repeat("c", 20)},
+	}
+	for _, file := range files {
+		uploadTestFile(t, user, file.path, file.content)
+	}
+	if _, err := IndexPendingFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sort       string
+		descending bool
+		want       []string // nil to only compare with a single page
+	}{
+		{SearchSortRelevance, false, nil},
+		{SearchSortName, false, []string{"Report-a.txt", "report-b.txt", "report-c.txt", "report-d.txt"}},
+		{SearchSortName, true, []string{"report-d.txt", "report-c.txt", "report-b.txt", "Report-a.txt"}},
+		{SearchSortSize, false, []string{"Report-a.txt", "report-d.txt", "report-c.txt", "report-b.txt"}},
+		{SearchSortSize, true, []string{"report-b.txt", "report-c.txt", "report-d.txt", "Report-a.txt"}},
+		{SearchSortUploaded, false, []string{"report-b.txt", "Report-a.txt", "report-d.txt", "report-c.txt"}},
+		{SearchSortUploaded, true, []string{"report-c.txt", "report-d.txt", "Report-a.txt", "report-b.txt"}},
+		{SearchSortModified, false, []string{"report-b.txt", "Report-a.txt", "report-d.txt", "report-c.txt"}},
+		{SearchSortModified, true, []string{"report-c.txt", "report-d.txt", "Report-a.txt", "report-b.txt"}},
+	}
+
+	for _, tt := range tests {
+		name := tt.sort
+		if tt.descending {
+			name += " descending"
+		}
+		t.Run(name, func(t *testing.T) {
+			filter := SearchFilter{Text: "report", Sort: tt.sort, Descending: tt.descending}
+			all, cursor, err := SearchFiles(user, filter)
+			if err != nil {
+				t.Fatalf("single page: %v", err)
+			}
+			if cursor != "" {
+				t.Errorf("single page has a next cursor")
+			}
+			want := tt.want
+			if want == nil {
+				want = searchResultNames(all)
+			}
+			if got := searchResultNames(all); !reflect.DeepEqual(got, want) {
+				t.Errorf("single page: %v, want %v", got, want)
+			}
+
+			filter.Limit = 2
+			first, cursor, err := SearchFiles(user, filter)
+			if err != nil {
+				t.Fatalf("first page: %v", err)
+			}
+			if cursor == "" {
+				t.Fatal("first page has no next cursor")
+			}
+			filter.Cursor = cursor
+			second, cursor, err := SearchFiles(user, filter)
+			if err != nil {
+				t.Fatalf("second page: %v", err)
+			}
+			if cursor != "" {
+				t.Errorf("last page has a next cursor")
+			}
+			if got := append(searchResultNames(first), searchResultNames(second)...); !reflect.DeepEqual(got, want) {
+				t.Errorf("two pages: %v, want %v", got, want)
+			}
+		})
+	}
+
+	// A cursor only continues the order it was made for
+	first, cursor, err := SearchFiles(user, SearchFilter{Text: "report", Sort: SearchSortName, Limit: 2})
+	if err != nil || len(first) != 2 {
+		t.Fatalf("first page: %d results, err %v", len(first), err)
+	}
+	for _, filter := range []SearchFilter{
+		{Text: "report", Sort: SearchSortSize, Cursor: cursor},
+		{Text: "report", Sort: SearchSortName, Descending: true, Cursor: cursor},
+		{Text: "report", Sort: SearchSortName, Cursor: "not a cursor"},
+	} {
+		if _, _, err := SearchFiles(user, filter); !errors.Is(err, ErrInvalidSearchCursor) {
+			t.Errorf("sort %s descending %v: err = %v, want %v", filter.Sort, filter.Descending, err, ErrInvalidSearchCursor)
+		}
+	}
+}
@@ -2,41 +2,205 @@ package services
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
-	"sync"
+	"log"
+	"time"
 
+	"github.com/HAYASAKA7/HAYA-DISK/config"
 	"github.com/HAYASAKA7/HAYA-DISK/models"
 )
 
-var (
-	sessionStore = make(map[string]*models.Session)
-	sessionMu    sync.RWMutex
-)
+// Session tokens are only ever stored as SHA-256 hashes so that a copy of the
+// database (or a backup zip) cannot be used to hijack live sessions.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionExpiry returns the sliding expiry for a session: the idle timeout
+// from the last activity, capped at the absolute session lifetime
+func sessionExpiry(createdAt, lastSeen time.Time) time.Time {
+	idle := lastSeen.Add(time.Duration(config.SessionIdleTimeout) * time.Second)
+	absolute := createdAt.Add(time.Duration(config.SessionAge) * time.Second)
+	if idle.After(absolute) {
+		return absolute
+	}
+	return idle
+}
+
+// CreateSession creates a new session for the given token
+func CreateSession(token string, session *models.Session) error {
+	now := time.Now().UTC()
+	session.CreatedAt = now
+	session.LastSeen = now
+	session.ExpiresAt = sessionExpiry(now, now)
+	session.CSRFToken = GenerateCSRFToken()
+
+	query := `INSERT INTO sessions (token_hash, username, created_at, last_seen, expires_at, ip_address, user_agent, csrf_token)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := db.Exec(query, hashSessionToken(token), session.Username, session.CreatedAt,
+		session.LastSeen, session.ExpiresAt, session.IPAddress, session.UserAgent, session.CSRFToken)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	session.ID, _ = result.LastInsertId()
+	return nil
+}
+
+// GetSession retrieves a live (non-expired) session by token
+func GetSession(token string) *models.Session {
+	query := `SELECT id, username, created_at, last_seen, expires_at, COALESCE(ip_address, ''), COALESCE(user_agent, ''), csrf_token
+			  FROM sessions WHERE token_hash = ? AND expires_at > ?`
+
+	var session models.Session
+	err := db.QueryRow(query, hashSessionToken(token), time.Now().UTC()).Scan(
+		&session.ID, &session.Username, &session.CreatedAt, &session.LastSeen,
+		&session.ExpiresAt, &session.IPAddress, &session.UserAgent, &session.CSRFToken,
+	)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Warning: failed to load session: %v", err)
+		}
+		return nil
+	}
+
+	// Sessions created before CSRF protection existed get a token lazily
+	if session.CSRFToken == "" {
+		session.CSRFToken = GenerateCSRFToken()
+		db.Exec(`UPDATE sessions SET csrf_token = ? WHERE id = ?`, session.CSRFToken, session.ID)
+	}
+
+	return &session
+}
+
+// TouchSession records activity on a session and slides its expiry forward
+func TouchSession(token string, session *models.Session, ipAddress string) error {
+	now := time.Now().UTC()
+	session.LastSeen = now
+	session.ExpiresAt = sessionExpiry(session.CreatedAt, now)
+	if ipAddress != "" {
+		session.IPAddress = ipAddress
+	}
+
+	query := `UPDATE sessions SET last_seen = ?, expires_at = ?, ip_address = ? WHERE token_hash = ?`
+	_, err := db.Exec(query, session.LastSeen, session.ExpiresAt, session.IPAddress, hashSessionToken(token))
+	if err != nil {
+		return fmt.Errorf("failed to touch session: %w", err)
+	}
+	return nil
+}
+
+// UpdateSessionUsername changes the username attached to a session
+func UpdateSessionUsername(token, newUsername string) error {
+	query := `UPDATE sessions SET username = ? WHERE token_hash = ?`
+	_, err := db.Exec(query, newUsername, hashSessionToken(token))
+	if err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+	return nil
+}
+
+// DeleteSession removes a session (server-side logout)
+func DeleteSession(token string) {
+	query := `DELETE FROM sessions WHERE token_hash = ?`
+	if _, err := db.Exec(query, hashSessionToken(token)); err != nil {
+		log.Printf("Warning: failed to delete session: %v", err)
+	}
+}
+
+// GetUserSessions lists all live sessions for a user, most recently active first
+func GetUserSessions(username string) ([]models.Session, error) {
+	query := `SELECT id, username, created_at, last_seen, expires_at, COALESCE(ip_address, ''), COALESCE(user_agent, '')
+			  FROM sessions WHERE username = ? AND expires_at > ? ORDER BY last_seen DESC`
+
+	rows, err := db.Query(query, username, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []models.Session
+	for rows.Next() {
+		var session models.Session
+		err := rows.Scan(
+			&session.ID, &session.Username, &session.CreatedAt, &session.LastSeen,
+			&session.ExpiresAt, &session.IPAddress, &session.UserAgent,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
 
-// CreateSession creates a new session
-func CreateSession(sessionID string, session *models.Session) {
-	sessionMu.Lock()
-	defer sessionMu.Unlock()
-	sessionStore[sessionID] = session
+	return sessions, nil
 }
 
-// GetSession retrieves a session by ID
-func GetSession(sessionID string) *models.Session {
-	sessionMu.RLock()
-	defer sessionMu.RUnlock()
-	return sessionStore[sessionID]
+// DeleteUserSessionByID revokes one of a user's sessions by its row ID
+func DeleteUserSessionByID(username string, sessionID int64) (bool, error) {
+	query := `DELETE FROM sessions WHERE id = ? AND username = ?`
+	result, err := db.Exec(query, sessionID, username)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke session: %w", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
 }
 
-// DeleteSession removes a session
-func DeleteSession(sessionID string) {
-	sessionMu.Lock()
-	defer sessionMu.Unlock()
-	delete(sessionStore, sessionID)
+// DeleteUserSessions revokes all of a user's sessions except the one for
+// exceptToken (pass "" to revoke every session)
+func DeleteUserSessions(username, exceptToken string) (int64, error) {
+	query := `DELETE FROM sessions WHERE username = ? AND token_hash != ?`
+	exceptHash := ""
+	if exceptToken != "" {
+		exceptHash = hashSessionToken(exceptToken)
+	}
+
+	result, err := db.Exec(query, username, exceptHash)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredSessions removes all sessions past their expiry
+func DeleteExpiredSessions() (int64, error) {
+	query := `DELETE FROM sessions WHERE expires_at <= ?`
+	result, err := db.Exec(query, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// InitSessionSweeper creates the background task that purges expired sessions
+func InitSessionSweeper() *PeriodicTask {
+	return NewPeriodicTask("Session sweeper", config.SessionSweepInterval, func() error {
+		removed, err := DeleteExpiredSessions()
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			log.Printf("Removed %d expired sessions", removed)
+		}
+		return nil
+	})
+}
+
+// GenerateCSRFToken generates a random 256-bit CSRF token
+func GenerateCSRFToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-// GenerateSessionID generates a random session ID
+// GenerateSessionID generates a random 256-bit session token
 func GenerateSessionID() string {
-	b := make([]byte, 8)
+	b := make([]byte, 32)
 	rand.Read(b)
-	return fmt.Sprintf("%x", b)
+	return hex.EncodeToString(b)
 }
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+func TestSessionExpiry(t *testing.T) {
+	idle := time.Duration(config.SessionIdleTimeout) * time.Second
+	absolute := time.Duration(config.SessionAge) * time.Second
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		lastSeen time.Time
+		want     time.Time
+	}{
+		{"new session", created, created.Add(idle)},
+		{"recent activity", created.Add(24 * time.Hour), created.Add(24*time.Hour + idle)},
+		{"idle limit reaches the lifetime", created.Add(absolute - idle), created.Add(absolute)},
+		{"capped at the lifetime", created.Add(absolute - time.Hour), created.Add(absolute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sessionExpiry(created, tt.lastSeen); !got.Equal(tt.want) {
+				t.Errorf("sessionExpiry = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// expireSession moves a session's expiry into the past
+func expireSession(t *testing.T, token string) {
+	t.Helper()
+	_, err := db.Exec(`UPDATE sessions SET expires_at = ? WHERE token_hash = ?`,
+		time.Now().UTC().Add(-time.Minute), hashSessionToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionTokenStoredHashed(t *testing.T) {
+	createTestUser(t, "session-hash", "x")
+	token := GenerateSessionID()
+	if err := CreateSession(token, &models.Session{Username: "session-hash"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored string
+	if err := db.QueryRow(`SELECT token_hash FROM sessions WHERE username = ?`, "session-hash").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == token {
+		t.Fatal("session token stored in plaintext")
+	}
+	if stored != hashSessionToken(token) {
+		t.Errorf("token_hash = %q, want %q", stored, hashSessionToken(token))
+	}
+
+	// The stored hash must not work as a token itself
+	if GetSession(stored) != nil {
+		t.Error("GetSession accepted the stored hash as a token")
+	}
+}
+
+func TestGetSession(t *testing.T) {
+	createTestUser(t, "session-get", "x")
+
+	live := GenerateSessionID()
+	expired := GenerateSessionID()
+	deleted := GenerateSessionID()
+	for _, token := range []string{live, expired, deleted} {
+		if err := CreateSession(token, &models.Session{Username: "session-get"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expireSession(t, expired)
+	DeleteSession(deleted)
+
+	tests := []struct {
+		name  string
+		token string
+		found bool
+	}{
+		{"live session", live, true},
+		{"expired session", expired, false},
+		{"deleted session", deleted, false},
+		{"unknown token", GenerateSessionID(), false},
+		{"empty token", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := GetSession(tt.token)
+			if (session != nil) != tt.found {
+				t.Fatalf("GetSession found = %v, want %v", session != nil, tt.found)
+			}
+			if session != nil && (session.Username != "session-get" || session.CSRFToken == "") {
+				t.Errorf("GetSession = %+v", session)
+			}
+		})
+	}
+}
+
+func TestTouchSessionSlidesExpiry(t *testing.T) {
+	createTestUser(t, "session-touch", "x")
+	token := GenerateSessionID()
+	session := &models.Session{Username: "session-touch"}
+	if err := CreateSession(token, session); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend the session was last used a day ago
+	past := session.CreatedAt.Add(-24 * time.Hour)
+	session.CreatedAt = past
+	session.LastSeen = past
+	_, err := db.Exec(`UPDATE sessions SET created_at = ?, last_seen = ?, expires_at = ? WHERE token_hash = ?`,
+		past, past, sessionExpiry(past, past), hashSessionToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := TouchSession(token, session, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := GetSession(token)
+	if loaded == nil {
+		t.Fatal("session gone after TouchSession")
+	}
+	if want := sessionExpiry(past, session.LastSeen); !loaded.ExpiresAt.Equal(want) {
+		t.Errorf("expires_at = %v, want %v", loaded.ExpiresAt, want)
+	}
+	if !loaded.ExpiresAt.After(sessionExpiry(past, past)) {
+		t.Error("TouchSession did not move the expiry forward")
+	}
+	if loaded.IPAddress != "192.0.2.1" {
+		t.Errorf("ip_address = %q, want 192.0.2.1", loaded.IPAddress)
+	}
+}
+
+func TestDeleteExpiredSessions(t *testing.T) {
+	createTestUser(t, "session-sweep", "x")
+	live := GenerateSessionID()
+	expired := GenerateSessionID()
+	for _, token := range []string{live, expired} {
+		if err := CreateSession(token, &models.Session{Username: "session-sweep"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expireSession(t, expired)
+
+	if _, err := DeleteExpiredSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining []string
+	rows, err := db.Query(`SELECT token_hash FROM sessions WHERE username = ?`, "session-sweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		rows.Scan(&hash)
+		remaining = append(remaining, hash)
+	}
+	if len(remaining) != 1 || remaining[0] != hashSessionToken(live) {
+		t.Errorf("sessions left after sweep = %v, want only the live one", remaining)
+	}
+}
+
+func TestDeleteUserSessionsKeepsCurrent(t *testing.T) {
+	createTestUser(t, "session-revoke", "x")
+	current := GenerateSessionID()
+	others := []string{GenerateSessionID(), GenerateSessionID()}
+	for _, token := range append([]string{current}, others...) {
+		if err := CreateSession(token, &models.Session{Username: "session-revoke"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := DeleteUserSessions("session-revoke", current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != int64(len(others)) {
+		t.Errorf("DeleteUserSessions removed %d, want %d", removed, len(others))
+	}
+	if GetSession(current) == nil {
+		t.Error("current session was revoked")
+	}
+	for _, token := range others {
+		if GetSession(token) != nil {
+			t.Error("other session survived DeleteUserSessions")
+		}
+	}
+}
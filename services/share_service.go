@@ -0,0 +1,238 @@
+package services
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+var (
+	// ErrShareNotFound is returned for unknown or revoked links, and links
+	// whose item is gone
+	ErrShareNotFound = errors.New("this link does not exist or has been revoked")
+	// ErrShareExpired is returned once a link is past its expiry date or
+	// download limit
+	ErrShareExpired = errors.New("this link has expired")
+	// ErrShareUploadNeedsFolder is returned when uploads are allowed on a
+	// link to a single file
+	ErrShareUploadNeedsFolder = errors.New("uploads can only be allowed on a shared folder")
+)
+
+// Link states reported in models.Share.Status
+const (
+	ShareActive  = "active"
+	ShareExpired = "expired"
+	ShareUsedUp  = "used up"
+)
+
+// NewShare holds the options of a link being created
+type NewShare struct {
+	Password     string    // "" for none
+	ExpiresAt    time.Time // Zero for never
+	MaxDownloads int       // 0 = unlimited
+	AllowUpload  bool      // Folders only
+}
+
+// shareTriggersSQL removes the links and user shares of a file deleted for
+// good, like labelTriggersSQL does for tags and stars. file_id is not a
+// foreign key, so moving a file to the trash keeps them, inactive since
+// lookups join files, until it is restored or purged.
+const shareTriggersSQL = `
+	CREATE TRIGGER IF NOT EXISTS files_shares_delete AFTER DELETE ON files
+	WHEN NOT EXISTS (SELECT 1 FROM trash_files WHERE file_id = OLD.id) BEGIN
+		DELETE FROM shares WHERE file_id = OLD.id;
+		DELETE FROM user_shares WHERE file_id = OLD.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trash_files_shares_delete AFTER DELETE ON trash_files
+	WHEN OLD.file_id != 0 AND NOT EXISTS (SELECT 1 FROM files WHERE id = OLD.file_id) BEGIN
+		DELETE FROM shares WHERE file_id = OLD.file_id;
+		DELETE FROM user_shares WHERE file_id = OLD.file_id;
+	END;`
+
+// createShareTriggers installs the triggers that clean up links and shares
+// (after migrations, which drop the old cascading foreign keys)
+func createShareTriggers() error {
+	if _, err := db.Exec(shareTriggersSQL); err != nil {
+		return fmt.Errorf("failed to create share triggers: %w", err)
+	}
+	return nil
+}
+
+// generateShareToken returns a random token for a link's URL. It is kept in
+// the clear so owners can copy their links again; 128 bits cannot be guessed.
+func generateShareToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// shareColumns is the column list read by scanShare; the item's current
+// name and place come from its files row
+const shareColumns = `s.id, s.token, f.username, s.file_id, f.filename, f.storage_path, f.is_directory,
+	s.password_hash, s.expires_at, s.max_downloads, s.download_count, s.allow_upload, s.created_at`
+
+// shareFrom joins a link to the item it points at
+const shareFrom = ` FROM shares s JOIN files f ON f.id = s.file_id`
+
+// scanShare reads a row selected with shareColumns
+func scanShare(row rowScanner) (*models.Share, error) {
+	var share models.Share
+	var passwordHash sql.NullString
+	var expiresAt sql.NullTime
+	err := row.Scan(&share.ID, &share.Token, &share.Owner, &share.FileID, &share.Filename, &share.StoragePath, &share.IsDirectory,
+		&passwordHash, &expiresAt, &share.MaxDownloads, &share.DownloadCount, &share.AllowUpload, &share.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	share.PasswordHash = passwordHash.String
+	share.HasPassword = passwordHash.String != ""
+	if expiresAt.Valid {
+		share.ExpiresAt = expiresAt.Time
+	}
+
+	switch {
+	case !share.ExpiresAt.IsZero() && !time.Now().Before(share.ExpiresAt):
+		share.Status = ShareExpired
+	case share.MaxDownloads > 0 && share.DownloadCount >= share.MaxDownloads:
+		share.Status = ShareUsedUp
+	default:
+		share.Status = ShareActive
+	}
+	return &share, nil
+}
+
+// CreateShare creates a public link to a file or folder of the user's
+func CreateShare(username, storagePath string, opts NewShare) (*models.Share, error) {
+	meta, err := GetFileByPath(username, storagePath)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, ErrFileNotFound
+	}
+	if opts.AllowUpload && !meta.IsDirectory {
+		return nil, ErrShareUploadNeedsFolder
+	}
+
+	var passwordHash, expiresAt interface{}
+	if opts.Password != "" {
+		if passwordHash, err = HashPassword(opts.Password); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.ExpiresAt.IsZero() {
+		expiresAt = opts.ExpiresAt.UTC()
+	}
+
+	token, err := generateShareToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate link: %w", err)
+	}
+
+	result, err := db.Exec(`INSERT INTO shares (token, username, file_id, password_hash, expires_at, max_downloads, allow_upload, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		token, username, meta.ID, passwordHash, expiresAt, opts.MaxDownloads, opts.AllowUpload, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create link: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create link: %w", err)
+	}
+
+	share, err := scanShare(db.QueryRow(`SELECT `+shareColumns+shareFrom+` WHERE s.id = ?`, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read link: %w", err)
+	}
+	return share, nil
+}
+
+// ListShares returns a user's links, newest first. Links whose item was
+// deleted are gone with it.
+func ListShares(username string) ([]models.Share, error) {
+	rows, err := db.Query(`SELECT `+shareColumns+shareFrom+` WHERE s.username = ? ORDER BY s.created_at DESC, s.id DESC`, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+	defer rows.Close()
+
+	shares := []models.Share{}
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan link: %w", err)
+		}
+		shares = append(shares, *share)
+	}
+	return shares, rows.Err()
+}
+
+// RevokeShare deletes one of a user's links
+func RevokeShare(username string, id int64) error {
+	result, err := db.Exec(`DELETE FROM shares WHERE id = ? AND username = ?`, id, username)
+	if err != nil {
+		return fmt.Errorf("failed to revoke link: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+// GetShareByToken looks up a link for a visitor. Links past their expiry
+// or download limit return ErrShareExpired; links of disabled accounts are
+// not found.
+func GetShareByToken(token string) (*models.Share, error) {
+	share, err := scanShare(db.QueryRow(`SELECT `+shareColumns+shareFrom+`
+		JOIN users u ON u.username = f.username
+		WHERE s.token = ? AND u.disabled = 0`, token))
+	if err == sql.ErrNoRows {
+		return nil, ErrShareNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link: %w", err)
+	}
+	if share.Status != ShareActive {
+		return nil, ErrShareExpired
+	}
+	return share, nil
+}
+
+// CountShareDownload records a download through a link, failing with
+// ErrShareExpired if that would go past its limit
+func CountShareDownload(share *models.Share) error {
+	result, err := db.Exec(`UPDATE shares SET download_count = download_count + 1
+		WHERE id = ? AND (max_downloads = 0 OR download_count < max_downloads)`, share.ID)
+	if err != nil {
+		return fmt.Errorf("failed to count download: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrShareExpired
+	}
+	share.DownloadCount++
+	return nil
+}
+
+// CheckSharePassword reports whether password opens a link
+func CheckSharePassword(share *models.Share, password string) bool {
+	if !share.HasPassword {
+		return true
+	}
+	match, _ := VerifyPassword(share.PasswordHash, password)
+	return match
+}
+
+// ShareAccessKey returns the value of the cookie that proves a visitor
+// entered a link's password. It is derived from the salted password hash,
+// which never leaves the server, so it cannot be made up.
+func ShareAccessKey(share *models.Share) string {
+	return hashSessionToken(share.Token + "\x00" + share.PasswordHash)
+}
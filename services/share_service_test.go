@@ -0,0 +1,219 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shareRowCounts returns how many links and user shares point at a file ID
+func shareRowCounts(t *testing.T, fileID int64) (links, userShares int) {
+	t.Helper()
+	db.QueryRow(`SELECT COUNT(*) FROM shares WHERE file_id = ?`, fileID).Scan(&links)
+	db.QueryRow(`SELECT COUNT(*) FROM user_shares WHERE file_id = ?`, fileID).Scan(&userShares)
+	return links, userShares
+}
+
+// shareTestFile uploads a file, shares it by link and with recipient, and
+// returns its ID and the link token
+func shareTestFile(t *testing.T, owner, recipient, storagePath string) (int64, string) {
+	t.Helper()
+	uploadTestFile(t, owner, storagePath, owner+" "+storagePath)
+	link, err := CreateShare(owner, storagePath, NewShare{})
+	if err != nil {
+		t.Fatalf("CreateShare: %v", err)
+	}
+	if _, err := ShareWithUser(owner, storagePath, recipient, "viewer"); err != nil {
+		t.Fatalf("ShareWithUser: %v", err)
+	}
+	meta, err := GetFileByPath(owner, storagePath)
+	if err != nil || meta == nil {
+		t.Fatalf("GetFileByPath: %v", err)
+	}
+	return meta.ID, link.Token
+}
+
+func TestSharesSurviveTrash(t *testing.T) {
+	const owner, recipient = "share-trash-owner", "share-trash-recipient"
+	userStoragePath := createTestUser(t, owner, "x")
+	createTestUser(t, recipient, "x")
+	fileID, token := shareTestFile(t, owner, recipient, "shared.txt")
+
+	// Each step runs against the state left by the previous ones
+	steps := []struct {
+		name       string
+		run        func() error
+		rows       int  // links and user shares still stored
+		accessible bool // the link and the share resolve
+	}{
+		{"shared", func() error { return nil }, 1, true},
+		{"in the trash", func() error {
+			_, err := MoveToTrash(owner, userStoragePath, "shared.txt")
+			return err
+		}, 1, false},
+		{"restored", func() error {
+			_, err := RestoreFromTrash(owner, userStoragePath, trashID(t, owner, "shared.txt"))
+			return err
+		}, 1, true},
+		{"in the trash again", func() error {
+			_, err := MoveToTrash(owner, userStoragePath, "shared.txt")
+			return err
+		}, 1, false},
+		{"purged", func() error {
+			return DeleteFromTrash(owner, trashID(t, owner, "shared.txt"))
+		}, 0, false},
+	}
+
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		links, userShares := shareRowCounts(t, fileID)
+		if links != step.rows || userShares != step.rows {
+			t.Errorf("%s: %d links and %d user shares stored, want %d each", step.name, links, userShares, step.rows)
+		}
+
+		_, err := GetShareByToken(token)
+		if (err == nil) != step.accessible {
+			t.Errorf("%s: GetShareByToken err = %v, want accessible = %v", step.name, err, step.accessible)
+		}
+		if !step.accessible && err != nil && !errors.Is(err, ErrShareNotFound) {
+			t.Errorf("%s: GetShareByToken err = %v, want %v", step.name, err, ErrShareNotFound)
+		}
+		shared, err := ListSharedWithUser(recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(shared) == 1) != step.accessible {
+			t.Errorf("%s: %d items shared with the recipient, want accessible = %v", step.name, len(shared), step.accessible)
+		}
+	}
+}
+
+func TestSharesOfFolderContentsSurviveTrash(t *testing.T) {
+	const owner, recipient = "share-folder-owner", "share-folder-recipient"
+	userStoragePath := createTestUser(t, owner, "x")
+	createTestUser(t, recipient, "x")
+	if err := AddFileMetadata(owner, "Folder", "Folder", "/", "", "", 0, true); err != nil {
+		t.Fatal(err)
+	}
+	fileID, token := shareTestFile(t, owner, recipient, "Folder/inner.txt")
+
+	if _, err := MoveToTrash(owner, userStoragePath, "Folder"); err != nil {
+		t.Fatal(err)
+	}
+	if links, userShares := shareRowCounts(t, fileID); links != 1 || userShares != 1 {
+		t.Errorf("in the trash: %d links and %d user shares, want 1 each", links, userShares)
+	}
+
+	if _, err := RestoreFromTrash(owner, userStoragePath, trashID(t, owner, "Folder")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetShareByToken(token); err != nil {
+		t.Errorf("link to a file in a restored folder: %v", err)
+	}
+}
+
+func TestSharesDeletedWithFile(t *testing.T) {
+	const owner, recipient = "share-delete-owner", "share-delete-recipient"
+	createTestUser(t, owner, "x")
+	createTestUser(t, recipient, "x")
+	fileID, _ := shareTestFile(t, owner, recipient, "gone.txt")
+
+	// Deleted without going through the trash
+	if err := DeleteFileMetadata(owner, "gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if links, userShares := shareRowCounts(t, fileID); links != 0 || userShares != 0 {
+		t.Errorf("%d links and %d user shares left, want none", links, userShares)
+	}
+}
+
+func TestMigrateShareFileKeys(t *testing.T) {
+	const owner, recipient = "share-migrate-owner", "share-migrate-recipient"
+	createTestUser(t, owner, "x")
+	createTestUser(t, recipient, "x")
+	fileID, token := shareTestFile(t, owner, recipient, "kept.txt")
+
+	// Put back the tables as they were, with cascading file_id keys and
+	// before the triggers that replace them
+	statements := []string{
+		`DROP TRIGGER files_shares_delete`,
+		`DROP TRIGGER trash_files_shares_delete`,
+		`ALTER TABLE shares RENAME TO shares_current`,
+		`CREATE TABLE shares (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token TEXT NOT NULL UNIQUE,
+			username TEXT NOT NULL,
+			file_id INTEGER NOT NULL,
+			password_hash TEXT,
+			expires_at DATETIME,
+			max_downloads INTEGER NOT NULL DEFAULT 0,
+			download_count INTEGER NOT NULL DEFAULT 0,
+			allow_upload BOOLEAN NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+			FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+		`INSERT INTO shares SELECT * FROM shares_current`,
+		`DROP TABLE shares_current`,
+		`ALTER TABLE user_shares RENAME TO user_shares_current`,
+		`CREATE TABLE user_shares (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			file_id INTEGER NOT NULL,
+			recipient TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'viewer',
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+			FOREIGN KEY (recipient) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+			UNIQUE(file_id, recipient)
+		)`,
+		`INSERT INTO user_shares SELECT * FROM user_shares_current`,
+		`DROP TABLE user_shares_current`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+
+	if err := migrateShareFileKeys(); err != nil {
+		t.Fatalf("migrateShareFileKeys: %v", err)
+	}
+	if err := createShareTriggers(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"shares", "user_shares"} {
+		tableSQL, err := tableDefinition(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(tableSQL, "REFERENCES files(id)") {
+			t.Errorf("%s still refers to files: %s", table, tableSQL)
+		}
+	}
+	if links, userShares := shareRowCounts(t, fileID); links != 1 || userShares != 1 {
+		t.Errorf("after migrating: %d links and %d user shares, want 1 each", links, userShares)
+	}
+	if _, err := GetShareByToken(token); err != nil {
+		t.Errorf("link after migrating: %v", err)
+	}
+
+	// Migrated once, there is nothing left to do
+	if err := migrateShareFileKeys(); err != nil {
+		t.Errorf("second migrateShareFileKeys: %v", err)
+	}
+
+	// New links still get fresh IDs
+	uploadTestFile(t, owner, "new.txt", "share-migrate new")
+	share, err := CreateShare(owner, "new.txt", NewShare{ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateShare after migrating: %v", err)
+	}
+	if share.ID == 0 {
+		t.Error("new link has no ID")
+	}
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+var (
+	// ErrSMSCodeTooSoon is returned when a new code is requested before the resend interval
+	ErrSMSCodeTooSoon = errors.New("please wait before requesting another code")
+	// ErrSMSCodeLimit is returned when a number or account has used up its hourly code allowance
+	ErrSMSCodeLimit = errors.New("too many codes requested, please try again later")
+	// ErrInvalidSMSCode is returned for wrong, expired or used-up codes
+	ErrInvalidSMSCode = errors.New("invalid or expired code")
+)
+
+// smsSettings is the active SMS login configuration
+var smsSettings = config.DefaultSMSSettings
+
+// generateNumericCode returns a uniformly random string of digits
+func generateNumericCode(length int) (string, error) {
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+	return string(code), nil
+}
+
+// hashSMSCode binds a code to its account before hashing
+func hashSMSCode(username, code string) string {
+	sum := sha256.Sum256([]byte(username + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// ReserveSMSCodeRequest records a request for a code to an E.164 number,
+// or fails with ErrSMSCodeTooSoon or ErrSMSCodeLimit. It is applied to every
+// number, registered or not, so its answer cannot tell them apart.
+func ReserveSMSCodeRequest(phone string) error {
+	now := time.Now().UTC()
+
+	// One statement, so concurrent requests cannot both slip under the limits
+	insert := `INSERT INTO sms_code_requests (phone, requested_at)
+			   SELECT ?, ?
+			   WHERE NOT EXISTS (SELECT 1 FROM sms_code_requests WHERE phone = ? AND requested_at > ?)
+			     AND (SELECT COUNT(*) FROM sms_code_requests WHERE phone = ? AND requested_at > ?) < ?`
+	result, err := db.Exec(insert, phone, now,
+		phone, now.Add(-smsSettings.ResendInterval),
+		phone, now.Add(-time.Hour), smsSettings.MaxCodesPerHour)
+	if err != nil {
+		return fmt.Errorf("failed to record SMS code request: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		return nil
+	}
+
+	var sentRecently int
+	query := `SELECT COUNT(*) FROM sms_code_requests WHERE phone = ? AND requested_at > ?`
+	if err := db.QueryRow(query, phone, now.Add(-smsSettings.ResendInterval)).Scan(&sentRecently); err != nil {
+		return fmt.Errorf("failed to check SMS code requests: %w", err)
+	}
+	if sentRecently > 0 {
+		return ErrSMSCodeTooSoon
+	}
+	return ErrSMSCodeLimit
+}
+
+// IssueSMSLoginCode creates a login code for an account and texts it to the
+// given E.164 number. Earlier unused codes stop working.
+func IssueSMSLoginCode(username, phone string) error {
+	now := time.Now().UTC()
+
+	var sentRecently, sentLastHour int
+	query := `SELECT COUNT(*) FROM sms_codes WHERE username = ? AND created_at > ?`
+	if err := db.QueryRow(query, username, now.Add(-smsSettings.ResendInterval)).Scan(&sentRecently); err != nil {
+		return fmt.Errorf("failed to check SMS codes: %w", err)
+	}
+	if sentRecently > 0 {
+		return ErrSMSCodeTooSoon
+	}
+	if err := db.QueryRow(query, username, now.Add(-time.Hour)).Scan(&sentLastHour); err != nil {
+		return fmt.Errorf("failed to check SMS codes: %w", err)
+	}
+	if sentLastHour >= smsSettings.MaxCodesPerHour {
+		return ErrSMSCodeLimit
+	}
+
+	code, err := generateNumericCode(smsSettings.CodeLength)
+	if err != nil {
+		return fmt.Errorf("failed to generate code: %w", err)
+	}
+
+	// Burn earlier codes but keep the rows so they count towards the limit
+	if _, err := db.Exec(`UPDATE sms_codes SET used_at = ? WHERE username = ? AND used_at IS NULL`, now, username); err != nil {
+		return fmt.Errorf("failed to replace SMS code: %w", err)
+	}
+
+	insert := `INSERT INTO sms_codes (username, phone, code_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`
+	if _, err := db.Exec(insert, username, phone, hashSMSCode(username, code), now, now.Add(smsSettings.CodeTTL)); err != nil {
+		return fmt.Errorf("failed to store SMS code: %w", err)
+	}
+
+	message := fmt.Sprintf("Your HAYA-DISK login code is %s. It expires in %d minutes. Never share this code.",
+		code, int(smsSettings.CodeTTL.Minutes()))
+	return SendSMS(phone, message)
+}
+
+// VerifySMSLoginCode checks a code against the account's latest live code.
+// Each code allows a limited number of guesses and works only once.
+func VerifySMSLoginCode(username, code string) error {
+	now := time.Now().UTC()
+
+	var id int64
+	var codeHash string
+	query := `SELECT id, code_hash FROM sms_codes
+			  WHERE username = ? AND used_at IS NULL AND expires_at > ?
+			  ORDER BY created_at DESC LIMIT 1`
+	err := db.QueryRow(query, username, now).Scan(&id, &codeHash)
+	if err == sql.ErrNoRows {
+		return ErrInvalidSMSCode
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load SMS code: %w", err)
+	}
+
+	// Count the guess before comparing, with a conditional update, so a
+	// burst of concurrent guesses cannot all pass the attempt limit
+	result, err := db.Exec(`UPDATE sms_codes SET attempts = attempts + 1 WHERE id = ? AND attempts < ? AND used_at IS NULL`,
+		id, smsSettings.MaxAttempts)
+	if err != nil {
+		return fmt.Errorf("failed to record SMS code attempt: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrInvalidSMSCode
+	}
+
+	if subtle.ConstantTimeCompare([]byte(codeHash), []byte(hashSMSCode(username, code))) != 1 {
+		return ErrInvalidSMSCode
+	}
+
+	// Conditional update so a code cannot be used by two requests at once
+	result, err = db.Exec(`UPDATE sms_codes SET used_at = ? WHERE id = ? AND used_at IS NULL`, now, id)
+	if err != nil {
+		return fmt.Errorf("failed to use SMS code: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrInvalidSMSCode
+	}
+	return nil
+}
+
+// DeleteOldSMSCodes removes codes and requests older than the hourly
+// issuance window
+func DeleteOldSMSCodes() (int64, error) {
+	cutoff := time.Now().UTC().Add(-time.Hour)
+	if _, err := db.Exec(`DELETE FROM sms_code_requests WHERE requested_at < ?`, cutoff); err != nil {
+		return 0, fmt.Errorf("failed to delete old SMS code requests: %w", err)
+	}
+	result, err := db.Exec(`DELETE FROM sms_codes WHERE created_at < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old SMS codes: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// InitSMSCodeSweeper creates the background task that purges old SMS codes
+func InitSMSCodeSweeper() *PeriodicTask {
+	return NewPeriodicTask("SMS code sweeper", config.TokenSweepInterval, func() error {
+		removed, err := DeleteOldSMSCodes()
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			log.Printf("Removed %d old SMS codes", removed)
+		}
+		return nil
+	})
+}
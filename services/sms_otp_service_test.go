@@ -0,0 +1,210 @@
+package services
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSMSSender keeps the messages it is asked to send
+type recordingSMSSender struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (s *recordingSMSSender) SendSMS(to, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+var smsCodePattern = regexp.MustCompile(`\b\d{6}\b`)
+
+// issueTestSMSCode issues a login code to a new user and returns the code
+// read back from the text message
+func issueTestSMSCode(t *testing.T, username string) string {
+	t.Helper()
+	createTestUser(t, username, "x")
+
+	sender := &recordingSMSSender{}
+	SetSMSSender(sender)
+	t.Cleanup(func() { SetSMSSender(ConsoleSMSSender{}) })
+
+	if err := IssueSMSLoginCode(username, "+15550100"); err != nil {
+		t.Fatalf("IssueSMSLoginCode: %v", err)
+	}
+	if len(sender.messages) != 1 {
+		t.Fatalf("%d messages sent, want 1", len(sender.messages))
+	}
+	code := smsCodePattern.FindString(sender.messages[0])
+	if code == "" {
+		t.Fatalf("no code in %q", sender.messages[0])
+	}
+	return code
+}
+
+// wrongSMSCode returns a code of the same length that is not code
+func wrongSMSCode(code string) string {
+	if code == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+func TestVerifySMSLoginCodeSingleUse(t *testing.T) {
+	code := issueTestSMSCode(t, "sms-single")
+
+	steps := []struct {
+		name string
+		code string
+		err  error
+	}{
+		{"wrong code", wrongSMSCode(code), ErrInvalidSMSCode},
+		{"right code", code, nil},
+		{"right code again", code, ErrInvalidSMSCode},
+	}
+	for _, step := range steps {
+		if err := VerifySMSLoginCode("sms-single", step.code); !errors.Is(err, step.err) {
+			t.Errorf("%s: err = %v, want %v", step.name, err, step.err)
+		}
+	}
+}
+
+func TestVerifySMSLoginCodeExpired(t *testing.T) {
+	code := issueTestSMSCode(t, "sms-expired")
+	_, err := db.Exec(`UPDATE sms_codes SET expires_at = ? WHERE username = ?`, time.Now().UTC().Add(-time.Second), "sms-expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifySMSLoginCode("sms-expired", code); !errors.Is(err, ErrInvalidSMSCode) {
+		t.Errorf("expired code: err = %v, want %v", err, ErrInvalidSMSCode)
+	}
+}
+
+func TestVerifySMSLoginCodeAttemptLimit(t *testing.T) {
+	code := issueTestSMSCode(t, "sms-attempts")
+
+	for i := 0; i < smsSettings.MaxAttempts; i++ {
+		if err := VerifySMSLoginCode("sms-attempts", wrongSMSCode(code)); !errors.Is(err, ErrInvalidSMSCode) {
+			t.Fatalf("guess %d: err = %v, want %v", i+1, err, ErrInvalidSMSCode)
+		}
+	}
+	if err := VerifySMSLoginCode("sms-attempts", code); !errors.Is(err, ErrInvalidSMSCode) {
+		t.Errorf("right code after %d wrong guesses: err = %v, want %v", smsSettings.MaxAttempts, err, ErrInvalidSMSCode)
+	}
+}
+
+func TestVerifySMSLoginCodeConcurrentGuesses(t *testing.T) {
+	code := issueTestSMSCode(t, "sms-burst")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4*smsSettings.MaxAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			VerifySMSLoginCode("sms-burst", wrongSMSCode(code))
+		}()
+	}
+	wg.Wait()
+
+	var attempts int
+	if err := db.QueryRow(`SELECT attempts FROM sms_codes WHERE username = ?`, "sms-burst").Scan(&attempts); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != smsSettings.MaxAttempts {
+		t.Errorf("attempts = %d after a burst of guesses, want %d", attempts, smsSettings.MaxAttempts)
+	}
+	if err := VerifySMSLoginCode("sms-burst", code); !errors.Is(err, ErrInvalidSMSCode) {
+		t.Errorf("right code after a burst of guesses: err = %v, want %v", err, ErrInvalidSMSCode)
+	}
+}
+
+func TestIssueSMSLoginCodeReplacesEarlierCode(t *testing.T) {
+	first := issueTestSMSCode(t, "sms-replace")
+
+	// Let the resend interval pass
+	_, err := db.Exec(`UPDATE sms_codes SET created_at = ? WHERE username = ?`,
+		time.Now().UTC().Add(-smsSettings.ResendInterval-time.Second), "sms-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &recordingSMSSender{}
+	SetSMSSender(sender)
+	if err := IssueSMSLoginCode("sms-replace", "+15550100"); err != nil {
+		t.Fatal(err)
+	}
+	second := smsCodePattern.FindString(sender.messages[0])
+
+	if first != second {
+		if err := VerifySMSLoginCode("sms-replace", first); !errors.Is(err, ErrInvalidSMSCode) {
+			t.Errorf("earlier code: err = %v, want %v", err, ErrInvalidSMSCode)
+		}
+	}
+	if err := VerifySMSLoginCode("sms-replace", second); err != nil {
+		t.Errorf("latest code: %v", err)
+	}
+}
+
+func TestReserveSMSCodeRequest(t *testing.T) {
+	const phone, other = "+15550111", "+15550112"
+	if _, err := db.Exec(`DELETE FROM sms_code_requests WHERE phone IN (?, ?)`, phone, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// backdate moves every request for phone back by d, as if time passed
+	backdate := func(d time.Duration) {
+		t.Helper()
+		rows, err := db.Query(`SELECT rowid, requested_at FROM sms_code_requests WHERE phone = ?`, phone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		type request struct {
+			id int64
+			at time.Time
+		}
+		var requests []request
+		for rows.Next() {
+			var r request
+			rows.Scan(&r.id, &r.at)
+			requests = append(requests, r)
+		}
+		rows.Close()
+		for _, r := range requests {
+			if _, err := db.Exec(`UPDATE sms_code_requests SET requested_at = ? WHERE rowid = ?`, r.at.Add(-d), r.id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := ReserveSMSCodeRequest(phone); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := ReserveSMSCodeRequest(phone); !errors.Is(err, ErrSMSCodeTooSoon) {
+		t.Errorf("immediate second request: err = %v, want %v", err, ErrSMSCodeTooSoon)
+	}
+	if err := ReserveSMSCodeRequest(other); err != nil {
+		t.Errorf("request for another number: %v", err)
+	}
+
+	gap := smsSettings.ResendInterval + time.Second
+	for i := 1; i < smsSettings.MaxCodesPerHour; i++ {
+		backdate(gap)
+		if err := ReserveSMSCodeRequest(phone); err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+	}
+	backdate(gap)
+	if err := ReserveSMSCodeRequest(phone); !errors.Is(err, ErrSMSCodeLimit) {
+		t.Errorf("request over the hourly limit: err = %v, want %v", err, ErrSMSCodeLimit)
+	}
+
+	// Requests older than an hour no longer count
+	backdate(time.Hour)
+	if err := ReserveSMSCodeRequest(phone); err != nil {
+		t.Errorf("request an hour later: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// SMSSender delivers text messages to phone numbers in E.164 format
+type SMSSender interface {
+	SendSMS(to, message string) error
+}
+
+// HTTPSMSSender posts messages to an SMS gateway's HTTP API
+type HTTPSMSSender struct {
+	URL    string
+	APIKey string
+	Sender string
+	Client *http.Client
+}
+
+// SendSMS sends a message through the gateway
+func (s *HTTPSMSSender) SendSMS(to, message string) error {
+	payload, _ := json.Marshal(map[string]string{
+		"to":      to,
+		"from":    s.Sender,
+		"message": message,
+	})
+
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to build SMS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send SMS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("SMS gateway returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// ConsoleSMSSender prints messages to the server log, for development
+type ConsoleSMSSender struct{}
+
+// SendSMS logs a message instead of sending it
+func (ConsoleSMSSender) SendSMS(to, message string) error {
+	log.Printf("SMS to %s: %s", to, message)
+	return nil
+}
+
+// NewSMSSender creates the sender selected by the settings
+func NewSMSSender(settings config.SMSSettings) SMSSender {
+	if settings.Driver == "http" {
+		return &HTTPSMSSender{
+			URL:    settings.GatewayURL,
+			APIKey: settings.APIKey,
+			Sender: settings.Sender,
+		}
+	}
+	return ConsoleSMSSender{}
+}
+
+var (
+	smsSender   SMSSender = NewSMSSender(config.DefaultSMSSettings)
+	smsSenderMu sync.RWMutex
+)
+
+// SetSMSSender replaces the sender used for text messages
+func SetSMSSender(s SMSSender) {
+	smsSenderMu.Lock()
+	defer smsSenderMu.Unlock()
+	smsSender = s
+}
+
+// SendSMS delivers a text message with the configured sender
+func SendSMS(to, message string) error {
+	smsSenderMu.RLock()
+	s := smsSender
+	smsSenderMu.RUnlock()
+	return s.SendSMS(to, message)
+}
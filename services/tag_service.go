@@ -0,0 +1,372 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+// Tags and color labels belong to a file, so everyone who can open it sees
+// them; stars are each user's own. All of them hang off files.id, which a
+// file keeps when it is renamed, moved, given new content or put in the
+// trash and restored, so only copies need theirs carried over. Triggers
+// drop them once a file is gone for good, and queue tagged files for the
+// search index, which matches their tags like their names.
+
+var (
+	// ErrInvalidTag is returned for an empty or overlong tag
+	ErrInvalidTag = fmt.Errorf("tags must be 1 to %d characters, without commas", config.MaxTagLength)
+	// ErrTooManyTags is returned when a file would get more than
+	// config.MaxTagsPerFile tags
+	ErrTooManyTags = fmt.Errorf("a file or folder can have up to %d tags", config.MaxTagsPerFile)
+	// ErrInvalidColorLabel is returned for a color not in ColorLabels
+	ErrInvalidColorLabel = errors.New("unknown color label")
+	// ErrStarNotFound is returned for a file the user has not starred
+	ErrStarNotFound = errors.New("starred item not found")
+)
+
+// ColorLabels are the colors a file or folder can be labeled with
+var ColorLabels = []string{"red", "orange", "yellow", "green", "blue", "purple", "gray"}
+
+// IsValidColorLabel reports whether color is one of ColorLabels, or "" for
+// no label
+func IsValidColorLabel(color string) bool {
+	if color == "" {
+		return true
+	}
+	for _, label := range ColorLabels {
+		if color == label {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanTag trims a tag and checks it. Tags are compared without regard to
+// case, and commas separate tags where several are typed at once.
+func CleanTag(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" || utf8.RuneCountInString(tag) > config.MaxTagLength || strings.Contains(tag, ",") {
+		return "", ErrInvalidTag
+	}
+	for _, r := range tag {
+		if unicode.IsControl(r) {
+			return "", ErrInvalidTag
+		}
+	}
+	return tag, nil
+}
+
+// labelTriggersSQL removes the tags and stars of a file deleted for good:
+// from files without going to the trash, or from the trash without being
+// restored. A tag no file carries any more goes too.
+const labelTriggersSQL = `
+	CREATE INDEX IF NOT EXISTS idx_trash_files_file ON trash_files(file_id);
+
+	CREATE TRIGGER IF NOT EXISTS files_labels_delete AFTER DELETE ON files
+	WHEN NOT EXISTS (SELECT 1 FROM trash_files WHERE file_id = OLD.id) BEGIN
+		DELETE FROM file_tags WHERE file_id = OLD.id;
+		DELETE FROM file_stars WHERE file_id = OLD.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trash_files_labels_delete AFTER DELETE ON trash_files
+	WHEN OLD.file_id != 0 AND NOT EXISTS (SELECT 1 FROM files WHERE id = OLD.file_id) BEGIN
+		DELETE FROM file_tags WHERE file_id = OLD.file_id;
+		DELETE FROM file_stars WHERE file_id = OLD.file_id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS file_tags_insert AFTER INSERT ON file_tags BEGIN
+		INSERT OR REPLACE INTO search_queue (file_id)
+		SELECT NEW.file_id WHERE EXISTS (SELECT 1 FROM files WHERE id = NEW.file_id);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS file_tags_delete AFTER DELETE ON file_tags BEGIN
+		INSERT OR REPLACE INTO search_queue (file_id)
+		SELECT OLD.file_id WHERE EXISTS (SELECT 1 FROM files WHERE id = OLD.file_id);
+		DELETE FROM tags WHERE id = OLD.tag_id AND NOT EXISTS (SELECT 1 FROM file_tags WHERE tag_id = OLD.tag_id);
+	END;`
+
+// createLabelTriggers installs the triggers that clean up tags and stars
+// (after migrations, which add trash_files.file_id to old databases)
+func createLabelTriggers() error {
+	if _, err := db.Exec(labelTriggersSQL); err != nil {
+		return fmt.Errorf("failed to create label triggers: %w", err)
+	}
+	return nil
+}
+
+// fileIDByPath returns the ID of the file or folder at storagePath
+func fileIDByPath(tx *sql.Tx, username, storagePath string) (int64, error) {
+	var id int64
+	err := tx.QueryRow(`SELECT id FROM files WHERE username = ? AND storage_path = ?`, username, storagePath).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrFileNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get file metadata: %w", err)
+	}
+	return id, nil
+}
+
+// TagFile adds tags, cleaned with CleanTag, to a file or folder of owner.
+// Tags it already has are left alone.
+func TagFile(owner, storagePath string, tags []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	fileID, err := fileIDByPath(tx, owner, storagePath)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		var tagID int64
+		err := tx.QueryRow(`INSERT INTO tags (username, name) VALUES (?, ?)
+			ON CONFLICT(username, name) DO UPDATE SET name = name
+			RETURNING id`, owner, tag).Scan(&tagID)
+		if err != nil {
+			return fmt.Errorf("failed to create tag: %w", err)
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO file_tags (file_id, tag_id) VALUES (?, ?)`, fileID, tagID); err != nil {
+			return fmt.Errorf("failed to tag file: %w", err)
+		}
+	}
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM file_tags WHERE file_id = ?`, fileID).Scan(&count); err != nil {
+		return fmt.Errorf("failed to count tags: %w", err)
+	}
+	if count > config.MaxTagsPerFile {
+		return ErrTooManyTags
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to tag file: %w", err)
+	}
+	return nil
+}
+
+// UntagFile removes tags from a file or folder of owner. Tags it does not
+// have are ignored.
+func UntagFile(owner, storagePath string, tags []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	fileID, err := fileIDByPath(tx, owner, storagePath)
+	if err != nil {
+		return err
+	}
+
+	query := `DELETE FROM file_tags WHERE file_id = ? AND tag_id IN (SELECT id FROM tags WHERE username = ? AND name = ?)`
+	for _, tag := range tags {
+		if _, err := tx.Exec(query, fileID, owner, tag); err != nil {
+			return fmt.Errorf("failed to untag file: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to untag file: %w", err)
+	}
+	return nil
+}
+
+// SetColorLabel labels a file or folder of owner with one of ColorLabels,
+// or clears its label ("")
+func SetColorLabel(owner, storagePath, color string) error {
+	if !IsValidColorLabel(color) {
+		return ErrInvalidColorLabel
+	}
+	result, err := db.Exec(`UPDATE files SET color_label = ? WHERE username = ? AND storage_path = ?`, color, owner, storagePath)
+	if err != nil {
+		return fmt.Errorf("failed to set color label: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrFileNotFound
+	}
+	return nil
+}
+
+// SetStarred stars a file or folder of owner for username, or takes the
+// star away
+func SetStarred(username, owner, storagePath string, starred bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	fileID, err := fileIDByPath(tx, owner, storagePath)
+	if err != nil {
+		return err
+	}
+	if starred {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO file_stars (username, file_id, starred_at) VALUES (?, ?, ?)`,
+			username, fileID, time.Now().UTC())
+	} else {
+		_, err = tx.Exec(`DELETE FROM file_stars WHERE username = ? AND file_id = ?`, username, fileID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to star file: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to star file: %w", err)
+	}
+	return nil
+}
+
+// RemoveStar takes username's star off a file or folder by its ID, which
+// also works once the user can no longer open it
+func RemoveStar(username string, fileID int64) error {
+	result, err := db.Exec(`DELETE FROM file_stars WHERE username = ? AND file_id = ?`, username, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to remove star: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrStarNotFound
+	}
+	return nil
+}
+
+// loadFileTags runs a query selecting (file_id, tag name) pairs and
+// returns the tags of each file in the order selected
+func loadFileTags(query string, args ...interface{}) (map[int64][]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := map[int64][]string{}
+	for rows.Next() {
+		var fileID int64
+		var tag string
+		if err := rows.Scan(&fileID, &tag); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		tags[fileID] = append(tags[fileID], tag)
+	}
+	return tags, rows.Err()
+}
+
+// GetFolderLabels returns the labels of the files and folders directly in
+// a folder of owner (a parent path, "/" for the top), by file ID, with the
+// stars of viewer
+func GetFolderLabels(owner, viewer, parentPath string) (map[int64]models.FileLabels, error) {
+	if parentPath == "" {
+		parentPath = "/"
+	}
+
+	tags, err := loadFileTags(`SELECT ft.file_id, t.name FROM file_tags ft
+		JOIN tags t ON t.id = ft.tag_id
+		JOIN files f ON f.id = ft.file_id
+		WHERE f.username = ? AND f.parent_path = ? ORDER BY t.name`, owner, parentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT f.id, f.color_label, EXISTS (SELECT 1 FROM file_stars s WHERE s.username = ? AND s.file_id = f.id)
+		FROM files f WHERE f.username = ? AND f.parent_path = ?`, viewer, owner, parentPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load labels: %w", err)
+	}
+	defer rows.Close()
+
+	labels := map[int64]models.FileLabels{}
+	for rows.Next() {
+		var fileID int64
+		var label models.FileLabels
+		if err := rows.Scan(&fileID, &label.ColorLabel, &label.Starred); err != nil {
+			return nil, fmt.Errorf("failed to scan labels: %w", err)
+		}
+		label.Tags = tags[fileID]
+		labels[fileID] = label
+	}
+	return labels, rows.Err()
+}
+
+// ListTags returns the tags in use in owner's files, with how many files
+// and folders carry each. A non-empty within counts only that file or
+// folder and what is inside it.
+func ListTags(owner, within string) ([]models.Tag, error) {
+	query := `SELECT t.name, COUNT(*) FROM tags t
+		JOIN file_tags ft ON ft.tag_id = t.id
+		JOIN files f ON f.id = ft.file_id
+		WHERE t.username = ?`
+	args := []interface{}{owner}
+	if within != "" {
+		query += ` AND (f.storage_path = ? OR substr(f.storage_path, 1, length(?)) = ?)`
+		prefix := within + string(filepath.Separator)
+		args = append(args, within, prefix, prefix)
+	}
+	query += ` GROUP BY t.id ORDER BY t.name`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := []models.Tag{}
+	for rows.Next() {
+		var tag models.Tag
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// ListStarredFiles returns the files and folders username starred, most
+// recently starred first, whoever owns them. Files in the trash are left
+// out until restored.
+func ListStarredFiles(username string) ([]models.StarredFile, error) {
+	tags, err := loadFileTags(`SELECT ft.file_id, t.name FROM file_tags ft
+		JOIN tags t ON t.id = ft.tag_id
+		JOIN file_stars s ON s.file_id = ft.file_id
+		WHERE s.username = ? ORDER BY t.name`, username)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT f.id, f.username, f.filename, f.storage_path, f.parent_path, f.file_size, f.mime_type, f.file_hash,
+			f.is_directory, f.uploaded_at, f.modified_at, f.color_label, s.starred_at
+		FROM file_stars s JOIN files f ON f.id = s.file_id
+		WHERE s.username = ? ORDER BY s.starred_at DESC, f.id DESC`, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list starred files: %w", err)
+	}
+	defer rows.Close()
+
+	files := []models.StarredFile{}
+	for rows.Next() {
+		var file models.StarredFile
+		var mimeType, fileHash sql.NullString
+		err := rows.Scan(&file.ID, &file.Username, &file.Filename, &file.StoragePath, &file.ParentPath,
+			&file.FileSize, &mimeType, &fileHash, &file.IsDirectory, &file.UploadedAt, &file.ModifiedAt,
+			&file.ColorLabel, &file.StarredAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan starred file: %w", err)
+		}
+		file.MimeType = mimeType.String
+		file.FileHash = fileHash.String
+		file.Tags = tags[file.ID]
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// Purposes of emailed single-use tokens
+const (
+	TokenPurposePasswordReset = "password_reset"
+	TokenPurposeVerifyEmail   = "verify_email"
+)
+
+// ErrInvalidToken is returned for unknown, expired or already used tokens
+var ErrInvalidToken = errors.New("this link is invalid or has expired")
+
+// UserToken is a single-use token emailed to a user
+type UserToken struct {
+	ID        int64
+	Username  string
+	Purpose   string
+	Email     string
+	ExpiresAt time.Time
+}
+
+// CreateUserToken issues a new token for a purpose, replacing any unused
+// token the user already had for it. Like session tokens, only the SHA-256
+// hash is stored.
+func CreateUserToken(username, purpose, email string, ttl time.Duration) (string, error) {
+	now := time.Now().UTC()
+	token := GenerateSessionID()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_tokens WHERE username = ? AND purpose = ? AND used_at IS NULL`, username, purpose); err != nil {
+		return "", fmt.Errorf("failed to replace token: %w", err)
+	}
+
+	query := `INSERT INTO user_tokens (token_hash, username, purpose, email, created_at, expires_at)
+			  VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, hashSessionToken(token), username, purpose, email, now, now.Add(ttl)); err != nil {
+		return "", fmt.Errorf("failed to create token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to create token: %w", err)
+	}
+	return token, nil
+}
+
+// GetUserToken looks up a live token without using it up
+func GetUserToken(token, purpose string) (*UserToken, error) {
+	query := `SELECT id, username, purpose, email, expires_at FROM user_tokens
+			  WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?`
+
+	var t UserToken
+	err := db.QueryRow(query, hashSessionToken(token), purpose, time.Now().UTC()).Scan(
+		&t.ID, &t.Username, &t.Purpose, &t.Email, &t.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	}
+	return &t, nil
+}
+
+// UserTokenIssuedSince reports whether a token for the purpose was sent to
+// the user after the given time (used to throttle repeat emails)
+func UserTokenIssuedSince(username, purpose string, since time.Time) bool {
+	var count int
+	query := `SELECT COUNT(*) FROM user_tokens WHERE username = ? AND purpose = ? AND created_at > ?`
+	db.QueryRow(query, username, purpose, since.UTC()).Scan(&count)
+	return count > 0
+}
+
+// ConsumeUserToken marks a live token as used and returns it. The update is
+// conditional, so two concurrent requests cannot both use the same token.
+func ConsumeUserToken(token, purpose string) (*UserToken, error) {
+	t, err := GetUserToken(token, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE user_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL`
+	result, err := db.Exec(query, time.Now().UTC(), t.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use token: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil, ErrInvalidToken
+	}
+	return t, nil
+}
+
+// DeleteExpiredUserTokens removes tokens that can no longer be used
+func DeleteExpiredUserTokens() (int64, error) {
+	query := `DELETE FROM user_tokens WHERE expires_at <= ? OR used_at IS NOT NULL`
+	result, err := db.Exec(query, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired tokens: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// InitUserTokenSweeper creates the background task that purges used and
+// expired tokens
+func InitUserTokenSweeper() *PeriodicTask {
+	return NewPeriodicTask("Token sweeper", config.TokenSweepInterval, func() error {
+		removed, err := DeleteExpiredUserTokens()
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			log.Printf("Removed %d used or expired tokens", removed)
+		}
+		return nil
+	})
+}
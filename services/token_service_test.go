@@ -0,0 +1,123 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// userTokenPurposes are the purposes tokens are emailed for
+var userTokenPurposes = []string{TokenPurposePasswordReset, TokenPurposeVerifyEmail}
+
+func TestConsumeUserTokenSingleUse(t *testing.T) {
+	for _, purpose := range userTokenPurposes {
+		t.Run(purpose, func(t *testing.T) {
+			user := "token-once-" + purpose
+			createTestUser(t, user, "x")
+			token, err := CreateUserToken(user, purpose, user+"@example.com", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			steps := []struct {
+				name string
+				err  error
+			}{
+				{"first use", nil},
+				{"second use", ErrInvalidToken},
+			}
+			for _, step := range steps {
+				got, err := ConsumeUserToken(token, purpose)
+				if !errors.Is(err, step.err) {
+					t.Fatalf("%s: err = %v, want %v", step.name, err, step.err)
+				}
+				if err == nil && (got.Username != user || got.Email != user+"@example.com") {
+					t.Errorf("%s: token for %s <%s>", step.name, got.Username, got.Email)
+				}
+			}
+			if _, err := GetUserToken(token, purpose); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("GetUserToken after use: err = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestConsumeUserTokenExpired(t *testing.T) {
+	for _, purpose := range userTokenPurposes {
+		t.Run(purpose, func(t *testing.T) {
+			user := "token-expired-" + purpose
+			createTestUser(t, user, "x")
+			token, err := CreateUserToken(user, purpose, user+"@example.com", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(`UPDATE user_tokens SET expires_at = ? WHERE username = ?`, time.Now().UTC().Add(-time.Second), user); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := GetUserToken(token, purpose); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("GetUserToken: err = %v, want %v", err, ErrInvalidToken)
+			}
+			if _, err := ConsumeUserToken(token, purpose); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("ConsumeUserToken: err = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestCreateUserTokenReplacesEarlierToken(t *testing.T) {
+	const user = "token-replace"
+	createTestUser(t, user, "x")
+	first, err := CreateUserToken(user, TokenPurposePasswordReset, user+"@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify, err := CreateUserToken(user, TokenPurposeVerifyEmail, user+"@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := CreateUserToken(user, TokenPurposePasswordReset, user+"@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		purpose string
+		err     error
+	}{
+		{"replaced token", first, TokenPurposePasswordReset, ErrInvalidToken},
+		{"token for another purpose", verify, TokenPurposePasswordReset, ErrInvalidToken},
+		{"latest token", second, TokenPurposePasswordReset, nil},
+		{"token of the other purpose", verify, TokenPurposeVerifyEmail, nil},
+	}
+	for _, tt := range tests {
+		if _, err := ConsumeUserToken(tt.token, tt.purpose); !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestDeleteExpiredUserTokens(t *testing.T) {
+	const user = "token-sweep"
+	createTestUser(t, user, "x")
+	used, _ := CreateUserToken(user, TokenPurposePasswordReset, user+"@example.com", time.Hour)
+	if _, err := ConsumeUserToken(used, TokenPurposePasswordReset); err != nil {
+		t.Fatal(err)
+	}
+	live, _ := CreateUserToken(user, TokenPurposeVerifyEmail, user+"@example.com", time.Hour)
+
+	if _, err := DeleteExpiredUserTokens(); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM user_tokens WHERE username = ?`, user).Scan(&count)
+	if count != 1 {
+		t.Errorf("%d tokens left, want only the live one", count)
+	}
+	if _, err := GetUserToken(live, TokenPurposeVerifyEmail); err != nil {
+		t.Errorf("live token after the sweep: %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// RFC 6238 parameters (the defaults every authenticator app supports)
+const (
+	totpPeriod = 30 // seconds per time step
+	totpDigits = 6
+	totpSkew   = 1 // accept codes one step either side for clock drift
+)
+
+var (
+	// ErrInvalidTOTPCode is returned when an authenticator or recovery code is wrong
+	ErrInvalidTOTPCode = errors.New("invalid verification code")
+	// ErrTOTPNotPending is returned when enabling 2FA without a pending secret
+	ErrTOTPNotPending = errors.New("two-factor setup has not been started")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random 160-bit base32 secret
+func GenerateTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+// TOTPProvisioningURI builds the otpauth:// URI authenticator apps import
+func TOTPProvisioningURI(secret, accountName string) string {
+	label := url.PathEscape(config.TOTPIssuer + ":" + accountName)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", config.TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCodeAt computes the HOTP value (RFC 4226) for a time step
+func totpCodeAt(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// matchTOTPCode returns the time step a code matches, or 0 if none does.
+// Steps at or before lastStep are rejected so a code cannot be replayed.
+func matchTOTPCode(secret, code string, lastStep int64) int64 {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for offset := -totpSkew; offset <= totpSkew; offset++ {
+		step := current + int64(offset)
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCodeAt(secret, step)
+		if err != nil {
+			return 0
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+// recoveryCodeBytes is the randomness in a recovery code. At 80 bits, a
+// leaked hash cannot be reversed by trying every code, which is what lets
+// hashRecoveryCode use a fast unsalted hash.
+const recoveryCodeBytes = 10
+
+// hashRecoveryCode hashes a recovery code for storage, ignoring case,
+// spaces and dashes
+func hashRecoveryCode(code string) string {
+	normalized := strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateRecoveryCodes returns plaintext codes, 16 base32 characters in
+// groups of four, and their hashes
+func generateRecoveryCodes() ([]string, []string) {
+	codes := make([]string, config.TOTPRecoveryCodeCount)
+	hashes := make([]string, config.TOTPRecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		rand.Read(b)
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))
+		groups := make([]string, 0, len(raw)/4)
+		for j := 0; j < len(raw); j += 4 {
+			groups = append(groups, raw[j:j+4])
+		}
+		codes[i] = strings.Join(groups, "-")
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes
+}
+
+// BeginTOTPEnrollment stores a new pending secret for a user and returns it
+// together with the provisioning URI. 2FA stays off until confirmed.
+func BeginTOTPEnrollment(username string) (secret, uri string, err error) {
+	user, err := GetUserByUsernameDB(username)
+	if err != nil {
+		return "", "", err
+	}
+	if user == nil {
+		return "", "", fmt.Errorf("user not found")
+	}
+	if user.TOTPEnabled {
+		return "", "", fmt.Errorf("two-factor authentication is already enabled")
+	}
+
+	secret = GenerateTOTPSecret()
+	query := `UPDATE users SET totp_secret = ?, totp_enabled = 0, totp_last_step = 0 WHERE username = ?`
+	if _, err := db.Exec(query, secret, username); err != nil {
+		return "", "", fmt.Errorf("failed to store TOTP secret: %w", err)
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.Username
+	}
+	return secret, TOTPProvisioningURI(secret, account), nil
+}
+
+// ConfirmTOTPEnrollment enables 2FA once the user proves their app works,
+// returning a fresh set of recovery codes (shown once, stored hashed)
+func ConfirmTOTPEnrollment(username, code string) ([]string, error) {
+	user, err := GetUserByUsernameDB(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		return nil, ErrTOTPNotPending
+	}
+
+	step := matchTOTPCode(user.TOTPSecret, code, 0)
+	if step == 0 {
+		return nil, ErrInvalidTOTPCode
+	}
+
+	codes, hashes := generateRecoveryCodes()
+	hashesJSON, _ := json.Marshal(hashes)
+
+	query := `UPDATE users SET totp_enabled = 1, totp_last_step = ?, totp_recovery_codes = ? WHERE username = ?`
+	if _, err := db.Exec(query, step, string(hashesJSON), username); err != nil {
+		return nil, fmt.Errorf("failed to enable two-factor authentication: %w", err)
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes for a user
+func RegenerateRecoveryCodes(username string) ([]string, error) {
+	codes, hashes := generateRecoveryCodes()
+	hashesJSON, _ := json.Marshal(hashes)
+
+	query := `UPDATE users SET totp_recovery_codes = ? WHERE username = ? AND totp_enabled = 1`
+	result, err := db.Exec(query, string(hashesJSON), username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil, fmt.Errorf("two-factor authentication is not enabled")
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns 2FA off and discards the secret and recovery codes
+func DisableTOTP(username string) error {
+	query := `UPDATE users SET totp_enabled = 0, totp_secret = NULL, totp_recovery_codes = NULL, totp_last_step = 0 WHERE username = ?`
+	if _, err := db.Exec(query, username); err != nil {
+		return fmt.Errorf("failed to disable two-factor authentication: %w", err)
+	}
+	return nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func CountRecoveryCodes(username string) int {
+	var raw string
+	db.QueryRow(`SELECT COALESCE(totp_recovery_codes, '[]') FROM users WHERE username = ?`, username).Scan(&raw)
+	var hashes []string
+	json.Unmarshal([]byte(raw), &hashes)
+	return len(hashes)
+}
+
+// recoveryCodeRetries bounds how often VerifySecondFactor reads the
+// recovery codes again after another login changed them
+const recoveryCodeRetries = 3
+
+// VerifySecondFactor checks an authenticator code or, failing that, a
+// single-use recovery code (which is consumed on success). Both are
+// consumed with a conditional UPDATE, so when two logins race with the same
+// code only one of them succeeds.
+func VerifySecondFactor(username, code string) error {
+	for attempt := 0; attempt < recoveryCodeRetries; attempt++ {
+		var secret, recoveryJSON string
+		var lastStep int64
+		query := `SELECT COALESCE(totp_secret, ''), COALESCE(totp_recovery_codes, '[]'), totp_last_step
+				  FROM users WHERE username = ? AND totp_enabled = 1`
+		if err := db.QueryRow(query, username).Scan(&secret, &recoveryJSON, &lastStep); err != nil {
+			return ErrInvalidTOTPCode
+		}
+
+		if step := matchTOTPCode(secret, code, lastStep); step != 0 {
+			// Remember the step so the same code cannot be used twice
+			result, err := db.Exec(`UPDATE users SET totp_last_step = ? WHERE username = ? AND totp_enabled = 1 AND totp_last_step < ?`,
+				step, username, step)
+			if err != nil {
+				return fmt.Errorf("failed to record TOTP step: %w", err)
+			}
+			if affected, _ := result.RowsAffected(); affected == 0 {
+				return ErrInvalidTOTPCode
+			}
+			return nil
+		}
+
+		var hashes []string
+		json.Unmarshal([]byte(recoveryJSON), &hashes)
+		codeHash := hashRecoveryCode(code)
+		match := -1
+		for i, hash := range hashes {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(codeHash)) == 1 {
+				match = i
+				break
+			}
+		}
+		if match < 0 {
+			return ErrInvalidTOTPCode
+		}
+
+		// Only replace the codes that were read; if another login used a
+		// code in the meantime, read them again
+		remaining := append(hashes[:match:match], hashes[match+1:]...)
+		remainingJSON, _ := json.Marshal(remaining)
+		result, err := db.Exec(`UPDATE users SET totp_recovery_codes = ? WHERE username = ? AND totp_enabled = 1 AND totp_recovery_codes = ?`,
+			string(remainingJSON), username, recoveryJSON)
+		if err != nil {
+			return fmt.Errorf("failed to consume recovery code: %w", err)
+		}
+		if affected, _ := result.RowsAffected(); affected == 1 {
+			return nil
+		}
+	}
+
+	return ErrInvalidTOTPCode
+}
+
+// ==================== PENDING LOGIN CHALLENGES ====================
+
+// loginChallenge is a half-finished login waiting for the second factor
+type loginChallenge struct {
+	username  string
+	expiresAt time.Time
+	attempts  int
+}
+
+var (
+	loginChallenges   = make(map[string]*loginChallenge)
+	loginChallengesMu sync.Mutex
+)
+
+// CreateLoginChallenge records that a user passed the password step and
+// returns the token identifying the pending second-factor check
+func CreateLoginChallenge(username string) string {
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+
+	// Drop stale challenges while we hold the lock
+	now := time.Now()
+	for token, challenge := range loginChallenges {
+		if now.After(challenge.expiresAt) {
+			delete(loginChallenges, token)
+		}
+	}
+
+	token := GenerateSessionID()
+	loginChallenges[hashSessionToken(token)] = &loginChallenge{
+		username:  username,
+		expiresAt: now.Add(config.TOTPChallengeTTL),
+	}
+	return token
+}
+
+// GetLoginChallengeUser returns the username for a live challenge, or ""
+func GetLoginChallengeUser(token string) string {
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+
+	challenge, exists := loginChallenges[hashSessionToken(token)]
+	if !exists || time.Now().After(challenge.expiresAt) {
+		return ""
+	}
+	return challenge.username
+}
+
+// RecordLoginChallengeFailure counts a wrong code and reports whether the
+// challenge is still usable (too many failures restart the login)
+func RecordLoginChallengeFailure(token string) bool {
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+
+	key := hashSessionToken(token)
+	challenge, exists := loginChallenges[key]
+	if !exists {
+		return false
+	}
+	challenge.attempts++
+	if challenge.attempts >= config.TOTPMaxAttempts {
+		delete(loginChallenges, key)
+		return false
+	}
+	return true
+}
+
+// DeleteLoginChallenge removes a pending challenge
+func DeleteLoginChallenge(token string) {
+	loginChallengesMu.Lock()
+	defer loginChallengesMu.Unlock()
+	delete(loginChallenges, hashSessionToken(token))
+}
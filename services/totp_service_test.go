@@ -0,0 +1,279 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+)
+
+// rfc6238Secret is the SHA-1 key from the RFC 6238 test vectors,
+// "12345678901234567890", in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeAt(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		got, err := totpCodeAt(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("totpCodeAt(%d): %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("totpCodeAt(%d) = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+
+	// Secrets are accepted in lower case and with stray whitespace
+	if got, _ := totpCodeAt(" "+strings.ToLower(rfc6238Secret)+"\n", 1); got != "287082" {
+		t.Errorf("totpCodeAt with a lower-case secret = %q, want 287082", got)
+	}
+	if _, err := totpCodeAt("not base32!", 1); err == nil {
+		t.Error("totpCodeAt accepted an invalid secret")
+	}
+}
+
+// currentTOTPStep returns the current time step, first waiting out the
+// last second of a step so the step cannot change during the test
+func currentTOTPStep() int64 {
+	if time.Now().Unix()%totpPeriod == totpPeriod-1 {
+		time.Sleep(time.Second)
+	}
+	return time.Now().Unix() / totpPeriod
+}
+
+// totpCode returns the code for a step, failing the test on error
+func totpCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	code, err := totpCodeAt(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestMatchTOTPCode(t *testing.T) {
+	secret := GenerateTOTPSecret()
+	current := currentTOTPStep()
+	code := func(offset int64) string { return totpCode(t, secret, current+offset) }
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		want     int64
+	}{
+		{"current step", code(0), 0, current},
+		{"previous step", code(-1), 0, current - 1},
+		{"next step", code(1), 0, current + 1},
+		{"two steps ago", code(-2), 0, 0},
+		{"two steps ahead", code(2), 0, 0},
+		{"with spaces", code(0)[:3] + " " + code(0)[3:], 0, current},
+		{"surrounding whitespace", " " + code(0) + "\n", 0, current},
+		{"too short", code(0)[:5], 0, 0},
+		{"too long", code(0) + "0", 0, 0},
+		{"empty", "", 0, 0},
+		{"replayed step", code(0), current, 0},
+		{"earlier than last step", code(-1), current, 0},
+		{"later than last step", code(1), current, current + 1},
+		{"previous step after older use", code(-1), current - 2, current - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchTOTPCode(secret, tt.code, tt.lastStep); got != tt.want {
+				t.Errorf("matchTOTPCode(%q, lastStep %d) = %d, want %d", tt.code, tt.lastStep, got, tt.want)
+			}
+		})
+	}
+
+	if got := matchTOTPCode("not base32!", code(0), 0); got != 0 {
+		t.Errorf("matchTOTPCode with an invalid secret = %d, want 0", got)
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := hashRecoveryCode("abcd-efgh-ijkl-mnop")
+	tests := []struct {
+		code  string
+		match bool
+	}{
+		{"abcd-efgh-ijkl-mnop", true},
+		{"ABCD-EFGH-IJKL-MNOP", true},
+		{"abcdefghijklmnop", true},
+		{"abcd efgh ijkl mnop", true},
+		{"  abcd-efgh-ijkl-mnop\n", true},
+		{"abcd-efgh-ijkl-mnoq", false},
+		{"abcd-efgh-ijkl", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := hashRecoveryCode(tt.code) == want; got != tt.match {
+			t.Errorf("hashRecoveryCode(%q) matches = %v, want %v", tt.code, got, tt.match)
+		}
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes := generateRecoveryCodes()
+	if len(codes) != config.TOTPRecoveryCodeCount || len(hashes) != len(codes) {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), config.TOTPRecoveryCodeCount)
+	}
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		// 80 bits of base32 is 16 characters, shown in groups of four
+		if len(strings.ReplaceAll(code, "-", "")) != recoveryCodeBytes*8/5 || strings.Count(code, "-") != 3 {
+			t.Errorf("code %q does not look like xxxx-xxxx-xxxx-xxxx", code)
+		}
+		if hashes[i] != hashRecoveryCode(code) {
+			t.Errorf("hash %d does not match its code", i)
+		}
+		if seen[code] {
+			t.Errorf("code %q issued twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+// enrollTOTP turns on 2FA for a new user and returns the secret, the step
+// the confirming code used and the recovery codes
+func enrollTOTP(t *testing.T, username string) (string, int64, []string) {
+	t.Helper()
+	createTestUser(t, username, "x")
+	secret, _, err := BeginTOTPEnrollment(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := currentTOTPStep()
+	codes, err := ConfirmTOTPEnrollment(username, totpCode(t, secret, current))
+	if err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment: %v", err)
+	}
+	return secret, current, codes
+}
+
+func TestConfirmTOTPEnrollment(t *testing.T) {
+	createTestUser(t, "totp-confirm", "x")
+	if _, err := ConfirmTOTPEnrollment("totp-confirm", "123456"); err != ErrTOTPNotPending {
+		t.Errorf("confirm before begin: err = %v, want %v", err, ErrTOTPNotPending)
+	}
+
+	secret, _, err := BeginTOTPEnrollment("totp-confirm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := currentTOTPStep()
+	if _, err := ConfirmTOTPEnrollment("totp-confirm", totpCode(t, secret, current+2)); err != ErrInvalidTOTPCode {
+		t.Errorf("confirm with a wrong code: err = %v, want %v", err, ErrInvalidTOTPCode)
+	}
+	if user, _ := GetUserByUsernameDB("totp-confirm"); user.TOTPEnabled {
+		t.Fatal("2FA enabled by a wrong code")
+	}
+
+	if _, err := ConfirmTOTPEnrollment("totp-confirm", totpCode(t, secret, current)); err != nil {
+		t.Fatalf("confirm with the right code: %v", err)
+	}
+	if user, _ := GetUserByUsernameDB("totp-confirm"); !user.TOTPEnabled {
+		t.Error("2FA not enabled after confirming")
+	}
+
+	// The code used to confirm cannot then be used to log in
+	if err := VerifySecondFactor("totp-confirm", totpCode(t, secret, current)); err != ErrInvalidTOTPCode {
+		t.Errorf("login with the confirming code: err = %v, want %v", err, ErrInvalidTOTPCode)
+	}
+}
+
+func TestVerifySecondFactorTOTP(t *testing.T) {
+	secret, current, _ := enrollTOTP(t, "totp-verify")
+
+	// Each step runs against the state left by the previous ones
+	steps := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{"replay of the confirming code", totpCode(t, secret, current), false},
+		{"earlier step", totpCode(t, secret, current-1), false},
+		{"wrong code", totpCode(t, secret, current+2), false},
+		{"next step", totpCode(t, secret, current+1), true},
+		{"replay of the next step", totpCode(t, secret, current+1), false},
+		{"current step after a later one", totpCode(t, secret, current), false},
+	}
+
+	for _, step := range steps {
+		err := VerifySecondFactor("totp-verify", step.code)
+		if (err == nil) != step.ok {
+			t.Errorf("%s: err = %v, want ok = %v", step.name, err, step.ok)
+		}
+	}
+
+	if err := VerifySecondFactor("nobody", totpCode(t, secret, current+1)); err != ErrInvalidTOTPCode {
+		t.Errorf("unknown user: err = %v, want %v", err, ErrInvalidTOTPCode)
+	}
+}
+
+func TestVerifySecondFactorRecoveryCode(t *testing.T) {
+	_, _, codes := enrollTOTP(t, "totp-recovery")
+
+	steps := []struct {
+		name string
+		code string
+		ok   bool
+		left int
+	}{
+		{"recovery code", codes[0], true, len(codes) - 1},
+		{"same code again", codes[0], false, len(codes) - 1},
+		{"upper case without dashes", strings.ToUpper(strings.ReplaceAll(codes[1], "-", "")), true, len(codes) - 2},
+		{"unknown code", "aaaa-bbbb-cccc-dddd", false, len(codes) - 2},
+		{"last code", codes[len(codes)-1], true, len(codes) - 3},
+	}
+
+	for _, step := range steps {
+		err := VerifySecondFactor("totp-recovery", step.code)
+		if (err == nil) != step.ok {
+			t.Errorf("%s: err = %v, want ok = %v", step.name, err, step.ok)
+		}
+		if left := CountRecoveryCodes("totp-recovery"); left != step.left {
+			t.Errorf("%s: %d recovery codes left, want %d", step.name, left, step.left)
+		}
+	}
+
+	// Regenerating invalidates the old codes
+	fresh, err := RegenerateRecoveryCodes("totp-recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySecondFactor("totp-recovery", codes[2]); err != ErrInvalidTOTPCode {
+		t.Errorf("old code after regenerating: err = %v, want %v", err, ErrInvalidTOTPCode)
+	}
+	if err := VerifySecondFactor("totp-recovery", fresh[0]); err != nil {
+		t.Errorf("new code after regenerating: %v", err)
+	}
+}
+
+func TestVerifySecondFactorAfterDisable(t *testing.T) {
+	secret, current, codes := enrollTOTP(t, "totp-disable")
+	if err := DisableTOTP("totp-disable"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, code := range []string{totpCode(t, secret, current+1), codes[0]} {
+		if err := VerifySecondFactor("totp-disable", code); err != ErrInvalidTOTPCode {
+			t.Errorf("VerifySecondFactor(%q) after disabling: err = %v, want %v", code, err, ErrInvalidTOTPCode)
+		}
+	}
+}
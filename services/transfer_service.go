@@ -0,0 +1,285 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+// ConflictPolicy decides what happens when a moved or copied item's name
+// is already taken in the destination folder
+type ConflictPolicy string
+
+const (
+	ConflictFail      ConflictPolicy = "fail"      // Report the conflict
+	ConflictSkip      ConflictPolicy = "skip"      // Leave the item where it is
+	ConflictOverwrite ConflictPolicy = "overwrite" // Replace what is there
+	ConflictRename    ConflictPolicy = "rename"    // Pick a free name such as "a (1).txt"
+)
+
+// ParseConflictPolicy reads a policy from a request, defaulting to
+// ConflictFail
+func ParseConflictPolicy(value string) (ConflictPolicy, bool) {
+	switch policy := ConflictPolicy(value); policy {
+	case "":
+		return ConflictFail, true
+	case ConflictFail, ConflictSkip, ConflictOverwrite, ConflictRename:
+		return policy, true
+	}
+	return "", false
+}
+
+var (
+	// ErrFileSkipped is returned when ConflictSkip left an item in place
+	ErrFileSkipped = errors.New("skipped because the name is already taken")
+	// ErrFolderNotFound is returned when the destination folder does not exist
+	ErrFolderNotFound = errors.New("destination folder not found")
+	// ErrMoveIntoSelf is returned when a folder would end up inside itself
+	ErrMoveIntoSelf = errors.New("a folder cannot be moved or copied into itself")
+)
+
+// isWithin reports whether storage path p is root or inside it
+func isWithin(p, root string) bool {
+	return p == root || strings.HasPrefix(p, root+string(filepath.Separator))
+}
+
+// freeName finds the first unused "name (n).ext" in folder dir
+func freeName(username, dir, name string, isDir bool) (string, error) {
+	ext := ""
+	if !isDir {
+		ext = filepath.Ext(name)
+	}
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; n <= 10000; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		taken, err := FileExistsInDB(username, filepath.Join(dir, candidate))
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+	return "", ErrFileExists
+}
+
+// subtreeSize adds up the file sizes of a subtree
+func subtreeSize(files []models.FileMetadata) int64 {
+	var size int64
+	for _, file := range files {
+		if !file.IsDirectory {
+			size += file.FileSize
+		}
+	}
+	return size
+}
+
+// TransferFile moves, or copies, the file or folder at srcPath into
+// dstFolder ("/" for the root, else "Folder/Sub") and returns its new
+// storage path. A taken name is handled according to policy. Contents stay
+// in the blob store, so either way only the metadata of the subtree is
+// rewritten, in one transaction. Callers hold the user's write lock.
+func TransferFile(username, userStoragePath, srcPath, dstFolder string, copyItem bool, policy ConflictPolicy) (string, error) {
+	src, err := GetFileByPath(username, srcPath)
+	if err != nil {
+		return "", err
+	}
+	if src == nil {
+		return "", ErrFileNotFound
+	}
+
+	dstDir := "" // Storage path of the destination folder
+	if dstFolder != "" && dstFolder != "/" {
+		dstDir = filepath.Clean(filepath.FromSlash(dstFolder))
+		folder, err := GetFileByPath(username, dstDir)
+		if err != nil {
+			return "", err
+		}
+		if folder == nil || !folder.IsDirectory {
+			return "", ErrFolderNotFound
+		}
+	}
+	if src.IsDirectory && dstDir != "" && isWithin(dstDir, srcPath) {
+		return "", ErrMoveIntoSelf
+	}
+
+	name := src.Filename
+	dstPath := filepath.Join(dstDir, name)
+	if dstPath == srcPath && !copyItem {
+		return srcPath, nil // Already there
+	}
+
+	overwrite := false
+	taken, err := FileExistsInDB(username, dstPath)
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		switch policy {
+		case ConflictSkip:
+			return "", ErrFileSkipped
+		case ConflictRename:
+			if name, err = freeName(username, dstDir, name, src.IsDirectory); err != nil {
+				return "", err
+			}
+			dstPath = filepath.Join(dstDir, name)
+		case ConflictOverwrite:
+			// Replacing the item itself, or a folder holding it, would
+			// destroy the source
+			if isWithin(srcPath, dstPath) {
+				return "", ErrFileExists
+			}
+			overwrite = true
+		default:
+			return "", ErrFileExists
+		}
+	}
+
+	files, err := GetFileSubtree(username, srcPath)
+	if err != nil {
+		return "", err
+	}
+	size := subtreeSize(files)
+
+	// An overwritten item goes to the trash, where it can be restored
+	var replaced *models.TrashItem
+	var replacedSize int64
+	if overwrite {
+		if replaced, err = newTrashItem(username, dstPath); err != nil {
+			return "", err
+		}
+		replacedSize = replaced.Size
+	}
+
+	// Items in the trash still count, so a copy needs room for all of itself
+	if copyItem {
+		if err := CheckQuota(username, size); err != nil {
+			return "", err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if overwrite {
+		if err := trashSubtree(tx, username, replaced); err != nil {
+			return "", err
+		}
+	}
+
+	if copyItem {
+		err = copySubtreeRows(tx, username, srcPath, dstPath, name, dstFolder, src.IsDirectory)
+	} else {
+		err = moveSubtreeRows(tx, username, srcPath, dstPath, name, dstFolder, src.IsDirectory)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to save file metadata: %w", err)
+	}
+
+	// Keep cached folder sizes in step
+	srcDisk := filepath.Join(userStoragePath, srcPath)
+	dstDisk := filepath.Join(userStoragePath, dstPath)
+	srcParentDisk := filepath.Dir(srcDisk)
+	dstParentDisk := filepath.Dir(dstDisk)
+	UpdateFolderSize(dstParentDisk, size-replacedSize)
+	if !copyItem {
+		UpdateFolderSize(srcParentDisk, -size)
+		if src.IsDirectory {
+			RenameFolderSizeCache(srcDisk, dstDisk)
+		}
+	}
+
+	return dstPath, nil
+}
+
+// moveSubtreeRows points the rows of a moved item, and everything inside a
+// moved folder, at its new place
+func moveSubtreeRows(tx *sql.Tx, username, srcPath, dstPath, name, dstFolder string, isDir bool) error {
+	query := `UPDATE files SET filename = ?, storage_path = ?, parent_path = ?, modified_at = ?
+			  WHERE username = ? AND storage_path = ?`
+	if _, err := tx.Exec(query, name, dstPath, normalizeParentPath(dstFolder), time.Now().UTC(), username, srcPath); err != nil {
+		return fmt.Errorf("failed to move file metadata: %w", err)
+	}
+	if isDir {
+		return rewriteChildPaths(tx, username, srcPath, dstPath)
+	}
+	return nil
+}
+
+// copySubtreeRows adds rows for a copied item and everything inside a
+// copied folder
+func copySubtreeRows(tx *sql.Tx, username, srcPath, dstPath, name, dstFolder string, isDir bool) error {
+	now := time.Now().UTC()
+	query := `INSERT INTO files (username, filename, storage_path, parent_path, file_size, mime_type, file_hash, is_directory, uploaded_at, modified_at, color_label)
+			  SELECT username, ?, ?, ?, file_size, mime_type, file_hash, is_directory, ?, ?, color_label
+			  FROM files WHERE username = ? AND storage_path = ?`
+	if _, err := tx.Exec(query, name, dstPath, normalizeParentPath(dstFolder), now, now, username, srcPath); err != nil {
+		return fmt.Errorf("failed to copy file metadata: %w", err)
+	}
+	if isDir {
+		if err := copyChildRows(tx, username, srcPath, dstPath, now); err != nil {
+			return err
+		}
+	}
+	return copyTags(tx, username, srcPath, dstPath)
+}
+
+// copyChildRows adds rows for everything inside a copied folder
+func copyChildRows(tx *sql.Tx, username, srcPath, dstPath string, now time.Time) error {
+	srcPrefix := srcPath + string(filepath.Separator)
+	dstPrefix := dstPath + string(filepath.Separator)
+	srcParent := filepath.ToSlash(srcPath)
+	dstParent := filepath.ToSlash(dstPath)
+	query := `INSERT INTO files (username, filename, storage_path, parent_path, file_size, mime_type, file_hash, is_directory, uploaded_at, modified_at, color_label)
+			  SELECT username, filename, ? || substr(storage_path, length(?) + 1),
+			         CASE WHEN parent_path = ? THEN ? ELSE ? || substr(parent_path, length(?) + 1) END,
+			         file_size, mime_type, file_hash, is_directory, ?, ?, color_label
+			  FROM files WHERE username = ? AND substr(storage_path, 1, length(?)) = ?`
+	_, err := tx.Exec(query, dstPrefix, srcPrefix,
+		srcParent, dstParent, dstParent+"/", srcParent+"/",
+		now, now, username, srcPrefix, srcPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to copy child metadata: %w", err)
+	}
+	return nil
+}
+
+// copyTags gives the copied rows at dstPath the tags of the rows they were
+// copied from at srcPath. Stars are not copied: they mark the file a user
+// starred, not its content.
+func copyTags(tx *sql.Tx, username, srcPath, dstPath string) error {
+	srcPrefix := srcPath + string(filepath.Separator)
+	dstPrefix := dstPath + string(filepath.Separator)
+	query := `INSERT OR IGNORE INTO file_tags (file_id, tag_id)
+			  SELECT d.id, ft.tag_id FROM files s
+			  JOIN file_tags ft ON ft.file_id = s.id
+			  JOIN files d ON d.username = s.username
+			   AND d.storage_path = CASE WHEN s.storage_path = ? THEN ? ELSE ? || substr(s.storage_path, length(?) + 1) END
+			  WHERE s.username = ? AND (s.storage_path = ? OR substr(s.storage_path, 1, length(?)) = ?)`
+	_, err := tx.Exec(query, srcPath, dstPath, dstPrefix, srcPrefix, username, srcPath, srcPrefix, srcPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to copy tags: %w", err)
+	}
+	return nil
+}
+
+// normalizeParentPath turns a folder from a request into parent_path form
+func normalizeParentPath(folder string) string {
+	folder = strings.Trim(filepath.ToSlash(filepath.Clean(filepath.FromSlash(folder))), "/")
+	if folder == "" || folder == "." {
+		return "/"
+	}
+	return folder
+}
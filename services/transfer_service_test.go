@@ -0,0 +1,184 @@
+package services
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fileTagNames returns the tags of the item at storagePath in name order
+func fileTagNames(t *testing.T, username, storagePath string) []string {
+	t.Helper()
+	file := mustGetFile(t, username, storagePath)
+	tags, err := loadFileTags(`SELECT ft.file_id, t.name FROM file_tags ft
+		JOIN tags t ON t.id = ft.tag_id WHERE ft.file_id = ? ORDER BY t.name`, file.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tags[file.ID]
+}
+
+func TestTransferFileIntoItself(t *testing.T) {
+	const user = "transfer-self"
+	userStoragePath := createTestUser(t, user, "x")
+	createTestFolder(t, user, "Docs")
+	createTestFolder(t, user, filepath.Join("Docs", "Sub"))
+
+	tests := []struct {
+		name     string
+		dst      string
+		copyItem bool
+	}{
+		{"move into itself", "Docs", false},
+		{"move into a subfolder", "Docs/Sub", false},
+		{"copy into itself", "Docs", true},
+		{"copy into a subfolder", "Docs/Sub", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := TransferFile(user, userStoragePath, "Docs", tt.dst, tt.copyItem, ConflictRename)
+			if !errors.Is(err, ErrMoveIntoSelf) {
+				t.Errorf("err = %v, want %v", err, ErrMoveIntoSelf)
+			}
+		})
+	}
+
+	mustGetFile(t, user, filepath.Join("Docs", "Sub"))
+	if file, _ := GetFileByPath(user, filepath.Join("Docs", "Sub", "Docs")); file != nil {
+		t.Error("folder ended up inside itself")
+	}
+}
+
+func TestTransferFileConflictPolicy(t *testing.T) {
+	tests := []struct {
+		policy   ConflictPolicy
+		copyItem bool
+		want     string // Path of the transferred item
+		err      error
+	}{
+		{ConflictFail, false, "", ErrFileExists},
+		{ConflictSkip, false, "", ErrFileSkipped},
+		{ConflictRename, false, "Docs/a (1).txt", nil},
+		{ConflictRename, true, "Docs/a (1).txt", nil},
+		{ConflictOverwrite, false, "Docs/a.txt", nil},
+		{ConflictOverwrite, true, "Docs/a.txt", nil},
+	}
+
+	for _, tt := range tests {
+		name := string(tt.policy)
+		if tt.copyItem {
+			name += " copy"
+		}
+		t.Run(name, func(t *testing.T) {
+			user := "transfer-" + string(tt.policy)
+			userStoragePath := createTestUser(t, user, "x")
+			createTestFolder(t, user, "Docs")
+			srcHash := uploadTestFile(t, user, "a.txt", "transfer source")
+			dstHash := uploadTestFile(t, user, filepath.Join("Docs", "a.txt"), user+" destination")
+
+			got, err := TransferFile(user, userStoragePath, "a.txt", "Docs", tt.copyItem, tt.policy)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if filepath.ToSlash(got) != tt.want {
+				t.Errorf("transferred to %q, want %q", got, tt.want)
+			}
+
+			// The source stays unless it was moved
+			src, _ := GetFileByPath(user, "a.txt")
+			if kept := src != nil; kept != (tt.err != nil || tt.copyItem) {
+				t.Errorf("source kept = %v", kept)
+			}
+			if tt.err != nil {
+				return
+			}
+			if file := mustGetFile(t, user, got); file.FileHash != srcHash {
+				t.Errorf("transferred item has hash %.8s, want %.8s", file.FileHash, srcHash)
+			}
+
+			// Replaced content goes to the trash, renamed content stays
+			replaced := mustGetFile(t, user, filepath.Join("Docs", "a.txt"))
+			if tt.policy == ConflictOverwrite {
+				trashID(t, user, filepath.Join("Docs", "a.txt"))
+			} else if replaced.FileHash != dstHash {
+				t.Errorf("existing item has hash %.8s, want %.8s", replaced.FileHash, dstHash)
+			}
+		})
+	}
+}
+
+func TestTransferFileOverwriteParentOfSource(t *testing.T) {
+	const user = "transfer-overwrite-parent"
+	userStoragePath := createTestUser(t, user, "x")
+	createTestFolder(t, user, "Docs")
+	createTestFolder(t, user, filepath.Join("Docs", "Docs"))
+
+	// Replacing Docs with Docs/Docs would delete the source
+	_, err := TransferFile(user, userStoragePath, filepath.Join("Docs", "Docs"), "/", false, ConflictOverwrite)
+	if !errors.Is(err, ErrFileExists) {
+		t.Fatalf("err = %v, want %v", err, ErrFileExists)
+	}
+	mustGetFile(t, user, filepath.Join("Docs", "Docs"))
+}
+
+func TestTransferFileCopiesTags(t *testing.T) {
+	const user = "transfer-tags"
+	userStoragePath := createTestUser(t, user, "x")
+	createTestFolder(t, user, "Docs")
+	createTestFolder(t, user, filepath.Join("Docs", "Sub"))
+	createTestFolder(t, user, "Archive")
+	uploadTestFile(t, user, filepath.Join("Docs", "a.txt"), "transfer-tags a")
+	uploadTestFile(t, user, filepath.Join("Docs", "Sub", "b.txt"), "transfer-tags b")
+
+	tagged := map[string][]string{
+		"Docs":                                {"project"},
+		filepath.Join("Docs", "a.txt"):        {"draft", "work"},
+		filepath.Join("Docs", "Sub", "b.txt"): {"work"},
+	}
+	for path, tags := range tagged {
+		if err := TagFile(user, path, tags); err != nil {
+			t.Fatalf("TagFile(%s): %v", path, err)
+		}
+	}
+	if err := SetStarred(user, user, filepath.Join("Docs", "a.txt"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TransferFile(user, userStoragePath, "Docs", "Archive", true, ConflictFail); err != nil {
+		t.Fatalf("copy of the folder: %v", err)
+	}
+	if _, err := TransferFile(user, userStoragePath, filepath.Join("Docs", "a.txt"), "Docs", true, ConflictRename); err != nil {
+		t.Fatalf("copy of the file beside itself: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{filepath.Join("Archive", "Docs"), []string{"project"}},
+		{filepath.Join("Archive", "Docs", "a.txt"), []string{"draft", "work"}},
+		{filepath.Join("Archive", "Docs", "Sub"), nil},
+		{filepath.Join("Archive", "Docs", "Sub", "b.txt"), []string{"work"}},
+		{filepath.Join("Docs", "a (1).txt"), []string{"draft", "work"}},
+
+		// The originals keep theirs
+		{"Docs", []string{"project"}},
+		{filepath.Join("Docs", "a.txt"), []string{"draft", "work"}},
+	}
+	for _, tt := range tests {
+		if got := fileTagNames(t, user, tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: tags %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	// Stars stay with the starred file
+	starred, err := ListStarredFiles(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(starred) != 1 {
+		t.Errorf("%d starred files after copying, want 1", len(starred))
+	}
+}
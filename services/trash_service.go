@@ -0,0 +1,351 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+// ErrTrashItemNotFound is returned when a trash entry does not exist or
+// belongs to someone else
+var ErrTrashItemNotFound = errors.New("trash item not found")
+
+// subtreeCondition matches a file or folder row and everything below it
+const subtreeCondition = `(storage_path = ? OR substr(storage_path, 1, length(?)) = ?)`
+
+// subtreeArgs returns the arguments for subtreeCondition
+func subtreeArgs(storagePath string) []interface{} {
+	prefix := storagePath + string(filepath.Separator)
+	return []interface{}{storagePath, prefix, prefix}
+}
+
+// MoveToTrash deletes a file or folder by moving its metadata, and that of
+// everything inside it, into the user's trash. The content stays in the
+// blob store, referenced by the trash rows, so it can be restored. Callers
+// hold the user's write lock.
+func MoveToTrash(username, userStoragePath, storagePath string) (*models.TrashItem, error) {
+	item, err := newTrashItem(username, storagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := trashSubtree(tx, username, item); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to move to trash: %w", err)
+	}
+
+	UpdateFolderSize(filepath.Dir(filepath.Join(userStoragePath, storagePath)), -item.Size)
+	return item, nil
+}
+
+// newTrashItem describes the trash item a file or folder of username would
+// become
+func newTrashItem(username, storagePath string) (*models.TrashItem, error) {
+	meta, err := GetFileByPath(username, storagePath)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, ErrFileNotFound
+	}
+
+	files, err := GetFileSubtree(username, storagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TrashItem{
+		Filename:       meta.Filename,
+		OriginalPath:   storagePath,
+		OriginalFolder: meta.ParentPath,
+		IsDirectory:    meta.IsDirectory,
+		Size:           subtreeSize(files),
+		ItemCount:      len(files),
+		DeletedAt:      time.Now().UTC(),
+	}, nil
+}
+
+// trashSubtree moves the rows of item's file or folder, everything inside
+// it and their earlier versions into the trash within tx, and sets item.ID
+func trashSubtree(tx *sql.Tx, username string, item *models.TrashItem) error {
+	storagePath := item.OriginalPath
+	result, err := tx.Exec(`INSERT INTO trash (username, filename, original_path, original_parent, is_directory, total_size, item_count, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		username, item.Filename, item.OriginalPath, item.OriginalFolder, item.IsDirectory, item.Size, item.ItemCount, item.DeletedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create trash item: %w", err)
+	}
+	if item.ID, err = result.LastInsertId(); err != nil {
+		return fmt.Errorf("failed to create trash item: %w", err)
+	}
+
+	args := append([]interface{}{item.ID, username}, subtreeArgs(storagePath)...)
+	query := `INSERT INTO trash_files (trash_id, filename, storage_path, parent_path, file_size, mime_type, file_hash, is_directory, uploaded_at, modified_at, file_id, version, uploaded_by, color_label)
+			  SELECT ?, filename, storage_path, parent_path, file_size, mime_type, file_hash, is_directory, uploaded_at, modified_at, id, version, uploaded_by, color_label
+			  FROM files WHERE username = ? AND ` + subtreeCondition
+	if _, err := tx.Exec(query, args...); err != nil {
+		return fmt.Errorf("failed to save trash metadata: %w", err)
+	}
+
+	// Earlier versions would go with the files rows, so they are kept too
+	query = `INSERT INTO trash_versions (trash_id, file_id, version, file_size, mime_type, file_hash, uploaded_by, uploaded_at, replaced_at)
+			 SELECT ?, file_id, version, file_size, mime_type, file_hash, uploaded_by, uploaded_at, replaced_at
+			 FROM file_versions WHERE file_id IN (SELECT file_id FROM trash_files WHERE trash_id = ?)`
+	if _, err := tx.Exec(query, item.ID, item.ID); err != nil {
+		return fmt.Errorf("failed to save version history: %w", err)
+	}
+
+	args = append([]interface{}{username}, subtreeArgs(storagePath)...)
+	if _, err := tx.Exec(`DELETE FROM files WHERE username = ? AND `+subtreeCondition, args...); err != nil {
+		return fmt.Errorf("failed to delete file metadata: %w", err)
+	}
+	return nil
+}
+
+// trashColumns is the column list read by scanTrashItem
+const trashColumns = `id, filename, original_path, original_parent, is_directory, total_size, item_count, deleted_at`
+
+// scanTrashItem reads a trash row selected with trashColumns
+func scanTrashItem(row rowScanner) (*models.TrashItem, error) {
+	var item models.TrashItem
+	err := row.Scan(&item.ID, &item.Filename, &item.OriginalPath, &item.OriginalFolder,
+		&item.IsDirectory, &item.Size, &item.ItemCount, &item.DeletedAt)
+	if err != nil {
+		return nil, err
+	}
+	if config.TrashRetention > 0 {
+		item.ExpiresAt = item.DeletedAt.Add(config.TrashRetention)
+	}
+	return &item, nil
+}
+
+// ListTrash returns a user's deleted items, newest first
+func ListTrash(username string) ([]models.TrashItem, error) {
+	rows, err := db.Query(`SELECT `+trashColumns+` FROM trash WHERE username = ? ORDER BY deleted_at DESC, id DESC`, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trash: %w", err)
+	}
+	defer rows.Close()
+
+	items := []models.TrashItem{}
+	for rows.Next() {
+		item, err := scanTrashItem(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan trash item: %w", err)
+		}
+		items = append(items, *item)
+	}
+	return items, rows.Err()
+}
+
+// GetTrashUsage returns the bytes and number of items in a user's trash
+func GetTrashUsage(username string) (int64, int, error) {
+	var size int64
+	var count int
+	err := db.QueryRow(`SELECT COALESCE(SUM(total_size), 0), COUNT(*) FROM trash WHERE username = ?`, username).Scan(&size, &count)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get trash usage: %w", err)
+	}
+	return size, count, nil
+}
+
+// getTrashItem loads one of a user's trash items
+func getTrashItem(username string, id int64) (*models.TrashItem, error) {
+	item, err := scanTrashItem(db.QueryRow(`SELECT `+trashColumns+` FROM trash WHERE id = ? AND username = ?`, id, username))
+	if err == sql.ErrNoRows {
+		return nil, ErrTrashItemNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trash item: %w", err)
+	}
+	return item, nil
+}
+
+// ensureParentFolders recreates any missing folders above storagePath as
+// metadata rows in tx
+func ensureParentFolders(tx *sql.Tx, username, parentFolder string) error {
+	if parentFolder == "/" || parentFolder == "" {
+		return nil
+	}
+
+	parent := "/"
+	dir := ""
+	for _, segment := range strings.Split(parentFolder, "/") {
+		dir = filepath.Join(dir, segment)
+
+		var isDir bool
+		err := tx.QueryRow(`SELECT is_directory FROM files WHERE username = ? AND storage_path = ?`, username, dir).Scan(&isDir)
+		switch {
+		case err == nil && !isDir:
+			return fmt.Errorf("%w: a file is in the way of folder %s", ErrFileExists, filepath.ToSlash(dir))
+		case err == sql.ErrNoRows:
+			now := time.Now().UTC()
+			_, err := tx.Exec(`INSERT INTO files (username, filename, storage_path, parent_path, file_size, mime_type, file_hash, is_directory, uploaded_at, modified_at)
+				VALUES (?, ?, ?, ?, 0, '', '', 1, ?, ?)`, username, segment, dir, parent, now, now)
+			if err != nil {
+				return fmt.Errorf("failed to recreate folder: %w", err)
+			}
+		case err != nil:
+			return fmt.Errorf("failed to check folder: %w", err)
+		}
+
+		parent = filepath.ToSlash(dir)
+	}
+	return nil
+}
+
+// RestoreFromTrash puts a deleted item back where it came from, recreating
+// any parent folders deleted since. If the name has been taken in the
+// meantime the item comes back as "name (1)". Returns the restored storage
+// path. Callers hold the user's write lock.
+func RestoreFromTrash(username, userStoragePath string, id int64) (string, error) {
+	item, err := getTrashItem(username, id)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := ensureParentFolders(tx, username, item.OriginalFolder); err != nil {
+		return "", err
+	}
+
+	dir := filepath.Dir(item.OriginalPath)
+	if dir == "." {
+		dir = ""
+	}
+	name := item.Filename
+	target := item.OriginalPath
+	if taken, err := FileExistsInDB(username, target); err != nil {
+		return "", err
+	} else if taken {
+		if name, err = freeName(username, dir, name, item.IsDirectory); err != nil {
+			return "", err
+		}
+		target = filepath.Join(dir, name)
+	}
+
+	// Rows go back under the (possibly new) name in one statement, with
+	// their old IDs so the version history, tags and stars are reattached
+	oldPrefix := item.OriginalPath + string(filepath.Separator)
+	newPrefix := target + string(filepath.Separator)
+	oldParent := filepath.ToSlash(item.OriginalPath)
+	newParent := filepath.ToSlash(target)
+	query := `INSERT INTO files (id, username, filename, storage_path, parent_path, file_size, mime_type, file_hash, is_directory, uploaded_at, modified_at, version, uploaded_by, color_label)
+			  SELECT NULLIF(file_id, 0), ?,
+			         CASE WHEN storage_path = ? THEN ? ELSE filename END,
+			         CASE WHEN storage_path = ? THEN ? ELSE ? || substr(storage_path, length(?) + 1) END,
+			         CASE WHEN parent_path = ? THEN ?
+			              WHEN substr(parent_path, 1, length(?)) = ? THEN ? || substr(parent_path, length(?) + 1)
+			              ELSE parent_path END,
+			         file_size, mime_type, file_hash, is_directory, uploaded_at, modified_at, version, uploaded_by, color_label
+			  FROM trash_files WHERE trash_id = ?`
+	_, err = tx.Exec(query, username,
+		item.OriginalPath, name,
+		item.OriginalPath, target, newPrefix, oldPrefix,
+		oldParent, newParent,
+		oldParent+"/", oldParent+"/", newParent+"/", oldParent+"/",
+		item.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to restore file metadata: %w", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO file_versions (file_id, username, version, file_size, mime_type, file_hash, uploaded_by, uploaded_at, replaced_at)
+		SELECT file_id, ?, version, file_size, mime_type, file_hash, uploaded_by, uploaded_at, replaced_at
+		FROM trash_versions WHERE trash_id = ?`, username, item.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to restore version history: %w", err)
+	}
+
+	// trash_files and trash_versions rows go with it (ON DELETE CASCADE)
+	result, err := tx.Exec(`DELETE FROM trash WHERE id = ?`, item.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete trash item: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return "", ErrTrashItemNotFound // Purged meanwhile
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to restore file metadata: %w", err)
+	}
+
+	UpdateFolderSize(filepath.Dir(filepath.Join(userStoragePath, target)), item.Size)
+	return target, nil
+}
+
+// DeleteFromTrash permanently deletes a trash item. Its content goes from
+// the blob store once nothing else refers to it. Callers hold the user's
+// write lock.
+func DeleteFromTrash(username string, id int64) error {
+	// trash_files and trash_versions rows go with it (ON DELETE CASCADE)
+	result, err := db.Exec(`DELETE FROM trash WHERE id = ? AND username = ?`, id, username)
+	if err != nil {
+		return fmt.Errorf("failed to delete trash item: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrTrashItemNotFound
+	}
+	return nil
+}
+
+// EmptyTrash permanently deletes everything in a user's trash. Callers
+// hold the user's write lock.
+func EmptyTrash(username string) (int, error) {
+	result, err := db.Exec(`DELETE FROM trash WHERE username = ?`, username)
+	if err != nil {
+		return 0, fmt.Errorf("failed to empty trash: %w", err)
+	}
+	removed, _ := result.RowsAffected()
+	return int(removed), nil
+}
+
+// PurgeExpiredTrash permanently deletes items older than TrashRetention
+func PurgeExpiredTrash() (int, error) {
+	if config.TrashRetention <= 0 {
+		return 0, nil
+	}
+
+	cutoff := time.Now().UTC().Add(-config.TrashRetention)
+	result, err := db.Exec(`DELETE FROM trash WHERE deleted_at < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge expired trash: %w", err)
+	}
+	removed, _ := result.RowsAffected()
+	return int(removed), nil
+}
+
+// InitTrashPurger creates the background task that empties old items out
+// of the trash
+func InitTrashPurger() *PeriodicTask {
+	return NewPeriodicTask("Trash purger", config.TrashPurgeInterval, func() error {
+		removed, err := PurgeExpiredTrash()
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			log.Printf("Purged %d expired trash items", removed)
+		}
+		return nil
+	})
+}
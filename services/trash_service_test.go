@@ -0,0 +1,161 @@
+package services
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+// createTestFolder records a folder at storagePath
+func createTestFolder(t *testing.T, username, storagePath string) {
+	t.Helper()
+	err := AddFileMetadata(username, filepath.Base(storagePath), storagePath, normalizeParentPath(filepath.Dir(storagePath)), "", "", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustGetFile returns the metadata at storagePath, failing if there is none
+func mustGetFile(t *testing.T, username, storagePath string) *models.FileMetadata {
+	t.Helper()
+	file, err := GetFileByPath(username, storagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file == nil {
+		t.Fatalf("no metadata at %s", storagePath)
+	}
+	return file
+}
+
+func TestRestoreFromTrashNameTaken(t *testing.T) {
+	const user = "trash-taken"
+	userStoragePath := createTestUser(t, user, "x")
+	createTestFolder(t, user, "Docs")
+	oldHash := uploadTestFile(t, user, filepath.Join("Docs", "a.txt"), "trash-taken old a")
+	uploadTestFile(t, user, "a.txt", "trash-taken old top a")
+
+	for _, path := range []string{"a.txt", "Docs"} {
+		if _, err := MoveToTrash(user, userStoragePath, path); err != nil {
+			t.Fatalf("MoveToTrash(%s): %v", path, err)
+		}
+	}
+
+	// New items take the names while the old ones are in the trash
+	createTestFolder(t, user, "Docs")
+	uploadTestFile(t, user, "a.txt", "trash-taken new a")
+
+	tests := []struct {
+		name         string
+		originalPath string
+		want         string
+	}{
+		{"file", "a.txt", "a (1).txt"},
+		{"folder", "Docs", "Docs (1)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored, err := RestoreFromTrash(user, userStoragePath, trashID(t, user, tt.originalPath))
+			if err != nil {
+				t.Fatalf("RestoreFromTrash: %v", err)
+			}
+			if restored != tt.want {
+				t.Errorf("restored to %q, want %q", restored, tt.want)
+			}
+			if file := mustGetFile(t, user, restored); file.Filename != tt.want || file.ParentPath != "/" {
+				t.Errorf("restored row named %q in %q, want %q in /", file.Filename, file.ParentPath, tt.want)
+			}
+			mustGetFile(t, user, tt.originalPath) // The new item is left alone
+		})
+	}
+
+	// The contents of a renamed folder follow it
+	child := mustGetFile(t, user, filepath.Join("Docs (1)", "a.txt"))
+	if child.ParentPath != "Docs (1)" || child.FileHash != oldHash {
+		t.Errorf("child of the restored folder: parent %q, hash %.8s; want %q, %.8s", child.ParentPath, child.FileHash, "Docs (1)", oldHash)
+	}
+	if file, _ := GetFileByPath(user, filepath.Join("Docs", "a.txt")); file != nil {
+		t.Error("child restored into the new folder")
+	}
+}
+
+func TestRestoreFromTrashMissingParents(t *testing.T) {
+	const user = "trash-parents"
+	userStoragePath := createTestUser(t, user, "x")
+	createTestFolder(t, user, "Docs")
+	createTestFolder(t, user, filepath.Join("Docs", "Sub"))
+	nested := filepath.Join("Docs", "Sub", "f.txt")
+	hash := uploadTestFile(t, user, nested, "trash-parents f")
+
+	// The file goes first, then the folders it was in
+	for _, path := range []string{nested, "Docs"} {
+		if _, err := MoveToTrash(user, userStoragePath, path); err != nil {
+			t.Fatalf("MoveToTrash(%s): %v", path, err)
+		}
+	}
+
+	restored, err := RestoreFromTrash(user, userStoragePath, trashID(t, user, nested))
+	if err != nil {
+		t.Fatalf("RestoreFromTrash: %v", err)
+	}
+	if restored != nested {
+		t.Errorf("restored to %q, want %q", restored, nested)
+	}
+	if file := mustGetFile(t, user, nested); file.FileHash != hash || file.ParentPath != "Docs/Sub" {
+		t.Errorf("restored file: parent %q, hash %.8s; want %q, %.8s", file.ParentPath, file.FileHash, "Docs/Sub", hash)
+	}
+
+	folders := []struct {
+		path   string
+		parent string
+	}{
+		{"Docs", "/"},
+		{filepath.Join("Docs", "Sub"), "Docs"},
+	}
+	for _, folder := range folders {
+		file := mustGetFile(t, user, folder.path)
+		if !file.IsDirectory || file.ParentPath != folder.parent {
+			t.Errorf("%s: directory = %v, parent %q; want a folder in %q", folder.path, file.IsDirectory, file.ParentPath, folder.parent)
+		}
+	}
+
+	// The folder itself now comes back beside the recreated one
+	restored, err = RestoreFromTrash(user, userStoragePath, trashID(t, user, "Docs"))
+	if err != nil {
+		t.Fatalf("RestoreFromTrash(Docs): %v", err)
+	}
+	if restored != "Docs (1)" {
+		t.Errorf("folder restored to %q, want %q", restored, "Docs (1)")
+	}
+}
+
+func TestRestoreFromTrashFileInTheWay(t *testing.T) {
+	const user = "trash-in-the-way"
+	userStoragePath := createTestUser(t, user, "x")
+	createTestFolder(t, user, "Docs")
+	nested := filepath.Join("Docs", "f.txt")
+	uploadTestFile(t, user, nested, "trash-in-the-way f")
+
+	for _, path := range []string{nested, "Docs"} {
+		if _, err := MoveToTrash(user, userStoragePath, path); err != nil {
+			t.Fatalf("MoveToTrash(%s): %v", path, err)
+		}
+	}
+
+	// A file now has the name of the folder to recreate
+	uploadTestFile(t, user, "Docs", "trash-in-the-way file named Docs")
+
+	id := trashID(t, user, nested)
+	if _, err := RestoreFromTrash(user, userStoragePath, id); !errors.Is(err, ErrFileExists) {
+		t.Fatalf("RestoreFromTrash: err = %v, want %v", err, ErrFileExists)
+	}
+	if file, _ := GetFileByPath(user, nested); file != nil {
+		t.Error("file restored despite the error")
+	}
+	if _, err := getTrashItem(user, id); err != nil {
+		t.Errorf("trash item after a failed restore: %v", err)
+	}
+}
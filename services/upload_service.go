@@ -0,0 +1,226 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+var (
+	// ErrUploadBusy is returned when another request is already writing to an upload
+	ErrUploadBusy = errors.New("upload is already in progress")
+	// ErrUploadTooLarge is returned when a chunk runs past the declared length
+	ErrUploadTooLarge = errors.New("upload exceeds its declared length")
+)
+
+var (
+	activeUploads   = make(map[string]bool)
+	activeUploadsMu sync.Mutex
+)
+
+// TryLockUpload claims an upload for one request at a time, so two PATCHes
+// cannot write the same staging file concurrently
+func TryLockUpload(id string) bool {
+	activeUploadsMu.Lock()
+	defer activeUploadsMu.Unlock()
+	if activeUploads[id] {
+		return false
+	}
+	activeUploads[id] = true
+	return true
+}
+
+// UnlockUpload releases an upload claimed with TryLockUpload
+func UnlockUpload(id string) {
+	activeUploadsMu.Lock()
+	defer activeUploadsMu.Unlock()
+	delete(activeUploads, id)
+}
+
+// ResumableUploadPath returns the staging file for an upload
+func ResumableUploadPath(id string) string {
+	return filepath.Join(config.ResumableUploadDir, id)
+}
+
+// CreateUploadSession records a new resumable upload and creates its empty
+// staging file
+func CreateUploadSession(username, filename, parentPath, mimeType string, length int64) (*models.UploadSession, error) {
+	if err := os.MkdirAll(config.ResumableUploadDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	now := time.Now().UTC()
+	upload := &models.UploadSession{
+		ID:         GenerateSessionID(),
+		Username:   username,
+		Filename:   filename,
+		ParentPath: parentPath,
+		MimeType:   mimeType,
+		Length:     length,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	// Insert the row first so the sweeper never sees an orphaned file
+	query := `INSERT INTO uploads (id, username, filename, parent_path, mime_type, upload_length, upload_offset, created_at, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?)`
+	if _, err := db.Exec(query, upload.ID, username, filename, parentPath, mimeType, length, now, now); err != nil {
+		return nil, fmt.Errorf("failed to create upload: %w", err)
+	}
+
+	f, err := os.Create(ResumableUploadPath(upload.ID))
+	if err != nil {
+		db.Exec(`DELETE FROM uploads WHERE id = ?`, upload.ID)
+		return nil, fmt.Errorf("failed to create staging file: %w", err)
+	}
+	f.Close()
+	return upload, nil
+}
+
+// GetUploadSession returns one of a user's unfinished uploads, or nil
+func GetUploadSession(id, username string) (*models.UploadSession, error) {
+	query := `SELECT id, username, filename, parent_path, mime_type, upload_length, upload_offset, created_at, updated_at
+			  FROM uploads WHERE id = ? AND username = ?`
+
+	var upload models.UploadSession
+	err := db.QueryRow(query, id, username).Scan(
+		&upload.ID, &upload.Username, &upload.Filename, &upload.ParentPath, &upload.MimeType,
+		&upload.Length, &upload.Offset, &upload.CreatedAt, &upload.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// PendingUploadBytes returns the bytes a user has reserved with unfinished
+// uploads, so new ones cannot promise more than the quota allows
+func PendingUploadBytes(username string) (int64, error) {
+	var total int64
+	err := db.QueryRow(`SELECT COALESCE(SUM(upload_length), 0) FROM uploads WHERE username = ?`, username).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sum pending uploads: %w", err)
+	}
+	return total, nil
+}
+
+// AppendUploadChunk writes src to the end of an upload's staging file and
+// returns the new offset. Whatever arrived is kept even if the connection
+// drops, so the client can resume from there. Callers hold TryLockUpload.
+func AppendUploadChunk(upload *models.UploadSession, src io.Reader) (int64, error) {
+	f, err := os.OpenFile(ResumableUploadPath(upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return upload.Offset, fmt.Errorf("failed to open staging file: %w", err)
+	}
+	defer f.Close()
+
+	// Drop anything past the recorded offset (e.g. a write that was never
+	// acknowledged before a crash)
+	if err := f.Truncate(upload.Offset); err != nil {
+		return upload.Offset, fmt.Errorf("failed to prepare staging file: %w", err)
+	}
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		return upload.Offset, fmt.Errorf("failed to prepare staging file: %w", err)
+	}
+
+	written, copyErr := io.CopyN(f, src, upload.Length-upload.Offset)
+	if copyErr == io.EOF {
+		copyErr = nil
+	}
+	if copyErr == nil {
+		// The chunk must not carry more than the declared length
+		if n, _ := src.Read(make([]byte, 1)); n > 0 {
+			copyErr = ErrUploadTooLarge
+		}
+	}
+
+	upload.Offset += written
+	upload.UpdatedAt = time.Now().UTC()
+	_, err = db.Exec(`UPDATE uploads SET upload_offset = ?, updated_at = ? WHERE id = ?`, upload.Offset, upload.UpdatedAt, upload.ID)
+	if err != nil {
+		return upload.Offset, fmt.Errorf("failed to record upload offset: %w", err)
+	}
+	return upload.Offset, copyErr
+}
+
+// DeleteUploadSession forgets an upload and removes its staging file
+func DeleteUploadSession(id string) error {
+	if _, err := db.Exec(`DELETE FROM uploads WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	if err := os.Remove(ResumableUploadPath(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove staging file: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredUploadSessions discards uploads that have been idle longer
+// than ResumableUploadExpiry, plus staging files whose upload row is gone
+// (e.g. because the account was deleted)
+func DeleteExpiredUploadSessions() (int, error) {
+	cutoff := time.Now().UTC().Add(-config.ResumableUploadExpiry)
+	rows, err := db.Query(`SELECT id FROM uploads WHERE updated_at < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find expired uploads: %w", err)
+	}
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			expired = append(expired, id)
+		}
+	}
+	rows.Close()
+
+	removed := 0
+	for _, id := range expired {
+		if !TryLockUpload(id) {
+			continue
+		}
+		if err := DeleteUploadSession(id); err != nil {
+			log.Printf("Warning: %v", err)
+		} else {
+			removed++
+		}
+		UnlockUpload(id)
+	}
+
+	entries, _ := os.ReadDir(config.ResumableUploadDir)
+	for _, entry := range entries {
+		var exists int
+		db.QueryRow(`SELECT COUNT(*) FROM uploads WHERE id = ?`, entry.Name()).Scan(&exists)
+		if exists == 0 && TryLockUpload(entry.Name()) {
+			os.Remove(ResumableUploadPath(entry.Name()))
+			UnlockUpload(entry.Name())
+		}
+	}
+
+	return removed, nil
+}
+
+// InitUploadSweeper creates the background task that discards abandoned
+// resumable uploads
+func InitUploadSweeper() *PeriodicTask {
+	return NewPeriodicTask("Upload sweeper", config.ResumableSweepInterval, func() error {
+		removed, err := DeleteExpiredUploadSessions()
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			log.Printf("Discarded %d abandoned uploads", removed)
+		}
+		return nil
+	})
+}
@@ -2,7 +2,9 @@ package services
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
@@ -17,6 +19,9 @@ var (
 	mu       sync.RWMutex
 )
 
+// ErrInvalidPassword is returned when a supplied current password is wrong
+var ErrInvalidPassword = errors.New("current password is incorrect")
+
 // GenerateUniqueCode generates a random unique code
 func GenerateUniqueCode() string {
 	b := make([]byte, 8)
@@ -96,8 +101,14 @@ func CreateUser(username, email, phone, phoneRegion, password string) (*models.U
 
 	createdAt := time.Now()
 
+	// Never store the raw password
+	passwordHash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create user in database
-	err := CreateUserDB(username, email, phone, phoneRegion, password, uniqueCode, createdAt, loginType)
+	err = CreateUserDB(username, email, phone, phoneRegion, passwordHash, uniqueCode, createdAt, loginType)
 	if err != nil {
 		return nil, err
 	}
@@ -106,10 +117,127 @@ func CreateUser(username, email, phone, phoneRegion, password string) (*models.U
 	userStoragePath := GetUserStoragePath(username, uniqueCode)
 	os.MkdirAll(userStoragePath, os.ModePerm)
 
+	// The first account on a fresh install becomes the admin
+	if promoted, err := EnsureAdminExists(); err != nil {
+		log.Printf("Warning: %v", err)
+	} else if promoted != "" {
+		log.Printf("✓ %s is the first account and has been made an admin", promoted)
+	}
+
 	// Return the created user
 	return GetUserByUsernameDB(username)
 }
 
+// AuthenticateUser checks a password for a user and transparently upgrades
+// legacy plaintext or outdated hashes on success
+func AuthenticateUser(user *models.User, password string) bool {
+	if user == nil {
+		return false
+	}
+
+	match, needsRehash := VerifyPassword(user.Password, password)
+	if !match {
+		return false
+	}
+
+	if needsRehash {
+		if passwordHash, err := HashPassword(password); err == nil {
+			if err := UpdateUserPasswordDB(user.Username, passwordHash); err != nil {
+				log.Printf("Warning: failed to upgrade password hash for %s: %v", user.Username, err)
+			} else {
+				user.Password = passwordHash
+			}
+		}
+	}
+
+	return true
+}
+
+// SetUserPassword hashes and stores a new password for a user
+func SetUserPassword(username, newPassword string) error {
+	passwordHash, err := HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	return UpdateUserPasswordDB(username, passwordHash)
+}
+
+// ChangePassword verifies the current password and replaces it with a new one
+func ChangePassword(username, currentPassword, newPassword string) error {
+	user, err := GetUserByUsernameDB(username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user not found")
+	}
+
+	if match, _ := VerifyPassword(user.Password, currentPassword); !match {
+		return ErrInvalidPassword
+	}
+
+	return SetUserPassword(username, newPassword)
+}
+
+// ResetPasswordWithToken sets a new password using an emailed reset token.
+// Every existing session is signed out and any login lockout is lifted.
+func ResetPasswordWithToken(token, newPassword string) (string, error) {
+	resetToken, err := ConsumeUserToken(token, TokenPurposePasswordReset)
+	if err != nil {
+		return "", err
+	}
+
+	if err := SetUserPassword(resetToken.Username, newPassword); err != nil {
+		return "", err
+	}
+
+	if _, err := DeleteUserSessions(resetToken.Username, ""); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	RecordLoginSuccess(UserThrottleKey(resetToken.Username))
+
+	return resetToken.Username, nil
+}
+
+// VerifyEmailWithToken confirms a user's email address with an emailed token
+func VerifyEmailWithToken(token string) (string, error) {
+	verifyToken, err := ConsumeUserToken(token, TokenPurposeVerifyEmail)
+	if err != nil {
+		return "", err
+	}
+
+	// The link only counts for the address it was sent to
+	verified, err := SetEmailVerifiedDB(verifyToken.Username, verifyToken.Email)
+	if err != nil {
+		return "", err
+	}
+	if !verified {
+		return "", ErrInvalidToken
+	}
+	return verifyToken.Username, nil
+}
+
+// UpgradeLegacyPasswords hashes any plaintext passwords left in the database
+func UpgradeLegacyPasswords() (int, error) {
+	users, err := GetAllUsersDB()
+	if err != nil {
+		return 0, err
+	}
+
+	upgraded := 0
+	for _, user := range users {
+		if IsPasswordHashed(user.Password) {
+			continue
+		}
+		if err := SetUserPassword(user.Username, user.Password); err != nil {
+			return upgraded, fmt.Errorf("failed to upgrade password for %s: %w", user.Username, err)
+		}
+		upgraded++
+	}
+
+	return upgraded, nil
+}
+
 // UpdateUserProfile updates user's email and phone
 func UpdateUserProfile(username, email, phone string) error {
 	return UpdateUserProfileWithRegion(username, email, phone, "")
@@ -144,9 +272,11 @@ func UpdateUserProfileWithRegion(username, email, phone, phoneRegion string) err
 		user.LoginType = "phone"
 	}
 
-	// Update in database
-	query := `UPDATE users SET email = ?, phone = ?, phone_region = ?, login_type = ? WHERE username = ?`
-	_, err = GetDB().Exec(query, user.Email, user.Phone, user.PhoneRegion, user.LoginType, username)
+	// Update in database (a changed email has to be verified again)
+	query := `UPDATE users SET email = ?, phone = ?, phone_region = ?, login_type = ?,
+			  email_verified = CASE WHEN email = ? THEN email_verified ELSE 0 END
+			  WHERE username = ?`
+	_, err = GetDB().Exec(query, user.Email, user.Phone, user.PhoneRegion, user.LoginType, user.Email, username)
 	return err
 }
 
@@ -180,7 +310,7 @@ func UpdateUsername(oldUsername, newUsername string) error {
 	oldPath := GetUserStoragePath(oldUsername, user.UniqueCode)
 	newPath := GetUserStoragePath(newUsername, user.UniqueCode)
 
-	if err := os.Rename(oldPath, newPath); err != nil {
+	if err := os.Rename(oldPath, newPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to rename storage folder: %v", err)
 	}
 
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+var (
+	// ErrUserShareNotFound is returned when an item is not (or no longer)
+	// shared with a user
+	ErrUserShareNotFound = errors.New("this item is not shared with you")
+	// ErrShareWithSelf is returned when a user picks themselves as recipient
+	ErrShareWithSelf = errors.New("you cannot share with yourself")
+)
+
+// Access levels of a models.UserShare
+const (
+	ShareRoleViewer = "viewer" // Browse and download
+	ShareRoleEditor = "editor" // Also upload, rename, move and delete inside
+)
+
+// IsValidShareRole reports whether role is a known access level
+func IsValidShareRole(role string) bool {
+	return role == ShareRoleViewer || role == ShareRoleEditor
+}
+
+// userShareColumns is the column list read by scanUserShare; the owner and
+// the item's current name and place come from its files row
+const userShareColumns = `us.id, f.username, us.recipient, us.file_id, f.filename, f.storage_path, f.is_directory,
+	us.role, us.created_at`
+
+// userShareFrom joins a share to the item it gives access to
+const userShareFrom = ` FROM user_shares us JOIN files f ON f.id = us.file_id`
+
+// scanUserShare reads a row selected with userShareColumns
+func scanUserShare(row rowScanner) (*models.UserShare, error) {
+	var share models.UserShare
+	err := row.Scan(&share.ID, &share.Owner, &share.Recipient, &share.FileID, &share.Filename, &share.StoragePath,
+		&share.IsDirectory, &share.Role, &share.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// queryUserShares runs a query selecting userShareColumns
+func queryUserShares(query string, args ...interface{}) ([]models.UserShare, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shares: %w", err)
+	}
+	defer rows.Close()
+
+	shares := []models.UserShare{}
+	for rows.Next() {
+		share, err := scanUserShare(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan share: %w", err)
+		}
+		shares = append(shares, *share)
+	}
+	return shares, rows.Err()
+}
+
+// ShareWithUser gives recipient access to a file or folder of owner's.
+// Sharing an item with the same user again changes their role.
+func ShareWithUser(owner, storagePath, recipient, role string) (*models.UserShare, error) {
+	if recipient == owner {
+		return nil, ErrShareWithSelf
+	}
+	meta, err := GetFileByPath(owner, storagePath)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, ErrFileNotFound
+	}
+
+	_, err = db.Exec(`INSERT INTO user_shares (file_id, recipient, role, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(file_id, recipient) DO UPDATE SET role = excluded.role`,
+		meta.ID, recipient, role, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to share: %w", err)
+	}
+
+	share, err := scanUserShare(db.QueryRow(`SELECT `+userShareColumns+userShareFrom+`
+		WHERE us.file_id = ? AND us.recipient = ?`, meta.ID, recipient))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read share: %w", err)
+	}
+	return share, nil
+}
+
+// ListUserSharesByOwner returns the items a user shared with others,
+// newest first
+func ListUserSharesByOwner(owner string) ([]models.UserShare, error) {
+	return queryUserShares(`SELECT `+userShareColumns+userShareFrom+`
+		WHERE f.username = ? ORDER BY us.created_at DESC, us.id DESC`, owner)
+}
+
+// ListSharedWithUser returns the items other users shared with a user,
+// newest first. Items of disabled accounts are left out.
+func ListSharedWithUser(recipient string) ([]models.UserShare, error) {
+	return queryUserShares(`SELECT `+userShareColumns+userShareFrom+`
+		JOIN users u ON u.username = f.username
+		WHERE us.recipient = ? AND u.disabled = 0 ORDER BY us.created_at DESC, us.id DESC`, recipient)
+}
+
+// GetSharedWithUser returns one item shared with a user. It is looked up
+// on every request, so removing a share or changing its role takes effect
+// at once.
+func GetSharedWithUser(recipient string, id int64) (*models.UserShare, error) {
+	share, err := scanUserShare(db.QueryRow(`SELECT `+userShareColumns+userShareFrom+`
+		JOIN users u ON u.username = f.username
+		WHERE us.id = ? AND us.recipient = ? AND u.disabled = 0`, id, recipient))
+	if err == sql.ErrNoRows {
+		return nil, ErrUserShareNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share: %w", err)
+	}
+	return share, nil
+}
+
+// RemoveUserShare ends a share. Either its owner or its recipient (leaving
+// the share) may remove it.
+func RemoveUserShare(username string, id int64) error {
+	result, err := db.Exec(`DELETE FROM user_shares WHERE id = ? AND (recipient = ?
+		OR file_id IN (SELECT id FROM files WHERE username = ?))`, id, username, username)
+	if err != nil {
+		return fmt.Errorf("failed to remove share: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrUserShareNotFound
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/HAYASAKA7/HAYA-DISK/config"
+	"github.com/HAYASAKA7/HAYA-DISK/models"
+)
+
+// ErrVersionNotFound is returned when a file has no version with the
+// requested number
+var ErrVersionNotFound = errors.New("version not found")
+
+// NewFileVersion is content already in the blob store about to become the
+// current version of a file
+type NewFileVersion struct {
+	Size       int64
+	Hash       string
+	MimeType   string
+	UploadedBy string
+}
+
+// versionUsageSQL returns a subquery for the bytes taken up by a user's
+// earlier versions, including those of files in the trash. Content shared
+// by several versions is only counted once. user is "?" (the username is
+// then bound twice) or a column.
+func versionUsageSQL(user string) string {
+	return `(SELECT COALESCE(SUM(file_size), 0) FROM (
+		SELECT MAX(file_size) AS file_size FROM (
+			SELECT file_hash, file_size FROM file_versions WHERE username = ` + user + `
+			UNION ALL
+			SELECT tv.file_hash, tv.file_size FROM trash_versions tv JOIN trash t ON t.id = tv.trash_id WHERE t.username = ` + user + `
+		) GROUP BY file_hash))`
+}
+
+// GetVersionUsage returns the bytes taken up by a user's earlier versions
+// and how many there are
+func GetVersionUsage(username string) (int64, int, error) {
+	var used int64
+	var count int
+	err := db.QueryRow(`SELECT `+versionUsageSQL("?")+`, (SELECT COUNT(*) FROM file_versions WHERE username = ?)
+		+ (SELECT COUNT(*) FROM trash_versions tv JOIN trash t ON t.id = tv.trash_id WHERE t.username = ?)`,
+		username, username, username, username).Scan(&used, &count)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get version usage: %w", err)
+	}
+	return used, count, nil
+}
+
+// GetVersionPolicy returns how many earlier versions a user keeps per file
+// and how many bytes they may use (0 = unlimited for either), and whether
+// each is the user's own setting rather than the default
+func GetVersionPolicy(username string) (maxVersions int, maxSpace int64, customVersions, customSpace bool, err error) {
+	var versions, space sql.NullInt64
+	err = db.QueryRow(`SELECT max_file_versions, max_version_space FROM users WHERE username = ?`, username).Scan(&versions, &space)
+	if err == sql.ErrNoRows {
+		return 0, 0, false, false, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, 0, false, false, fmt.Errorf("failed to get version policy: %w", err)
+	}
+
+	maxVersions, maxSpace = config.DefaultMaxFileVersions, config.DefaultMaxVersionSpace
+	if versions.Valid {
+		maxVersions = int(versions.Int64)
+	}
+	if space.Valid {
+		maxSpace = space.Int64
+	}
+	return maxVersions, maxSpace, versions.Valid, space.Valid, nil
+}
+
+// SetVersionPolicy stores a user's history limits; nil returns a limit to
+// the default
+func SetVersionPolicy(username string, maxVersions *int, maxSpace *int64) error {
+	if (maxVersions != nil && *maxVersions < 0) || (maxSpace != nil && *maxSpace < 0) {
+		return fmt.Errorf("limits cannot be negative")
+	}
+
+	result, err := db.Exec(`UPDATE users SET max_file_versions = ?, max_version_space = ? WHERE username = ?`, maxVersions, maxSpace, username)
+	if err != nil {
+		return fmt.Errorf("failed to update version policy: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// currentVersion is the files row of a file whose history is being read
+// or extended
+type currentVersion struct {
+	id         int64
+	version    int
+	size       int64
+	hash       string
+	mimeType   string
+	uploadedBy string
+	modifiedAt time.Time
+	isDir      bool
+}
+
+// getCurrentVersion loads the files row for storagePath
+func getCurrentVersion(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, username, storagePath string) (*currentVersion, error) {
+	var current currentVersion
+	var mimeType, hash sql.NullString
+	err := q.QueryRow(`SELECT id, version, file_size, file_hash, mime_type, uploaded_by, modified_at, is_directory
+		FROM files WHERE username = ? AND storage_path = ?`, username, storagePath).Scan(
+		&current.id, &current.version, &current.size, &hash, &mimeType, &current.uploadedBy, &current.modifiedAt, &current.isDir)
+	if err == sql.ErrNoRows {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file: %w", err)
+	}
+	current.hash = hash.String
+	current.mimeType = mimeType.String
+	if current.uploadedBy == "" {
+		current.uploadedBy = username
+	}
+	return &current, nil
+}
+
+// ListFileVersions returns the current version of a file followed by its
+// earlier versions, newest first
+func ListFileVersions(username, storagePath string) ([]models.FileVersion, error) {
+	current, err := getCurrentVersion(db, username, storagePath)
+	if err != nil {
+		return nil, err
+	}
+	if current.isDir {
+		return nil, ErrFileNotFound
+	}
+
+	versions := []models.FileVersion{{
+		Version:    current.version,
+		Size:       current.size,
+		Hash:       current.hash,
+		MimeType:   current.mimeType,
+		UploadedBy: current.uploadedBy,
+		UploadedAt: current.modifiedAt,
+		Current:    true,
+	}}
+
+	rows, err := db.Query(`SELECT version, file_size, file_hash, mime_type, uploaded_by, uploaded_at, replaced_at
+		FROM file_versions WHERE file_id = ? ORDER BY version DESC`, current.id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version models.FileVersion
+		var mimeType sql.NullString
+		err := rows.Scan(&version.Version, &version.Size, &version.Hash, &mimeType,
+			&version.UploadedBy, &version.UploadedAt, &version.ReplacedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan version: %w", err)
+		}
+		version.MimeType = mimeType.String
+		if version.UploadedBy == "" {
+			version.UploadedBy = username
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// GetFileVersion returns an earlier version of a file
+func GetFileVersion(username, storagePath string, version int) (*models.FileVersion, error) {
+	var v models.FileVersion
+	var mimeType sql.NullString
+	err := db.QueryRow(`SELECT v.version, v.file_size, v.file_hash, v.mime_type, v.uploaded_by, v.uploaded_at, v.replaced_at
+		FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE f.username = ? AND f.storage_path = ? AND v.version = ?`, username, storagePath, version).Scan(
+		&v.Version, &v.Size, &v.Hash, &mimeType, &v.UploadedBy, &v.UploadedAt, &v.ReplacedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get version: %w", err)
+	}
+	v.MimeType = mimeType.String
+	return &v, nil
+}
+
+// AddFileVersion makes next the current content of the file at storagePath.
+// The content it replaces is kept as an earlier version; both stay in the
+// blob store, so this only changes metadata. Callers hold the user's write
+// lock.
+func AddFileVersion(username, userStoragePath, storagePath string, next NewFileVersion) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	current, err := getCurrentVersion(tx, username, storagePath)
+	if err != nil {
+		return err
+	}
+	if current.isDir {
+		return ErrFileExists
+	}
+	if current.hash == "" {
+		return fmt.Errorf("unknown hash for %s", storagePath)
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(`INSERT INTO file_versions (file_id, username, version, file_size, mime_type, file_hash, uploaded_by, uploaded_at, replaced_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		current.id, username, current.version, current.size, current.mimeType, current.hash, current.uploadedBy, current.modifiedAt, now)
+	if err != nil {
+		return fmt.Errorf("failed to save version: %w", err)
+	}
+
+	_, err = tx.Exec(`UPDATE files SET file_size = ?, mime_type = ?, file_hash = ?, modified_at = ?, version = version + 1, uploaded_by = ?
+		WHERE id = ?`, next.Size, next.MimeType, next.Hash, now, next.UploadedBy, current.id)
+	if err != nil {
+		return fmt.Errorf("failed to update file metadata: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save version: %w", err)
+	}
+
+	UpdateFolderSize(filepath.Dir(filepath.Join(userStoragePath, storagePath)), next.Size-current.size)
+	if err := applyVersionPolicy(username, current.id); err != nil {
+		log.Printf("Warning: failed to apply version policy for %s: %v", username, err)
+	}
+	return nil
+}
+
+// RestoreFileVersion makes an earlier version the current content of a
+// file again. The content it replaces is kept as a new version, so a
+// restore can itself be undone. Callers hold the user's write lock.
+func RestoreFileVersion(username, userStoragePath, storagePath string, version int, restoredBy string) error {
+	v, err := GetFileVersion(username, storagePath, version)
+	if err != nil {
+		return err
+	}
+
+	// The restored content counts twice from now on (as the file and as its
+	// old version), so it needs room
+	if err := CheckQuota(username, v.Size); err != nil {
+		return err
+	}
+
+	return AddFileVersion(username, userStoragePath, storagePath, NewFileVersion{
+		Size:       v.Size,
+		Hash:       v.Hash,
+		MimeType:   v.MimeType,
+		UploadedBy: restoredBy,
+	})
+}
+
+// applyVersionPolicy deletes the oldest versions of fileID beyond the
+// user's per-file limit, then the user's oldest versions overall until
+// their history fits in its space limit
+func applyVersionPolicy(username string, fileID int64) error {
+	maxVersions, maxSpace, _, _, err := GetVersionPolicy(username)
+	if err != nil {
+		return err
+	}
+
+	if maxVersions > 0 {
+		_, err := deleteVersions(`SELECT id FROM file_versions WHERE file_id = ?
+			ORDER BY version DESC LIMIT -1 OFFSET ?`, fileID, maxVersions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if maxSpace > 0 {
+		for {
+			var used int64
+			err := db.QueryRow(`SELECT COALESCE(SUM(file_size), 0) FROM (
+				SELECT MAX(file_size) AS file_size FROM file_versions WHERE username = ? GROUP BY file_hash)`, username).Scan(&used)
+			if err != nil {
+				return fmt.Errorf("failed to get version usage: %w", err)
+			}
+			if used <= maxSpace {
+				break
+			}
+			removed, err := deleteVersions(`SELECT id FROM file_versions WHERE username = ?
+				ORDER BY replaced_at, id LIMIT 1`, username)
+			if err != nil {
+				return err
+			}
+			if removed == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// deleteVersions deletes the file_versions rows whose ids a query returns,
+// and returns how many there were. Their content goes once no other row
+// refers to it.
+func deleteVersions(query string, args ...interface{}) (int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find versions: %w", err)
+	}
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	if _, err := db.Exec(`DELETE FROM file_versions WHERE id IN (`+placeholders+`)`, ids...); err != nil {
+		return 0, fmt.Errorf("failed to delete versions: %w", err)
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,436 @@
+// Shared settings modal logic: email verification, password change, two-factor
+// authentication and active sessions
+
+// CSRF token embedded by the server in the page's <meta name="csrf-token">
+function csrfToken() {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    return meta ? meta.getAttribute('content') : '';
+}
+
+// Submit a POST form (with CSRF token) built from a plain object; array
+// values become repeated fields
+function submitPostForm(action, fields) {
+    const form = document.createElement('form');
+    form.method = 'post';
+    form.action = action;
+
+    const allFields = Object.assign({ csrf_token: csrfToken() }, fields);
+    Object.keys(allFields).forEach(key => {
+        [].concat(allFields[key]).forEach(value => {
+            const input = document.createElement('input');
+            input.type = 'hidden';
+            input.name = key;
+            input.value = value;
+            form.appendChild(input);
+        });
+    });
+
+    document.body.appendChild(form);
+    form.submit();
+    form.remove();
+}
+
+// Show whether the current email is verified, with a resend link if not
+function showEmailVerification(user) {
+    const status = document.getElementById('emailVerification');
+    if (!status) return;
+
+    status.innerHTML = '';
+    status.className = 'email-status';
+    if (!user.email) return;
+
+    if (user.email_verified) {
+        status.classList.add('verified');
+        status.textContent = '✓ Verified';
+        return;
+    }
+
+    status.classList.add('unverified');
+    status.textContent = 'Not verified · ';
+    const link = document.createElement('a');
+    link.href = '#';
+    link.textContent = 'Resend link';
+    link.addEventListener('click', (e) => {
+        e.preventDefault();
+        resendVerification();
+    });
+    status.appendChild(link);
+}
+
+async function resendVerification() {
+    const messageDiv = document.getElementById('settingsMessage');
+
+    try {
+        const response = await fetch('/api/resend-verification', {
+            method: 'POST',
+            headers: { 'X-CSRF-Token': csrfToken() }
+        });
+        const data = await response.json();
+
+        messageDiv.style.display = 'block';
+        messageDiv.className = 'settings-message ' + (data.success ? 'success' : 'error');
+        messageDiv.textContent = (data.success ? '✅ ' : '⚠️ ') + data.message;
+    } catch (error) {
+        messageDiv.style.display = 'block';
+        messageDiv.className = 'settings-message error';
+        messageDiv.textContent = '⚠️ Failed to send verification email';
+    }
+}
+
+// Handle password change
+document.getElementById('passwordForm').addEventListener('submit', async (e) => {
+    e.preventDefault();
+
+    const messageDiv = document.getElementById('passwordMessage');
+
+    try {
+        const response = await fetch('/api/change-password', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': csrfToken()
+            },
+            body: JSON.stringify({
+                current_password: document.getElementById('currentPassword').value,
+                new_password: document.getElementById('newPassword').value,
+                confirm_password: document.getElementById('confirmNewPassword').value,
+                revoke_other_sessions: document.getElementById('passwordRevokeOthers').checked
+            })
+        });
+
+        const data = await response.json();
+        messageDiv.style.display = 'block';
+
+        if (data.success) {
+            messageDiv.className = 'settings-message success';
+            messageDiv.textContent = '✅ ' + data.message;
+            document.getElementById('passwordForm').reset();
+            loadSessions();
+        } else {
+            messageDiv.className = 'settings-message error';
+            messageDiv.textContent = '⚠️ ' + data.message;
+        }
+    } catch (error) {
+        messageDiv.style.display = 'block';
+        messageDiv.className = 'settings-message error';
+        messageDiv.textContent = '⚠️ Error changing password';
+    }
+});
+
+function showSessionsMessage(text, isError) {
+    const messageDiv = document.getElementById('sessionsMessage');
+    messageDiv.style.display = 'block';
+    messageDiv.className = 'settings-message ' + (isError ? 'error' : 'success');
+    messageDiv.textContent = (isError ? '⚠️ ' : '✅ ') + text;
+}
+
+// Load and render the user's active sessions
+async function loadSessions() {
+    const list = document.getElementById('sessionList');
+    if (!list) return;
+
+    try {
+        const response = await fetch('/api/sessions');
+        const data = await response.json();
+        list.innerHTML = '';
+
+        if (data.error) {
+            showSessionsMessage(data.error, true);
+            return;
+        }
+
+        data.sessions.forEach(session => {
+            const item = document.createElement('div');
+            item.className = 'session-item' + (session.current ? ' current' : '');
+
+            const info = document.createElement('div');
+            info.className = 'session-info';
+
+            const device = document.createElement('div');
+            device.className = 'session-device';
+            device.textContent = session.device + (session.current ? ' (this device)' : '');
+
+            const details = document.createElement('div');
+            details.className = 'session-details';
+            details.textContent = `${session.ip_address || 'Unknown IP'} · Signed in ${new Date(session.created_at).toLocaleString()} · Last active ${new Date(session.last_seen).toLocaleString()}`;
+
+            info.appendChild(device);
+            info.appendChild(details);
+            item.appendChild(info);
+
+            if (!session.current) {
+                const button = document.createElement('button');
+                button.type = 'button';
+                button.className = 'btn btn-delete';
+                button.textContent = 'Revoke';
+                button.addEventListener('click', () => revokeSession(session.id));
+                item.appendChild(button);
+            }
+
+            list.appendChild(item);
+        });
+    } catch (error) {
+        showSessionsMessage('Failed to load sessions', true);
+    }
+}
+
+// Revoke a single session
+async function revokeSession(sessionId) {
+    try {
+        const response = await fetch('/api/sessions/revoke', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': csrfToken()
+            },
+            body: JSON.stringify({ session_id: sessionId })
+        });
+
+        const data = await response.json();
+        showSessionsMessage(data.message, !data.success);
+        loadSessions();
+    } catch (error) {
+        showSessionsMessage('Failed to revoke session', true);
+    }
+}
+
+// Sign out of all other sessions, or everywhere including this one
+async function revokeAllSessions(keepCurrent) {
+    const message = keepCurrent
+        ? 'Sign out of all other sessions?'
+        : 'Sign out everywhere, including this device?';
+    if (!confirm(message)) return;
+
+    try {
+        const response = await fetch('/api/sessions/revoke-all', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': csrfToken()
+            },
+            body: JSON.stringify({ keep_current: keepCurrent })
+        });
+
+        const data = await response.json();
+        if (data.success && !keepCurrent) {
+            window.location.href = '/login';
+            return;
+        }
+
+        showSessionsMessage(data.message, !data.success);
+        loadSessions();
+    } catch (error) {
+        showSessionsMessage('Failed to revoke sessions', true);
+    }
+}
+
+function showTwoFactorMessage(text, isError) {
+    const messageDiv = document.getElementById('twoFactorMessage');
+    messageDiv.style.display = 'block';
+    messageDiv.className = 'settings-message ' + (isError ? 'error' : 'success');
+    messageDiv.textContent = (isError ? '⚠️ ' : '✅ ') + text;
+}
+
+// Show or hide the 2FA controls for the given state: 'off', 'setup' or 'on'
+function setTwoFactorView(state, recoveryCodesLeft) {
+    const status = document.getElementById('twoFactorStatus');
+    if (state === 'on') {
+        status.textContent = `Enabled · ${recoveryCodesLeft} recovery codes left`;
+    } else if (state === 'setup') {
+        status.textContent = 'Setup in progress';
+    } else {
+        status.textContent = 'Off · Protect your account with an authenticator app';
+    }
+
+    document.getElementById('twoFactorSetup').style.display = state === 'setup' ? 'block' : 'none';
+    document.getElementById('twoFactorManage').style.display = state === 'on' ? 'block' : 'none';
+    document.getElementById('twoFactorSetupBtn').style.display = state === 'off' ? '' : 'none';
+    document.getElementById('twoFactorEnableBtn').style.display = state === 'setup' ? '' : 'none';
+    document.getElementById('twoFactorRecoveryBtn').style.display = state === 'on' ? '' : 'none';
+    document.getElementById('twoFactorDisableBtn').style.display = state === 'on' ? '' : 'none';
+}
+
+// Render recovery codes once; the server never shows them again
+function showRecoveryCodes(codes) {
+    const box = document.getElementById('recoveryCodes');
+    box.innerHTML = '';
+
+    const note = document.createElement('p');
+    note.textContent = 'Save these recovery codes somewhere safe. Each can be used once if you lose your device.';
+    box.appendChild(note);
+
+    codes.forEach(code => {
+        const span = document.createElement('span');
+        span.textContent = code;
+        box.appendChild(span);
+    });
+    box.style.display = 'grid';
+}
+
+async function postTwoFactor(url, body) {
+    const response = await fetch(url, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            'X-CSRF-Token': csrfToken()
+        },
+        body: JSON.stringify(body || {})
+    });
+    return response.json();
+}
+
+// Load the current user's 2FA state
+async function loadTwoFactorStatus() {
+    if (!document.getElementById('twoFactorStatus')) return;
+
+    document.getElementById('recoveryCodes').style.display = 'none';
+    document.getElementById('twoFactorMessage').style.display = 'none';
+
+    try {
+        const response = await fetch('/api/2fa/status');
+        const data = await response.json();
+        if (data.error) {
+            showTwoFactorMessage(data.error, true);
+            return;
+        }
+        setTwoFactorView(data.enabled ? 'on' : 'off', data.recovery_codes_left);
+    } catch (error) {
+        showTwoFactorMessage('Failed to load two-factor status', true);
+    }
+}
+
+async function startTwoFactorSetup() {
+    try {
+        const data = await postTwoFactor('/api/2fa/setup');
+        if (!data.success) {
+            showTwoFactorMessage(data.message, true);
+            return;
+        }
+
+        document.getElementById('twoFactorSecret').textContent = data.secret.match(/.{1,4}/g).join(' ');
+        document.getElementById('twoFactorURI').href = data.otpauth_uri;
+        document.getElementById('twoFactorEnableCode').value = '';
+        setTwoFactorView('setup');
+    } catch (error) {
+        showTwoFactorMessage('Failed to start two-factor setup', true);
+    }
+}
+
+async function enableTwoFactor() {
+    try {
+        const data = await postTwoFactor('/api/2fa/enable', {
+            code: document.getElementById('twoFactorEnableCode').value
+        });
+        if (!data.success) {
+            showTwoFactorMessage(data.message, true);
+            return;
+        }
+
+        setTwoFactorView('on', data.recovery_codes.length);
+        showTwoFactorMessage(data.message, false);
+        showRecoveryCodes(data.recovery_codes);
+    } catch (error) {
+        showTwoFactorMessage('Failed to enable two-factor authentication', true);
+    }
+}
+
+async function regenerateRecoveryCodes() {
+    try {
+        const data = await postTwoFactor('/api/2fa/recovery-codes', {
+            code: document.getElementById('twoFactorCode').value
+        });
+        if (!data.success) {
+            showTwoFactorMessage(data.message, true);
+            return;
+        }
+
+        document.getElementById('twoFactorCode').value = '';
+        setTwoFactorView('on', data.recovery_codes.length);
+        showTwoFactorMessage(data.message, false);
+        showRecoveryCodes(data.recovery_codes);
+    } catch (error) {
+        showTwoFactorMessage('Failed to generate recovery codes', true);
+    }
+}
+
+async function disableTwoFactor() {
+    if (!confirm('Disable two-factor authentication?')) return;
+
+    try {
+        const data = await postTwoFactor('/api/2fa/disable', {
+            password: document.getElementById('twoFactorPassword').value,
+            code: document.getElementById('twoFactorCode').value
+        });
+        if (!data.success) {
+            showTwoFactorMessage(data.message, true);
+            return;
+        }
+
+        document.getElementById('twoFactorPassword').value = '';
+        document.getElementById('twoFactorCode').value = '';
+        document.getElementById('recoveryCodes').style.display = 'none';
+        setTwoFactorView('off');
+        showTwoFactorMessage(data.message, false);
+    } catch (error) {
+        showTwoFactorMessage('Failed to disable two-factor authentication', true);
+    }
+}
+
+function showVersionPolicyMessage(text, isError) {
+    const messageDiv = document.getElementById('versionPolicyMessage');
+    messageDiv.style.display = 'block';
+    messageDiv.className = 'settings-message ' + (isError ? 'error' : 'success');
+    messageDiv.textContent = (isError ? '⚠️ ' : '✅ ') + text;
+}
+
+// Load the user's file history limits
+async function loadVersionPolicy() {
+    if (!document.getElementById('versionPolicyForm')) return;
+
+    try {
+        const response = await fetch('/api/versions/policy');
+        const data = await response.json();
+        if (data.error) {
+            showVersionPolicyMessage(data.error, true);
+            return;
+        }
+        const mb = 1024 * 1024;
+        const count = document.getElementById('versionMaxCount');
+        const space = document.getElementById('versionMaxSpace');
+        count.placeholder = 'Default: ' + (data.default_max_versions || 'unlimited');
+        space.placeholder = 'Default: ' + (data.default_max_space ? Math.round(data.default_max_space / mb) : 'unlimited');
+        count.value = data.custom_versions ? data.max_versions : '';
+        space.value = data.custom_space ? Math.round(data.max_space / mb) : '';
+        document.getElementById('versionUsage').textContent = 'Earlier versions use ' + data.used_space_str + '.';
+    } catch (error) {
+        showVersionPolicyMessage('Failed to load file history settings', true);
+    }
+}
+
+const versionPolicyForm = document.getElementById('versionPolicyForm');
+if (versionPolicyForm) {
+    versionPolicyForm.addEventListener('submit', async (e) => {
+        e.preventDefault();
+
+        const count = document.getElementById('versionMaxCount').value.trim();
+        const space = document.getElementById('versionMaxSpace').value.trim();
+        try {
+            const response = await fetch('/api/versions/policy', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'X-CSRF-Token': csrfToken()
+                },
+                body: JSON.stringify({
+                    max_versions: count === '' ? null : parseInt(count, 10),
+                    max_space: space === '' ? null : parseInt(space, 10) * 1024 * 1024
+                })
+            });
+            const data = await response.json();
+            showVersionPolicyMessage(data.message, !data.success);
+            if (data.success) loadVersionPolicy();
+        } catch (error) {
+            showVersionPolicyMessage('Error saving file history settings', true);
+        }
+    });
+}
@@ -69,13 +69,23 @@ func migrateUsers() error {
 			createdAt = time.Now()
 		}
 
+		// Hash legacy plaintext passwords before they reach the database
+		password := user.Password
+		if !services.IsPasswordHashed(password) {
+			password, err = services.HashPassword(password)
+			if err != nil {
+				log.Printf("Failed to hash password for user %s: %v", user.Username, err)
+				continue
+			}
+		}
+
 		// Insert user (with empty phone_region for legacy data)
 		err = services.CreateUserDB(
 			user.Username,
 			user.Email,
 			user.Phone,
 			"", // phone_region - empty for legacy migrated users
-			user.Password,
+			password,
 			user.UniqueCode,
 			createdAt,
 			user.LoginType,
@@ -7,6 +7,8 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"sort"
+	"strings"
 )
 
 // IsValidEmail validates email format
@@ -57,36 +59,51 @@ func IsImageFile(ext string) bool {
 	return imageExts[ext]
 }
 
+// FileCategories lists the categories of GetFileCategory, "Others" last
+var FileCategories = []string{"Images", "Videos", "Audio", "Documents", "Archives", "Code", "Others"}
+
+// categoryExtensions maps each category but "Others" to its extensions
+var categoryExtensions = map[string]map[string]bool{
+	"Images":    {".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".bmp": true, ".svg": true, ".webp": true, ".ico": true},
+	"Videos":    {".mp4": true, ".avi": true, ".mkv": true, ".mov": true, ".wmv": true, ".flv": true, ".webm": true, ".m4v": true},
+	"Audio":     {".mp3": true, ".wav": true, ".flac": true, ".aac": true, ".ogg": true, ".wma": true, ".m4a": true, ".opus": true},
+	"Documents": {".pdf": true, ".doc": true, ".docx": true, ".txt": true, ".rtf": true, ".odt": true, ".xls": true, ".xlsx": true, ".ppt": true, ".pptx": true, ".md": true},
+	"Archives":  {".zip": true, ".rar": true, ".7z": true, ".tar": true, ".gz": true, ".bz2": true, ".xz": true},
+	"Code":      {".go": true, ".js": true, ".py": true, ".java": true, ".cpp": true, ".c": true, ".h": true, ".html": true, ".css": true, ".json": true, ".xml": true, ".sql": true, ".sh": true, ".bat": true, ".rs": true, ".ts": true, ".php": true, ".rb": true},
+}
+
 // GetFileCategory returns the category for a file extension
 func GetFileCategory(ext string) string {
-	imageExts := map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".bmp": true, ".svg": true, ".webp": true, ".ico": true}
-	videoExts := map[string]bool{".mp4": true, ".avi": true, ".mkv": true, ".mov": true, ".wmv": true, ".flv": true, ".webm": true, ".m4v": true}
-	audioExts := map[string]bool{".mp3": true, ".wav": true, ".flac": true, ".aac": true, ".ogg": true, ".wma": true, ".m4a": true, ".opus": true}
-	docExts := map[string]bool{".pdf": true, ".doc": true, ".docx": true, ".txt": true, ".rtf": true, ".odt": true, ".xls": true, ".xlsx": true, ".ppt": true, ".pptx": true, ".md": true}
-	archiveExts := map[string]bool{".zip": true, ".rar": true, ".7z": true, ".tar": true, ".gz": true, ".bz2": true, ".xz": true}
-	codeExts := map[string]bool{".go": true, ".js": true, ".py": true, ".java": true, ".cpp": true, ".c": true, ".h": true, ".html": true, ".css": true, ".json": true, ".xml": true, ".sql": true, ".sh": true, ".bat": true, ".rs": true, ".ts": true, ".php": true, ".rb": true}
-
-	if imageExts[ext] {
-		return "Images"
-	}
-	if videoExts[ext] {
-		return "Videos"
-	}
-	if audioExts[ext] {
-		return "Audio"
-	}
-	if docExts[ext] {
-		return "Documents"
-	}
-	if archiveExts[ext] {
-		return "Archives"
-	}
-	if codeExts[ext] {
-		return "Code"
+	for _, category := range FileCategories {
+		if categoryExtensions[category][ext] {
+			return category
+		}
 	}
 	return "Others"
 }
 
+// CategoryExtensions returns the extensions of a category, sorted. For
+// "Others", which is everything else, it returns the extensions of all
+// other categories. ok is false for an unknown category.
+func CategoryExtensions(category string) (exts []string, ok bool) {
+	if category == "Others" {
+		for _, other := range categoryExtensions {
+			for ext := range other {
+				exts = append(exts, ext)
+			}
+		}
+	} else {
+		for ext := range categoryExtensions[category] {
+			exts = append(exts, ext)
+		}
+		if exts == nil {
+			return nil, false
+		}
+	}
+	sort.Strings(exts)
+	return exts, true
+}
+
 // GetFileIcon returns an emoji icon based on file category
 func GetFileIcon(ext string) string {
 	category := GetFileCategory(ext)
@@ -113,6 +130,8 @@ func GetImageContentType(ext string) string {
 		".gif":  "image/gif",
 		".webp": "image/webp",
 		".bmp":  "image/bmp",
+		".svg":  "image/svg+xml",
+		".ico":  "image/x-icon",
 	}
 	if ct, exists := contentTypes[ext]; exists {
 		return ct
@@ -135,3 +154,73 @@ func CalculateFileSHA256(filePath string) string {
 
 	return hex.EncodeToString(hash.Sum(nil))
 }
+
+// DescribeUserAgent returns a short "Browser on OS" description of a User-Agent string
+func DescribeUserAgent(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	// Order matters: Edge and Opera also report Chrome, Chrome also reports Safari
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(userAgent, "curl/"):
+		browser = "curl"
+	}
+
+	platform := "Unknown OS"
+	switch {
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		platform = "iOS"
+	case strings.Contains(userAgent, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	}
+
+	return browser + " on " + platform
+}
+
+// ContentDisposition builds an RFC 6266 Content-Disposition header value
+// ("inline" or "attachment"). Browsers that understand filename* get the
+// exact UTF-8 name; older clients fall back to an ASCII approximation.
+func ContentDisposition(disposition, filename string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range filename {
+		if r < 0x20 || r == 0x7f || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+
+	// RFC 8187 attr-char is the only set allowed unescaped in filename*
+	const attrChars = "!#$&+-.^_`|~"
+	for _, b := range []byte(filename) {
+		if ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9') || strings.IndexByte(attrChars, b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	value := disposition + `; filename="` + fallback.String() + `"`
+	if encoded.String() != fallback.String() {
+		value += "; filename*=UTF-8''" + encoded.String()
+	}
+	return value
+}
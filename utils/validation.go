@@ -195,6 +195,17 @@ func CleanPhoneNumber(phone string) string {
 	return replacer.Replace(phone)
 }
 
+// FormatE164 returns a cleaned national number in international format
+// (e.g. "+8613812345678") for sending SMS
+func FormatE164(phone, region string) string {
+	phone = CleanPhoneNumber(phone)
+	regionInfo, exists := PhoneRegions[region]
+	if !exists {
+		return "+" + phone
+	}
+	return regionInfo.Code + strings.TrimPrefix(phone, "0")
+}
+
 // GetPhoneRegionInfo returns the region info for a given region code
 func GetPhoneRegionInfo(region string) (PhoneRegionInfo, bool) {
 	info, exists := PhoneRegions[region]